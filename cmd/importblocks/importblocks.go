@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/catalogfi/indexer/consensus"
+	"github.com/catalogfi/indexer/database"
+	"github.com/catalogfi/indexer/dogecoin"
+	"github.com/catalogfi/indexer/netsync"
+	"github.com/catalogfi/indexer/store"
+	"go.uber.org/zap"
+)
+
+// importblocks indexes the blocks of the blk*.dat files of a bitcoind or
+// dogecoind, which is much faster than downloading them from a peer. The
+// database is opened exclusively, so the indexer must be stopped; it resumes
+// from the imported blocks once started again.
+func main() {
+	dbPath := flag.String("db", os.Getenv("DB_PATH"), "path of the indexer database")
+	blocksDir := flag.String("blocks", "", "blocks directory of the node, holding the blk*.dat files")
+	chain := flag.String("chain", os.Getenv("CHAIN"), "bitcoin or dogecoin")
+	network := flag.String("network", os.Getenv("NETWORK"), "mainnet or testnet")
+	verifyAuxPow := flag.Bool("verify-auxpow", os.Getenv("VERIFY_AUXPOW") == "true", "check that the merged mining proofs commit to the dogecoin blocks")
+	flag.Parse()
+
+	config := zap.NewDevelopmentConfig()
+	config.OutputPaths = []string{"stderr"}
+	logger, err := config.Build()
+	if err != nil {
+		panic(err)
+	}
+	if *blocksDir == "" {
+		logger.Fatal("the blocks directory is required")
+	}
+
+	// the proof of work rules are picked with the chain, dogecoin hashes its
+	// headers with scrypt and accepts merged mined blocks
+	var params *chaincfg.Params
+	var rules consensus.Rules
+	if *chain == "dogecoin" {
+		if *network == "mainnet" {
+			params = &dogecoin.MainNetParams
+		} else {
+			params = &dogecoin.TestNet3Params
+		}
+		rules = consensus.NewDogecoinRules(params)
+	} else {
+		if *network == "mainnet" {
+			params = &chaincfg.MainNetParams
+		} else {
+			params = &chaincfg.TestNet3Params
+		}
+		rules = consensus.NewBitcoinRules(params, consensus.DoubleSHA256)
+	}
+
+	db, err := database.NewRocksDB(*dbPath, logger)
+	if err != nil {
+		logger.Fatal("error opening database", zap.Error(err))
+	}
+	defer db.Close()
+
+	// the peers are never connected to
+	syncManager, err := netsync.NewSyncManager(netsync.SyncConfig{
+		DNSSeeds:     true,
+		ChainParams:  params,
+		Rules:        rules,
+		Store:        store.NewStorage(db).SetLogger(logger),
+		Logger:       logger,
+		VerifyAuxPow: *verifyAuxPow,
+	})
+	if err != nil {
+		logger.Fatal("error creating sync manager", zap.Error(err))
+	}
+
+	// SIGINT and SIGTERM stop the import after the block being connected
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := syncManager.ImportBlkFiles(ctx, *blocksDir); err != nil && err != context.Canceled {
+		logger.Error("error importing blocks", zap.Error(err))
+		db.Close()
+		os.Exit(1)
+	}
+	logger.Info("import stopped")
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
 	// "fmt"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/catalogfi/indexer/command"
+	"github.com/catalogfi/indexer/consensus"
 	"github.com/catalogfi/indexer/database"
 	"github.com/catalogfi/indexer/netsync"
 	"github.com/catalogfi/indexer/rpc"
@@ -31,33 +38,113 @@ func main() {
 	}
 	defer db.Close()
 
+	// the proof of work rules are picked with the chain, dogecoin hashes its
+	// headers with scrypt and accepts merged mined blocks
 	var params *chaincfg.Params
+	var rules consensus.Rules
 	if os.Getenv("CHAIN") == "dogecoin" {
 		if os.Getenv("NETWORK") == "mainnet" {
 			params = &dogecoin.MainNetParams
 		} else {
 			params = &dogecoin.TestNet3Params
 		}
+		rules = consensus.NewDogecoinRules(params)
 	} else {
 		if os.Getenv("NETWORK") == "mainnet" {
 			params = &chaincfg.MainNetParams
 		} else {
 			params = &chaincfg.TestNet3Params
 		}
+		rules = consensus.NewBitcoinRules(params, consensus.DoubleSHA256)
+	}
+	pruneDepth := uint64(0)
+	if os.Getenv("PRUNE_DEPTH") != "" {
+		pruneDepth, err = strconv.ParseUint(os.Getenv("PRUNE_DEPTH"), 10, 64)
+		if err != nil {
+			panic(err)
+		}
+	}
+	maxPeers := 0
+	if os.Getenv("MAX_PEERS") != "" {
+		maxPeers, err = strconv.Atoi(os.Getenv("MAX_PEERS"))
+		if err != nil {
+			panic(err)
+		}
+	}
+	// PEER_URL holds comma separated static peers, the DNS seeds are used
+	// without them or when DNS_SEEDS is set
+	peerAddrs := make([]string, 0)
+	for _, addr := range strings.Split(os.Getenv("PEER_URL"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			peerAddrs = append(peerAddrs, addr)
+		}
+	}
+	dnsSeeds := len(peerAddrs) == 0 || os.Getenv("DNS_SEEDS") == "true"
+	// BLOCK_SOURCE=rpc fetches the blocks from the node at RPC_URL instead of
+	// the peers
+	var source netsync.BlockSource
+	if os.Getenv("BLOCK_SOURCE") == "rpc" {
+		source, err = netsync.NewRPCSource(netsync.RPCSourceConfig{
+			URL:         os.Getenv("RPC_URL"),
+			User:        os.Getenv("RPC_USER"),
+			Pass:        os.Getenv("RPC_PASS"),
+			ChainParams: params,
+			Rules:       rules,
+			Logger:      logger,
+		})
+		if err != nil {
+			panic(err)
+		}
 	}
 	store := store.NewStorage(db).SetLogger(logger)
 	// fmt.Println(store.GetBlockRangeNBitsGrouped(1,100000,2016))
 	syncManager, err := netsync.NewSyncManager(netsync.SyncConfig{
-		PeerAddr:    os.Getenv("PEER_URL"),
+		PeerAddrs:   peerAddrs,
+		DNSSeeds:    dnsSeeds,
+		MaxPeers:    maxPeers,
 		ChainParams: params,
+		Rules:       rules,
 		Store:       store,
 		Logger:      logger,
+		PruneDepth:  pruneDepth,
+		// checks that the merged mining proofs commit to the dogecoin blocks
+		VerifyAuxPow: os.Getenv("VERIFY_AUXPOW") == "true",
+		Source:       source,
 	})
 	if err != nil {
 		panic(err)
 	}
-	go syncManager.Sync()
 
-	rpcServer := rpc.Default(store, params).SetLogger(logger)
-	rpcServer.Run(":"+os.Getenv("PORT"))
+	// SIGINT and SIGTERM stop the rpc server and the sync, which finishes the
+	// block being connected, before the database is closed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	syncDone := make(chan error, 1)
+	go func() {
+		syncDone <- syncManager.Sync(ctx)
+	}()
+
+	rpcServer := rpc.Default(store, params).SetLogger(logger).SetReadiness(syncManager.Ready)
+	rpcServer.RegisterCommand(command.EstimateSmartFee(syncManager.FeeEstimator()))
+	rpcServer.RegisterCommand(command.GetMempoolFeeHistogram(syncManager.FeeEstimator()))
+	rpcServer.RegisterCommand(command.CreateWallet(syncManager.Wallets()))
+	rpcServer.RegisterCommand(command.ListWallets(syncManager.Wallets()))
+	rpcServer.RegisterCommand(command.ImportAddress(syncManager.Wallets()))
+	rpcServer.RegisterCommand(command.ImportDescriptor(syncManager.Wallets()))
+	rpcServer.RegisterCommand(command.RescanWallet(syncManager.Wallets()))
+	rpcServer.RegisterCommand(command.SetLabel(syncManager.Wallets()))
+	rpcServer.RegisterCommand(command.ListTransactions(syncManager.Wallets()))
+	rpcServer.RegisterCommand(command.ListUnspent(syncManager.Wallets()))
+	rpcServer.RegisterCommand(command.GetBalance(syncManager.Wallets()))
+	rpcServer.RegisterCommand(command.Reindex(syncManager))
+	rpcServer.RegisterCommand(command.GetReindexProgress(syncManager))
+	rpcServer.RegisterCommand(command.GetSyncStatus(syncManager))
+	if err := rpcServer.Run(ctx, ":"+os.Getenv("PORT")); err != nil {
+		logger.Error("rpc server stopped", zap.Error(err))
+	}
+	stop()
+	if err := <-syncDone; err != nil {
+		logger.Error("sync stopped", zap.Error(err))
+	}
+	logger.Info("indexer stopped")
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"os"
+
+	"github.com/catalogfi/indexer/database"
+	"github.com/catalogfi/indexer/store"
+	"go.uber.org/zap"
+)
+
+// verifychain checks the consistency of an indexer database and writes a JSON
+// report. The database is opened exclusively, so the indexer must be stopped.
+// It exits with status 1 if unrepaired issues remain.
+func main() {
+	dbPath := flag.String("db", os.Getenv("DB_PATH"), "path of the indexer database")
+	start := flag.Uint64("start", 0, "first height to verify")
+	end := flag.Uint64("end", math.MaxUint64, "last height to verify, the tip by default")
+	repair := flag.Bool("repair", false, "fix the issues which can be fixed from the stored data")
+	reportPath := flag.String("report", "", "file to write the report to, stdout by default")
+	flag.Parse()
+
+	config := zap.NewDevelopmentConfig()
+	config.OutputPaths = []string{"stderr"}
+	logger, err := config.Build()
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := database.NewRocksDB(*dbPath, logger)
+	if err != nil {
+		logger.Fatal("error opening database", zap.Error(err))
+	}
+	defer db.Close()
+
+	report, err := store.NewStorage(db).SetLogger(logger).VerifyChain(store.VerifyOptions{
+		StartHeight: *start,
+		EndHeight:   *end,
+		Repair:      *repair,
+	})
+	if err != nil {
+		logger.Fatal("error verifying chain", zap.Error(err))
+	}
+	data, err := report.Marshal()
+	if err != nil {
+		logger.Fatal("error marshalling report", zap.Error(err))
+	}
+	data = append(data, '\n')
+	if *reportPath == "" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(*reportPath, data, 0644)
+	}
+	if err != nil {
+		logger.Fatal("error writing report", zap.Error(err))
+	}
+
+	logger.Info("chain verified",
+		zap.Uint64("blocks", report.BlocksChecked),
+		zap.Int("issues", len(report.Issues)),
+		zap.Int("repaired", report.Repaired))
+	if report.Repaired < len(report.Issues) {
+		db.Close()
+		os.Exit(1)
+	}
+}
@@ -2,7 +2,10 @@ package command
 
 import (
 	"encoding/json"
+	"fmt"
+	"time"
 
+	"github.com/catalogfi/indexer/model"
 	"github.com/catalogfi/indexer/store"
 )
 
@@ -88,4 +91,153 @@ func GetBlockByHeight(store *store.Storage) Command {
 	return &getBlockByHeight{
 		store: store,
 	}
-}
\ No newline at end of file
+}
+// get_block_stats
+
+type getBlockStats struct {
+	store *store.Storage
+}
+
+func (g *getBlockStats) Name() string {
+	return "get_block_stats"
+}
+
+// Execute accepts either a block height or a block hash.
+func (g *getBlockStats) Execute(params json.RawMessage) (interface{}, error) {
+	var (
+		stats  *model.BlockStats
+		exists bool
+		err    error
+		height uint64
+		hash   string
+	)
+	if json.Unmarshal(params, &height) == nil {
+		stats, exists, err = g.store.GetBlockStatsByHeight(height)
+	} else if json.Unmarshal(params, &hash) == nil {
+		stats, exists, err = g.store.GetBlockStats(hash)
+	} else {
+		return nil, fmt.Errorf("expected a block height or hash")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, store.ErrGetBlockStatsNotFound
+	}
+	return stats, nil
+}
+
+func GetBlockStats(store *store.Storage) Command {
+	return &getBlockStats{
+		store: store,
+	}
+}
+
+// get_block_stats_range
+
+const maxBlockStatsRange = 1000
+
+type blockStatsRangeParams struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+type getBlockStatsRange struct {
+	store *store.Storage
+}
+
+func (g *getBlockStatsRange) Name() string {
+	return "get_block_stats_range"
+}
+
+// Execute returns the stats of the blocks in [start, end], skipping heights
+// without stats.
+func (g *getBlockStatsRange) Execute(params json.RawMessage) (interface{}, error) {
+	var p blockStatsRangeParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	if p.End < p.Start {
+		return nil, fmt.Errorf("end must not be below start")
+	}
+	if p.End-p.Start >= maxBlockStatsRange {
+		return nil, fmt.Errorf("range must not exceed %d blocks", maxBlockStatsRange)
+	}
+	statsRange := make([]*model.BlockStats, 0, p.End-p.Start+1)
+	for height := p.Start; height <= p.End; height++ {
+		stats, exists, err := g.store.GetBlockStatsByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			statsRange = append(statsRange, stats)
+		}
+	}
+	return statsRange, nil
+}
+
+func GetBlockStatsRange(store *store.Storage) Command {
+	return &getBlockStatsRange{
+		store: store,
+	}
+}
+
+// get_block_by_time
+
+type blockByTimeParams struct {
+	Timestamp int64 `json:"timestamp"`
+	// Direction is either "before" (default) for the last block at or before
+	// the timestamp, or "after" for the first block after it
+	Direction     string `json:"direction"`
+	UseHeaderTime bool   `json:"use_header_time"`
+}
+
+type BlockByTime struct {
+	*model.Block
+	MedianTime int64
+}
+
+type getBlockByTime struct {
+	store *store.Storage
+}
+
+func (g *getBlockByTime) Name() string {
+	return "get_block_by_time"
+}
+
+func (g *getBlockByTime) Execute(params json.RawMessage) (interface{}, error) {
+	var p blockByTimeParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	after := false
+	switch p.Direction {
+	case "", "before":
+	case "after":
+		after = true
+	default:
+		return nil, fmt.Errorf("invalid direction %q, expected before or after", p.Direction)
+	}
+
+	block, exists, err := g.store.GetBlockByTime(time.Unix(p.Timestamp, 0), after, p.UseHeaderTime)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, store.ErrGetBlockNotFound
+	}
+	medianTime, err := g.store.GetMedianTimePast(block.Height)
+	if err != nil {
+		return nil, err
+	}
+	return BlockByTime{
+		Block:      block,
+		MedianTime: medianTime.Unix(),
+	}, nil
+}
+
+func GetBlockByTime(store *store.Storage) Command {
+	return &getBlockByTime{
+		store: store,
+	}
+}
@@ -0,0 +1,68 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/catalogfi/indexer/fees"
+)
+
+// estimate_smart_fee
+
+type estimateSmartFeeParams struct {
+	ConfTarget uint32 `json:"conf_target"`
+	// Mode is either "economical" (default) or "conservative"
+	Mode string `json:"mode"`
+}
+
+type estimateSmartFee struct {
+	estimator *fees.Estimator
+}
+
+func (e *estimateSmartFee) Name() string {
+	return "estimate_smart_fee"
+}
+
+// Execute returns the feerate in satoshis per virtual byte needed to confirm
+// within conf_target blocks.
+func (e *estimateSmartFee) Execute(params json.RawMessage) (interface{}, error) {
+	var p estimateSmartFeeParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	mode := fees.ModeEconomical
+	switch p.Mode {
+	case "", string(fees.ModeEconomical):
+	case string(fees.ModeConservative):
+		mode = fees.ModeConservative
+	default:
+		return nil, fmt.Errorf("invalid mode %q, expected economical or conservative", p.Mode)
+	}
+	return e.estimator.EstimateSmartFee(p.ConfTarget, mode)
+}
+
+func EstimateSmartFee(estimator *fees.Estimator) Command {
+	return &estimateSmartFee{
+		estimator: estimator,
+	}
+}
+
+// get_mempool_fee_histogram
+
+type getMempoolFeeHistogram struct {
+	estimator *fees.Estimator
+}
+
+func (g *getMempoolFeeHistogram) Name() string {
+	return "get_mempool_fee_histogram"
+}
+
+func (g *getMempoolFeeHistogram) Execute(params json.RawMessage) (interface{}, error) {
+	return g.estimator.FeeHistogram(), nil
+}
+
+func GetMempoolFeeHistogram(estimator *fees.Estimator) Command {
+	return &getMempoolFeeHistogram{
+		estimator: estimator,
+	}
+}
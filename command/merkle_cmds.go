@@ -0,0 +1,381 @@
+package command
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/merkle"
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/store"
+)
+
+const (
+	defaultHeaderChainLen = 6
+	maxHeaderChainLen     = 2016
+)
+
+var (
+	ErrTxNotConfirmed    = errors.New("transaction is not confirmed")
+	ErrTxNotInBlock      = errors.New("transaction is not in the block")
+	ErrBlockNotInChain   = errors.New("block is not in the main chain")
+	ErrInvalidTxOutProof = errors.New("merkle root of the proof does not match the block header")
+)
+
+// HeaderChain is a segment of the main chain starting at the block of a
+// proof, so a remote verifier can check the work built on top of it.
+type HeaderChain struct {
+	StartHeight uint64 `json:"start_height"`
+	// Headers are the hex encoded block headers, in height order
+	Headers []string `json:"headers"`
+	// Work is the hex encoded sum of the work of the headers
+	Work      string `json:"work"`
+	TipHeight uint64 `json:"tip_height"`
+}
+
+// TxMerkleProof is an Esplora style merkle proof.
+type TxMerkleProof struct {
+	BlockHeight uint64 `json:"block_height"`
+	BlockHash   string `json:"block_hash"`
+	// Merkle is the branch from the transaction up to the merkle root
+	Merkle      []string    `json:"merkle"`
+	Pos         int         `json:"pos"`
+	HeaderChain HeaderChain `json:"header_chain"`
+}
+
+// TxOutProof is a serialized merkle block, as returned by gettxoutproof.
+type TxOutProof struct {
+	Proof       string      `json:"proof"`
+	HeaderChain HeaderChain `json:"header_chain"`
+}
+
+// get_tx_merkle_proof
+
+type txMerkleProofParams struct {
+	TxId string `json:"txid"`
+	// Headers is the length of the header chain, starting at the block of the
+	// transaction
+	Headers uint64 `json:"headers"`
+}
+
+type getTxMerkleProof struct {
+	store *store.Storage
+}
+
+func (g *getTxMerkleProof) Name() string {
+	return "get_tx_merkle_proof"
+}
+
+func (g *getTxMerkleProof) Execute(params json.RawMessage) (interface{}, error) {
+	p := txMerkleProofParams{Headers: defaultHeaderChainLen}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	blockHash, err := getTxBlockHash(g.store, p.TxId)
+	if err != nil {
+		return nil, err
+	}
+	block, err := getProofBlock(g.store, blockHash)
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := txHashes(block)
+	if err != nil {
+		return nil, err
+	}
+	pos := -1
+	for i, hash := range block.Txs {
+		if hash == p.TxId {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		return nil, ErrTxNotInBlock
+	}
+	branch, err := merkle.Branch(hashes, pos)
+	if err != nil {
+		return nil, err
+	}
+	headerChain, err := getHeaderChain(g.store, block.Height, p.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	proof := TxMerkleProof{
+		BlockHeight: block.Height,
+		BlockHash:   block.Hash,
+		Merkle:      make([]string, len(branch)),
+		Pos:         pos,
+		HeaderChain: *headerChain,
+	}
+	for i, hash := range branch {
+		proof.Merkle[i] = hash.String()
+	}
+	return proof, nil
+}
+
+func GetTxMerkleProof(store *store.Storage) Command {
+	return &getTxMerkleProof{
+		store: store,
+	}
+}
+
+// get_tx_out_proof
+
+type txOutProofParams struct {
+	TxIds []string `json:"txids"`
+	// BlockHash is the block to look the transactions up in, the block of the
+	// first transaction if omitted
+	BlockHash string `json:"blockhash"`
+	Headers   uint64 `json:"headers"`
+}
+
+type getTxOutProof struct {
+	store *store.Storage
+}
+
+func (g *getTxOutProof) Name() string {
+	return "get_tx_out_proof"
+}
+
+// Execute returns a proof that all the transactions are in one block.
+func (g *getTxOutProof) Execute(params json.RawMessage) (interface{}, error) {
+	p := txOutProofParams{Headers: defaultHeaderChainLen}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	if len(p.TxIds) == 0 {
+		return nil, fmt.Errorf("txids must not be empty")
+	}
+	if p.BlockHash == "" {
+		blockHash, err := getTxBlockHash(g.store, p.TxIds[0])
+		if err != nil {
+			return nil, err
+		}
+		p.BlockHash = blockHash
+	}
+	block, err := getProofBlock(g.store, p.BlockHash)
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := txHashes(block)
+	if err != nil {
+		return nil, err
+	}
+	inBlock := make(map[string]bool, len(block.Txs))
+	for _, hash := range block.Txs {
+		inBlock[hash] = true
+	}
+	matched := make(map[chainhash.Hash]bool, len(p.TxIds))
+	for _, txId := range p.TxIds {
+		if !inBlock[txId] {
+			return nil, fmt.Errorf("%s: %w", txId, ErrTxNotInBlock)
+		}
+		hash, err := chainhash.NewHashFromStr(txId)
+		if err != nil {
+			return nil, err
+		}
+		matched[*hash] = true
+	}
+
+	header, err := block.Header()
+	if err != nil {
+		return nil, err
+	}
+	merkleBlock, err := merkle.NewMerkleBlock(*header, hashes, matched)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := merkleBlock.BtcEncode(&buf, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		return nil, err
+	}
+	headerChain, err := getHeaderChain(g.store, block.Height, p.Headers)
+	if err != nil {
+		return nil, err
+	}
+	return TxOutProof{
+		Proof:       hex.EncodeToString(buf.Bytes()),
+		HeaderChain: *headerChain,
+	}, nil
+}
+
+func GetTxOutProof(store *store.Storage) Command {
+	return &getTxOutProof{
+		store: store,
+	}
+}
+
+// verify_tx_out_proof
+
+type verifyTxOutProofParams struct {
+	Proof string `json:"proof"`
+}
+
+type verifyTxOutProof struct {
+	store *store.Storage
+}
+
+func (v *verifyTxOutProof) Name() string {
+	return "verify_tx_out_proof"
+}
+
+// Execute returns the transactions the proof commits to, once the proof is
+// checked against a block of the main chain.
+func (v *verifyTxOutProof) Execute(params json.RawMessage) (interface{}, error) {
+	var p verifyTxOutProofParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	data, err := hex.DecodeString(p.Proof)
+	if err != nil {
+		return nil, err
+	}
+	merkleBlock := &wire.MsgMerkleBlock{}
+	if err := merkleBlock.BtcDecode(bytes.NewReader(data), wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		return nil, err
+	}
+	root, matches, _, err := merkle.ExtractMatches(merkleBlock)
+	if err != nil {
+		return nil, err
+	}
+	if root != merkleBlock.Header.MerkleRoot {
+		return nil, ErrInvalidTxOutProof
+	}
+	// the header is all that is needed, so pruned blocks are fine
+	if _, err := getMainChainBlock(v.store, merkleBlock.Header.BlockHash().String()); err != nil {
+		return nil, err
+	}
+	txIds := make([]string, len(matches))
+	for i, hash := range matches {
+		txIds[i] = hash.String()
+	}
+	return txIds, nil
+}
+
+func VerifyTxOutProof(store *store.Storage) Command {
+	return &verifyTxOutProof{
+		store: store,
+	}
+}
+
+// getTxBlockHash returns the hash of the main chain block of the transaction.
+// The block hash of the stored transaction is not used, as the side chain
+// blocks including it overwrite it.
+func getTxBlockHash(s *store.Storage, txId string) (string, error) {
+	location, exists, err := s.GetTxLocation(txId)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return location.BlockHash, nil
+	}
+	_, exists, err = s.GetTx(txId)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", store.ErrGetTxNotFound
+	}
+	return "", ErrTxNotConfirmed
+}
+
+// getProofBlock returns the main chain block with the given hash, with its
+// transactions.
+func getProofBlock(s *store.Storage, hash string) (*model.Block, error) {
+	block, err := getMainChainBlock(s, hash)
+	if err != nil {
+		return nil, err
+	}
+	if block.Pruned {
+		return nil, store.ErrBlockPruned
+	}
+	return block, nil
+}
+
+// getMainChainBlock returns the block with the given hash if it is still at
+// its height in the main chain, as orphaned blocks stay indexed by hash.
+func getMainChainBlock(s *store.Storage, hash string) (*model.Block, error) {
+	block, exists, err := s.GetBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrBlockNotInChain
+	}
+	atHeight, exists, err := s.GetBlockByHeight(block.Height)
+	if err != nil {
+		return nil, err
+	}
+	if !exists || atHeight.Hash != block.Hash {
+		return nil, ErrBlockNotInChain
+	}
+	return atHeight, nil
+}
+
+func txHashes(block *model.Block) ([]chainhash.Hash, error) {
+	hashes := make([]chainhash.Hash, len(block.Txs))
+	for i, txId := range block.Txs {
+		hash, err := chainhash.NewHashFromStr(txId)
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = *hash
+	}
+	return hashes, nil
+}
+
+// getHeaderChain returns up to length headers of the main chain starting at
+// the given height.
+func getHeaderChain(s *store.Storage, start, length uint64) (*HeaderChain, error) {
+	if length == 0 || length > maxHeaderChainLen {
+		return nil, fmt.Errorf("headers must be between 1 and %d", maxHeaderChainLen)
+	}
+	tip, exists, err := s.GetLatestBlockHeight()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, store.ErrGetLatestBlockHeightNone
+	}
+	end := start + length - 1
+	if end > tip {
+		end = tip
+	}
+	heights := make([]uint64, 0, end-start+1)
+	for height := start; height <= end; height++ {
+		heights = append(heights, height)
+	}
+	blocks, err := s.GetBlocks(heights)
+	if err != nil {
+		return nil, err
+	}
+
+	work := new(big.Int)
+	headers := make([]string, len(blocks))
+	for i, block := range blocks {
+		header, err := block.Header()
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := header.Serialize(&buf); err != nil {
+			return nil, err
+		}
+		headers[i] = hex.EncodeToString(buf.Bytes())
+		work.Add(work, blockchain.CalcWork(block.Bits))
+	}
+	return &HeaderChain{
+		StartHeight: start,
+		Headers:     headers,
+		Work:        work.Text(16),
+		TipHeight:   tip,
+	}, nil
+}
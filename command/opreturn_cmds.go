@@ -0,0 +1,118 @@
+package command
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/catalogfi/indexer/store"
+)
+
+const (
+	defaultOpReturnLimit = 50
+	maxOpReturnLimit     = 500
+)
+
+// search_op_return
+
+type searchOpReturnParams struct {
+	Payload string `json:"payload"`
+	// Match is either "exact" (default) or "prefix"
+	Match  string `json:"match"`
+	Offset int    `json:"offset"`
+	Limit  int    `json:"limit"`
+}
+
+type OpReturnResult struct {
+	TxId          string `json:"txid"`
+	Index         uint32 `json:"vout"`
+	Payload       string `json:"payload"`
+	Height        uint64 `json:"height"`
+	BlockHash     string `json:"blockhash"`
+	Confirmations uint64 `json:"confirmations"`
+}
+
+type OpReturnSearchResult struct {
+	Results    []OpReturnResult `json:"results"`
+	NextOffset int              `json:"next_offset,omitempty"`
+	HasMore    bool             `json:"has_more"`
+}
+
+type searchOpReturn struct {
+	store *store.Storage
+}
+
+func (s *searchOpReturn) Name() string {
+	return "search_op_return"
+}
+
+func (s *searchOpReturn) Execute(params json.RawMessage) (interface{}, error) {
+	var p searchOpReturnParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	payload := strings.ToLower(p.Payload)
+	if _, err := hex.DecodeString(payload); err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+	isPrefix := false
+	switch p.Match {
+	case "", "exact":
+	case "prefix":
+		if payload == "" {
+			return nil, fmt.Errorf("prefix must not be empty")
+		}
+		isPrefix = true
+	default:
+		return nil, fmt.Errorf("invalid match %q, expected exact or prefix", p.Match)
+	}
+	if p.Offset < 0 {
+		return nil, fmt.Errorf("offset must not be negative")
+	}
+	limit := p.Limit
+	if limit <= 0 {
+		limit = defaultOpReturnLimit
+	}
+	if limit > maxOpReturnLimit {
+		limit = maxOpReturnLimit
+	}
+
+	opReturns, hasMore, err := s.store.SearchOpReturns(payload, isPrefix, p.Offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	tip, _, err := s.store.GetLatestBlockHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	result := OpReturnSearchResult{
+		Results: make([]OpReturnResult, len(opReturns)),
+		HasMore: hasMore,
+	}
+	for i, opReturn := range opReturns {
+		confirmations := uint64(0)
+		if opReturn.BlockHash != "" && tip >= opReturn.Height {
+			confirmations = tip - opReturn.Height + 1
+		}
+		result.Results[i] = OpReturnResult{
+			TxId:          opReturn.TxId,
+			Index:         opReturn.Index,
+			Payload:       opReturn.Payload,
+			Height:        opReturn.Height,
+			BlockHash:     opReturn.BlockHash,
+			Confirmations: confirmations,
+		}
+	}
+	if hasMore {
+		result.NextOffset = p.Offset + len(opReturns)
+	}
+	return result, nil
+}
+
+func SearchOpReturn(store *store.Storage) Command {
+	return &searchOpReturn{
+		store: store,
+	}
+}
@@ -0,0 +1,70 @@
+package command
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/catalogfi/indexer/database"
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/store"
+	"go.uber.org/zap"
+)
+
+func newTestStorage(t *testing.T) *store.Storage {
+	db, err := database.NewRocksDB(t.TempDir(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.NewStorage(db)
+}
+
+func TestSearchOpReturn(t *testing.T) {
+	s := newTestStorage(t)
+	if err := s.SetLatestBlockHeight(10); err != nil {
+		t.Fatal(err)
+	}
+	err := s.PutOpReturns([]model.OpReturn{
+		{TxId: "01", Payload: "aabb", Height: 10, BlockHash: "tip"},
+		{TxId: "02", Payload: "aabb", Height: 1, BlockHash: "first"},
+		// in the mempool
+		{TxId: "03", Payload: "aabb"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	search := SearchOpReturn(s)
+	execute := func(params string) OpReturnSearchResult {
+		t.Helper()
+		result, err := search.Execute(json.RawMessage(params))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.(OpReturnSearchResult)
+	}
+
+	result := execute(`{"payload": "AABB", "limit": 2}`)
+	if len(result.Results) != 2 || !result.HasMore || result.NextOffset != 2 {
+		t.Fatalf("unexpected first page %+v", result)
+	}
+	if result.Results[0].Confirmations != 1 || result.Results[1].Confirmations != 10 {
+		t.Fatalf("expected 1 and 10 confirmations, got %+v", result.Results)
+	}
+	result = execute(`{"payload": "aabb", "offset": 2, "limit": 2}`)
+	if len(result.Results) != 1 || result.HasMore || result.NextOffset != 0 {
+		t.Fatalf("unexpected last page %+v", result)
+	}
+	if result.Results[0].TxId != "03" || result.Results[0].Confirmations != 0 {
+		t.Fatalf("expected an unconfirmed result, got %+v", result.Results[0])
+	}
+
+	for _, params := range []string{
+		`{"payload": "zz"}`,
+		`{"payload": "", "match": "prefix"}`,
+		`{"payload": "aa", "match": "suffix"}`,
+		`{"payload": "aa", "offset": -1}`,
+	} {
+		if _, err := search.Execute(json.RawMessage(params)); err == nil {
+			t.Fatalf("expected an error for %s", params)
+		}
+	}
+}
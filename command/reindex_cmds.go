@@ -0,0 +1,70 @@
+package command
+
+import (
+	"encoding/json"
+
+	"github.com/catalogfi/indexer/model"
+)
+
+type reindexer interface {
+	Reindex(indexes []string) (*model.ReindexProgress, error)
+	ReindexProgress() (*model.ReindexProgress, bool, error)
+}
+
+// reindex
+
+type reindexParams struct {
+	// Indexes to rebuild, any of utxos, history, outspends, op_returns,
+	// block_stats, swaps and tx_locations. The last unfinished reindex is
+	// resumed if empty.
+	Indexes []string `json:"indexes"`
+}
+
+type reindex struct {
+	reindexer reindexer
+}
+
+func (r *reindex) Name() string {
+	return "reindex"
+}
+
+func (r *reindex) Execute(params json.RawMessage) (interface{}, error) {
+	var p reindexParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	return r.reindexer.Reindex(p.Indexes)
+}
+
+func Reindex(reindexer reindexer) Command {
+	return &reindex{
+		reindexer: reindexer,
+	}
+}
+
+// get_reindex_progress
+
+type getReindexProgress struct {
+	reindexer reindexer
+}
+
+func (g *getReindexProgress) Name() string {
+	return "get_reindex_progress"
+}
+
+func (g *getReindexProgress) Execute(params json.RawMessage) (interface{}, error) {
+	progress, exists, err := g.reindexer.ReindexProgress()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+	return progress, nil
+}
+
+func GetReindexProgress(reindexer reindexer) Command {
+	return &getReindexProgress{
+		reindexer: reindexer,
+	}
+}
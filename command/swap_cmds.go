@@ -0,0 +1,193 @@
+package command
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/store"
+	"github.com/catalogfi/indexer/swap"
+)
+
+// Statuses of a swap contract.
+const (
+	SwapUnfunded = "unfunded"
+	SwapFunded   = "funded"
+	SwapRedeemed = "redeemed"
+	SwapRefunded = "refunded"
+)
+
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SwapFunding is an output paying to the contract. Height is zero for
+// mempool transactions.
+type SwapFunding struct {
+	TxId   string `json:"txid"`
+	Index  uint32 `json:"index"`
+	Value  int64  `json:"value"`
+	Height uint64 `json:"height"`
+}
+
+type SwapStatus struct {
+	ScriptPubKey string `json:"script_pub_key"`
+	Status       string `json:"status"`
+	// Confirmed tells whether the transaction the status comes from is
+	// confirmed
+	Confirmed bool               `json:"confirmed"`
+	Secret    string             `json:"secret,omitempty"`
+	Fundings  []SwapFunding      `json:"fundings"`
+	Spends    []*model.SwapSpend `json:"spends"`
+}
+
+// get_swap_status
+
+type getSwapStatus struct {
+	store       *store.Storage
+	chainParams *chaincfg.Params
+}
+
+func (g *getSwapStatus) Name() string {
+	return "get_swap_status"
+}
+
+// Execute returns the status of the contract with the given address or hex
+// encoded script. Confirmed spends take precedence over mempool ones.
+func (g *getSwapStatus) Execute(params json.RawMessage) (interface{}, error) {
+	var p string
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	scriptPubKey, err := g.parseScript(p)
+	if err != nil {
+		return nil, err
+	}
+	fundings, err := g.getFundings(scriptPubKey)
+	if err != nil {
+		return nil, err
+	}
+	spends, err := g.store.GetSwapSpends(scriptPubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	status := SwapStatus{
+		ScriptPubKey: scriptPubKey,
+		Status:       SwapUnfunded,
+		Fundings:     fundings,
+		Spends:       spends,
+	}
+	for _, funding := range fundings {
+		status.Status = SwapFunded
+		status.Confirmed = status.Confirmed || funding.Height > 0
+	}
+	var settled *model.SwapSpend
+	for _, spend := range spends {
+		if settled == nil || settled.Height == 0 && spend.Height > 0 {
+			settled = spend
+		}
+	}
+	if settled != nil {
+		status.Status = SwapRefunded
+		if settled.Kind == swap.SpendRedeem {
+			status.Status = SwapRedeemed
+			status.Secret = settled.Secret
+		}
+		status.Confirmed = settled.Height > 0
+	}
+	return status, nil
+}
+
+func (g *getSwapStatus) parseScript(scriptOrAddress string) (string, error) {
+	address, err := btcutil.DecodeAddress(scriptOrAddress, g.chainParams)
+	if err == nil {
+		script, err := txscript.PayToAddrScript(address)
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(script), nil
+	}
+	if _, err := hex.DecodeString(scriptOrAddress); err != nil {
+		return "", errors.New("invalid address or script")
+	}
+	return strings.ToLower(scriptOrAddress), nil
+}
+
+func (g *getSwapStatus) getFundings(scriptPubKey string) ([]SwapFunding, error) {
+	hashes, err := g.store.GetTxHashesOfPubScript(scriptPubKey)
+	if err != nil {
+		return nil, err
+	}
+	txs, err := g.store.GetTxs(hashes)
+	if err != nil {
+		return nil, err
+	}
+	fundings := make([]SwapFunding, 0)
+	for _, tx := range txs {
+		// the block hash of the transaction may be the one of a side chain
+		// block including it too
+		height := uint64(0)
+		location, exists, err := g.store.GetTxLocation(tx.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			height = location.Height
+		}
+		for _, vout := range tx.Vouts {
+			if vout.ScriptPubKey == scriptPubKey {
+				fundings = append(fundings, SwapFunding{
+					TxId:   tx.Hash,
+					Index:  vout.Index,
+					Value:  vout.Value,
+					Height: height,
+				})
+			}
+		}
+	}
+	return fundings, nil
+}
+
+func GetSwapStatus(store *store.Storage, chainParams *chaincfg.Params) Command {
+	return &getSwapStatus{
+		store:       store,
+		chainParams: chainParams,
+	}
+}
+
+// get_secret_by_hash
+
+type getSecretByHash struct {
+	store *store.Storage
+}
+
+func (g *getSecretByHash) Name() string {
+	return "get_secret_by_hash"
+}
+
+// Execute returns the redeem which revealed the secret of the hex encoded
+// hash, as pushed in the contract.
+func (g *getSecretByHash) Execute(params json.RawMessage) (interface{}, error) {
+	var p string
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	spend, exists, err := g.store.GetSecret(strings.ToLower(p))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrSecretNotFound
+	}
+	return spend, nil
+}
+
+func GetSecretByHash(store *store.Storage) Command {
+	return &getSecretByHash{
+		store: store,
+	}
+}
@@ -0,0 +1,31 @@
+package command
+
+import (
+	"encoding/json"
+
+	"github.com/catalogfi/indexer/model"
+)
+
+type syncStatusProvider interface {
+	SyncStatus() (*model.SyncStatus, error)
+}
+
+// get_sync_status
+
+type getSyncStatus struct {
+	provider syncStatusProvider
+}
+
+func (g *getSyncStatus) Name() string {
+	return "get_sync_status"
+}
+
+func (g *getSyncStatus) Execute(params json.RawMessage) (interface{}, error) {
+	return g.provider.SyncStatus()
+}
+
+func GetSyncStatus(provider syncStatusProvider) Command {
+	return &getSyncStatus{
+		provider: provider,
+	}
+}
@@ -3,13 +3,115 @@ package command
 import (
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"sort"
 
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/txscript"
+	"github.com/catalogfi/indexer/model"
 	"github.com/catalogfi/indexer/store"
 )
 
+// UTXO is an unspent output with its confirmation state. Confirmations is
+// zero for outputs of mempool transactions. Spendable is unset for coinbase
+// outputs until they reach the coinbase maturity, and for outputs already
+// spent by a mempool transaction, which are flagged PendingSpend.
+type UTXO struct {
+	*model.Vout
+	Confirmations uint64 `json:"confirmations"`
+	Spendable     bool   `json:"spendable"`
+	PendingSpend  bool   `json:"pending_spend"`
+}
+
+// Sort orders of get_utxos. Without one the outputs are returned in storage
+// order, which lets the count and sum limits stop the scan early.
+const (
+	SortAmountAsc         = "amount_asc"
+	SortAmountDesc        = "amount_desc"
+	SortConfirmationsAsc  = "confirmations_asc"
+	SortConfirmationsDesc = "confirmations_desc"
+)
+
+var (
+	ErrInvalidAmountRange       = errors.New("maximum amount is below the minimum amount")
+	ErrInvalidConfirmationRange = errors.New("maximum confirmations is below the minimum confirmations")
+	ErrInvalidUTXOSort          = errors.New("invalid sort order")
+)
+
+// UTXOOptions filters the outputs returned by get_utxos. Zero maximums are
+// unbounded. Once MinimumSumAmount is reached no further outputs are added.
+// Unsafe outputs, the unconfirmed ones and the ones already spent by a
+// mempool transaction, are included unless IncludeUnsafe is false.
+type UTXOOptions struct {
+	MinimumAmount    int64  `json:"minimum_amount"`
+	MaximumAmount    int64  `json:"maximum_amount"`
+	MaximumCount     int    `json:"maximum_count"`
+	MinimumSumAmount int64  `json:"minimum_sum_amount"`
+	MinConfirmations uint64 `json:"min_confirmations"`
+	MaxConfirmations uint64 `json:"max_confirmations"`
+	IncludeUnsafe    *bool  `json:"include_unsafe"`
+	Sort             string `json:"sort"`
+}
+
+type utxosParams struct {
+	Address string `json:"address"`
+	UTXOOptions
+}
+
+func (o *UTXOOptions) validate() error {
+	if o.MaximumAmount > 0 && o.MaximumAmount < o.MinimumAmount {
+		return ErrInvalidAmountRange
+	}
+	if o.MaxConfirmations > 0 && o.MaxConfirmations < o.MinConfirmations {
+		return ErrInvalidConfirmationRange
+	}
+	switch o.Sort {
+	case "", SortAmountAsc, SortAmountDesc, SortConfirmationsAsc, SortConfirmationsDesc:
+		return nil
+	default:
+		return ErrInvalidUTXOSort
+	}
+}
+
+func (o *UTXOOptions) match(utxo UTXO) bool {
+	if utxo.Value < o.MinimumAmount || o.MaximumAmount > 0 && utxo.Value > o.MaximumAmount {
+		return false
+	}
+	if utxo.Confirmations < o.MinConfirmations || o.MaxConfirmations > 0 && utxo.Confirmations > o.MaxConfirmations {
+		return false
+	}
+	if o.IncludeUnsafe != nil && !*o.IncludeUnsafe && (utxo.Confirmations == 0 || utxo.PendingSpend) {
+		return false
+	}
+	return true
+}
+
+// limit returns the leading outputs within the count and sum limits.
+func (o *UTXOOptions) limit(utxos []UTXO) []UTXO {
+	sum := int64(0)
+	for i, utxo := range utxos {
+		if o.MaximumCount > 0 && i == o.MaximumCount || o.MinimumSumAmount > 0 && sum >= o.MinimumSumAmount {
+			return utxos[:i]
+		}
+		sum += utxo.Value
+	}
+	return utxos
+}
+
+func sortUTXOs(utxos []UTXO, order string) {
+	switch order {
+	case SortAmountAsc:
+		sort.SliceStable(utxos, func(i, j int) bool { return utxos[i].Value < utxos[j].Value })
+	case SortAmountDesc:
+		sort.SliceStable(utxos, func(i, j int) bool { return utxos[i].Value > utxos[j].Value })
+	case SortConfirmationsAsc:
+		sort.SliceStable(utxos, func(i, j int) bool { return utxos[i].Confirmations < utxos[j].Confirmations })
+	case SortConfirmationsDesc:
+		sort.SliceStable(utxos, func(i, j int) bool { return utxos[i].Confirmations > utxos[j].Confirmations })
+	}
+}
+
 type utxos struct {
 	store       *store.Storage
 	chainParams *chaincfg.Params
@@ -19,14 +121,20 @@ func (u *utxos) Name() string {
 	return "get_utxos"
 }
 
+// Execute takes either an address, or an object with the address and the
+// UTXOOptions. The amount and confirmation filters are applied while
+// scanning the outputs of the address.
 func (u *utxos) Execute(params json.RawMessage) (interface{}, error) {
-
-	var p string
-	err := json.Unmarshal(params, &p)
-	if err != nil {
+	var p utxosParams
+	if err := json.Unmarshal(params, &p.Address); err != nil {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.validate(); err != nil {
 		return nil, err
 	}
-	address, err := btcutil.DecodeAddress(p, u.chainParams)
+	address, err := btcutil.DecodeAddress(p.Address, u.chainParams)
 	if err != nil {
 		return nil, err
 	}
@@ -34,7 +142,47 @@ func (u *utxos) Execute(params json.RawMessage) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	return u.store.GetUTXOs(hex.EncodeToString(script))
+	tip, _, err := u.store.GetLatestBlockHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	utxos := make([]UTXO, 0)
+	sum := int64(0)
+	err = u.store.IterateUTXOs(hex.EncodeToString(script), func(vout *model.Vout, pendingSpend bool) bool {
+		utxo := u.newUTXO(vout, pendingSpend, tip)
+		if !p.match(utxo) {
+			return true
+		}
+		utxos = append(utxos, utxo)
+		sum += utxo.Value
+		if p.Sort != "" {
+			return true
+		}
+		// in storage order the limits can end the scan
+		if p.MaximumCount > 0 && len(utxos) >= p.MaximumCount {
+			return false
+		}
+		return p.MinimumSumAmount <= 0 || sum < p.MinimumSumAmount
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortUTXOs(utxos, p.Sort)
+	return p.limit(utxos), nil
+}
+
+func (u *utxos) newUTXO(vout *model.Vout, pendingSpend bool, tip uint64) UTXO {
+	utxo := UTXO{
+		Vout:         vout,
+		PendingSpend: pendingSpend,
+	}
+	if vout.Height > 0 && vout.Height <= tip {
+		utxo.Confirmations = tip - vout.Height + 1
+	}
+	mature := !vout.Coinbase || utxo.Confirmations >= uint64(u.chainParams.CoinbaseMaturity)
+	utxo.Spendable = mature && !utxo.PendingSpend
+	return utxo
 }
 
 func UTXOs(store *store.Storage, chainParams *chaincfg.Params) Command {
@@ -46,6 +194,28 @@ func UTXOs(store *store.Storage, chainParams *chaincfg.Params) Command {
 
 // getTx
 
+// Statuses of a transaction.
+const (
+	TxConfirmed = "confirmed"
+	TxMempool   = "mempool"
+	TxOrphaned  = "orphaned"
+	TxReplaced  = "replaced"
+)
+
+// TxWithStatus is a transaction with its place in the chain. Height and
+// BlockTime are those of the orphaned block for orphaned transactions.
+// ReplacedBy is only known when the conflicting transaction is in the
+// mempool.
+type TxWithStatus struct {
+	*model.Transaction
+	Status        string  `json:"status"`
+	Height        uint64  `json:"height,omitempty"`
+	BlockTime     int64   `json:"block_time,omitempty"`
+	Confirmations uint64  `json:"confirmations"`
+	Position      *uint32 `json:"position,omitempty"`
+	ReplacedBy    string  `json:"replaced_by,omitempty"`
+}
+
 type getTx struct {
 	store *store.Storage
 }
@@ -67,7 +237,63 @@ func (g *getTx) Execute(params json.RawMessage) (interface{}, error) {
 	if !exists {
 		return nil, store.ErrGetTxNotFound
 	}
-	return tx, nil
+
+	result := TxWithStatus{
+		Transaction: tx,
+		Status:      TxMempool,
+	}
+	location, exists, err := g.store.GetTxLocation(tx.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		block, exists, err := g.store.GetBlock(location.BlockHash)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, store.ErrGetBlockNotFound
+		}
+		tip, _, err := g.store.GetLatestBlockHeight()
+		if err != nil {
+			return nil, err
+		}
+		// the body keeps the hash of the last block it was stored with,
+		// which may be an orphaned one
+		tx.BlockHash = location.BlockHash
+		result.Status = TxConfirmed
+		result.Height = location.Height
+		result.BlockTime = block.Timestamp.Unix()
+		result.Position = &location.Index
+		if location.Height <= tip {
+			result.Confirmations = tip - location.Height + 1
+		}
+		return result, nil
+	}
+
+	// blocks leaving the main chain are only stored as orphans
+	if tx.BlockHash != "" {
+		block, exists, err := g.store.GetOrphanBlock(tx.BlockHash)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			result.Status = TxOrphaned
+			result.Height = block.Height
+			result.BlockTime = block.Timestamp.Unix()
+			return result, nil
+		}
+	}
+
+	replacedBy, replaced, err := g.store.GetTxConflict(tx)
+	if err != nil {
+		return nil, err
+	}
+	if replaced {
+		result.Status = TxReplaced
+		result.ReplacedBy = replacedBy
+	}
+	return result, nil
 }
 
 func GetTx(store *store.Storage) Command {
@@ -0,0 +1,252 @@
+package command
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/store"
+)
+
+func testTxId(b byte) string {
+	return strings.Repeat(hex.EncodeToString([]byte{b}), 32)
+}
+
+// newTestAddress returns a regtest address and its script.
+func newTestAddress(t *testing.T) (string, string) {
+	address, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := txscript.PayToAddrScript(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return address.EncodeAddress(), hex.EncodeToString(script)
+}
+
+func getUTXOs(t *testing.T, s *store.Storage, params string) map[string]UTXO {
+	t.Helper()
+	result, err := UTXOs(s, &chaincfg.RegressionNetParams).Execute(json.RawMessage(params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	utxos := make(map[string]UTXO)
+	for _, utxo := range result.([]UTXO) {
+		utxos[utxo.TxId] = utxo
+	}
+	return utxos
+}
+
+func TestGetUTXOs(t *testing.T) {
+	s := newTestStorage(t)
+	address, script := newTestAddress(t)
+	// the coinbase maturity of regtest is 100 blocks
+	if err := s.SetLatestBlockHeight(200); err != nil {
+		t.Fatal(err)
+	}
+	vouts := []model.Vout{
+		{TxId: testTxId(1), Value: 1000, ScriptPubKey: script, Height: 101, Coinbase: true},
+		{TxId: testTxId(2), Value: 1000, ScriptPubKey: script, Height: 102, Coinbase: true},
+		{TxId: testTxId(3), Value: 1000, ScriptPubKey: script},
+		{TxId: testTxId(4), Value: 1000, ScriptPubKey: script, Height: 200},
+		{TxId: testTxId(5), Value: 1000, ScriptPubKey: script, Height: 150},
+	}
+	if err := s.PutUTXOs(vouts); err != nil {
+		t.Fatal(err)
+	}
+	// the output of 5 is spent by a mempool transaction
+	vin := model.Vin{TxId: testTxId(6), PreviousTxId: testTxId(5)}
+	if _, err := s.MarkUTXOsSpent([]string{testTxId(5)}, []uint32{0}, []model.Vin{vin}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]struct {
+		confirmations uint64
+		spendable     bool
+		pendingSpend  bool
+	}{
+		testTxId(1): {100, true, false},
+		testTxId(2): {99, false, false},
+		testTxId(3): {0, true, false},
+		testTxId(4): {1, true, false},
+		testTxId(5): {51, false, true},
+	}
+	utxos := getUTXOs(t, s, `"`+address+`"`)
+	if len(utxos) != len(expected) {
+		t.Fatalf("expected %d utxos, got %d", len(expected), len(utxos))
+	}
+	for hash, e := range expected {
+		utxo := utxos[hash]
+		if utxo.Confirmations != e.confirmations || utxo.Spendable != e.spendable || utxo.PendingSpend != e.pendingSpend {
+			t.Fatalf("expected %s to have %d confirmations, spendable %v, pending spend %v, got %+v", hash, e.confirmations, e.spendable, e.pendingSpend, utxo)
+		}
+	}
+
+	// the unconfirmed output and the one spent in the mempool are unsafe
+	utxos = getUTXOs(t, s, `{"address": "`+address+`", "include_unsafe": false}`)
+	if len(utxos) != 3 {
+		t.Fatalf("expected 3 safe utxos, got %d", len(utxos))
+	}
+	if _, ok := utxos[testTxId(3)]; ok {
+		t.Fatal("the unconfirmed output is unsafe")
+	}
+	if _, ok := utxos[testTxId(5)]; ok {
+		t.Fatal("the output spent in the mempool is unsafe")
+	}
+}
+
+func TestUTXOOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  UTXOOptions
+		expected error
+	}{
+		{"defaults", UTXOOptions{}, nil},
+		{"amount range", UTXOOptions{MinimumAmount: 10, MaximumAmount: 10}, nil},
+		{"unbounded amount", UTXOOptions{MinimumAmount: 10}, nil},
+		{"inverted amount range", UTXOOptions{MinimumAmount: 10, MaximumAmount: 9}, ErrInvalidAmountRange},
+		{"confirmation range", UTXOOptions{MinConfirmations: 6, MaxConfirmations: 6}, nil},
+		{"unbounded confirmations", UTXOOptions{MinConfirmations: 6}, nil},
+		{"inverted confirmation range", UTXOOptions{MinConfirmations: 6, MaxConfirmations: 5}, ErrInvalidConfirmationRange},
+		{"sort", UTXOOptions{Sort: SortConfirmationsDesc}, nil},
+		{"unknown sort", UTXOOptions{Sort: "amount"}, ErrInvalidUTXOSort},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.options.validate(); err != test.expected {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestUTXOOptionsMatch(t *testing.T) {
+	unsafe := false
+	newUTXO := func(value int64, confirmations uint64, pendingSpend bool) UTXO {
+		return UTXO{Vout: &model.Vout{Value: value}, Confirmations: confirmations, PendingSpend: pendingSpend}
+	}
+	tests := []struct {
+		name     string
+		options  UTXOOptions
+		utxo     UTXO
+		expected bool
+	}{
+		{"no filter", UTXOOptions{}, newUTXO(1, 0, true), true},
+		{"minimum amount", UTXOOptions{MinimumAmount: 100}, newUTXO(100, 1, false), true},
+		{"below the minimum amount", UTXOOptions{MinimumAmount: 100}, newUTXO(99, 1, false), false},
+		{"maximum amount", UTXOOptions{MaximumAmount: 100}, newUTXO(100, 1, false), true},
+		{"above the maximum amount", UTXOOptions{MaximumAmount: 100}, newUTXO(101, 1, false), false},
+		{"minimum confirmations", UTXOOptions{MinConfirmations: 6}, newUTXO(1, 6, false), true},
+		{"below the minimum confirmations", UTXOOptions{MinConfirmations: 6}, newUTXO(1, 5, false), false},
+		{"maximum confirmations", UTXOOptions{MaxConfirmations: 6}, newUTXO(1, 6, false), true},
+		{"above the maximum confirmations", UTXOOptions{MaxConfirmations: 6}, newUTXO(1, 7, false), false},
+		{"safe", UTXOOptions{IncludeUnsafe: &unsafe}, newUTXO(1, 1, false), true},
+		{"unconfirmed", UTXOOptions{IncludeUnsafe: &unsafe}, newUTXO(1, 0, false), false},
+		{"pending spend", UTXOOptions{IncludeUnsafe: &unsafe}, newUTXO(1, 1, true), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if match := test.options.match(test.utxo); match != test.expected {
+				t.Fatalf("expected match %v, got %v", test.expected, match)
+			}
+		})
+	}
+}
+
+func TestUTXOOptionsLimit(t *testing.T) {
+	utxos := make([]UTXO, 4)
+	for i := range utxos {
+		utxos[i] = UTXO{Vout: &model.Vout{Value: int64(10 * (i + 1))}}
+	}
+	tests := []struct {
+		name     string
+		options  UTXOOptions
+		expected int
+	}{
+		{"no limit", UTXOOptions{}, 4},
+		{"maximum count", UTXOOptions{MaximumCount: 2}, 2},
+		{"maximum count above the outputs", UTXOOptions{MaximumCount: 5}, 4},
+		// 10 + 20 + 30 reaches 60
+		{"minimum sum", UTXOOptions{MinimumSumAmount: 60}, 3},
+		{"minimum sum between outputs", UTXOOptions{MinimumSumAmount: 31}, 3},
+		{"minimum sum above the total", UTXOOptions{MinimumSumAmount: 1000}, 4},
+		{"count before sum", UTXOOptions{MaximumCount: 1, MinimumSumAmount: 60}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if limited := test.options.limit(utxos); len(limited) != test.expected {
+				t.Fatalf("expected %d utxos, got %d", test.expected, len(limited))
+			}
+		})
+	}
+}
+
+func TestSortUTXOs(t *testing.T) {
+	newUTXOs := func() []UTXO {
+		// values and confirmations in different orders, with ties kept in
+		// storage order
+		return []UTXO{
+			{Vout: &model.Vout{TxId: "a", Value: 20}, Confirmations: 3},
+			{Vout: &model.Vout{TxId: "b", Value: 10}, Confirmations: 1},
+			{Vout: &model.Vout{TxId: "c", Value: 30}, Confirmations: 1},
+			{Vout: &model.Vout{TxId: "d", Value: 10}, Confirmations: 2},
+		}
+	}
+	tests := []struct {
+		order    string
+		expected string
+	}{
+		{"", "abcd"},
+		{SortAmountAsc, "bdac"},
+		{SortAmountDesc, "cabd"},
+		{SortConfirmationsAsc, "bcda"},
+		{SortConfirmationsDesc, "adbc"},
+	}
+	for _, test := range tests {
+		t.Run(test.order, func(t *testing.T) {
+			utxos := newUTXOs()
+			sortUTXOs(utxos, test.order)
+			order := ""
+			for _, utxo := range utxos {
+				order += utxo.TxId
+			}
+			if order != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, order)
+			}
+		})
+	}
+}
+
+func TestGetUTXOsSortAndLimit(t *testing.T) {
+	s := newTestStorage(t)
+	address, script := newTestAddress(t)
+	if err := s.SetLatestBlockHeight(10); err != nil {
+		t.Fatal(err)
+	}
+	vouts := []model.Vout{
+		{TxId: testTxId(1), Value: 300, ScriptPubKey: script, Height: 10},
+		{TxId: testTxId(2), Value: 100, ScriptPubKey: script, Height: 5},
+		{TxId: testTxId(3), Value: 200, ScriptPubKey: script, Height: 1},
+	}
+	if err := s.PutUTXOs(vouts); err != nil {
+		t.Fatal(err)
+	}
+	// the limit applies to the sorted outputs
+	result, err := UTXOs(s, &chaincfg.RegressionNetParams).Execute(json.RawMessage(`{"address": "` + address + `", "sort": "amount_desc", "minimum_sum_amount": 400}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	utxos := result.([]UTXO)
+	if len(utxos) != 2 || utxos[0].TxId != testTxId(1) || utxos[1].TxId != testTxId(3) {
+		t.Fatalf("expected the two largest outputs, got %+v", utxos)
+	}
+	if _, err := UTXOs(s, &chaincfg.RegressionNetParams).Execute(json.RawMessage(`{"address": "` + address + `", "min_confirmations": 2, "max_confirmations": 1}`)); err != ErrInvalidConfirmationRange {
+		t.Fatalf("expected %v, got %v", ErrInvalidConfirmationRange, err)
+	}
+}
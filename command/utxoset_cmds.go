@@ -0,0 +1,74 @@
+package command
+
+import (
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/catalogfi/indexer/muhash"
+	"github.com/catalogfi/indexer/store"
+)
+
+// get_tx_out_set_info
+
+type TxOutSetInfo struct {
+	Height    uint64 `json:"height"`
+	BestBlock string `json:"bestblock"`
+	TxOuts    uint64 `json:"txouts"`
+	// TotalAmount is the value of all unspent outputs in satoshis
+	TotalAmount int64             `json:"total_amount"`
+	ScriptTypes map[string]uint64 `json:"script_types"`
+	MuHash      string            `json:"muhash"`
+}
+
+type getTxOutSetInfo struct {
+	store *store.Storage
+}
+
+func (g *getTxOutSetInfo) Name() string {
+	return "get_tx_out_set_info"
+}
+
+func (g *getTxOutSetInfo) Execute(params json.RawMessage) (interface{}, error) {
+	height, exists, err := g.store.GetLatestBlockHeight()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, store.ErrGetLatestBlockHeightNone
+	}
+	block, exists, err := g.store.GetBlockByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, store.ErrGetBlockNotFound
+	}
+	info, err := g.store.GetUTXOSetInfo()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := muhash.Deserialize(info.MuHash)
+	if err != nil {
+		return nil, err
+	}
+
+	// displayed in reverse byte order like bitcoind
+	digest := hash.Finalize()
+	for i, j := 0, len(digest)-1; i < j; i, j = i+1, j-1 {
+		digest[i], digest[j] = digest[j], digest[i]
+	}
+	return TxOutSetInfo{
+		Height:      height,
+		BestBlock:   block.Hash,
+		TxOuts:      info.TxOuts,
+		TotalAmount: info.TotalAmount,
+		ScriptTypes: info.ScriptTypes,
+		MuHash:      hex.EncodeToString(digest[:]),
+	}, nil
+}
+
+func GetTxOutSetInfo(store *store.Storage) Command {
+	return &getTxOutSetInfo{
+		store: store,
+	}
+}
@@ -0,0 +1,51 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/catalogfi/indexer/store"
+)
+
+// verify_chain
+
+const maxVerifyChainRange = 1000
+
+type verifyChainParams struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+type verifyChain struct {
+	store *store.Storage
+}
+
+func (v *verifyChain) Name() string {
+	return "verify_chain"
+}
+
+// Execute verifies the blocks in [start, end] without repairing anything, as
+// repairs must not race with the indexing. Larger ranges and repairs are left
+// to the verifychain tool.
+func (v *verifyChain) Execute(params json.RawMessage) (interface{}, error) {
+	var p verifyChainParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	if p.End < p.Start {
+		return nil, fmt.Errorf("end must not be below start")
+	}
+	if p.End-p.Start >= maxVerifyChainRange {
+		return nil, fmt.Errorf("range must not exceed %d blocks", maxVerifyChainRange)
+	}
+	return v.store.VerifyChain(store.VerifyOptions{
+		StartHeight: p.Start,
+		EndHeight:   p.End,
+	})
+}
+
+func VerifyChain(store *store.Storage) Command {
+	return &verifyChain{
+		store: store,
+	}
+}
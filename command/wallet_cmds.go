@@ -0,0 +1,295 @@
+package command
+
+import (
+	"encoding/json"
+
+	"github.com/catalogfi/indexer/wallet"
+)
+
+const defaultListTransactionsCount = 10
+
+type ImportResult struct {
+	// RescannedTxs is the number of wallet transactions found by the rescan
+	RescannedTxs int `json:"rescanned_txs"`
+}
+
+// create_wallet
+
+type createWalletParams struct {
+	Name string `json:"name"`
+}
+
+type createWallet struct {
+	wallets *wallet.Manager
+}
+
+func (c *createWallet) Name() string {
+	return "create_wallet"
+}
+
+func (c *createWallet) Execute(params json.RawMessage) (interface{}, error) {
+	var p createWalletParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	return c.wallets.CreateWallet(p.Name)
+}
+
+func CreateWallet(wallets *wallet.Manager) Command {
+	return &createWallet{
+		wallets: wallets,
+	}
+}
+
+// list_wallets
+
+type listWallets struct {
+	wallets *wallet.Manager
+}
+
+func (l *listWallets) Name() string {
+	return "list_wallets"
+}
+
+func (l *listWallets) Execute(params json.RawMessage) (interface{}, error) {
+	return l.wallets.ListWallets()
+}
+
+func ListWallets(wallets *wallet.Manager) Command {
+	return &listWallets{
+		wallets: wallets,
+	}
+}
+
+// import_address
+
+type importAddressParams struct {
+	Wallet  string `json:"wallet"`
+	Address string `json:"address"`
+	Label   string `json:"label"`
+	// RescanHeight is the height the rescan starts from, the whole chain is
+	// rescanned if omitted
+	RescanHeight uint64 `json:"rescan_height"`
+}
+
+type importAddress struct {
+	wallets *wallet.Manager
+}
+
+func (i *importAddress) Name() string {
+	return "import_address"
+}
+
+func (i *importAddress) Execute(params json.RawMessage) (interface{}, error) {
+	var p importAddressParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	if err := i.wallets.ImportAddress(p.Wallet, p.Address, p.Label); err != nil {
+		return nil, err
+	}
+	txs, err := i.wallets.Rescan(p.Wallet, p.RescanHeight)
+	if err != nil {
+		return nil, err
+	}
+	return ImportResult{RescannedTxs: txs}, nil
+}
+
+func ImportAddress(wallets *wallet.Manager) Command {
+	return &importAddress{
+		wallets: wallets,
+	}
+}
+
+// import_descriptor
+
+type importDescriptorParams struct {
+	Wallet string `json:"wallet"`
+	// Descriptor is an output descriptor or an extended public key
+	Descriptor   string `json:"descriptor"`
+	GapLimit     uint32 `json:"gap_limit"`
+	Label        string `json:"label"`
+	RescanHeight uint64 `json:"rescan_height"`
+}
+
+type importDescriptor struct {
+	wallets *wallet.Manager
+}
+
+func (i *importDescriptor) Name() string {
+	return "import_descriptor"
+}
+
+func (i *importDescriptor) Execute(params json.RawMessage) (interface{}, error) {
+	p := importDescriptorParams{GapLimit: wallet.DefaultGapLimit}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	if err := i.wallets.ImportDescriptor(p.Wallet, p.Descriptor, p.GapLimit, p.Label); err != nil {
+		return nil, err
+	}
+	txs, err := i.wallets.Rescan(p.Wallet, p.RescanHeight)
+	if err != nil {
+		return nil, err
+	}
+	return ImportResult{RescannedTxs: txs}, nil
+}
+
+func ImportDescriptor(wallets *wallet.Manager) Command {
+	return &importDescriptor{
+		wallets: wallets,
+	}
+}
+
+// rescan_wallet
+
+type rescanWalletParams struct {
+	Wallet      string `json:"wallet"`
+	StartHeight uint64 `json:"start_height"`
+}
+
+type rescanWallet struct {
+	wallets *wallet.Manager
+}
+
+func (r *rescanWallet) Name() string {
+	return "rescan_wallet"
+}
+
+func (r *rescanWallet) Execute(params json.RawMessage) (interface{}, error) {
+	var p rescanWalletParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	txs, err := r.wallets.Rescan(p.Wallet, p.StartHeight)
+	if err != nil {
+		return nil, err
+	}
+	return ImportResult{RescannedTxs: txs}, nil
+}
+
+func RescanWallet(wallets *wallet.Manager) Command {
+	return &rescanWallet{
+		wallets: wallets,
+	}
+}
+
+// set_label
+
+type setLabelParams struct {
+	Wallet  string `json:"wallet"`
+	Address string `json:"address"`
+	Label   string `json:"label"`
+}
+
+type setLabel struct {
+	wallets *wallet.Manager
+}
+
+func (s *setLabel) Name() string {
+	return "set_label"
+}
+
+func (s *setLabel) Execute(params json.RawMessage) (interface{}, error) {
+	var p setLabelParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	if err := s.wallets.SetLabel(p.Wallet, p.Address, p.Label); err != nil {
+		return nil, err
+	}
+	return p.Label, nil
+}
+
+func SetLabel(wallets *wallet.Manager) Command {
+	return &setLabel{
+		wallets: wallets,
+	}
+}
+
+// list_transactions
+
+type listTransactionsParams struct {
+	Wallet string `json:"wallet"`
+	Count  int    `json:"count"`
+	Skip   int    `json:"skip"`
+}
+
+type listTransactions struct {
+	wallets *wallet.Manager
+}
+
+func (l *listTransactions) Name() string {
+	return "list_transactions"
+}
+
+func (l *listTransactions) Execute(params json.RawMessage) (interface{}, error) {
+	p := listTransactionsParams{Count: defaultListTransactionsCount}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	return l.wallets.ListTransactions(p.Wallet, p.Count, p.Skip)
+}
+
+func ListTransactions(wallets *wallet.Manager) Command {
+	return &listTransactions{
+		wallets: wallets,
+	}
+}
+
+// list_unspent
+
+type listUnspentParams struct {
+	Wallet  string `json:"wallet"`
+	MinConf uint64 `json:"min_conf"`
+}
+
+type listUnspent struct {
+	wallets *wallet.Manager
+}
+
+func (l *listUnspent) Name() string {
+	return "list_unspent"
+}
+
+func (l *listUnspent) Execute(params json.RawMessage) (interface{}, error) {
+	var p listUnspentParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	return l.wallets.ListUnspent(p.Wallet, p.MinConf)
+}
+
+func ListUnspent(wallets *wallet.Manager) Command {
+	return &listUnspent{
+		wallets: wallets,
+	}
+}
+
+// get_balance
+
+type getBalanceParams struct {
+	Wallet string `json:"wallet"`
+}
+
+type getBalance struct {
+	wallets *wallet.Manager
+}
+
+func (g *getBalance) Name() string {
+	return "get_balance"
+}
+
+func (g *getBalance) Execute(params json.RawMessage) (interface{}, error) {
+	var p getBalanceParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	return g.wallets.GetBalance(p.Wallet)
+}
+
+func GetBalance(wallets *wallet.Manager) Command {
+	return &getBalance{
+		wallets: wallets,
+	}
+}
@@ -0,0 +1,151 @@
+package command
+
+import (
+	"encoding/json"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/store"
+	"github.com/catalogfi/indexer/wallet"
+)
+
+type xpubParams struct {
+	// Key is an extended public key or an output descriptor
+	Key      string `json:"key"`
+	GapLimit uint32 `json:"gap_limit"`
+}
+
+type XpubIndices struct {
+	NextReceiveIndex uint32  `json:"next_receive_index"`
+	NextChangeIndex  *uint32 `json:"next_change_index,omitempty"`
+}
+
+type XpubBalance struct {
+	Confirmed   int64            `json:"confirmed"`
+	Unconfirmed int64            `json:"unconfirmed"`
+	Addresses   []wallet.Address `json:"addresses"`
+	XpubIndices
+}
+
+type XpubUTXOs struct {
+	UTXOs []wallet.UTXO `json:"utxos"`
+	XpubIndices
+}
+
+type XpubTxs struct {
+	Txs []*model.Transaction `json:"txs"`
+	XpubIndices
+}
+
+func scanXpub(s *store.Storage, chainParams *chaincfg.Params, params json.RawMessage) (*wallet.ScanResult, XpubIndices, error) {
+	p := xpubParams{GapLimit: wallet.DefaultGapLimit}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, XpubIndices{}, err
+	}
+	desc, err := wallet.ParseDescriptor(p.Key, chainParams)
+	if err != nil {
+		return nil, XpubIndices{}, err
+	}
+	result, err := wallet.Scan(s, desc, p.GapLimit)
+	if err != nil {
+		return nil, XpubIndices{}, err
+	}
+	indices := XpubIndices{NextReceiveIndex: result.NextIndex[0]}
+	if len(result.NextIndex) > 1 {
+		indices.NextChangeIndex = &result.NextIndex[1]
+	}
+	return result, indices, nil
+}
+
+// get_xpub_balance
+
+type getXpubBalance struct {
+	store       *store.Storage
+	chainParams *chaincfg.Params
+}
+
+func (g *getXpubBalance) Name() string {
+	return "get_xpub_balance"
+}
+
+func (g *getXpubBalance) Execute(params json.RawMessage) (interface{}, error) {
+	result, indices, err := scanXpub(g.store, g.chainParams, params)
+	if err != nil {
+		return nil, err
+	}
+	return XpubBalance{
+		Confirmed:   result.ConfirmedBalance,
+		Unconfirmed: result.UnconfirmedBalance,
+		Addresses:   result.Addresses,
+		XpubIndices: indices,
+	}, nil
+}
+
+func GetXpubBalance(store *store.Storage, chainParams *chaincfg.Params) Command {
+	return &getXpubBalance{
+		store:       store,
+		chainParams: chainParams,
+	}
+}
+
+// get_xpub_utxos
+
+type getXpubUTXOs struct {
+	store       *store.Storage
+	chainParams *chaincfg.Params
+}
+
+func (g *getXpubUTXOs) Name() string {
+	return "get_xpub_utxos"
+}
+
+func (g *getXpubUTXOs) Execute(params json.RawMessage) (interface{}, error) {
+	result, indices, err := scanXpub(g.store, g.chainParams, params)
+	if err != nil {
+		return nil, err
+	}
+	return XpubUTXOs{
+		UTXOs:       result.UTXOs,
+		XpubIndices: indices,
+	}, nil
+}
+
+func GetXpubUTXOs(store *store.Storage, chainParams *chaincfg.Params) Command {
+	return &getXpubUTXOs{
+		store:       store,
+		chainParams: chainParams,
+	}
+}
+
+// get_xpub_txs
+
+type getXpubTxs struct {
+	store       *store.Storage
+	chainParams *chaincfg.Params
+}
+
+func (g *getXpubTxs) Name() string {
+	return "get_xpub_txs"
+}
+
+func (g *getXpubTxs) Execute(params json.RawMessage) (interface{}, error) {
+	result, indices, err := scanXpub(g.store, g.chainParams, params)
+	if err != nil {
+		return nil, err
+	}
+	txs, err := g.store.GetTxs(result.TxHashes)
+	if err != nil {
+		return nil, err
+	}
+	return XpubTxs{
+		Txs:         txs,
+		XpubIndices: indices,
+	}, nil
+}
+
+func GetXpubTxs(store *store.Storage, chainParams *chaincfg.Params) Command {
+	return &getXpubTxs{
+		store:       store,
+		chainParams: chainParams,
+	}
+}
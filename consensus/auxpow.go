@@ -0,0 +1,225 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// AuxPowVersion is the version bit of merged mined headers, followed by
+	// their AuxPoW on the wire
+	AuxPowVersion = 1 << 8
+
+	// maxMerkleBranch bounds the branches decoded, maxChainMerkleBranch the
+	// chain merkle branch accepted
+	maxMerkleBranch      = 64
+	maxChainMerkleBranch = 30
+	// the chain merkle root must start in the first bytes of coinbases
+	// without the merged mining header
+	maxRootOffset = 20
+)
+
+// mergedMiningHeader is the magic before the chain merkle root in the parent
+// coinbase.
+var mergedMiningHeader = []byte{0xfa, 0xbe, 'm', 'm'}
+
+var (
+	ErrMissingAuxPow    = fmt.Errorf("%w: merged mined header without AuxPoW", ErrInvalidHeader)
+	ErrUnexpectedAuxPow = fmt.Errorf("%w: AuxPoW on a header that is not merged mined", ErrInvalidHeader)
+	ErrBadAuxPow        = fmt.Errorf("%w: invalid AuxPoW", ErrInvalidHeader)
+	ErrEarlyAuxPow      = fmt.Errorf("%w: merged mined before the AuxPoW start height", ErrInvalidHeader)
+	ErrBadChainID       = fmt.Errorf("%w: wrong chain id", ErrInvalidHeader)
+)
+
+// MergedMiningRules are the rules of chains accepting merged mined blocks.
+type MergedMiningRules interface {
+	Rules
+	// AuxPowChainID returns the chain id of the merged mined headers
+	AuxPowChainID() int32
+	// AuxPowStartHeight returns the height from which headers may be merged
+	// mined
+	AuxPowStartHeight() uint64
+	// StrictChainID tells whether the headers that are not legacy must have
+	// the chain id
+	StrictChainID() bool
+	// ParentPowHash returns the hash of the parent block header of an
+	// AuxPoW checked against the target of the merged mined header
+	ParentPowHash(header *wire.BlockHeader) chainhash.Hash
+}
+
+// AuxPow is the merged mining proof following a merged mined header: the
+// coinbase of a block of the parent chain committing to the header hash, and
+// the header of that parent block whose work secures the header.
+type AuxPow struct {
+	CoinbaseTx wire.MsgTx
+	// ParentHash is the hash of the parent block, not used
+	ParentHash chainhash.Hash
+	// CoinbaseBranch links the coinbase to the merkle root of the parent
+	CoinbaseBranch []chainhash.Hash
+	CoinbaseIndex  int32
+	// ChainBranch links the header hash to the root committed to by the
+	// coinbase
+	ChainBranch  []chainhash.Hash
+	ChainIndex   int32
+	ParentHeader wire.BlockHeader
+}
+
+// Deserialize decodes an AuxPow in the wire format.
+func (a *AuxPow) Deserialize(r io.Reader) error {
+	if err := a.CoinbaseTx.DeserializeNoWitness(r); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r, a.ParentHash[:]); err != nil {
+		return err
+	}
+	var err error
+	if a.CoinbaseBranch, a.CoinbaseIndex, err = readMerkleBranch(r); err != nil {
+		return err
+	}
+	if a.ChainBranch, a.ChainIndex, err = readMerkleBranch(r); err != nil {
+		return err
+	}
+	return a.ParentHeader.Deserialize(r)
+}
+
+// Serialize encodes the AuxPow in the wire format.
+func (a *AuxPow) Serialize(w io.Writer) error {
+	if err := a.CoinbaseTx.SerializeNoWitness(w); err != nil {
+		return err
+	}
+	if _, err := w.Write(a.ParentHash[:]); err != nil {
+		return err
+	}
+	if err := writeMerkleBranch(w, a.CoinbaseBranch, a.CoinbaseIndex); err != nil {
+		return err
+	}
+	if err := writeMerkleBranch(w, a.ChainBranch, a.ChainIndex); err != nil {
+		return err
+	}
+	return a.ParentHeader.Serialize(w)
+}
+
+func readMerkleBranch(r io.Reader) ([]chainhash.Hash, int32, error) {
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if count > maxMerkleBranch {
+		return nil, 0, fmt.Errorf("merkle branch of %d hashes", count)
+	}
+	branch := make([]chainhash.Hash, count)
+	for i := range branch {
+		if _, err := io.ReadFull(r, branch[i][:]); err != nil {
+			return nil, 0, err
+		}
+	}
+	var index int32
+	if err := binary.Read(r, binary.LittleEndian, &index); err != nil {
+		return nil, 0, err
+	}
+	return branch, index, nil
+}
+
+func writeMerkleBranch(w io.Writer, branch []chainhash.Hash, index int32) error {
+	if err := wire.WriteVarInt(w, 0, uint64(len(branch))); err != nil {
+		return err
+	}
+	for i := range branch {
+		if _, err := w.Write(branch[i][:]); err != nil {
+			return err
+		}
+	}
+	return binary.Write(w, binary.LittleEndian, index)
+}
+
+// Check checks that the AuxPow commits to the header of the chain with
+// chainID, as in namecoin and dogecoin core. The work of the parent header
+// is not checked.
+func (a *AuxPow) Check(header *wire.BlockHeader, chainID int32) error {
+	if a.CoinbaseIndex != 0 {
+		return fmt.Errorf("%w: not a coinbase", ErrBadAuxPow)
+	}
+	if a.ParentHeader.Version>>16 == chainID {
+		return fmt.Errorf("%w: parent block has our chain id", ErrBadAuxPow)
+	}
+	if len(a.ChainBranch) > maxChainMerkleBranch {
+		return fmt.Errorf("%w: chain merkle branch too long", ErrBadAuxPow)
+	}
+	if merkleBranchRoot(a.CoinbaseTx.TxHash(), a.CoinbaseBranch, a.CoinbaseIndex) != a.ParentHeader.MerkleRoot {
+		return fmt.Errorf("%w: coinbase not in the parent block", ErrBadAuxPow)
+	}
+	if len(a.CoinbaseTx.TxIn) == 0 {
+		return fmt.Errorf("%w: coinbase without input", ErrBadAuxPow)
+	}
+
+	// the coinbase commits to the root in reversed byte order
+	root := merkleBranchRoot(header.BlockHash(), a.ChainBranch, a.ChainIndex)
+	rootBytes := make([]byte, chainhash.HashSize)
+	for i := range root {
+		rootBytes[i] = root[chainhash.HashSize-1-i]
+	}
+	script := a.CoinbaseTx.TxIn[0].SignatureScript
+	pos := bytes.Index(script, rootBytes)
+	if pos < 0 {
+		return fmt.Errorf("%w: chain merkle root not in the parent coinbase", ErrBadAuxPow)
+	}
+	if head := bytes.Index(script, mergedMiningHeader); head >= 0 {
+		if bytes.Contains(script[head+1:], mergedMiningHeader) {
+			return fmt.Errorf("%w: several merged mining headers in the parent coinbase", ErrBadAuxPow)
+		}
+		if head+len(mergedMiningHeader) != pos {
+			return fmt.Errorf("%w: merged mining header not before the chain merkle root", ErrBadAuxPow)
+		}
+	} else if pos > maxRootOffset {
+		return fmt.Errorf("%w: chain merkle root too far in the parent coinbase", ErrBadAuxPow)
+	}
+
+	// the root is followed by the size of the chain merkle tree and the
+	// nonce picking the slot of the chain in it
+	pos += len(rootBytes)
+	if len(script)-pos < 8 {
+		return fmt.Errorf("%w: chain merkle tree size and nonce missing", ErrBadAuxPow)
+	}
+	size := binary.LittleEndian.Uint32(script[pos:])
+	if size != 1<<len(a.ChainBranch) {
+		return fmt.Errorf("%w: chain merkle tree size does not match the branch", ErrBadAuxPow)
+	}
+	nonce := binary.LittleEndian.Uint32(script[pos+4:])
+	if a.ChainIndex != expectedChainIndex(nonce, chainID, len(a.ChainBranch)) {
+		return fmt.Errorf("%w: wrong chain merkle index", ErrBadAuxPow)
+	}
+	return nil
+}
+
+// isLegacyVersion tells whether the header version predates the chain ids.
+func isLegacyVersion(version int32) bool {
+	return version == 1 || version == 2
+}
+
+// merkleBranchRoot returns the merkle root of hash at index with branch.
+func merkleBranchRoot(hash chainhash.Hash, branch []chainhash.Hash, index int32) chainhash.Hash {
+	for i := range branch {
+		if index&1 == 1 {
+			hash = blockchain.HashMerkleBranches(&branch[i], &hash)
+		} else {
+			hash = blockchain.HashMerkleBranches(&hash, &branch[i])
+		}
+		index >>= 1
+	}
+	return hash
+}
+
+// expectedChainIndex is the slot of the chain in a chain merkle tree of the
+// given height.
+func expectedChainIndex(nonce uint32, chainID int32, height int) int32 {
+	rand := nonce*1103515245 + 12345
+	rand += uint32(chainID)
+	rand = rand*1103515245 + 12345
+	return int32(rand % (1 << height))
+}
@@ -0,0 +1,140 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/dogecoin"
+)
+
+// easyBits is a target any other hash meets, so parent blocks are mined
+// with a couple of scrypt hashes.
+const easyBits = 0x207fffff
+
+// mergedMined returns a merged mined dogecoin header and its AuxPoW, the
+// coinbase committing to the header alone.
+func mergedMined() (*wire.BlockHeader, *AuxPow) {
+	header := wire.NewBlockHeader(dogecoinChainID<<16|AuxPowVersion|4, &chainhash.Hash{1}, &chainhash.Hash{2}, easyBits, 0)
+	hash := header.BlockHash()
+
+	script := append([]byte{}, mergedMiningHeader...)
+	for i := range hash {
+		script = append(script, hash[chainhash.HashSize-1-i])
+	}
+	// a chain merkle tree of size 1 and a nonce
+	var sizeAndNonce [8]byte
+	binary.LittleEndian.PutUint32(sizeAndNonce[:4], 1)
+	binary.LittleEndian.PutUint32(sizeAndNonce[4:], 7)
+	script = append(script, sizeAndNonce[:]...)
+
+	auxPow := &AuxPow{}
+	auxPow.CoinbaseTx.Version = 1
+	auxPow.CoinbaseTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), script, nil))
+	auxPow.CoinbaseTx.AddTxOut(wire.NewTxOut(50, []byte{0x51}))
+	auxPow.ParentHeader = *wire.NewBlockHeader(1, &chainhash.Hash{3}, &chainhash.Hash{}, 0, 0)
+	auxPow.ParentHeader.MerkleRoot = auxPow.CoinbaseTx.TxHash()
+	mineParent(auxPow, header.Bits)
+	return header, auxPow
+}
+
+// mineParent increments the nonce of the parent header until it has the work
+// required by bits.
+func mineParent(auxPow *AuxPow, bits uint32) {
+	target := blockchain.CompactToBig(bits)
+	for {
+		powHash := Scrypt(&auxPow.ParentHeader)
+		if blockchain.HashToBig(&powHash).Cmp(target) <= 0 {
+			return
+		}
+		auxPow.ParentHeader.Nonce++
+	}
+}
+
+func TestAuxPowSerialize(t *testing.T) {
+	_, auxPow := mergedMined()
+	auxPow.CoinbaseBranch = []chainhash.Hash{{4}, {5}}
+	auxPow.ChainIndex = 3
+
+	var buf bytes.Buffer
+	if err := auxPow.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	decoded := &AuxPow{}
+	if err := decoded.Deserialize(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	if err := decoded.Serialize(&again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+		t.Fatal("AuxPoW changed by a round trip")
+	}
+}
+
+func TestCheckAuxPow(t *testing.T) {
+	v := NewValidator(&dogecoin.MainNetParams, NewDogecoinRules(&dogecoin.MainNetParams), nil)
+	header, auxPow := mergedMined()
+	if err := v.CheckAuxPow(header, auxPow, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.CheckAuxPow(header, nil, false); !errors.Is(err, ErrMissingAuxPow) {
+		t.Fatalf("expected ErrMissingAuxPow, got %v", err)
+	}
+
+	// commitment tells whether the tampering breaks the commitment only,
+	// which is not checked without it
+	tests := []struct {
+		name       string
+		commitment bool
+		tamper     func(header *wire.BlockHeader, auxPow *AuxPow)
+	}{
+		{"other header", true, func(header *wire.BlockHeader, auxPow *AuxPow) { header.Nonce++ }},
+		{"other chain id", false, func(header *wire.BlockHeader, auxPow *AuxPow) { header.Version = 1<<16 | AuxPowVersion | 4 }},
+		{"parent with our chain id", true, func(header *wire.BlockHeader, auxPow *AuxPow) {
+			auxPow.ParentHeader.Version = dogecoinChainID << 16
+			mineParent(auxPow, header.Bits)
+		}},
+		{"coinbase not in the parent", true, func(header *wire.BlockHeader, auxPow *AuxPow) {
+			auxPow.ParentHeader.MerkleRoot = chainhash.Hash{}
+			mineParent(auxPow, header.Bits)
+		}},
+		{"not a coinbase", true, func(header *wire.BlockHeader, auxPow *AuxPow) { auxPow.CoinbaseIndex = 1 }},
+		{"wrong chain index", true, func(header *wire.BlockHeader, auxPow *AuxPow) { auxPow.ChainIndex = 1 }},
+		{"parent work", false, func(header *wire.BlockHeader, auxPow *AuxPow) {
+			target := blockchain.CompactToBig(header.Bits)
+			for {
+				auxPow.ParentHeader.Nonce++
+				powHash := Scrypt(&auxPow.ParentHeader)
+				if blockchain.HashToBig(&powHash).Cmp(target) > 0 {
+					return
+				}
+			}
+		}},
+	}
+	for _, test := range tests {
+		header, auxPow := mergedMined()
+		test.tamper(header, auxPow)
+		if err := v.CheckAuxPow(header, auxPow, true); !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("%s: expected an invalid header, got %v", test.name, err)
+		}
+		err := v.CheckAuxPow(header, auxPow, false)
+		if test.commitment && err != nil {
+			t.Errorf("%s: expected the commitment not to be checked, got %v", test.name, err)
+		}
+		if !test.commitment && !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("%s: expected an invalid header without the commitment, got %v", test.name, err)
+		}
+	}
+
+	// headers that are not merged mined have no AuxPoW
+	header.Version = 4
+	if err := v.CheckAuxPow(header, auxPow, false); !errors.Is(err, ErrUnexpectedAuxPow) {
+		t.Fatalf("expected ErrUnexpectedAuxPow, got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package consensus
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// BitcoinRules are the proof of work rules of bitcoin: a retarget every
+// TargetTimespan, as in btcd, with the headers hashed by powHash. Bitcoin
+// hashes them with DoubleSHA256, litecoin family chains with Scrypt.
+type BitcoinRules struct {
+	params  *chaincfg.Params
+	powHash PowHashFunc
+}
+
+func NewBitcoinRules(params *chaincfg.Params, powHash PowHashFunc) *BitcoinRules {
+	return &BitcoinRules{
+		params:  params,
+		powHash: powHash,
+	}
+}
+
+func (r *BitcoinRules) PowHash(header *wire.BlockHeader) (chainhash.Hash, bool) {
+	return r.powHash(header), true
+}
+
+func (r *BitcoinRules) NextBits(view *View, height uint64, header *wire.BlockHeader) (uint32, error) {
+	prev := view.Tip()
+	if r.params.PoWNoRetargeting {
+		return prev.Bits, nil
+	}
+	interval := uint64(r.params.TargetTimespan / r.params.TargetTimePerBlock)
+	if height%interval != 0 {
+		if !r.params.ReduceMinDifficulty {
+			return prev.Bits, nil
+		}
+		// a block more than MinDiffReductionTime after the previous one may
+		// use the minimum difficulty
+		if header.Timestamp.After(prev.Timestamp.Add(r.params.MinDiffReductionTime)) {
+			return r.params.PowLimitBits, nil
+		}
+		return r.lastNonMinBits(view, prev, interval)
+	}
+
+	first, err := view.Ancestor(height - interval)
+	if err != nil {
+		return 0, err
+	}
+	return RetargetBits(prev.Bits, prev.Timestamp.Sub(first.Timestamp), r.params.TargetTimespan, r.params.RetargetAdjustmentFactor, r.params.PowLimit), nil
+}
+
+// lastNonMinBits returns the difficulty of the last block not mined at the
+// minimum difficulty since the last retarget.
+func (r *BitcoinRules) lastNonMinBits(view *View, node Node, interval uint64) (uint32, error) {
+	for node.Height > 0 && node.Height%interval != 0 && node.Bits == r.params.PowLimitBits {
+		prev, err := view.Ancestor(node.Height - 1)
+		if err != nil {
+			return 0, err
+		}
+		node = prev
+	}
+	return node.Bits, nil
+}
+
+// RetargetBits scales the target of bits by the actual timespan over the
+// target timespan, the former clamped to a factor of adjustmentFactor of the
+// latter, and caps the result at powLimit.
+func RetargetBits(bits uint32, actualTimespan, targetTimespan time.Duration, adjustmentFactor int64, powLimit *big.Int) uint32 {
+	minTimespan := int64(targetTimespan/time.Second) / adjustmentFactor
+	maxTimespan := int64(targetTimespan/time.Second) * adjustmentFactor
+	return scaleBits(bits, int64(actualTimespan/time.Second), minTimespan, maxTimespan, int64(targetTimespan/time.Second), powLimit)
+}
+
+// scaleBits scales the target of bits by timespan, clamped to
+// [minTimespan, maxTimespan], over targetTimespan, all in seconds, and caps
+// the result at powLimit.
+func scaleBits(bits uint32, timespan, minTimespan, maxTimespan, targetTimespan int64, powLimit *big.Int) uint32 {
+	if timespan < minTimespan {
+		timespan = minTimespan
+	} else if timespan > maxTimespan {
+		timespan = maxTimespan
+	}
+
+	target := blockchain.CompactToBig(bits)
+	target.Mul(target, big.NewInt(timespan))
+	target.Div(target, big.NewInt(targetTimespan))
+	if target.Cmp(powLimit) > 0 {
+		target.Set(powLimit)
+	}
+	return blockchain.BigToCompact(target)
+}
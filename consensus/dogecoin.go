@@ -0,0 +1,133 @@
+package consensus
+
+import (
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/dogecoin"
+)
+
+const (
+	// DigishieldHeight is the height from which dogecoin retargets every
+	// block with DigiShield
+	DigishieldHeight = 145000
+	// digishieldMinDifficultyHeight is the height from which testnet blocks
+	// may be mined at the minimum difficulty again
+	digishieldMinDifficultyHeight = 157500
+	// preDigishieldTimespan is the retarget timespan before DigiShield, the
+	// chain params have the DigiShield one
+	preDigishieldTimespan = 4 * time.Hour
+
+	// dogecoinChainID is the chain id of merged mined dogecoin headers
+	dogecoinChainID = 0x62
+	// auxPowStartHeight is the height from which dogecoin headers may be
+	// merged mined, testnetAuxPowStartHeight the one of the testnet
+	auxPowStartHeight        = 371337
+	testnetAuxPowStartHeight = 158100
+)
+
+// DogecoinRules are the proof of work rules of dogecoin: scrypt header
+// hashes, a retarget every four hours until DigishieldHeight then one every
+// block with DigiShield, as in dogecoin core.
+type DogecoinRules struct {
+	*BitcoinRules
+}
+
+func NewDogecoinRules(params *chaincfg.Params) *DogecoinRules {
+	return &DogecoinRules{
+		BitcoinRules: NewBitcoinRules(params, Scrypt),
+	}
+}
+
+// PowHash returns the scrypt hash of the header, or false for merged mined
+// headers whose work is in their parent block.
+func (r *DogecoinRules) PowHash(header *wire.BlockHeader) (chainhash.Hash, bool) {
+	if header.Version&AuxPowVersion != 0 {
+		return chainhash.Hash{}, false
+	}
+	return r.BitcoinRules.PowHash(header)
+}
+
+func (r *DogecoinRules) AuxPowChainID() int32 {
+	return dogecoinChainID
+}
+
+func (r *DogecoinRules) AuxPowStartHeight() uint64 {
+	switch r.params.Net {
+	case dogecoin.MainNet:
+		return auxPowStartHeight
+	case dogecoin.TestNet3:
+		return testnetAuxPowStartHeight
+	default:
+		return 0
+	}
+}
+
+// StrictChainID is false on the testnet, whose headers may have any chain id
+// as in dogecoin core.
+func (r *DogecoinRules) StrictChainID() bool {
+	return r.params.Net != dogecoin.TestNet3
+}
+
+func (r *DogecoinRules) ParentPowHash(header *wire.BlockHeader) chainhash.Hash {
+	return r.powHash(header)
+}
+
+func (r *DogecoinRules) NextBits(view *View, height uint64, header *wire.BlockHeader) (uint32, error) {
+	prev := view.Tip()
+	spacing := r.params.TargetTimePerBlock
+	if r.params.ReduceMinDifficulty && prev.Height >= digishieldMinDifficultyHeight &&
+		header.Timestamp.After(prev.Timestamp.Add(2*spacing)) {
+		return r.params.PowLimitBits, nil
+	}
+
+	digishield := height >= DigishieldHeight
+	interval := uint64(1)
+	timespan := r.params.TargetTimespan
+	if !digishield {
+		timespan = preDigishieldTimespan
+		interval = uint64(timespan / spacing)
+	}
+	if height%interval != 0 {
+		if !r.params.ReduceMinDifficulty {
+			return prev.Bits, nil
+		}
+		if header.Timestamp.After(prev.Timestamp.Add(r.params.MinDiffReductionTime)) {
+			return r.params.PowLimitBits, nil
+		}
+		return r.lastNonMinBits(view, prev, interval)
+	}
+
+	// as in litecoin, the first retarget goes back one block less than the
+	// others
+	back := interval
+	if height == interval {
+		back = interval - 1
+	}
+	first, err := view.Ancestor(prev.Height - back)
+	if err != nil {
+		return 0, err
+	}
+
+	target := int64(timespan / time.Second)
+	actual := int64(prev.Timestamp.Sub(first.Timestamp) / time.Second)
+	var minTimespan, maxTimespan int64
+	switch {
+	case digishield:
+		actual = target + (actual-target)/8
+		minTimespan = target - target/4
+		maxTimespan = target + target/2
+	case height > 10000:
+		minTimespan = target / 4
+		maxTimespan = target * 4
+	case height > 5000:
+		minTimespan = target / 8
+		maxTimespan = target * 4
+	default:
+		minTimespan = target / 16
+		maxTimespan = target * 4
+	}
+	return scaleBits(prev.Bits, actual, minTimespan, maxTimespan, target, r.params.PowLimit), nil
+}
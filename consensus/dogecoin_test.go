@@ -0,0 +1,145 @@
+package consensus
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/dogecoin"
+	"github.com/catalogfi/indexer/model"
+)
+
+func TestScryptDogecoinGenesis(t *testing.T) {
+	params := &dogecoin.MainNetParams
+	header := &params.GenesisBlock.Header
+	target := blockchain.CompactToBig(header.Bits)
+
+	rules := NewDogecoinRules(params)
+	hash, ok := rules.PowHash(header)
+	if !ok {
+		t.Fatal("genesis work not checked")
+	}
+	if blockchain.HashToBig(&hash).Cmp(target) > 0 {
+		t.Fatalf("scrypt hash %s above the target", hash)
+	}
+	// the block hash is not the proof of work
+	sha := DoubleSHA256(header)
+	if blockchain.HashToBig(&sha).Cmp(target) <= 0 {
+		t.Fatalf("block hash %s below the target", sha)
+	}
+	if bits := blockchain.BigToCompact(params.PowLimit); bits != params.PowLimitBits {
+		t.Fatalf("expected pow limit bits %08x, got %08x", bits, params.PowLimitBits)
+	}
+}
+
+func TestDogecoinMergedMinedHeader(t *testing.T) {
+	rules := NewDogecoinRules(&dogecoin.MainNetParams)
+	header := wire.NewBlockHeader(0x620104, &chainhash.Hash{}, &chainhash.Hash{}, 0x1b0404cb, 0)
+	if _, ok := rules.PowHash(header); ok {
+		t.Fatal("merged mined header checked against its own hash")
+	}
+}
+
+func TestCheckMergedMining(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  *chaincfg.Params
+		height  uint64
+		version int32
+		err     error
+	}{
+		{"legacy", &dogecoin.MainNetParams, 1000, 2, nil},
+		{"chain id", &dogecoin.MainNetParams, 1000, dogecoinChainID<<16 | 4, nil},
+		{"other chain id", &dogecoin.MainNetParams, 1000, 1<<16 | 4, ErrBadChainID},
+		{"merged mined", &dogecoin.MainNetParams, auxPowStartHeight, dogecoinChainID<<16 | AuxPowVersion | 4, nil},
+		{"merged mined early", &dogecoin.MainNetParams, auxPowStartHeight - 1, dogecoinChainID<<16 | AuxPowVersion | 4, ErrEarlyAuxPow},
+		{"merged mined early on testnet", &dogecoin.TestNet3Params, testnetAuxPowStartHeight - 1, dogecoinChainID<<16 | AuxPowVersion | 4, ErrEarlyAuxPow},
+		{"other chain id on testnet", &dogecoin.TestNet3Params, testnetAuxPowStartHeight, 1<<16 | AuxPowVersion | 4, nil},
+	}
+	for _, test := range tests {
+		header := wire.NewBlockHeader(test.version, &chainhash.Hash{}, &chainhash.Hash{}, 0, 0)
+		err := checkMergedMining(NewDogecoinRules(test.params), test.height, header)
+		if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+// dogecoinView is a view of two blocks at height and height+1, the last one
+// spacing after the first.
+func dogecoinView(height uint64, bits uint32, spacing time.Duration) *View {
+	first := wire.NewBlockHeader(0x620004, &chainhash.Hash{}, &chainhash.Hash{}, bits, 0)
+	first.Timestamp = genesisTime
+	firstHash := first.BlockHash()
+	last := wire.NewBlockHeader(0x620004, &firstHash, &chainhash.Hash{}, bits, 0)
+	last.Timestamp = genesisTime.Add(spacing)
+
+	chain := &memChain{
+		byHash:   make(map[string]*model.Block),
+		byHeight: make(map[uint64]*model.Block),
+	}
+	chain.put(first, height)
+	view, err := newView(chain, chain.put(last, height+1))
+	if err != nil {
+		panic(err)
+	}
+	return view
+}
+
+func TestDigishieldNextBits(t *testing.T) {
+	const bits = 0x1b0404cb
+	rules := NewDogecoinRules(&dogecoin.MainNetParams)
+	tests := []struct {
+		name     string
+		spacing  time.Duration
+		timespan int64
+	}{
+		{"on time", time.Minute, 60},
+		// the timespan moves by an eighth of the difference
+		{"slow", 2 * time.Minute, 67},
+		{"fast", 20 * time.Second, 55},
+		// and is clamped to [45, 90] seconds
+		{"very slow", time.Hour, 90},
+		{"very fast", -time.Hour, 45},
+	}
+	for _, test := range tests {
+		view := dogecoinView(DigishieldHeight, bits, test.spacing)
+		tip := view.Tip()
+		header := wire.NewBlockHeader(0x620004, &tip.Hash, &chainhash.Hash{}, 0, 0)
+		header.Timestamp = tip.Timestamp.Add(time.Minute)
+
+		got, err := rules.NextBits(view, DigishieldHeight+2, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := blockchain.CompactToBig(bits)
+		target.Mul(target, big.NewInt(test.timespan))
+		target.Div(target, big.NewInt(60))
+		if expected := blockchain.BigToCompact(target); got != expected {
+			t.Errorf("%s: expected bits %08x, got %08x", test.name, expected, got)
+		}
+	}
+}
+
+func TestPreDigishieldNextBits(t *testing.T) {
+	const bits = 0x1b0404cb
+	rules := NewDogecoinRules(&dogecoin.MainNetParams)
+
+	// the difficulty only changes every 240 blocks
+	view := dogecoinView(1000, bits, time.Hour)
+	tip := view.Tip()
+	header := wire.NewBlockHeader(0x620004, &tip.Hash, &chainhash.Hash{}, 0, 0)
+	header.Timestamp = tip.Timestamp.Add(time.Minute)
+	got, err := rules.NextBits(view, 1002, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != bits {
+		t.Fatalf("expected bits %08x, got %08x", uint32(bits), got)
+	}
+}
@@ -0,0 +1,33 @@
+package consensus
+
+import (
+	"bytes"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PowHashFunc hashes a header for its proof of work.
+type PowHashFunc func(header *wire.BlockHeader) chainhash.Hash
+
+// DoubleSHA256 is the proof of work hash of bitcoin, the block hash.
+func DoubleSHA256(header *wire.BlockHeader) chainhash.Hash {
+	return header.BlockHash()
+}
+
+// Scrypt is the proof of work hash of litecoin and dogecoin: scrypt with
+// N=1024, r=1 and p=1 of the serialized header, salted with itself.
+func Scrypt(header *wire.BlockHeader) chainhash.Hash {
+	buf := bytes.NewBuffer(make([]byte, 0, wire.MaxBlockHeaderPayload))
+	// writing to a bytes.Buffer does not fail
+	_ = header.Serialize(buf)
+	key, err := scrypt.Key(buf.Bytes(), buf.Bytes(), 1024, 1, 1, chainhash.HashSize)
+	if err != nil {
+		// only returned for invalid parameters
+		panic(err)
+	}
+	var hash chainhash.Hash
+	copy(hash[:], key)
+	return hash
+}
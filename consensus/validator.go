@@ -0,0 +1,339 @@
+// Package consensus checks block headers against the consensus rules of a
+// chain: proof of work, difficulty retargeting, timestamps and checkpoints.
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/model"
+)
+
+const (
+	// medianTimeBlocks is the number of blocks the median time past is
+	// computed over
+	medianTimeBlocks = 11
+	// MaxTimeOffset is how far in the future a header timestamp may be
+	MaxTimeOffset = 2 * time.Hour
+)
+
+// ErrInvalidHeader is wrapped by all the errors of headers breaking the
+// consensus rules, so the peers sending them can be banned.
+var ErrInvalidHeader = errors.New("invalid header")
+
+var (
+	ErrUnconnectedHeader    = fmt.Errorf("%w: does not connect to the previous one", ErrInvalidHeader)
+	ErrCheckpointMismatch   = fmt.Errorf("%w: does not match the checkpoint", ErrInvalidHeader)
+	ErrForkBeforeCheckpoint = fmt.Errorf("%w: forks the chain before the last checkpoint", ErrInvalidHeader)
+	ErrTimeTooOld           = fmt.Errorf("%w: timestamp not after the median time past", ErrInvalidHeader)
+	ErrTimeTooNew           = fmt.Errorf("%w: timestamp too far in the future", ErrInvalidHeader)
+	ErrUnexpectedBits       = fmt.Errorf("%w: unexpected difficulty", ErrInvalidHeader)
+	ErrTargetOutOfRange     = fmt.Errorf("%w: target out of range", ErrInvalidHeader)
+	ErrHighHash             = fmt.Errorf("%w: hash above the target", ErrInvalidHeader)
+	ErrBadMerkleRoot        = fmt.Errorf("%w: merkle root does not match the transactions", ErrInvalidHeader)
+)
+
+// Chain looks up the stored blocks the validated headers build on.
+type Chain interface {
+	GetBlock(hash string) (*model.Block, bool, error)
+	GetBlockByHeight(height uint64) (*model.Block, bool, error)
+}
+
+// Rules are the proof of work rules that differ between chains.
+type Rules interface {
+	// PowHash returns the hash of the header checked against its target, or
+	// false if the work of the header is proven by a merged mining parent
+	// block instead
+	PowHash(header *wire.BlockHeader) (chainhash.Hash, bool)
+	// NextBits returns the difficulty required of the header at height
+	NextBits(view *View, height uint64, header *wire.BlockHeader) (uint32, error)
+}
+
+// Validator checks headers against the consensus rules of the chain.
+// Without Rules, for chains it does not know, only the connection,
+// timestamps and checkpoints of the headers are checked.
+type Validator struct {
+	params *chaincfg.Params
+	rules  Rules
+	chain  Chain
+	now    func() time.Time
+}
+
+func NewValidator(params *chaincfg.Params, rules Rules, chain Chain) *Validator {
+	return &Validator{
+		params: params,
+		rules:  rules,
+		chain:  chain,
+		now:    time.Now,
+	}
+}
+
+// CheckHeaders checks a chain of headers building on the stored block parent.
+func (v *Validator) CheckHeaders(parent *model.Block, headers []*wire.BlockHeader) error {
+	view, err := newView(v.chain, parent)
+	if err != nil {
+		return err
+	}
+	for _, header := range headers {
+		height := view.tip.Height + 1
+		if err := v.checkHeader(view, height, header); err != nil {
+			return fmt.Errorf("header %s at height %d: %w", header.BlockHash(), height, err)
+		}
+		view.push(header)
+	}
+	return nil
+}
+
+// CheckBlock checks the header of the block and that its merkle root commits
+// to its transactions.
+func (v *Validator) CheckBlock(parent *model.Block, block *wire.MsgBlock) error {
+	if err := v.CheckHeaders(parent, []*wire.BlockHeader{&block.Header}); err != nil {
+		return err
+	}
+	txs := make([]*btcutil.Tx, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		txs[i] = btcutil.NewTx(tx)
+	}
+	if root := blockchain.CalcMerkleRoot(txs, false); root != block.Header.MerkleRoot {
+		return fmt.Errorf("block %s: %w", block.BlockHash(), ErrBadMerkleRoot)
+	}
+	return nil
+}
+
+// CheckAuxPow checks the merged mining proof of a header of a chain with
+// MergedMiningRules: that a merged mined header has an AuxPoW whose parent
+// header has the work required of it. With commitment, the AuxPoW is also
+// checked to commit to the header, without it any parent block with enough
+// work is accepted. auxPow is nil for headers that are not merged mined.
+func (v *Validator) CheckAuxPow(header *wire.BlockHeader, auxPow *AuxPow, commitment bool) error {
+	rules, ok := v.rules.(MergedMiningRules)
+	if !ok {
+		return nil
+	}
+	if header.Version&AuxPowVersion == 0 {
+		if auxPow != nil {
+			return ErrUnexpectedAuxPow
+		}
+		return nil
+	}
+	if auxPow == nil {
+		return ErrMissingAuxPow
+	}
+	if err := checkChainID(rules, header); err != nil {
+		return err
+	}
+	if commitment {
+		// the commitment is to the chain id of the header, which differs on
+		// chains without strict chain ids
+		if err := auxPow.Check(header, header.Version>>16); err != nil {
+			return err
+		}
+	}
+	powHash := rules.ParentPowHash(&auxPow.ParentHeader)
+	if blockchain.HashToBig(&powHash).Cmp(blockchain.CompactToBig(header.Bits)) > 0 {
+		return fmt.Errorf("%w: parent block hash above the target", ErrBadAuxPow)
+	}
+	return nil
+}
+
+// checkMergedMining rejects the merged mined headers below the AuxPoW start
+// height and the headers with another chain id.
+func checkMergedMining(rules MergedMiningRules, height uint64, header *wire.BlockHeader) error {
+	if header.Version&AuxPowVersion != 0 && height < rules.AuxPowStartHeight() {
+		return ErrEarlyAuxPow
+	}
+	return checkChainID(rules, header)
+}
+
+func checkChainID(rules MergedMiningRules, header *wire.BlockHeader) error {
+	if !rules.StrictChainID() || isLegacyVersion(header.Version) {
+		return nil
+	}
+	if chainID := header.Version >> 16; chainID != rules.AuxPowChainID() {
+		return fmt.Errorf("%w: %d", ErrBadChainID, chainID)
+	}
+	return nil
+}
+
+func (v *Validator) checkHeader(view *View, height uint64, header *wire.BlockHeader) error {
+	if header.PrevBlock != view.tip.Hash {
+		return ErrUnconnectedHeader
+	}
+	hash := header.BlockHash()
+	if err := v.checkCheckpoints(height, hash); err != nil {
+		return err
+	}
+
+	mtp, err := view.MedianTimePast()
+	if err != nil {
+		return err
+	}
+	if !header.Timestamp.After(mtp) {
+		return ErrTimeTooOld
+	}
+	if header.Timestamp.After(v.now().Add(MaxTimeOffset)) {
+		return ErrTimeTooNew
+	}
+
+	if v.rules == nil {
+		return nil
+	}
+	bits, err := v.rules.NextBits(view, height, header)
+	if err != nil {
+		return err
+	}
+	if header.Bits != bits {
+		return fmt.Errorf("%w: got %08x, expected %08x", ErrUnexpectedBits, header.Bits, bits)
+	}
+	target := blockchain.CompactToBig(header.Bits)
+	if target.Sign() <= 0 || target.Cmp(v.params.PowLimit) > 0 {
+		return ErrTargetOutOfRange
+	}
+	if rules, ok := v.rules.(MergedMiningRules); ok {
+		if err := checkMergedMining(rules, height, header); err != nil {
+			return err
+		}
+	}
+	powHash, ok := v.rules.PowHash(header)
+	if ok && blockchain.HashToBig(&powHash).Cmp(target) > 0 {
+		return ErrHighHash
+	}
+	return nil
+}
+
+// checkCheckpoints rejects headers that contradict a checkpoint, and the ones
+// forking the stored chain at or below the last checkpoint.
+func (v *Validator) checkCheckpoints(height uint64, hash chainhash.Hash) error {
+	checkpoints := v.params.Checkpoints
+	if len(checkpoints) == 0 {
+		return nil
+	}
+	for _, checkpoint := range checkpoints {
+		if uint64(checkpoint.Height) == height && *checkpoint.Hash != hash {
+			return ErrCheckpointMismatch
+		}
+	}
+	if height > uint64(checkpoints[len(checkpoints)-1].Height) {
+		return nil
+	}
+	stored, exists, err := v.chain.GetBlockByHeight(height)
+	if err != nil {
+		return err
+	}
+	if exists && stored.Hash != hash.String() {
+		return ErrForkBeforeCheckpoint
+	}
+	return nil
+}
+
+// Node is the part of a header the rules look at.
+type Node struct {
+	Hash      chainhash.Hash
+	Height    uint64
+	Timestamp time.Time
+	Bits      uint32
+}
+
+// View is the chain ending with the headers being validated. Stored
+// ancestors are loaded on demand by following the previous block hashes, so
+// forks see their own ancestors.
+type View struct {
+	chain Chain
+	tip   Node
+	// nodes are the loaded ancestors and the validated headers by height
+	nodes map[uint64]Node
+	// lowest is the lowest loaded stored ancestor
+	lowest     Node
+	lowestPrev string
+}
+
+func newView(chain Chain, parent *model.Block) (*View, error) {
+	node, err := blockNode(parent)
+	if err != nil {
+		return nil, err
+	}
+	return &View{
+		chain:      chain,
+		tip:        node,
+		nodes:      map[uint64]Node{node.Height: node},
+		lowest:     node,
+		lowestPrev: parent.PreviousBlock,
+	}, nil
+}
+
+func blockNode(block *model.Block) (Node, error) {
+	hash, err := chainhash.NewHashFromStr(block.Hash)
+	if err != nil {
+		return Node{}, err
+	}
+	return Node{
+		Hash:      *hash,
+		Height:    block.Height,
+		Timestamp: block.Timestamp,
+		Bits:      block.Bits,
+	}, nil
+}
+
+// Tip returns the last node of the view.
+func (v *View) Tip() Node {
+	return v.tip
+}
+
+// Ancestor returns the node at height, which must not be above the tip.
+func (v *View) Ancestor(height uint64) (Node, error) {
+	if height > v.tip.Height {
+		return Node{}, fmt.Errorf("no ancestor at height %d above the tip %d", height, v.tip.Height)
+	}
+	for height < v.lowest.Height {
+		block, exists, err := v.chain.GetBlock(v.lowestPrev)
+		if err != nil {
+			return Node{}, err
+		}
+		if !exists {
+			return Node{}, fmt.Errorf("ancestor %s at height %d not found", v.lowestPrev, v.lowest.Height-1)
+		}
+		node, err := blockNode(block)
+		if err != nil {
+			return Node{}, err
+		}
+		v.nodes[node.Height] = node
+		v.lowest = node
+		v.lowestPrev = block.PreviousBlock
+	}
+	return v.nodes[height], nil
+}
+
+// MedianTimePast returns the median timestamp of the tip and the ten nodes
+// before it.
+func (v *View) MedianTimePast() (time.Time, error) {
+	timestamps := make([]time.Time, 0, medianTimeBlocks)
+	for i := uint64(0); i < medianTimeBlocks && i <= v.tip.Height; i++ {
+		node, err := v.Ancestor(v.tip.Height - i)
+		if err != nil {
+			return time.Time{}, err
+		}
+		timestamps = append(timestamps, node.Timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i].Before(timestamps[j])
+	})
+	return timestamps[len(timestamps)/2], nil
+}
+
+func (v *View) push(header *wire.BlockHeader) {
+	node := Node{
+		Hash:      header.BlockHash(),
+		Height:    v.tip.Height + 1,
+		Timestamp: header.Timestamp,
+		Bits:      header.Bits,
+	}
+	v.nodes[node.Height] = node
+	v.tip = node
+}
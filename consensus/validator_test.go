@@ -0,0 +1,221 @@
+package consensus
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/model"
+)
+
+var genesisTime = time.Unix(1600000000, 0)
+
+// memChain is a Chain of stored blocks kept in memory.
+type memChain struct {
+	byHash   map[string]*model.Block
+	byHeight map[uint64]*model.Block
+}
+
+func newMemChain(genesis *wire.BlockHeader) *memChain {
+	c := &memChain{
+		byHash:   make(map[string]*model.Block),
+		byHeight: make(map[uint64]*model.Block),
+	}
+	c.put(genesis, 0)
+	return c
+}
+
+func (c *memChain) put(header *wire.BlockHeader, height uint64) *model.Block {
+	block := &model.Block{
+		Hash:          header.BlockHash().String(),
+		Height:        height,
+		PreviousBlock: header.PrevBlock.String(),
+		Timestamp:     header.Timestamp,
+		Bits:          header.Bits,
+	}
+	c.byHash[block.Hash] = block
+	c.byHeight[height] = block
+	return block
+}
+
+func (c *memChain) tip() *model.Block {
+	return c.byHeight[uint64(len(c.byHeight)-1)]
+}
+
+func (c *memChain) GetBlock(hash string) (*model.Block, bool, error) {
+	block, ok := c.byHash[hash]
+	return block, ok, nil
+}
+
+func (c *memChain) GetBlockByHeight(height uint64) (*model.Block, bool, error) {
+	block, ok := c.byHeight[height]
+	return block, ok, nil
+}
+
+// testParams retarget every 4 blocks of 10 minutes.
+func testParams() *chaincfg.Params {
+	params := chaincfg.RegressionNetParams
+	params.PoWNoRetargeting = false
+	params.ReduceMinDifficulty = false
+	params.TargetTimePerBlock = 10 * time.Minute
+	params.TargetTimespan = 40 * time.Minute
+	params.Checkpoints = nil
+	return &params
+}
+
+// mine returns a header on prev whose hash is below the target of bits, or
+// above it if high is set.
+func mine(prev chainhash.Hash, timestamp time.Time, bits uint32, high bool) *wire.BlockHeader {
+	header := wire.NewBlockHeader(1, &prev, &chainhash.Hash{}, bits, 0)
+	header.Timestamp = timestamp
+	return mineHeader(header, high)
+}
+
+func mineHeader(header *wire.BlockHeader, high bool) *wire.BlockHeader {
+	target := blockchain.CompactToBig(header.Bits)
+	for {
+		hash := header.BlockHash()
+		if (blockchain.HashToBig(&hash).Cmp(target) <= 0) != high {
+			return header
+		}
+		header.Nonce++
+	}
+}
+
+func newTestValidator(params *chaincfg.Params) (*Validator, *memChain) {
+	chain := newMemChain(mine(chainhash.Hash{}, genesisTime, params.PowLimitBits, false))
+	v := NewValidator(params, NewBitcoinRules(params, DoubleSHA256), chain)
+	v.now = func() time.Time { return genesisTime.Add(24 * time.Hour) }
+	return v, chain
+}
+
+func TestCheckHeaders(t *testing.T) {
+	params := testParams()
+	v, chain := newTestValidator(params)
+	genesis := chain.tip()
+	genesisHash, _ := chainhash.NewHashFromStr(genesis.Hash)
+
+	headers := make([]*wire.BlockHeader, 0)
+	prev := *genesisHash
+	for i := 1; i <= 3; i++ {
+		header := mine(prev, genesisTime.Add(time.Duration(i)*10*time.Minute), params.PowLimitBits, false)
+		headers = append(headers, header)
+		prev = header.BlockHash()
+	}
+	if err := v.CheckHeaders(genesis, headers); err != nil {
+		t.Fatal(err)
+	}
+
+	next := genesisTime.Add(10 * time.Minute)
+	tests := []struct {
+		name   string
+		header *wire.BlockHeader
+		err    error
+	}{
+		{"unconnected", mine(chainhash.Hash{1}, next, params.PowLimitBits, false), ErrUnconnectedHeader},
+		{"unexpected bits", mine(*genesisHash, next, 0x1f7fffff, false), ErrUnexpectedBits},
+		{"high hash", mine(*genesisHash, next, params.PowLimitBits, true), ErrHighHash},
+		{"time too old", mine(*genesisHash, genesisTime, params.PowLimitBits, false), ErrTimeTooOld},
+		{"time too new", mine(*genesisHash, v.now().Add(3*time.Hour), params.PowLimitBits, false), ErrTimeTooNew},
+	}
+	for _, test := range tests {
+		err := v.CheckHeaders(genesis, []*wire.BlockHeader{test.header})
+		if !errors.Is(err, test.err) || !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestCheckHeadersRetarget(t *testing.T) {
+	params := testParams()
+	v, chain := newTestValidator(params)
+
+	// three blocks a minute apart, then the retarget at height 4
+	prev, _ := chainhash.NewHashFromStr(chain.tip().Hash)
+	for i := 1; i <= 3; i++ {
+		header := mine(*prev, genesisTime.Add(time.Duration(i)*time.Minute), params.PowLimitBits, false)
+		if err := v.CheckHeaders(chain.tip(), []*wire.BlockHeader{header}); err != nil {
+			t.Fatal(err)
+		}
+		chain.put(header, uint64(i))
+		hash := header.BlockHash()
+		prev = &hash
+	}
+
+	// the blocks came more than four times too fast, the target is divided
+	// by the adjustment factor
+	bits := RetargetBits(params.PowLimitBits, 3*time.Minute, params.TargetTimespan, params.RetargetAdjustmentFactor, params.PowLimit)
+	target := blockchain.CompactToBig(params.PowLimitBits)
+	target.Div(target, big.NewInt(params.RetargetAdjustmentFactor))
+	if expected := blockchain.BigToCompact(target); bits != expected {
+		t.Fatalf("expected bits %08x, got %08x", expected, bits)
+	}
+
+	next := genesisTime.Add(4 * time.Minute)
+	err := v.CheckHeaders(chain.tip(), []*wire.BlockHeader{mine(*prev, next, params.PowLimitBits, false)})
+	if !errors.Is(err, ErrUnexpectedBits) {
+		t.Fatalf("expected ErrUnexpectedBits, got %v", err)
+	}
+	if err := v.CheckHeaders(chain.tip(), []*wire.BlockHeader{mine(*prev, next, bits, false)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckHeadersCheckpoints(t *testing.T) {
+	params := testParams()
+	v, chain := newTestValidator(params)
+	genesis := chain.tip()
+	genesisHash, _ := chainhash.NewHashFromStr(genesis.Hash)
+
+	first := mine(*genesisHash, genesisTime.Add(10*time.Minute), params.PowLimitBits, false)
+	chain.put(first, 1)
+	firstHash := first.BlockHash()
+	second := mine(firstHash, genesisTime.Add(20*time.Minute), params.PowLimitBits, false)
+	chain.put(second, 2)
+	params.Checkpoints = []chaincfg.Checkpoint{{Height: 2, Hash: &chainhash.Hash{2}}}
+
+	err := v.CheckHeaders(chain.byHeight[1], []*wire.BlockHeader{second})
+	if !errors.Is(err, ErrCheckpointMismatch) {
+		t.Fatalf("expected ErrCheckpointMismatch, got %v", err)
+	}
+
+	secondHash := second.BlockHash()
+	params.Checkpoints = []chaincfg.Checkpoint{{Height: 2, Hash: &secondHash}}
+	if err := v.CheckHeaders(chain.byHeight[1], []*wire.BlockHeader{second}); err != nil {
+		t.Fatal(err)
+	}
+	// a valid fork of the first block is below the checkpoint
+	fork := mine(*genesisHash, genesisTime.Add(11*time.Minute), params.PowLimitBits, false)
+	err = v.CheckHeaders(genesis, []*wire.BlockHeader{fork})
+	if !errors.Is(err, ErrForkBeforeCheckpoint) {
+		t.Fatalf("expected ErrForkBeforeCheckpoint, got %v", err)
+	}
+}
+
+func TestCheckBlockMerkleRoot(t *testing.T) {
+	params := testParams()
+	v, chain := newTestValidator(params)
+	genesisHash, _ := chainhash.NewHashFromStr(chain.tip().Hash)
+
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), []byte{1, 1}, nil))
+	coinbase.AddTxOut(wire.NewTxOut(50, []byte{0x51}))
+
+	header := mine(*genesisHash, genesisTime.Add(10*time.Minute), params.PowLimitBits, false)
+	block := wire.NewMsgBlock(header)
+	block.AddTransaction(coinbase)
+	if err := v.CheckBlock(chain.tip(), block); !errors.Is(err, ErrBadMerkleRoot) {
+		t.Fatalf("expected ErrBadMerkleRoot, got %v", err)
+	}
+
+	header.MerkleRoot = coinbase.TxHash()
+	block.Header = *mineHeader(header, false)
+	if err := v.CheckBlock(chain.tip(), block); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,6 +4,9 @@ type Db interface {
 	Close()
 	Get(string) ([]byte, error)
 	GetWithPrefix(string) ([][]byte, error)
+	// IterateWithPrefix calls fn for every key with the given prefix in key
+	// order until fn returns false.
+	IterateWithPrefix(prefix string, fn func(key, value []byte) bool) error
 	GetMulti([]string) ([][]byte, error)
 	Put(string, []byte) error
 	PutMulti([]string, [][]byte) error
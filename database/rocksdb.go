@@ -35,7 +35,15 @@ func NewRocksDB(path string, logger *zap.Logger) (*RocksDB, error) {
 	}, nil
 }
 
+// Close flushes the memtables, which may hold writes made without the WAL,
+// and closes the database.
 func (r *RocksDB) Close() {
+	fo := grocksdb.NewDefaultFlushOptions()
+	defer fo.Destroy()
+	fo.SetWait(true)
+	if err := r.db.Flush(fo); err != nil {
+		r.logger.Error("error flushing database", zap.Error(err))
+	}
 	r.db.Close()
 }
 
@@ -194,3 +202,35 @@ func (r *RocksDB) GetWithPrefix(prefix string) ([][]byte, error) {
 	return vals, nil
 
 }
+
+// IterateWithPrefix walks the keys with the given prefix in order and calls fn
+// for each of them. Iteration stops as soon as fn returns false, so callers can
+// paginate or filter without loading every value into memory.
+func (r *RocksDB) IterateWithPrefix(prefix string, fn func(key, value []byte) bool) error {
+	ro := grocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+
+	ro.SetFillCache(false)
+	ro.SetPrefixSameAsStart(true)
+
+	iter := r.db.NewIterator(ro)
+	defer iter.Close()
+
+	for iter.Seek([]byte(prefix)); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		value := iter.Value()
+		keyData := key.Data()
+		if len(prefix) > len(keyData) || string(keyData[:len(prefix)]) != prefix {
+			key.Free()
+			value.Free()
+			break
+		}
+		cont := fn(append([]byte(nil), keyData...), append([]byte(nil), value.Data()...))
+		key.Free()
+		value.Free()
+		if !cont {
+			break
+		}
+	}
+	return iter.Err()
+}
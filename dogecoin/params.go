@@ -48,7 +48,7 @@ var MainNetParams = chaincfg.Params{
 	GenesisBlock:             &genesisBlock,
 	GenesisHash:              &genesisHash,
 	PowLimit:                 mainPowLimit,
-	PowLimitBits:             0x3bffffff,
+	PowLimitBits:             0x1e0fffff,
 	BIP0034Height:            1034383, // 251f53c3e66f122347b7667c45aaadfffb52c2a05b8c80edcce68450b639f7f6
 	BIP0065Height:            3464751, // 34cd2cbba4ba366f47e5aa0db5f02c19eba2adf679ceb6653ac003bdc9a0ef1f
 	BIP0066Height:            1034383, // 251f53c3e66f122347b7667c45aaadfffb52c2a05b8c80edcce68450b639f7f6
@@ -61,23 +61,32 @@ var MainNetParams = chaincfg.Params{
 	MinDiffReductionTime:     0,
 	GenerateSupported:        false,
 
-	// Checkpoints ordered from oldest to newest.
+	// Checkpoints ordered from oldest to newest, the checkpointData of the
+	// mainnet in the chainparams.cpp of dogecoin core.
 	Checkpoints: []chaincfg.Checkpoint{
-		{Height: 0, Hash: newHashFromStr("bb0a78264637406b6360aad926284d544d7049f45189db5664f3c4d07350559e")},
-		{Height: 483173, Hash: newHashFromStr("a804201ca0aceb7e937ef7a3c613a9b7589245b10cc095148c4ce4965b0b73b5")},
-		{Height: 591117, Hash: newHashFromStr("5f6b93b2c28cedf32467d900369b8be6700f0649388a7dbfd3ebd4a01b1ffad8")},
-		{Height: 658924, Hash: newHashFromStr("ed6c8324d9a77195ee080f225a0fca6346495e08ded99bcda47a8eea5a8a620b")},
-		{Height: 703635, Hash: newHashFromStr("839fa54617adcd582d53030a37455c14a87a806f6615aa8213f13e196230ff7f")},
-		{Height: 1000000, Hash: newHashFromStr("1fe4d44ea4d1edb031f52f0d7c635db8190dc871a190654c41d2450086b8ef0e")},
-		{Height: 1202214, Hash: newHashFromStr("a2179767a87ee4e95944703976fee63578ec04fa3ac2fc1c9c2c83587d096977")},
-		{Height: 1250000, Hash: newHashFromStr("b46affb421872ca8efa30366b09694e2f9bf077f7258213be14adb05a9f41883")},
-		{Height: 1500000, Hash: newHashFromStr("0caa041b47b4d18a4f44bdc05cef1a96d5196ce7b2e32ad3e4eb9ba505144917")},
-		{Height: 1750000, Hash: newHashFromStr("8042462366d854ad39b8b95ed2ca12e89a526ceee5a90042d55ebb24d5aab7e9")},
-		{Height: 2000000, Hash: newHashFromStr("d6acde73e1b42fc17f29dcc76f63946d378ae1bd4eafab44d801a25be784103c")},
-		{Height: 2250000, Hash: newHashFromStr("c4342ae6d9a522a02e5607411df1b00e9329563ef844a758d762d601d42c86dc")},
-		{Height: 2500000, Hash: newHashFromStr("3a66ec4933fbb348c9b1889aaf2f732fe429fd9a8f74fee6895eae061ac897e2")},
-		{Height: 2750000, Hash: newHashFromStr("473ea9f625d59f534ffcc9738ffc58f7b7b1e0e993078614f5484a9505885563")},
-		{Height: 3062910, Hash: newHashFromStr("113c41c00934f940a41f99d18b2ad9aefd183a4b7fe80527e1e6c12779bd0246")},
+		{Height: 0, Hash: &genesisHash},
+		{Height: 104679, Hash: newHashFromStr("35eb87ae90d44b98898fec8c39577b76cb1eb08e1261cfc10706c8ce9a1d01cf")},
+		{Height: 145000, Hash: newHashFromStr("cc47cae70d7c5c92828d3214a266331dde59087d4a39071fa76ddfff9b7bde72")},
+		{Height: 371337, Hash: newHashFromStr("60323982f9c5ff1b5a954eac9dc1269352835f47c2c5222691d80f0d50dcf053")},
+		{Height: 450000, Hash: newHashFromStr("d279277f8f846a224d776450aa04da3cf978991a182c6f3075db4c48b173bbd7")},
+		{Height: 771275, Hash: newHashFromStr("1b7d789ed82cbdc640952e7e7a54966c6488a32eaad54fc39dff83f310dbaaed")},
+		{Height: 1000000, Hash: newHashFromStr("6aae55bea74235f0c80bd066349d4440c31f2d0f27d54265ecd484d8c1d11b47")},
+		{Height: 1250000, Hash: newHashFromStr("00c7a442055c1a990e11eea5371ca5c1c02a0677b33cc88ec728c45edc4ec060")},
+		{Height: 1500000, Hash: newHashFromStr("f1d32d6920de7b617d51e74bdf4e58adccaa582ffdc8657464454f16a952fca6")},
+		{Height: 1750000, Hash: newHashFromStr("5c8e7327984f0d6f59447d89d143e5f6eafc524c82ad95d176c5cec082ae2001")},
+		{Height: 2000000, Hash: newHashFromStr("9914f0e82e39bbf21950792e8816620d71b9965bdbbc14e72a95e3ab9618fea8")},
+		{Height: 2031142, Hash: newHashFromStr("893297d89afb7599a3c571ca31a3b80e8353f4cf39872400ad0f57d26c4c5d42")},
+		{Height: 2250000, Hash: newHashFromStr("0a87a8d4e40dca52763f93812a288741806380cd569537039ee927045c6bc338")},
+		{Height: 2510150, Hash: newHashFromStr("77e3f4a4bcb4a2c15e8015525e3d15b466f6c022f6ca82698f329edef7d9777e")},
+		{Height: 2750000, Hash: newHashFromStr("d4f8abb835930d3c4f92ca718aaa09bef545076bd872354e0b2b85deefacf2e3")},
+		{Height: 3000000, Hash: newHashFromStr("195a83b091fb3ee7ecb56f2e63d01709293f57f971ccf373d93890c8dc1033db")},
+		{Height: 3250000, Hash: newHashFromStr("7f3e28bf9e309c4b57a4b70aa64d3b2ddf1b1ffb3ab5c0cb0ef2c4d5a1e6b4f9")},
+		{Height: 3500000, Hash: newHashFromStr("eaa303b93c1c64d2b3a2cdcf6ccf21b10cc36626965cc2619661e8e1879abdfb")},
+		{Height: 3606083, Hash: newHashFromStr("954c7c66dee51f0a3fb1edb26200b735f5275fe54d9505c76ebd2bcabac36f1e")},
+		{Height: 3854173, Hash: newHashFromStr("e4b4ecda4c022406c502a247c0525480268ce7abbbef632796e8ca1646425e75")},
+		{Height: 3963597, Hash: newHashFromStr("2b6927cfaa5e82353d45f02be8aadd3bfd165ece5ce24b9bfa4db20432befb5d")},
+		{Height: 4303965, Hash: newHashFromStr("ed7d266dcbd8bb8af80f9ccb8deb3e18f9cc3f6972912680feeb37b090f8cee0")},
+		{Height: 5050000, Hash: newHashFromStr("e7d4577405223918491477db725a393bcfc349d8ee63b0a4fde23cbfbfd81dea")},
 	},
 
 	// Consensus rule change deployments.
@@ -142,7 +151,7 @@ var TestNet3Params = chaincfg.Params{
 	GenesisBlock:             &testNet3GenesisBlock,
 	GenesisHash:              &testNet3GenesisHash,
 	PowLimit:                 testNet3PowLimit,
-	PowLimitBits:             0x3bffffff,
+	PowLimitBits:             0x1e0fffff,
 	BIP0034Height:            708658,  // 21b8b97dcdb94caa67c7f8f6dbf22e61e0cfe0e46e1fff3528b22864659e9b38
 	BIP0065Height:            1854705, // 955bd496d23790aba1ecfacb722b089a6ae7ddabaedf7d8fb0878f48308a71f9
 	BIP0066Height:            708658,  // 21b8b97dcdb94caa67c7f8f6dbf22e61e0cfe0e46e1fff3528b22864659e9b38
@@ -0,0 +1,32 @@
+package dogecoin
+
+import "testing"
+
+func TestMainNetCheckpoints(t *testing.T) {
+	expected := map[int32]string{
+		0:       "1a91e3dace36e2be3bf030a65679fe821aa1d6ef92e7c9902eb318182c355691",
+		104679:  "35eb87ae90d44b98898fec8c39577b76cb1eb08e1261cfc10706c8ce9a1d01cf",
+		371337:  "60323982f9c5ff1b5a954eac9dc1269352835f47c2c5222691d80f0d50dcf053",
+		1000000: "6aae55bea74235f0c80bd066349d4440c31f2d0f27d54265ecd484d8c1d11b47",
+		2000000: "9914f0e82e39bbf21950792e8816620d71b9965bdbbc14e72a95e3ab9618fea8",
+	}
+	found := 0
+	prev := int32(-1)
+	for _, checkpoint := range MainNetParams.Checkpoints {
+		if checkpoint.Height <= prev {
+			t.Fatalf("checkpoint %d is not after %d", checkpoint.Height, prev)
+		}
+		prev = checkpoint.Height
+		hash, ok := expected[checkpoint.Height]
+		if !ok {
+			continue
+		}
+		if checkpoint.Hash.String() != hash {
+			t.Fatalf("expected checkpoint %s at %d, got %s", hash, checkpoint.Height, checkpoint.Hash)
+		}
+		found++
+	}
+	if found != len(expected) {
+		t.Fatalf("expected %d of the checked heights to be checkpoints, found %d", len(expected), found)
+	}
+}
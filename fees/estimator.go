@@ -0,0 +1,330 @@
+// Package fees estimates feerates from how long the mempool transactions we
+// observe take to get mined, modelled after bitcoind's CBlockPolicyEstimator.
+//
+// Transactions are grouped into exponentially spaced feerate buckets. For
+// every bucket and confirmation target the estimator keeps exponentially
+// decaying counts of transactions that confirmed within the target and of
+// transactions that did not, and answers an estimate with the lowest bucket
+// range whose success rate is above the requested threshold.
+package fees
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/catalogfi/indexer/dogecoin"
+)
+
+const (
+	// feerates are tracked in satoshis per virtual byte
+	minBucketFeeRate = 1.0
+	maxBucketFeeRate = 1e7
+	feeSpacing       = 1.05
+
+	// a bucket range needs at least this many decayed data points per block
+	// of the horizon before its success rate is trusted
+	sufficientTxs = 0.1
+
+	halfSuccessPct   = 0.60
+	successPct       = 0.85
+	doubleSuccessPct = 0.95
+
+	// MaxConfirmTarget is the largest confirmation target supported.
+	MaxConfirmTarget = 1008
+)
+
+var (
+	ErrInsufficientData  = errors.New("insufficient data or no feerate found")
+	ErrInvalidConfTarget = errors.New("invalid confirmation target")
+)
+
+type EstimateMode string
+
+const (
+	ModeEconomical   EstimateMode = "economical"
+	ModeConservative EstimateMode = "conservative"
+)
+
+// Estimate is the result of EstimateSmartFee. FeeRate is in satoshis per
+// virtual byte and Blocks is the target the estimate is valid for.
+type Estimate struct {
+	FeeRate float64 `json:"feerate"`
+	Blocks  uint32  `json:"blocks"`
+}
+
+// FeeHistogramBin is a [feerate, vsize] pair of the mempool fee histogram:
+// vsize virtual bytes of transactions pay at least feerate.
+type FeeHistogramBin [2]float64
+
+type mempoolTx struct {
+	height  uint64
+	bucket  int
+	feeRate float64
+	vsize   int
+}
+
+type Estimator struct {
+	mu sync.Mutex
+
+	buckets    []float64
+	minFeeRate float64
+
+	shortStats  *confirmStats
+	mediumStats *confirmStats
+	longStats   *confirmStats
+
+	height  uint64
+	mempool map[string]mempoolTx
+}
+
+// NewEstimator returns an empty estimator for chainParams. Dogecoin has a
+// much higher relay fee than Bitcoin, which is used as the estimate floor.
+func NewEstimator(chainParams *chaincfg.Params) *Estimator {
+	buckets := make([]float64, 0)
+	for feeRate := minBucketFeeRate; feeRate <= maxBucketFeeRate; feeRate *= feeSpacing {
+		buckets = append(buckets, feeRate)
+	}
+	buckets = append(buckets, math.Inf(1))
+
+	return &Estimator{
+		buckets:     buckets,
+		minFeeRate:  minFeeRate(chainParams),
+		shortStats:  newConfirmStats(len(buckets), 12, 1, 0.962),
+		mediumStats: newConfirmStats(len(buckets), 24, 2, 0.9952),
+		longStats:   newConfirmStats(len(buckets), 42, 24, 0.99931),
+		mempool:     make(map[string]mempoolTx),
+	}
+}
+
+func minFeeRate(chainParams *chaincfg.Params) float64 {
+	switch chainParams.Net {
+	case dogecoin.MainNet, dogecoin.TestNet3:
+		// 0.01 DOGE/kB, the recommended minimum relay fee
+		return 1000
+	default:
+		return 1
+	}
+}
+
+// ObserveTx starts tracking a mempool transaction paying fee satoshis for
+// vsize virtual bytes.
+func (e *Estimator) ObserveTx(txid string, fee int64, vsize int) {
+	if vsize <= 0 || fee < 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.mempool[txid]; ok {
+		return
+	}
+	feeRate := float64(fee) / float64(vsize)
+	e.mempool[txid] = mempoolTx{
+		height:  e.height,
+		bucket:  e.bucketIndex(feeRate),
+		feeRate: feeRate,
+		vsize:   vsize,
+	}
+}
+
+// RemoveTx stops tracking a transaction which left the mempool without being
+// mined, counting it as a failure for the targets it already missed.
+func (e *Estimator) RemoveTx(txid string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	tx, ok := e.mempool[txid]
+	if !ok {
+		return
+	}
+	delete(e.mempool, txid)
+	if e.height > tx.height {
+		blocks := int(e.height - tx.height)
+		for _, stats := range e.allStats() {
+			stats.recordFailure(blocks, tx.bucket)
+		}
+	}
+}
+
+// ProcessBlock records the confirmation of the tracked transactions in txids,
+// mined at height.
+func (e *Estimator) ProcessBlock(height uint64, txids []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// reorgs and replayed blocks are not used for estimation
+	if height <= e.height {
+		return
+	}
+	e.height = height
+
+	for _, stats := range e.allStats() {
+		stats.decay()
+	}
+	for _, txid := range txids {
+		tx, ok := e.mempool[txid]
+		if !ok {
+			continue
+		}
+		delete(e.mempool, txid)
+		// transactions seen before the estimator caught up carry no signal
+		if tx.height == 0 || height <= tx.height {
+			continue
+		}
+		blocks := int(height - tx.height)
+		for _, stats := range e.allStats() {
+			stats.recordConfirmation(blocks, tx.bucket, tx.feeRate)
+		}
+	}
+
+	// transactions stuck for longer than the longest horizon failed all targets
+	for txid, tx := range e.mempool {
+		if tx.height != 0 && height-tx.height > MaxConfirmTarget {
+			delete(e.mempool, txid)
+			for _, stats := range e.allStats() {
+				stats.recordFailure(int(height-tx.height), tx.bucket)
+			}
+		}
+	}
+}
+
+// EstimateSmartFee returns the feerate needed for a transaction to confirm
+// within confTarget blocks. Conservative estimates also consider the long
+// horizon and are less responsive to short term drops in fees.
+func (e *Estimator) EstimateSmartFee(confTarget uint32, mode EstimateMode) (*Estimate, error) {
+	if confTarget == 0 || confTarget > MaxConfirmTarget {
+		return nil, ErrInvalidConfTarget
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// a target of one block can not be estimated, we use two instead
+	if confTarget == 1 {
+		confTarget = 2
+	}
+	target := int(confTarget)
+	extra := e.unconfirmedCounts()
+
+	median := e.estimateCombined(target/2, halfSuccessPct, true, extra)
+	if est := e.estimateCombined(target, successPct, true, extra); est > median {
+		median = est
+	}
+	if est := e.estimateCombined(2*target, doubleSuccessPct, mode != ModeConservative, extra); est > median {
+		median = est
+	}
+	if mode == ModeConservative || median < 0 {
+		if est := e.longStats.estimate(e.buckets, 2*target, doubleSuccessPct, extra); est > median {
+			median = est
+		}
+	}
+	if median < 0 {
+		return nil, ErrInsufficientData
+	}
+	if median < e.minFeeRate {
+		median = e.minFeeRate
+	}
+	return &Estimate{
+		FeeRate: median,
+		Blocks:  confTarget,
+	}, nil
+}
+
+// estimateCombined uses the shortest horizon able to answer target, and
+// optionally makes sure a shorter horizon does not require a higher fee.
+func (e *Estimator) estimateCombined(target int, successThreshold float64, checkShorterHorizon bool, extra map[int][]float64) float64 {
+	if target < 1 {
+		return -1
+	}
+	var estimate float64 = -1
+	switch {
+	case target <= e.shortStats.maxTarget():
+		estimate = e.shortStats.estimate(e.buckets, target, successThreshold, extra)
+	case target <= e.mediumStats.maxTarget():
+		estimate = e.mediumStats.estimate(e.buckets, target, successThreshold, extra)
+	case target <= e.longStats.maxTarget():
+		estimate = e.longStats.estimate(e.buckets, target, successThreshold, extra)
+	}
+	if !checkShorterHorizon {
+		return estimate
+	}
+	if target > e.mediumStats.maxTarget() {
+		if est := e.mediumStats.estimate(e.buckets, e.mediumStats.maxTarget(), successThreshold, extra); est > estimate {
+			estimate = est
+		}
+	}
+	if target > e.shortStats.maxTarget() {
+		if est := e.shortStats.estimate(e.buckets, e.shortStats.maxTarget(), successThreshold, extra); est > estimate {
+			estimate = est
+		}
+	}
+	return estimate
+}
+
+// unconfirmedCounts returns, for every waiting time in blocks, the number of
+// tracked mempool transactions per bucket. Transactions still waiting longer
+// than a target count as failures for it.
+func (e *Estimator) unconfirmedCounts() map[int][]float64 {
+	extra := make(map[int][]float64)
+	for _, tx := range e.mempool {
+		if tx.height == 0 || e.height <= tx.height {
+			continue
+		}
+		blocks := int(e.height - tx.height)
+		if _, ok := extra[blocks]; !ok {
+			extra[blocks] = make([]float64, len(e.buckets))
+		}
+		extra[blocks][tx.bucket]++
+	}
+	return extra
+}
+
+// FeeHistogram returns the tracked mempool transactions binned by feerate in
+// descending order, in the format used by Electrum servers.
+func (e *Estimator) FeeHistogram() []FeeHistogramBin {
+	e.mu.Lock()
+	txs := make([]mempoolTx, 0, len(e.mempool))
+	for _, tx := range e.mempool {
+		txs = append(txs, tx)
+	}
+	e.mu.Unlock()
+
+	sort.Slice(txs, func(i, j int) bool {
+		return txs[i].feeRate > txs[j].feeRate
+	})
+
+	histogram := make([]FeeHistogramBin, 0)
+	binSize := 30000.0
+	size := 0.0
+	lastFeeRate := 0.0
+	for _, tx := range txs {
+		if size > binSize && tx.feeRate < lastFeeRate {
+			histogram = append(histogram, FeeHistogramBin{lastFeeRate, size})
+			size = 0
+			binSize *= 1.1
+		}
+		size += float64(tx.vsize)
+		lastFeeRate = tx.feeRate
+	}
+	if size > 0 {
+		histogram = append(histogram, FeeHistogramBin{lastFeeRate, size})
+	}
+	return histogram
+}
+
+// Height returns the height of the last block processed.
+func (e *Estimator) Height() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.height
+}
+
+func (e *Estimator) allStats() []*confirmStats {
+	return []*confirmStats{e.shortStats, e.mediumStats, e.longStats}
+}
+
+func (e *Estimator) bucketIndex(feeRate float64) int {
+	return sort.SearchFloat64s(e.buckets, feeRate)
+}
@@ -0,0 +1,75 @@
+package fees_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/catalogfi/indexer/fees"
+)
+
+func TestEstimator(t *testing.T) {
+	estimator := fees.NewEstimator(&chaincfg.MainNetParams)
+
+	_, err := estimator.EstimateSmartFee(6, fees.ModeEconomical)
+	if err != fees.ErrInsufficientData {
+		t.Fatalf("expected insufficient data, got %v", err)
+	}
+
+	// every block, high fee transactions confirm in the next block and
+	// low fee ones take ten blocks
+	height := uint64(100)
+	estimator.ProcessBlock(height, nil)
+	pending := map[uint64][]string{}
+	for i := 0; i < 300; i++ {
+		for j := 0; j < 5; j++ {
+			fast := fmt.Sprintf("fast-%d-%d", i, j)
+			slow := fmt.Sprintf("slow-%d-%d", i, j)
+			estimator.ObserveTx(fast, 5000, 250)
+			estimator.ObserveTx(slow, 500, 250)
+			pending[height+1] = append(pending[height+1], fast)
+			pending[height+10] = append(pending[height+10], slow)
+		}
+		height++
+		estimator.ProcessBlock(height, pending[height])
+		delete(pending, height)
+	}
+
+	t.Run("should require the high feerate for short targets", func(t *testing.T) {
+		estimate, err := estimator.EstimateSmartFee(2, fees.ModeEconomical)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if estimate.FeeRate < 15 {
+			t.Fatalf("expected the high feerate, got %v", estimate.FeeRate)
+		}
+	})
+
+	t.Run("should allow the low feerate for long targets", func(t *testing.T) {
+		estimate, err := estimator.EstimateSmartFee(25, fees.ModeEconomical)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if estimate.FeeRate > 5 {
+			t.Fatalf("expected the low feerate, got %v", estimate.FeeRate)
+		}
+	})
+
+	t.Run("should build a histogram of the mempool", func(t *testing.T) {
+		histogram := estimator.FeeHistogram()
+		if len(histogram) == 0 {
+			t.Fatal("expected a non empty histogram")
+		}
+		for i := 1; i < len(histogram); i++ {
+			if histogram[i][0] > histogram[i-1][0] {
+				t.Fatal("expected feerates in descending order")
+			}
+		}
+	})
+
+	t.Run("should reject invalid targets", func(t *testing.T) {
+		if _, err := estimator.EstimateSmartFee(0, fees.ModeConservative); err != fees.ErrInvalidConfTarget {
+			t.Fatalf("expected invalid target, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package fees
+
+// confirmStats tracks, for one horizon, how long transactions in each feerate
+// bucket took to confirm. Confirmation targets are grouped into periods of
+// scale blocks so the long horizon stays small.
+type confirmStats struct {
+	periods     int
+	scale       int
+	decayFactor float64
+
+	// confAvg[p][b] is the decayed count of transactions of bucket b that
+	// confirmed within (p+1)*scale blocks
+	confAvg [][]float64
+	// failAvg[p][b] is the decayed count of transactions of bucket b that
+	// left the mempool unconfirmed after more than (p+1)*scale blocks
+	failAvg [][]float64
+	// txCtAvg and feeRateAvg are the decayed count and feerate sum of all
+	// confirmed transactions of a bucket
+	txCtAvg    []float64
+	feeRateAvg []float64
+}
+
+func newConfirmStats(buckets, periods, scale int, decayFactor float64) *confirmStats {
+	stats := &confirmStats{
+		periods:     periods,
+		scale:       scale,
+		decayFactor: decayFactor,
+		confAvg:     make([][]float64, periods),
+		failAvg:     make([][]float64, periods),
+		txCtAvg:     make([]float64, buckets),
+		feeRateAvg:  make([]float64, buckets),
+	}
+	for p := 0; p < periods; p++ {
+		stats.confAvg[p] = make([]float64, buckets)
+		stats.failAvg[p] = make([]float64, buckets)
+	}
+	return stats
+}
+
+func (c *confirmStats) maxTarget() int {
+	return c.periods * c.scale
+}
+
+func (c *confirmStats) decay() {
+	for p := 0; p < c.periods; p++ {
+		for b := range c.confAvg[p] {
+			c.confAvg[p][b] *= c.decayFactor
+			c.failAvg[p][b] *= c.decayFactor
+		}
+	}
+	for b := range c.txCtAvg {
+		c.txCtAvg[b] *= c.decayFactor
+		c.feeRateAvg[b] *= c.decayFactor
+	}
+}
+
+func (c *confirmStats) recordConfirmation(blocks, bucket int, feeRate float64) {
+	periodsToConfirm := (blocks + c.scale - 1) / c.scale
+	for p := periodsToConfirm - 1; p < c.periods; p++ {
+		c.confAvg[p][bucket]++
+	}
+	c.txCtAvg[bucket]++
+	c.feeRateAvg[bucket] += feeRate
+}
+
+func (c *confirmStats) recordFailure(blocks, bucket int) {
+	periodsAgo := blocks / c.scale
+	for p := 0; p < periodsAgo && p < c.periods; p++ {
+		c.failAvg[p][bucket]++
+	}
+}
+
+// estimate walks the buckets from the highest feerate down, grouping them
+// into ranges with enough data points, and returns the median feerate of the
+// lowest range whose success rate for target meets successThreshold, or -1.
+// extra holds the mempool transactions per bucket by blocks waited so far.
+func (c *confirmStats) estimate(buckets []float64, target int, successThreshold float64, extra map[int][]float64) float64 {
+	if target < 1 || target > c.maxTarget() {
+		return -1
+	}
+	period := (target+c.scale-1)/c.scale - 1
+	sufficient := sufficientTxs / (1 - c.decayFactor)
+
+	var nConf, totalNum, failNum, extraNum float64
+	maxBucket := len(buckets) - 1
+	curNear, curFar := maxBucket, maxBucket
+	bestNear, bestFar := maxBucket, maxBucket
+	foundAnswer := false
+	newRange := true
+
+	for bucket := maxBucket; bucket >= 0; bucket-- {
+		if newRange {
+			curNear = bucket
+			newRange = false
+		}
+		curFar = bucket
+		nConf += c.confAvg[period][bucket]
+		totalNum += c.txCtAvg[bucket]
+		failNum += c.failAvg[period][bucket]
+		for blocks, counts := range extra {
+			if blocks >= target {
+				extraNum += counts[bucket]
+			}
+		}
+
+		if totalNum < sufficient {
+			continue
+		}
+		if nConf/(totalNum+failNum+extraNum) < successThreshold {
+			// keep widening the range towards lower feerates
+			continue
+		}
+		foundAnswer = true
+		bestNear, bestFar = curNear, curFar
+		newRange = true
+		nConf, totalNum, failNum, extraNum = 0, 0, 0, 0
+	}
+	if !foundAnswer {
+		return -1
+	}
+
+	// median feerate of the transactions in the passing range
+	txSum := 0.0
+	for b := bestFar; b <= bestNear; b++ {
+		txSum += c.txCtAvg[b]
+	}
+	if txSum == 0 {
+		return -1
+	}
+	txSum /= 2
+	for b := bestFar; b <= bestNear; b++ {
+		if c.txCtAvg[b] < txSum {
+			txSum -= c.txCtAvg[b]
+			continue
+		}
+		return c.feeRateAvg[b] / c.txCtAvg[b]
+	}
+	return -1
+}
@@ -1,16 +1,23 @@
 package mempool
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"strings"
 
+	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/fees"
 	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/store"
 	"github.com/catalogfi/indexer/utils"
+	"github.com/catalogfi/indexer/swap"
+	"github.com/catalogfi/indexer/wallet"
 )
 
 // package for handling mempool transactions
@@ -20,14 +27,20 @@ type storage interface {
 	PutTx(tx *model.Transaction) error
 	PutTxs(txs []*model.Transaction) error
 	PutUTXOs(vouts []model.Vout) error
-	RemoveUTXOs(hashes []string, indices []uint32, vins []model.Vin) error
+	PutOpReturns(opReturns []model.OpReturn) error
+	MarkUTXOsSpent(hashes []string, indices []uint32, vins []model.Vin) ([]string, error)
 	PutOrphanTx(tx *model.Transaction) error
 	GetOrphanTx(hash string) (*model.Transaction, bool, error)
 	GetOrphanDescendants(hash string) ([]*model.Transaction, error)
+	GetPrevouts(hashes []string, indices []uint32) ([]*model.Vout, error)
+	GetTxLocation(hash string) (*model.TxLocation, bool, error)
 }
 
 type Mempool struct {
-	store storage
+	store        storage
+	feeEstimator *fees.Estimator
+	wallets      *wallet.Manager
+	swaps        *swap.Watcher
 }
 
 func New(store storage) *Mempool {
@@ -36,10 +49,31 @@ func New(store storage) *Mempool {
 	}
 }
 
+// SetFeeEstimator makes the mempool report the fee of every accepted
+// transaction to estimator.
+func (m *Mempool) SetFeeEstimator(estimator *fees.Estimator) *Mempool {
+	m.feeEstimator = estimator
+	return m
+}
+
+// SetWalletManager makes the mempool report every accepted transaction to
+// the watch-only wallets.
+func (m *Mempool) SetWalletManager(wallets *wallet.Manager) *Mempool {
+	m.wallets = wallets
+	return m
+}
+
+// SetSwapWatcher makes the mempool report every accepted transaction to the
+// HTLC watcher.
+func (m *Mempool) SetSwapWatcher(swaps *swap.Watcher) *Mempool {
+	m.swaps = swaps
+	return m
+}
+
 // not fully tested. should not be used in production
 func (m *Mempool) ProcessTx(tx *wire.MsgTx) error {
 	// check if tx is already in mempool
-	_, exists, err := m.store.GetTx(tx.TxHash().String())
+	exists, err := m.txExists(tx.TxHash().String())
 	if err != nil {
 		return err
 	}
@@ -75,6 +109,64 @@ func (m *Mempool) ProcessTx(tx *wire.MsgTx) error {
 	return m.putInOrphanPool(tx)
 }
 
+// ReaddTxs puts the transactions of blocks leaving the main chain back in the
+// mempool. They are known already, so they skip the checks of ProcessTx, and
+// have to be given parents first. The ones the new main chain confirmed, or
+// spending outputs it spent, are dropped along with their descendants.
+func (m *Mempool) ReaddTxs(txs []*wire.MsgTx) error {
+	dropped := make([]string, 0)
+	for _, tx := range txs {
+		_, confirmed, err := m.store.GetTxLocation(tx.TxHash().String())
+		if err != nil {
+			return err
+		}
+		if confirmed {
+			continue
+		}
+		hashes := make([]string, len(tx.TxIn))
+		indices := make([]uint32, len(tx.TxIn))
+		for i, txIn := range tx.TxIn {
+			hashes[i] = txIn.PreviousOutPoint.Hash.String()
+			indices[i] = txIn.PreviousOutPoint.Index
+		}
+		prevouts, err := m.store.GetPrevouts(hashes, indices)
+		if err != nil {
+			return err
+		}
+		spendable := true
+		for _, prevout := range prevouts {
+			if prevout == nil {
+				spendable = false
+				break
+			}
+		}
+		if !spendable {
+			dropped = append(dropped, tx.TxHash().String())
+			continue
+		}
+		if err := m.putTx(tx); err != nil {
+			return err
+		}
+	}
+	return m.RemoveTxs(dropped)
+}
+
+// RemoveTxs reports the transactions leaving the mempool without being mined,
+// replaced or conflicting with the main chain.
+func (m *Mempool) RemoveTxs(hashes []string) error {
+	if m.feeEstimator != nil {
+		for _, hash := range hashes {
+			m.feeEstimator.RemoveTx(hash)
+		}
+	}
+	if m.wallets != nil {
+		if err := m.wallets.RemoveTxs(hashes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // removes the used utxos, adds the new utxos and the tx to the db
 func (m *Mempool) putTx(tx *wire.MsgTx) error {
 
@@ -104,6 +196,8 @@ func (m *Mempool) putTx(tx *wire.MsgTx) error {
 			Sequence:        txIn.Sequence,
 			SignatureScript: hex.EncodeToString(txIn.SignatureScript),
 			Witness:         witness,
+			PreviousTxId:    txIn.PreviousOutPoint.Hash.String(),
+			PreviousIndex:   txIn.PreviousOutPoint.Index,
 		}
 		vins[i] = *vin
 		hashes[i] = txIn.PreviousOutPoint.Hash.String()
@@ -121,10 +215,30 @@ func (m *Mempool) putTx(tx *wire.MsgTx) error {
 	if err := m.store.PutUTXOs(vouts); err != nil {
 		return err
 	}
-	if err := m.store.RemoveUTXOs(hashes, indices, vins); err != nil {
+	if err := m.store.PutOpReturns(utils.OpReturns(vouts, "", 0)); err != nil {
 		return err
 	}
-	return m.store.PutTx(transaction)
+	replaced, err := m.store.MarkUTXOsSpent(hashes, indices, vins)
+	if err != nil {
+		return err
+	}
+	if err := m.RemoveTxs(replaced); err != nil {
+		return err
+	}
+	if err := m.store.PutTx(transaction); err != nil {
+		return err
+	}
+	if m.wallets != nil {
+		if err := m.wallets.ConnectTxs([]*model.Transaction{transaction}, 0, ""); err != nil {
+			return err
+		}
+	}
+	if m.swaps != nil {
+		if err := m.swaps.ConnectTxs([]*model.Transaction{transaction}, 0, ""); err != nil {
+			return err
+		}
+	}
+	return m.observeFee(tx)
 }
 
 func (m *Mempool) putTxMulti(txs []*wire.MsgTx) error {
@@ -135,16 +249,73 @@ func (m *Mempool) putTxMulti(txs []*wire.MsgTx) error {
 	if err := m.store.PutUTXOs(vouts); err != nil {
 		return err
 	}
+	if err := m.store.PutOpReturns(utils.OpReturns(vouts, "", 0)); err != nil {
+		return err
+	}
 	hashes := make([]string, len(txIns))
 	indices := make([]uint32, len(txIns))
 	for i, txIn := range txIns {
 		hashes[i] = txIn.PreviousOutPoint.Hash.String()
 		indices[i] = txIn.PreviousOutPoint.Index
 	}
-	if err := m.store.RemoveUTXOs(hashes, indices, vins[1:]); err != nil {
+	replaced, err := m.store.MarkUTXOsSpent(hashes, indices, vins)
+	if err != nil {
+		return err
+	}
+	if err := m.RemoveTxs(replaced); err != nil {
+		return err
+	}
+	if err := m.store.PutTxs(transactions); err != nil {
+		return err
+	}
+	if m.wallets != nil {
+		if err := m.wallets.ConnectTxs(transactions, 0, ""); err != nil {
+			return err
+		}
+	}
+	if m.swaps != nil {
+		if err := m.swaps.ConnectTxs(transactions, 0, ""); err != nil {
+			return err
+		}
+	}
+	for _, tx := range txs {
+		if err := m.observeFee(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// observeFee reports the feerate of tx to the fee estimator. Transactions
+// with prevouts missing from the UTXO set are skipped.
+func (m *Mempool) observeFee(tx *wire.MsgTx) error {
+	if m.feeEstimator == nil {
+		return nil
+	}
+	hashes := make([]string, len(tx.TxIn))
+	indices := make([]uint32, len(tx.TxIn))
+	for i, txIn := range tx.TxIn {
+		hashes[i] = txIn.PreviousOutPoint.Hash.String()
+		indices[i] = txIn.PreviousOutPoint.Index
+	}
+	prevouts, err := m.store.GetPrevouts(hashes, indices)
+	if err != nil {
 		return err
 	}
-	return m.store.PutTxs(transactions)
+	fee := int64(0)
+	for _, prevout := range prevouts {
+		if prevout == nil {
+			return nil
+		}
+		fee += prevout.Value
+	}
+	for _, txOut := range tx.TxOut {
+		fee -= txOut.Value
+	}
+	weight := tx.SerializeSizeStripped()*(blockchain.WitnessScaleFactor-1) + tx.SerializeSize()
+	vsize := (weight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor
+	m.feeEstimator.ObserveTx(tx.TxHash().String(), fee, vsize)
+	return nil
 }
 
 // check if txIns have any txOuts of previous transactions in the indexed data
@@ -154,7 +325,7 @@ func (m *Mempool) checkForTxIns(tx *wire.MsgTx) (bool, error) {
 			continue
 		}
 		// check if txIn is present in blockchain
-		_, exists, err := m.store.GetTx(txIn.PreviousOutPoint.Hash.String())
+		exists, err := m.txExists(txIn.PreviousOutPoint.Hash.String())
 		if err != nil {
 			return false, err
 		}
@@ -165,6 +336,16 @@ func (m *Mempool) checkForTxIns(tx *wire.MsgTx) (bool, error) {
 	return true, nil
 }
 
+// txExists checks if the tx is indexed. Pruned transactions were mined long
+// ago and still count as indexed.
+func (m *Mempool) txExists(hash string) (bool, error) {
+	_, exists, err := m.store.GetTx(hash)
+	if errors.Is(err, store.ErrTxPruned) {
+		return true, nil
+	}
+	return exists, err
+}
+
 // we only put the tx in the orphan pool if it does not have any parents
 // we do not put utxos or remove utxos from the orphan pool
 func (m *Mempool) putInOrphanPool(tx *wire.MsgTx) error {
@@ -196,6 +377,8 @@ func (m *Mempool) putInOrphanPool(tx *wire.MsgTx) error {
 			vin.Witness = witnessString
 			vin.TxId = txHash
 			vin.Index = inIndex
+			vin.PreviousTxId = txIn.PreviousOutPoint.Hash.String()
+			vin.PreviousIndex = txIn.PreviousOutPoint.Index
 			vins[i] = *vin
 			continue
 		}
@@ -292,7 +475,9 @@ func (m *Mempool) GetAllMemPoolTxHashes(rpcURL, rpcUser, rpcPass string) ([]*cha
 	return txHashes, nil
 }
 
-func (m *Mempool) SyncMempool(rpcURL, rpcUser, rpcPass string) error {
+// SyncMempool fetches the mempool of the node at rpcURL and processes its
+// transactions, stopping early once ctx is cancelled.
+func (m *Mempool) SyncMempool(ctx context.Context, rpcURL, rpcUser, rpcPass string) error {
 	txHashes, err := m.GetAllMemPoolTxHashes(rpcURL, rpcUser, rpcPass)
 	if err != nil {
 		return err
@@ -314,6 +499,9 @@ func (m *Mempool) SyncMempool(rpcURL, rpcUser, rpcPass string) error {
 	defer client.Shutdown()
 
 	for _, hash := range txHashes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		fmt.Println("Getting tx", hash.String())
 		tx, err := client.GetRawTransactionVerbose(hash)
 		if err != nil {
@@ -0,0 +1,234 @@
+// Package merkle builds and verifies transaction inclusion proofs: Esplora
+// style merkle branches and the bitcoind partial merkle trees served by
+// gettxoutproof.
+package merkle
+
+import (
+	"errors"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+var (
+	ErrPositionOutOfRange = errors.New("merkle: position out of range")
+	ErrNoTransactions     = errors.New("merkle: no transactions")
+	ErrInvalidTree        = errors.New("merkle: invalid partial merkle tree")
+)
+
+// Branch returns the sibling hashes from the leaf at pos up to the root.
+func Branch(hashes []chainhash.Hash, pos int) ([]chainhash.Hash, error) {
+	if pos < 0 || pos >= len(hashes) {
+		return nil, ErrPositionOutOfRange
+	}
+	level := make([]chainhash.Hash, len(hashes))
+	copy(level, hashes)
+	branch := make([]chainhash.Hash, 0)
+	for len(level) > 1 {
+		// an odd level is completed by duplicating its last hash
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		branch = append(branch, level[pos^1])
+		next := make([]chainhash.Hash, len(level)/2)
+		for i := range next {
+			next[i] = blockchain.HashMerkleBranches(&level[2*i], &level[2*i+1])
+		}
+		level = next
+		pos /= 2
+	}
+	return branch, nil
+}
+
+// Root returns the merkle root of the transaction hashes.
+func Root(hashes []chainhash.Hash) (chainhash.Hash, error) {
+	if len(hashes) == 0 {
+		return chainhash.Hash{}, ErrNoTransactions
+	}
+	branch, err := Branch(hashes, 0)
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+	return RootFromBranch(hashes[0], branch, 0), nil
+}
+
+// RootFromBranch returns the merkle root committing to leaf at pos with the
+// given branch.
+func RootFromBranch(leaf chainhash.Hash, branch []chainhash.Hash, pos int) chainhash.Hash {
+	hash := leaf
+	for _, sibling := range branch {
+		sibling := sibling
+		if pos&1 == 1 {
+			hash = blockchain.HashMerkleBranches(&sibling, &hash)
+		} else {
+			hash = blockchain.HashMerkleBranches(&hash, &sibling)
+		}
+		pos >>= 1
+	}
+	return hash
+}
+
+// partialTree mirrors the CPartialMerkleTree of bitcoind: a depth-first walk
+// of the tree keeping the hashes of the nodes which are not ancestors of a
+// matched leaf, and one flag bit per visited node.
+type partialTree struct {
+	numTx   uint32
+	hashes  []chainhash.Hash
+	matched []bool
+
+	bits        []bool
+	finalHashes []chainhash.Hash
+}
+
+func (t *partialTree) width(height uint32) uint32 {
+	return (t.numTx + (1 << height) - 1) >> height
+}
+
+func (t *partialTree) hash(height, pos uint32) chainhash.Hash {
+	if height == 0 {
+		return t.hashes[pos]
+	}
+	left := t.hash(height-1, pos*2)
+	right := left
+	if pos*2+1 < t.width(height-1) {
+		right = t.hash(height-1, pos*2+1)
+	}
+	return blockchain.HashMerkleBranches(&left, &right)
+}
+
+func (t *partialTree) build(height, pos uint32) {
+	parent := false
+	for i := pos << height; i < (pos+1)<<height && i < t.numTx; i++ {
+		parent = parent || t.matched[i]
+	}
+	t.bits = append(t.bits, parent)
+	if height == 0 || !parent {
+		t.finalHashes = append(t.finalHashes, t.hash(height, pos))
+		return
+	}
+	t.build(height-1, pos*2)
+	if pos*2+1 < t.width(height-1) {
+		t.build(height-1, pos*2+1)
+	}
+}
+
+func (t *partialTree) height() uint32 {
+	height := uint32(0)
+	for t.width(height) > 1 {
+		height++
+	}
+	return height
+}
+
+// NewMerkleBlock returns the merkle block proving the inclusion of the
+// matched transactions in the block with the given header and transaction
+// hashes.
+func NewMerkleBlock(header wire.BlockHeader, hashes []chainhash.Hash, matched map[chainhash.Hash]bool) (*wire.MsgMerkleBlock, error) {
+	if len(hashes) == 0 {
+		return nil, ErrNoTransactions
+	}
+	tree := &partialTree{
+		numTx:   uint32(len(hashes)),
+		hashes:  hashes,
+		matched: make([]bool, len(hashes)),
+	}
+	for i, hash := range hashes {
+		tree.matched[i] = matched[hash]
+	}
+	tree.build(tree.height(), 0)
+
+	merkleBlock := &wire.MsgMerkleBlock{
+		Header:       header,
+		Transactions: tree.numTx,
+		Hashes:       make([]*chainhash.Hash, 0, len(tree.finalHashes)),
+		Flags:        make([]byte, (len(tree.bits)+7)/8),
+	}
+	for i := range tree.finalHashes {
+		if err := merkleBlock.AddTxHash(&tree.finalHashes[i]); err != nil {
+			return nil, err
+		}
+	}
+	for i, bit := range tree.bits {
+		if bit {
+			merkleBlock.Flags[i/8] |= 1 << (i % 8)
+		}
+	}
+	return merkleBlock, nil
+}
+
+// ExtractMatches walks the partial merkle tree of a merkle block and returns
+// the merkle root it commits to along with the matched transaction hashes and
+// their positions in the block. The caller still has to compare the root with
+// the one in the header.
+func ExtractMatches(merkleBlock *wire.MsgMerkleBlock) (chainhash.Hash, []chainhash.Hash, []uint32, error) {
+	numTx := merkleBlock.Transactions
+	if numTx == 0 {
+		return chainhash.Hash{}, nil, nil, ErrNoTransactions
+	}
+	// at most one hash per transaction, and one flag bit per hash
+	if uint32(len(merkleBlock.Hashes)) > numTx || len(merkleBlock.Flags)*8 < len(merkleBlock.Hashes) {
+		return chainhash.Hash{}, nil, nil, ErrInvalidTree
+	}
+	tree := &partialTree{numTx: numTx}
+	walker := &treeWalker{
+		tree:   tree,
+		flags:  merkleBlock.Flags,
+		hashes: merkleBlock.Hashes,
+	}
+	root, err := walker.walk(tree.height(), 0)
+	if err != nil {
+		return chainhash.Hash{}, nil, nil, err
+	}
+	// every hash and every flag byte must have been used
+	if walker.hashUsed != len(walker.hashes) || (walker.bitsUsed+7)/8 != len(walker.flags) {
+		return chainhash.Hash{}, nil, nil, ErrInvalidTree
+	}
+	return root, walker.matches, walker.positions, nil
+}
+
+type treeWalker struct {
+	tree   *partialTree
+	flags  []byte
+	hashes []*chainhash.Hash
+
+	bitsUsed  int
+	hashUsed  int
+	matches   []chainhash.Hash
+	positions []uint32
+}
+
+func (w *treeWalker) walk(height, pos uint32) (chainhash.Hash, error) {
+	if w.bitsUsed >= len(w.flags)*8 {
+		return chainhash.Hash{}, ErrInvalidTree
+	}
+	parent := w.flags[w.bitsUsed/8]&(1<<(w.bitsUsed%8)) != 0
+	w.bitsUsed++
+	if height == 0 || !parent {
+		if w.hashUsed >= len(w.hashes) {
+			return chainhash.Hash{}, ErrInvalidTree
+		}
+		hash := *w.hashes[w.hashUsed]
+		w.hashUsed++
+		if height == 0 && parent {
+			w.matches = append(w.matches, hash)
+			w.positions = append(w.positions, pos)
+		}
+		return hash, nil
+	}
+	left, err := w.walk(height-1, pos*2)
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+	right := left
+	if pos*2+1 < w.tree.width(height-1) {
+		if right, err = w.walk(height-1, pos*2+1); err != nil {
+			return chainhash.Hash{}, err
+		}
+		// identical siblings would allow the CVE-2012-2459 malleability
+		if right == left {
+			return chainhash.Hash{}, ErrInvalidTree
+		}
+	}
+	return blockchain.HashMerkleBranches(&left, &right), nil
+}
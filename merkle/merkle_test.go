@@ -0,0 +1,124 @@
+package merkle
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/bloom"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func testBlock(numTx int) *wire.MsgBlock {
+	block := wire.NewMsgBlock(&wire.BlockHeader{Version: 1, Bits: 0x207fffff})
+	for i := 0; i < numTx; i++ {
+		tx := wire.NewMsgTx(1)
+		tx.AddTxIn(&wire.TxIn{PreviousOutPoint: wire.OutPoint{Index: uint32(i)}})
+		tx.AddTxOut(wire.NewTxOut(int64(i), []byte{0x51}))
+		block.AddTransaction(tx)
+	}
+	txs := make([]*btcutil.Tx, numTx)
+	for i, tx := range block.Transactions {
+		txs[i] = btcutil.NewTx(tx)
+	}
+	block.Header.MerkleRoot = blockchain.CalcMerkleRoot(txs, false)
+	return block
+}
+
+func txHashes(block *wire.MsgBlock) []chainhash.Hash {
+	hashes := make([]chainhash.Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		hashes[i] = tx.TxHash()
+	}
+	return hashes
+}
+
+func TestBranch(t *testing.T) {
+	for _, numTx := range []int{1, 2, 3, 7, 8, 13} {
+		block := testBlock(numTx)
+		hashes := txHashes(block)
+		for pos := range hashes {
+			branch, err := Branch(hashes, pos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if root := RootFromBranch(hashes[pos], branch, pos); root != block.Header.MerkleRoot {
+				t.Fatalf("%d txs, pos %d: got root %s, want %s", numTx, pos, root, block.Header.MerkleRoot)
+			}
+		}
+	}
+	for _, numTx := range []int{1, 2, 3, 7} {
+		block := testBlock(numTx)
+		if root, err := Root(txHashes(block)); err != nil || root != block.Header.MerkleRoot {
+			t.Fatalf("%d txs: got root %s, want %s", numTx, root, block.Header.MerkleRoot)
+		}
+	}
+	if _, err := Root(nil); err != ErrNoTransactions {
+		t.Fatalf("got %v, want %v", err, ErrNoTransactions)
+	}
+	if _, err := Branch(txHashes(testBlock(3)), 3); err != ErrPositionOutOfRange {
+		t.Fatalf("got %v, want %v", err, ErrPositionOutOfRange)
+	}
+}
+
+func TestMerkleBlock(t *testing.T) {
+	for _, numTx := range []int{1, 2, 5, 9} {
+		block := testBlock(numTx)
+		hashes := txHashes(block)
+		for pos := range hashes {
+			// the bloom filter of btcutil builds the same trees
+			filter := bloom.NewFilter(10, 0, 0.0001, wire.BloomUpdateNone)
+			filter.AddHash(&hashes[pos])
+			want, _ := bloom.NewMerkleBlock(btcutil.NewBlock(block), filter)
+
+			got, err := NewMerkleBlock(block.Header, hashes, map[chainhash.Hash]bool{hashes[pos]: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotBuf, wantBuf bytes.Buffer
+			if err := got.BtcEncode(&gotBuf, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+				t.Fatal(err)
+			}
+			if err := want.BtcEncode(&wantBuf, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(gotBuf.Bytes(), wantBuf.Bytes()) {
+				t.Fatalf("%d txs, pos %d: merkle block differs from btcutil", numTx, pos)
+			}
+
+			root, matches, positions, err := ExtractMatches(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if root != block.Header.MerkleRoot {
+				t.Fatalf("%d txs, pos %d: got root %s, want %s", numTx, pos, root, block.Header.MerkleRoot)
+			}
+			if len(matches) != 1 || matches[0] != hashes[pos] || positions[0] != uint32(pos) {
+				t.Fatalf("%d txs, pos %d: got matches %v at %v", numTx, pos, matches, positions)
+			}
+		}
+	}
+}
+
+func TestExtractMatchesInvalid(t *testing.T) {
+	block := testBlock(4)
+	hashes := txHashes(block)
+	merkleBlock, err := NewMerkleBlock(block.Header, hashes, map[chainhash.Hash]bool{hashes[1]: true, hashes[2]: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	truncated := *merkleBlock
+	truncated.Hashes = truncated.Hashes[:len(truncated.Hashes)-1]
+	if _, _, _, err := ExtractMatches(&truncated); err != ErrInvalidTree {
+		t.Fatalf("got %v, want %v", err, ErrInvalidTree)
+	}
+
+	extra := *merkleBlock
+	extra.Flags = append(append([]byte{}, extra.Flags...), 0)
+	if _, _, _, err := ExtractMatches(&extra); err != ErrInvalidTree {
+		t.Fatalf("got %v, want %v", err, ErrInvalidTree)
+	}
+}
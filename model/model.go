@@ -3,10 +3,13 @@ package model
 import (
 	"encoding/hex"
 	"encoding/json"
+	"math"
 	"strings"
 	"time"
 
 	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 )
 
@@ -24,6 +27,31 @@ type Block struct {
 
 	//Transactions
 	Txs []string
+	// Pruned is set once the transactions of the block have been pruned,
+	// leaving Txs empty.
+	Pruned bool
+	// AuxPow is the hex encoded merged mining proof of merged mined blocks.
+	AuxPow string `json:",omitempty"`
+}
+
+// Header returns the wire header of the block.
+func (b *Block) Header() (*wire.BlockHeader, error) {
+	prevBlock, err := chainhash.NewHashFromStr(b.PreviousBlock)
+	if err != nil {
+		return nil, err
+	}
+	merkleRoot, err := chainhash.NewHashFromStr(b.MerkleRoot)
+	if err != nil {
+		return nil, err
+	}
+	return &wire.BlockHeader{
+		Version:    b.Version,
+		PrevBlock:  *prevBlock,
+		MerkleRoot: *merkleRoot,
+		Timestamp:  b.Timestamp,
+		Bits:       b.Bits,
+		Nonce:      b.Nonce,
+	}, nil
 }
 
 type Transaction struct {
@@ -40,14 +68,24 @@ type Transaction struct {
 
 func (t *Transaction) ToWireTx() (*wire.MsgTx, error) {
 	wireTx := &wire.MsgTx{}
+	wireTx.Version = t.Version
+	wireTx.LockTime = t.LockTime
 	for _, vin := range t.Vins {
 		witnessBytes, err := vin.DecodeWitness()
 		if err != nil {
 			return nil, err
 		}
+		prevOut, err := vin.PreviousOutPoint()
+		if err != nil {
+			return nil, err
+		}
+		signatureScript, err := hex.DecodeString(vin.SignatureScript)
+		if err != nil {
+			return nil, err
+		}
 		wireTx.AddTxIn(&wire.TxIn{
-			PreviousOutPoint: wire.OutPoint{},
-			SignatureScript:  []byte(vin.SignatureScript),
+			PreviousOutPoint: *prevOut,
+			SignatureScript:  signatureScript,
 			Sequence:         vin.Sequence,
 			Witness:          witnessBytes,
 		})
@@ -68,16 +106,19 @@ func UnmarshalTxRawResult(data *btcjson.TxRawResult) (*Transaction, error) {
 		LockTime: data.LockTime,
 		Version:  int32(data.Version),
 	}
-	for _, vin := range data.Vin {
-		if len(vin.Witness) == 0 {
-			vin.Witness = []string{""}
+	for i, vin := range data.Vin {
+		signatureScript := vin.Coinbase
+		if vin.ScriptSig != nil {
+			signatureScript = vin.ScriptSig.Hex
 		}
 		tx.Vins = append(tx.Vins, Vin{
-			TxId:            vin.Txid,
-			Index:           vin.Vout,
+			TxId:            data.Txid,
+			Index:           uint32(i),
 			Sequence:        vin.Sequence,
-			SignatureScript: vin.ScriptSig.Hex,
-			Witness:         vin.Witness[0],
+			SignatureScript: signatureScript,
+			Witness:         strings.Join(vin.Witness, ","),
+			PreviousTxId:    vin.Txid,
+			PreviousIndex:   vin.Vout,
 		})
 	}
 	for _, vout := range data.Vout {
@@ -85,7 +126,7 @@ func UnmarshalTxRawResult(data *btcjson.TxRawResult) (*Transaction, error) {
 			TxId:         data.Txid,
 			Index:        uint32(vout.N),
 			ScriptPubKey: vout.ScriptPubKey.Hex,
-			Value:        int64(vout.Value),
+			Value:        int64(math.Round(vout.Value * btcutil.SatoshiPerBitcoin)),
 			Type:         vout.ScriptPubKey.Type,
 		})
 	}
@@ -98,9 +139,30 @@ type Vin struct {
 	Sequence        uint32
 	SignatureScript string
 	Witness         string
+
+	// PreviousTxId and PreviousIndex locate the output spent by this input,
+	// they are empty for coinbase inputs.
+	PreviousTxId  string
+	PreviousIndex uint32
+}
+
+// PreviousOutPoint returns the outpoint spent by the input, the null
+// outpoint for coinbase inputs.
+func (v *Vin) PreviousOutPoint() (*wire.OutPoint, error) {
+	if v.PreviousTxId == "" {
+		return wire.NewOutPoint(&chainhash.Hash{}, math.MaxUint32), nil
+	}
+	hash, err := chainhash.NewHashFromStr(v.PreviousTxId)
+	if err != nil {
+		return nil, err
+	}
+	return wire.NewOutPoint(hash, v.PreviousIndex), nil
 }
 
 func (v *Vin) DecodeWitness() ([][]byte, error) {
+	if v.Witness == "" {
+		return nil, nil
+	}
 	splits := strings.Split(v.Witness, ",")
 	var witness [][]byte
 	for _, s := range splits {
@@ -127,6 +189,52 @@ type Vout struct {
 	ScriptPubKey string
 	Value        int64
 	Type         string
+
+	// Height is the height of the block that created the output,
+	// zero for outputs of mempool transactions.
+	Height   uint64
+	Coinbase bool
+}
+
+// Outspend records the input of a mempool transaction spending an output.
+type Outspend struct {
+	TxId  string
+	Index uint32
+}
+
+func (o *Outspend) Marshal() ([]byte, error) {
+	return json.Marshal(o)
+}
+
+func UnmarshalOutspend(data []byte) (*Outspend, error) {
+	outspend := &Outspend{}
+	err := json.Unmarshal(data, outspend)
+	if err != nil {
+		return nil, err
+	}
+	return outspend, nil
+}
+
+// UTXOSetInfo holds the statistics of the confirmed UTXO set.
+type UTXOSetInfo struct {
+	TxOuts      uint64
+	TotalAmount int64
+	ScriptTypes map[string]uint64
+	// MuHash is the serialized rolling MuHash3072 state of the set
+	MuHash []byte
+}
+
+func (u *UTXOSetInfo) Marshal() ([]byte, error) {
+	return json.Marshal(u)
+}
+
+func UnmarshalUTXOSetInfo(data []byte) (*UTXOSetInfo, error) {
+	info := &UTXOSetInfo{}
+	err := json.Unmarshal(data, info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
 }
 
 func UnmarshalBlock(data []byte) (*Block, error) {
@@ -182,3 +290,310 @@ func UnmarshalTransaction(data []byte) (*Transaction, error) {
 	}
 	return tx, nil
 }
+
+// OpReturn is a nulldata output indexed by its pushed payload.
+type OpReturn struct {
+	TxId      string
+	Index     uint32
+	Payload   string
+	Height    uint64
+	BlockHash string
+}
+
+func (o *OpReturn) Marshal() ([]byte, error) {
+	return json.Marshal(o)
+}
+
+func UnmarshalOpReturn(data []byte) (*OpReturn, error) {
+	opReturn := &OpReturn{}
+	err := json.Unmarshal(data, opReturn)
+	if err != nil {
+		return nil, err
+	}
+	return opReturn, nil
+}
+
+// BlockStats are the per block statistics served by get_block_stats.
+// Feerates are in satoshis per virtual byte and amounts in satoshis.
+type BlockStats struct {
+	Height    uint64    `json:"height"`
+	BlockHash string    `json:"blockhash"`
+	Time      time.Time `json:"time"`
+
+	Txs      int   `json:"txs"`
+	Ins      int   `json:"ins"`
+	Outs     int   `json:"outs"`
+	TotalOut int64 `json:"total_out"`
+
+	TotalSize   int `json:"total_size"`
+	TotalWeight int `json:"total_weight"`
+
+	TotalFee           int64    `json:"totalfee"`
+	AvgFee             int64    `json:"avgfee"`
+	AvgFeeRate         int64    `json:"avgfeerate"`
+	MinFeeRate         int64    `json:"minfeerate"`
+	MaxFeeRate         int64    `json:"maxfeerate"`
+	MedianFeeRate      int64    `json:"medianfeerate"`
+	FeeRatePercentiles [5]int64 `json:"feerate_percentiles"`
+	// UnresolvedTxs counts the transactions left out of the fee statistics
+	// because some of their prevouts could not be found.
+	UnresolvedTxs int `json:"unresolved_txs"`
+
+	SegwitTxs    int     `json:"swtxs"`
+	SegwitShare  float64 `json:"swtxs_share"`
+	TaprootTxs   int     `json:"taproot_txs"`
+	TaprootShare float64 `json:"taproot_txs_share"`
+
+	Subsidy int64 `json:"subsidy"`
+}
+
+func (b *BlockStats) Marshal() ([]byte, error) {
+	return json.Marshal(b)
+}
+
+func UnmarshalBlockStats(data []byte) (*BlockStats, error) {
+	stats := &BlockStats{}
+	err := json.Unmarshal(data, stats)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Wallet is a named watch-only wallet. Its addresses are stored separately
+// as WalletAddress entries.
+type Wallet struct {
+	Name        string             `json:"name"`
+	Descriptors []WalletDescriptor `json:"descriptors"`
+	CreatedAt   time.Time          `json:"created_at"`
+}
+
+// WalletDescriptor is an output descriptor imported in a wallet. NextIndex is
+// the first unused address index of every branch and Derived the number of
+// addresses derived and watched so far. Label is given to every derived
+// address.
+type WalletDescriptor struct {
+	Descriptor string   `json:"descriptor"`
+	GapLimit   uint32   `json:"gap_limit"`
+	Label      string   `json:"label"`
+	NextIndex  []uint32 `json:"next_index"`
+	Derived    []uint32 `json:"derived"`
+}
+
+func (w *Wallet) Marshal() ([]byte, error) {
+	return json.Marshal(w)
+}
+
+func UnmarshalWallet(data []byte) (*Wallet, error) {
+	wallet := &Wallet{}
+	err := json.Unmarshal(data, wallet)
+	if err != nil {
+		return nil, err
+	}
+	return wallet, nil
+}
+
+// WalletAddress is an address watched by a wallet. Descriptor is the index
+// of the descriptor it was derived from, or -1 for imported addresses.
+type WalletAddress struct {
+	Wallet       string `json:"wallet"`
+	Address      string `json:"address"`
+	ScriptPubKey string `json:"script_pubkey"`
+	Label        string `json:"label"`
+	Descriptor   int    `json:"descriptor"`
+	Branch       int    `json:"branch"`
+	Index        uint32 `json:"index"`
+}
+
+func (w *WalletAddress) Marshal() ([]byte, error) {
+	return json.Marshal(w)
+}
+
+func UnmarshalWalletAddress(data []byte) (*WalletAddress, error) {
+	addr := &WalletAddress{}
+	err := json.Unmarshal(data, addr)
+	if err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+// WalletTx is a transaction touching the addresses of a wallet. Received and
+// Sent are the satoshis paid to and spent from the wallet, Height is zero
+// while the transaction is unconfirmed.
+type WalletTx struct {
+	Wallet    string   `json:"wallet"`
+	TxId      string   `json:"txid"`
+	Height    uint64   `json:"height"`
+	BlockHash string   `json:"blockhash"`
+	Received  int64    `json:"received"`
+	Sent      int64    `json:"sent"`
+	Addresses []string `json:"addresses"`
+}
+
+func (w *WalletTx) Marshal() ([]byte, error) {
+	return json.Marshal(w)
+}
+
+func UnmarshalWalletTx(data []byte) (*WalletTx, error) {
+	tx := &WalletTx{}
+	err := json.Unmarshal(data, tx)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// ReindexProgress tracks a rebuild of derived indexes from the stored blocks.
+// NextHeight is the next block to replay and LastHash the hash of the block
+// below it when it was replayed.
+type ReindexProgress struct {
+	Indexes      []string  `json:"indexes"`
+	NextHeight   uint64    `json:"next_height"`
+	LastHash     string    `json:"last_hash,omitempty"`
+	TargetHeight uint64    `json:"target_height"`
+	Running      bool      `json:"running"`
+	Done         bool      `json:"done"`
+	Error        string    `json:"error,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+func (r *ReindexProgress) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func UnmarshalReindexProgress(data []byte) (*ReindexProgress, error) {
+	progress := &ReindexProgress{}
+	err := json.Unmarshal(data, progress)
+	if err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+// ReorgProgress records a reorganization of the main chain while it is
+// applied, so one interrupted by a crash is finished on restart. Disconnect
+// holds the main chain blocks above Ancestor and Connect the side chain
+// blocks replacing them, both from the lowest up.
+type ReorgProgress struct {
+	Ancestor       string   `json:"ancestor"`
+	AncestorHeight uint64   `json:"ancestor_height"`
+	Disconnect     []string `json:"disconnect"`
+	Connect        []string `json:"connect"`
+}
+
+func (r *ReorgProgress) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func UnmarshalReorgProgress(data []byte) (*ReorgProgress, error) {
+	progress := &ReorgProgress{}
+	err := json.Unmarshal(data, progress)
+	if err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+// SyncStatus reports how far the indexer is behind the best chain of its
+// peers.
+type SyncStatus struct {
+	IndexedHeight  uint64 `json:"indexed_height"`
+	BestPeerHeight uint64 `json:"best_peer_height"`
+	// HeadersHeight is the height of the last validated header, whose block
+	// may not be indexed yet
+	HeadersHeight uint64 `json:"headers_height"`
+	// Progress is the percentage of the best peer height indexed
+	Progress float64 `json:"progress"`
+	// BlocksPerSecond is the indexing rate over the recent windows, keyed by
+	// window
+	BlocksPerSecond map[string]float64 `json:"blocks_per_second"`
+	// ETASeconds is the estimated time left to index up to the best peer
+	// height, null when nothing is being indexed
+	ETASeconds    *float64 `json:"eta_seconds"`
+	Synced        bool     `json:"synced"`
+	MempoolSynced bool     `json:"mempool_synced"`
+	Peers         int      `json:"peers"`
+}
+
+// VerifyReport lists the inconsistencies found by a chain verification of the
+// blocks in [StartHeight, EndHeight].
+type VerifyReport struct {
+	StartHeight   uint64        `json:"start_height"`
+	EndHeight     uint64        `json:"end_height"`
+	TipHeight     uint64        `json:"tip_height"`
+	Repair        bool          `json:"repair"`
+	BlocksChecked uint64        `json:"blocks_checked"`
+	TxsChecked    uint64        `json:"txs_checked"`
+	PrunedBlocks  uint64        `json:"pruned_blocks"`
+	Issues        []VerifyIssue `json:"issues"`
+	// Repaired is the number of issues fixed in repair mode
+	Repaired  int       `json:"repaired"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+}
+
+// VerifyIssue is a single inconsistency. Hash is the block hash, or the
+// transaction id for issues about transactions and their outputs.
+type VerifyIssue struct {
+	Kind     string  `json:"kind"`
+	Height   uint64  `json:"height"`
+	Hash     string  `json:"hash,omitempty"`
+	Index    *uint32 `json:"index,omitempty"`
+	Detail   string  `json:"detail"`
+	Repaired bool    `json:"repaired"`
+}
+
+func (r *VerifyReport) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// SwapSpend is an input spending an HTLC output. Secret is only set when the
+// contract is redeemed. Height is zero while the spend is in the mempool.
+type SwapSpend struct {
+	ScriptPubKey string `json:"script_pub_key"`
+	TxId         string `json:"txid"`
+	Vin          uint32 `json:"vin"`
+	PrevTxId     string `json:"prev_txid"`
+	PrevIndex    uint32 `json:"prev_index"`
+	Kind         string `json:"kind"`
+	HashType     string `json:"hash_type,omitempty"`
+	SecretHash   string `json:"secret_hash,omitempty"`
+	Secret       string `json:"secret,omitempty"`
+	Height       uint64 `json:"height"`
+	BlockHash    string `json:"block_hash,omitempty"`
+}
+
+func (s *SwapSpend) Marshal() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+func UnmarshalSwapSpend(data []byte) (*SwapSpend, error) {
+	spend := &SwapSpend{}
+	err := json.Unmarshal(data, spend)
+	if err != nil {
+		return nil, err
+	}
+	return spend, nil
+}
+
+// TxLocation is the position of a transaction in a main chain block.
+type TxLocation struct {
+	BlockHash string
+	Height    uint64
+	Index     uint32
+}
+
+func (l *TxLocation) Marshal() ([]byte, error) {
+	return json.Marshal(l)
+}
+
+func UnmarshalTxLocation(data []byte) (*TxLocation, error) {
+	location := &TxLocation{}
+	err := json.Unmarshal(data, location)
+	if err != nil {
+		return nil, err
+	}
+	return location, nil
+}
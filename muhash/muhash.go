@@ -0,0 +1,108 @@
+// Package muhash implements the MuHash3072 rolling set hash used by bitcoind
+// for the UTXO set commitment reported by gettxoutsetinfo.
+package muhash
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/big"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+const byteSize = 384
+
+// prime is the MuHash3072 modulus 2^3072 - 1103717.
+var prime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 3072), big.NewInt(1103717))
+
+var ErrInvalidState = errors.New("muhash: invalid serialized state")
+
+// MuHash keeps the running product of inserted elements and the running
+// product of removed elements separately, so updates never need a modular
+// inverse until the digest is computed.
+type MuHash struct {
+	numerator   *big.Int
+	denominator *big.Int
+}
+
+// New returns the MuHash of the empty set.
+func New() *MuHash {
+	return &MuHash{
+		numerator:   big.NewInt(1),
+		denominator: big.NewInt(1),
+	}
+}
+
+// Insert adds data to the set.
+func (m *MuHash) Insert(data []byte) {
+	m.numerator.Mul(m.numerator, toNum3072(data))
+	m.numerator.Mod(m.numerator, prime)
+}
+
+// Remove removes data from the set.
+func (m *MuHash) Remove(data []byte) {
+	m.denominator.Mul(m.denominator, toNum3072(data))
+	m.denominator.Mod(m.denominator, prime)
+}
+
+// Combine merges the elements of other into m.
+func (m *MuHash) Combine(other *MuHash) {
+	m.numerator.Mul(m.numerator, other.numerator)
+	m.numerator.Mod(m.numerator, prime)
+	m.denominator.Mul(m.denominator, other.denominator)
+	m.denominator.Mod(m.denominator, prime)
+}
+
+// Finalize returns the 32 byte digest of the set in internal byte order.
+// Callers displaying it like bitcoind should reverse it.
+func (m *MuHash) Finalize() [32]byte {
+	inverse := new(big.Int).ModInverse(m.denominator, prime)
+	result := new(big.Int).Mul(m.numerator, inverse)
+	result.Mod(result, prime)
+
+	// serialized as a little endian 3072 bit number
+	be := result.FillBytes(make([]byte, byteSize))
+	le := make([]byte, byteSize)
+	for i := range be {
+		le[i] = be[byteSize-1-i]
+	}
+	return sha256.Sum256(le)
+}
+
+// Serialize returns the numerator and denominator so the state can be
+// persisted and restored with Deserialize.
+func (m *MuHash) Serialize() []byte {
+	data := make([]byte, 2*byteSize)
+	m.numerator.FillBytes(data[:byteSize])
+	m.denominator.FillBytes(data[byteSize:])
+	return data
+}
+
+func Deserialize(data []byte) (*MuHash, error) {
+	if len(data) != 2*byteSize {
+		return nil, ErrInvalidState
+	}
+	return &MuHash{
+		numerator:   new(big.Int).SetBytes(data[:byteSize]),
+		denominator: new(big.Int).SetBytes(data[byteSize:]),
+	}, nil
+}
+
+// toNum3072 maps data to a 3072 bit number by expanding its sha256 hash with
+// the ChaCha20 keystream, read as a little endian integer.
+func toNum3072(data []byte) *big.Int {
+	hash := sha256.Sum256(data)
+	cipher, err := chacha20.NewUnauthenticatedCipher(hash[:], make([]byte, chacha20.NonceSize))
+	if err != nil {
+		// the key and nonce sizes are fixed, this can not happen
+		panic(err)
+	}
+	stream := make([]byte, byteSize)
+	cipher.XORKeyStream(stream, stream)
+
+	be := make([]byte, byteSize)
+	for i := range stream {
+		be[i] = stream[byteSize-1-i]
+	}
+	return new(big.Int).SetBytes(be)
+}
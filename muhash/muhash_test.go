@@ -0,0 +1,64 @@
+package muhash_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/catalogfi/indexer/muhash"
+)
+
+func element(i byte) []byte {
+	data := make([]byte, 32)
+	data[0] = i
+	return data
+}
+
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[i] = b[len(b)-1-i]
+	}
+	return r
+}
+
+// vector from bitcoind's crypto_tests.cpp
+func TestMuHash(t *testing.T) {
+	m := muhash.New()
+	m.Insert(element(0))
+	m.Insert(element(1))
+	m.Remove(element(2))
+	digest := m.Finalize()
+	got := hex.EncodeToString(reverse(digest[:]))
+	want := "10d312b100cbd32ada024a6646e40d3482fcff103668d2625f10002a607d5863"
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+
+	t.Run("should be order independent", func(t *testing.T) {
+		a := muhash.New()
+		a.Insert(element(1))
+		a.Insert(element(2))
+		a.Insert(element(3))
+		a.Remove(element(2))
+
+		b := muhash.New()
+		b.Insert(element(3))
+		b.Insert(element(1))
+
+		da, db := a.Finalize(), b.Finalize()
+		if !bytes.Equal(da[:], db[:]) {
+			t.Fatal("expected equal digests")
+		}
+	})
+
+	t.Run("should survive serialization", func(t *testing.T) {
+		restored, err := muhash.Deserialize(m.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored.Finalize() != digest {
+			t.Fatal("digest changed after serialization")
+		}
+	})
+}
@@ -0,0 +1,223 @@
+package netsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/consensus"
+)
+
+const (
+	messageHeaderSize = 24
+	// maxAuxPows bounds the AuxPoWs kept for blocks and headers not
+	// processed yet
+	maxAuxPows = 2 * wire.MaxBlockHeadersPerMsg
+)
+
+// auxPowConn decodes the block and headers messages of merged mined chains,
+// which btcd can not decode, read from a connection. It strips the AuxPoW
+// following the merged mined headers from the messages handed to btcd and
+// keeps it until taken with the header hash.
+type auxPowConn struct {
+	net.Conn
+	// buf holds the rewritten messages not read yet
+	buf bytes.Buffer
+
+	mu      sync.Mutex
+	auxPows map[chainhash.Hash]*consensus.AuxPow
+	order   []chainhash.Hash
+}
+
+func newAuxPowConn(conn net.Conn) *auxPowConn {
+	return &auxPowConn{
+		Conn:    conn,
+		auxPows: make(map[chainhash.Hash]*consensus.AuxPow),
+	}
+}
+
+func (c *auxPowConn) Read(b []byte) (int, error) {
+	if c.buf.Len() == 0 {
+		if err := c.readMessage(); err != nil {
+			return 0, err
+		}
+	}
+	return c.buf.Read(b)
+}
+
+// take returns the AuxPoW of the header with the given hash, if it was
+// merged mined, and forgets it.
+func (c *auxPowConn) take(hash chainhash.Hash) *consensus.AuxPow {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	auxPow := c.auxPows[hash]
+	delete(c.auxPows, hash)
+	return auxPow
+}
+
+func (c *auxPowConn) put(hash chainhash.Hash, auxPow *consensus.AuxPow) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.auxPows[hash]; !ok {
+		c.order = append(c.order, hash)
+	}
+	c.auxPows[hash] = auxPow
+	for len(c.order) > maxAuxPows {
+		delete(c.auxPows, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// encodeAuxPow returns the hex encoded AuxPoW stored with a merged mined
+// block, empty for the other blocks.
+func encodeAuxPow(auxPow *consensus.AuxPow) (string, error) {
+	if auxPow == nil {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	if err := auxPow.Serialize(&buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf.Bytes()), nil
+}
+
+// readMessage reads the next message into buf, without the AuxPoWs of its
+// headers.
+func (c *auxPowConn) readMessage() error {
+	var header [messageHeaderSize]byte
+	if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+		return err
+	}
+	length := binary.LittleEndian.Uint32(header[16:20])
+	if length > wire.MaxMessagePayload {
+		return fmt.Errorf("message payload of %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.Conn, payload); err != nil {
+		return err
+	}
+
+	command := string(bytes.TrimRight(header[4:16], "\x00"))
+	checksum := chainhash.DoubleHashB(payload)[:4]
+	// messages with a bad checksum are left for btcd to reject
+	if (command == wire.CmdBlock || command == wire.CmdHeaders) && bytes.Equal(checksum, header[20:24]) {
+		stripped := bytes.NewBuffer(make([]byte, 0, len(payload)))
+		var err error
+		if command == wire.CmdBlock {
+			err = c.stripBlock(bytes.NewReader(payload), stripped)
+		} else {
+			err = c.stripHeaders(bytes.NewReader(payload), stripped)
+		}
+		if err != nil {
+			return fmt.Errorf("decoding %s message: %w", command, err)
+		}
+		payload = stripped.Bytes()
+		binary.LittleEndian.PutUint32(header[16:20], uint32(len(payload)))
+		copy(header[20:24], chainhash.DoubleHashB(payload)[:4])
+	}
+	c.buf.Write(header[:])
+	c.buf.Write(payload)
+	return nil
+}
+
+func (c *auxPowConn) stripBlock(r *bytes.Reader, w *bytes.Buffer) error {
+	if err := c.stripHeader(r, w); err != nil {
+		return err
+	}
+	// the transactions are left as they are
+	_, err := r.WriteTo(w)
+	return err
+}
+
+func (c *auxPowConn) stripHeaders(r *bytes.Reader, w *bytes.Buffer) error {
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return err
+	}
+	if count > wire.MaxBlockHeadersPerMsg {
+		return fmt.Errorf("%d headers", count)
+	}
+	if err := wire.WriteVarInt(w, 0, count); err != nil {
+		return err
+	}
+	for i := uint64(0); i < count; i++ {
+		if err := c.stripHeader(r, w); err != nil {
+			return err
+		}
+		// the transaction count, always zero
+		txCount, err := wire.ReadVarInt(r, 0)
+		if err != nil {
+			return err
+		}
+		if err := wire.WriteVarInt(w, 0, txCount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stripHeader copies a header and keeps the AuxPoW following it, if any.
+func (c *auxPowConn) stripHeader(r *bytes.Reader, w *bytes.Buffer) error {
+	header, auxPow, err := readAuxPowHeader(r)
+	if err != nil {
+		return err
+	}
+	if err := header.Serialize(w); err != nil {
+		return err
+	}
+	if auxPow != nil {
+		c.put(header.BlockHash(), auxPow)
+	}
+	return nil
+}
+
+// readAuxPowHeader reads a header of a merged mined chain and the AuxPoW
+// following it, nil if the header is not merged mined.
+func readAuxPowHeader(r io.Reader) (*wire.BlockHeader, *consensus.AuxPow, error) {
+	header := &wire.BlockHeader{}
+	if err := header.Deserialize(r); err != nil {
+		return nil, nil, err
+	}
+	if header.Version&consensus.AuxPowVersion == 0 {
+		return header, nil, nil
+	}
+	auxPow := &consensus.AuxPow{}
+	if err := auxPow.Deserialize(r); err != nil {
+		return nil, nil, fmt.Errorf("AuxPoW of %s: %w", header.BlockHash(), err)
+	}
+	return header, auxPow, nil
+}
+
+// decodeAuxPowBlock decodes a block of a merged mined chain, returning its
+// AuxPoW apart.
+func decodeAuxPowBlock(data []byte) (*wire.MsgBlock, *consensus.AuxPow, error) {
+	r := bytes.NewReader(data)
+	header, auxPow, err := readAuxPowHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	block := &wire.MsgBlock{Header: *header}
+	txCount, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	// every transaction takes more than a byte
+	if txCount > uint64(r.Len()) {
+		return nil, nil, fmt.Errorf("%d transactions in %d bytes", txCount, r.Len())
+	}
+	block.Transactions = make([]*wire.MsgTx, 0, txCount)
+	for i := uint64(0); i < txCount; i++ {
+		tx := &wire.MsgTx{}
+		if err := tx.Deserialize(r); err != nil {
+			return nil, nil, err
+		}
+		block.Transactions = append(block.Transactions, tx)
+	}
+	return block, auxPow, nil
+}
@@ -0,0 +1,107 @@
+package netsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/consensus"
+	"github.com/catalogfi/indexer/dogecoin"
+)
+
+// rawMessage frames a payload as a dogecoin mainnet message.
+func rawMessage(command string, payload []byte) []byte {
+	var header [messageHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[:4], uint32(dogecoin.MainNet))
+	copy(header[4:16], command)
+	binary.LittleEndian.PutUint32(header[16:20], uint32(len(payload)))
+	copy(header[20:24], chainhash.DoubleHashB(payload)[:4])
+	return append(header[:], payload...)
+}
+
+func testAuxPow() *consensus.AuxPow {
+	auxPow := &consensus.AuxPow{
+		CoinbaseBranch: []chainhash.Hash{{1}},
+		ChainBranch:    []chainhash.Hash{{2}, {3}},
+		ChainIndex:     2,
+		ParentHeader:   *wire.NewBlockHeader(1, &chainhash.Hash{4}, &chainhash.Hash{5}, 0x1e0fffff, 6),
+	}
+	auxPow.CoinbaseTx.Version = 1
+	auxPow.CoinbaseTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), []byte{1, 2, 3}, nil))
+	auxPow.CoinbaseTx.AddTxOut(wire.NewTxOut(50, []byte{0x51}))
+	return auxPow
+}
+
+func TestAuxPowConnStripsAuxPow(t *testing.T) {
+	mergedMined := wire.NewBlockHeader(0x620104, &chainhash.Hash{7}, &chainhash.Hash{8}, 0x1e0fffff, 9)
+	plain := wire.NewBlockHeader(0x620004, &chainhash.Hash{10}, &chainhash.Hash{11}, 0x1e0fffff, 12)
+	auxPow := testAuxPow()
+	var encodedAuxPow bytes.Buffer
+	if err := auxPow.Serialize(&encodedAuxPow); err != nil {
+		t.Fatal(err)
+	}
+
+	// a headers message with both headers, then a merged mined block
+	var headers bytes.Buffer
+	_ = wire.WriteVarInt(&headers, 0, 2)
+	_ = mergedMined.Serialize(&headers)
+	headers.Write(encodedAuxPow.Bytes())
+	_ = wire.WriteVarInt(&headers, 0, 0)
+	_ = plain.Serialize(&headers)
+	_ = wire.WriteVarInt(&headers, 0, 0)
+
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), []byte{4}, nil))
+	tx.AddTxOut(wire.NewTxOut(10, []byte{0x51}))
+	var block bytes.Buffer
+	_ = mergedMined.Serialize(&block)
+	block.Write(encodedAuxPow.Bytes())
+	_ = wire.WriteVarInt(&block, 0, 1)
+	_ = tx.Serialize(&block)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		_, _ = server.Write(rawMessage(wire.CmdHeaders, headers.Bytes()))
+		_, _ = server.Write(rawMessage(wire.CmdBlock, block.Bytes()))
+	}()
+	conn := newAuxPowConn(client)
+
+	_, msg, _, err := wire.ReadMessageN(conn, wire.ProtocolVersion, dogecoin.MainNet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgHeaders, ok := msg.(*wire.MsgHeaders)
+	if !ok || len(msgHeaders.Headers) != 2 {
+		t.Fatalf("unexpected headers message %#v", msg)
+	}
+	if msgHeaders.Headers[0].BlockHash() != mergedMined.BlockHash() || msgHeaders.Headers[1].BlockHash() != plain.BlockHash() {
+		t.Fatal("headers changed")
+	}
+	if conn.take(plain.BlockHash()) != nil {
+		t.Fatal("AuxPoW for a header that is not merged mined")
+	}
+	if conn.take(mergedMined.BlockHash()) == nil {
+		t.Fatal("AuxPoW of the merged mined header not kept")
+	}
+
+	_, msg, _, err = wire.ReadMessageN(conn, wire.ProtocolVersion, dogecoin.MainNet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgBlock, ok := msg.(*wire.MsgBlock)
+	if !ok || msgBlock.BlockHash() != mergedMined.BlockHash() || len(msgBlock.Transactions) != 1 || msgBlock.Transactions[0].TxHash() != tx.TxHash() {
+		t.Fatalf("unexpected block message %#v", msg)
+	}
+	encoded, err := encodeAuxPow(conn.take(mergedMined.BlockHash()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, _ := hex.DecodeString(encoded); !bytes.Equal(decoded, encodedAuxPow.Bytes()) {
+		t.Fatal("AuxPoW of the block changed")
+	}
+}
@@ -0,0 +1,312 @@
+package netsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/consensus"
+	"go.uber.org/zap"
+)
+
+// blkRecordHeaderSize is the size of the network magic and block size
+// preceding every block in the blk files.
+const blkRecordHeaderSize = 8
+
+// blkBlock locates a block in the blk files of a node.
+type blkBlock struct {
+	hash chainhash.Hash
+	prev chainhash.Hash
+	file int
+	// offset is the position of the serialized block in its file
+	offset int64
+	size   uint32
+}
+
+// blkFiles reads the blk files of a node, deobfuscated with the key of its
+// xor.dat if it has one. A single file is kept open, as the blocks are mostly
+// read in file order.
+type blkFiles struct {
+	paths []string
+	key   []byte
+
+	current int
+	file    *os.File
+}
+
+func openBlkFiles(dir string) (*blkFiles, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "blk*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	// the files are numbered with leading zeros
+	sort.Strings(paths)
+	key, err := readXorKey(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &blkFiles{paths: paths, key: key, current: -1}, nil
+}
+
+// readXorKey returns the key bitcoind obfuscates its blk files with, nil if
+// they are not obfuscated.
+func readXorKey(dir string) ([]byte, error) {
+	key, err := os.ReadFile(filepath.Join(dir, "xor.dat"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 8 {
+		return nil, fmt.Errorf("xor.dat holds %d bytes instead of 8", len(key))
+	}
+	if bytes.Equal(key, make([]byte, len(key))) {
+		return nil, nil
+	}
+	return key, nil
+}
+
+// open returns the ith file and its size.
+func (f *blkFiles) open(i int) (*os.File, int64, error) {
+	if f.current != i {
+		if err := f.Close(); err != nil {
+			return nil, 0, err
+		}
+		file, err := os.Open(f.paths[i])
+		if err != nil {
+			return nil, 0, err
+		}
+		f.file = file
+		f.current = i
+	}
+	info, err := f.file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	return f.file, info.Size(), nil
+}
+
+func (f *blkFiles) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	f.current = -1
+	return err
+}
+
+// readAt reads len(p) bytes of the ith file at off.
+func (f *blkFiles) readAt(i int, p []byte, off int64) error {
+	file, _, err := f.open(i)
+	if err != nil {
+		return err
+	}
+	if _, err := file.ReadAt(p, off); err != nil {
+		return err
+	}
+	if len(f.key) > 0 {
+		for j := range p {
+			p[j] ^= f.key[(off+int64(j))%int64(len(f.key))]
+		}
+	}
+	return nil
+}
+
+// scan locates the blocks of the ith file from their headers, in file order.
+// It stops at the zeros the node preallocates files with and at a block cut
+// short by a crash of the node.
+func (f *blkFiles) scan(i int, magic wire.BitcoinNet) ([]*blkBlock, error) {
+	_, size, err := f.open(i)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([]*blkBlock, 0)
+	record := make([]byte, blkRecordHeaderSize+wire.MaxBlockHeaderPayload)
+	for offset := int64(0); offset+int64(len(record)) <= size; {
+		if err := f.readAt(i, record, offset); err != nil {
+			return nil, err
+		}
+		netMagic := binary.LittleEndian.Uint32(record[:4])
+		if netMagic == 0 {
+			break
+		}
+		if wire.BitcoinNet(netMagic) != magic {
+			return nil, fmt.Errorf("%s: network magic %08x at %d, expected %08x", f.paths[i], netMagic, offset, uint32(magic))
+		}
+		blockSize := binary.LittleEndian.Uint32(record[4:8])
+		if blockSize < wire.MaxBlockHeaderPayload || blockSize > wire.MaxMessagePayload {
+			return nil, fmt.Errorf("%s: block of %d bytes at %d", f.paths[i], blockSize, offset)
+		}
+		offset += blkRecordHeaderSize
+		if offset+int64(blockSize) > size {
+			break
+		}
+
+		var header wire.BlockHeader
+		if err := header.Deserialize(bytes.NewReader(record[blkRecordHeaderSize:])); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, &blkBlock{
+			hash:   header.BlockHash(),
+			prev:   header.PrevBlock,
+			file:   i,
+			offset: offset,
+			size:   blockSize,
+		})
+		offset += int64(blockSize)
+	}
+	return blocks, nil
+}
+
+// ImportBlkFiles indexes the blocks of the blk*.dat files of a bitcoind or
+// dogecoind, found in its blocks directory. The node writes the blocks as it
+// downloads them, out of order, so they are located by their headers first
+// and put from parents to children, through the same checks and fork choice
+// as the blocks of the peers. Blocks already indexed are skipped, so an
+// interrupted import resumes where it stopped.
+func (s *SyncManager) ImportBlkFiles(ctx context.Context, dir string) error {
+	if err := s.checkForGensisBlock(); err != nil {
+		return err
+	}
+	if err := s.resumeReorg(); err != nil {
+		return err
+	}
+	files, err := openBlkFiles(dir)
+	if err != nil {
+		return err
+	}
+	defer files.Close()
+	if len(files.paths) == 0 {
+		return fmt.Errorf("no blk files in %s", dir)
+	}
+
+	// located keeps the first copy of the blocks the node wrote twice
+	located := make(map[chainhash.Hash]*blkBlock)
+	children := make(map[chainhash.Hash][]*blkBlock)
+	blocks := make([]*blkBlock, 0)
+	for i := range files.paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fileBlocks, err := files.scan(i, s.chainParams.Net)
+		if err != nil {
+			return err
+		}
+		for _, block := range fileBlocks {
+			if _, ok := located[block.hash]; ok {
+				continue
+			}
+			located[block.hash] = block
+			children[block.prev] = append(children[block.prev], block)
+			blocks = append(blocks, block)
+		}
+	}
+	s.logger.Info("located blocks", zap.Int("files", len(files.paths)), zap.Int("blocks", len(blocks)))
+
+	// the blocks whose parent is not in the files start the chains, which
+	// are put if they connect to the blocks we have
+	queue := make([]*blkBlock, 0)
+	unconnected := 0
+	for _, block := range blocks {
+		if _, ok := located[block.prev]; ok {
+			continue
+		}
+		connects, err := s.knownBlock(block.prev)
+		if err != nil {
+			return err
+		}
+		if !connects {
+			if connects, err = s.knownBlock(block.hash); err != nil {
+				return err
+			}
+		}
+		if !connects {
+			unconnected++
+			continue
+		}
+		queue = append(queue, block)
+	}
+
+	_, mergedMining := s.rules.(consensus.MergedMiningRules)
+	put, skipped, invalid := 0, 0, 0
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		block := queue[0]
+		queue = queue[1:]
+
+		exists, err := s.store.BlockExists(block.hash.String())
+		if err != nil {
+			return err
+		}
+		if exists {
+			skipped++
+			queue = append(queue, children[block.hash]...)
+			continue
+		}
+		msgBlock, auxPow, err := files.read(block, mergedMining)
+		if err != nil {
+			return err
+		}
+		if err := s.PutBlock(msgBlock, auxPow); err != nil {
+			if !errors.Is(err, consensus.ErrInvalidHeader) {
+				return fmt.Errorf("block %s: %w", block.hash, err)
+			}
+			// the descendants of an invalid block are invalid too
+			s.logger.Warn("invalid block in the blk files", zap.String("hash", block.hash.String()), zap.Error(err))
+			invalid++
+			continue
+		}
+		put++
+		queue = append(queue, children[block.hash]...)
+	}
+
+	s.logger.Info("imported blk files",
+		zap.Int("put", put),
+		zap.Int("skipped", skipped),
+		zap.Int("invalid", invalid),
+		zap.Int("unconnected", unconnected),
+		zap.Uint64("height", s.latestHeight))
+	return nil
+}
+
+// knownBlock tells whether the block is in the main chain or among the
+// orphans.
+func (s *SyncManager) knownBlock(hash chainhash.Hash) (bool, error) {
+	_, exists, err := blockChain{s.store}.GetBlock(hash.String())
+	return exists, err
+}
+
+// read decodes a located block, with its AuxPoW if the chain is merged mined.
+func (f *blkFiles) read(block *blkBlock, mergedMining bool) (*wire.MsgBlock, *consensus.AuxPow, error) {
+	data := make([]byte, block.size)
+	if err := f.readAt(block.file, data, block.offset); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, fmt.Errorf("reading block %s: %w", block.hash, err)
+	}
+	if mergedMining {
+		msgBlock, auxPow, err := decodeAuxPowBlock(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding block %s: %w", block.hash, err)
+		}
+		return msgBlock, auxPow, nil
+	}
+	msgBlock := &wire.MsgBlock{}
+	if err := msgBlock.Deserialize(bytes.NewReader(data)); err != nil {
+		return nil, nil, fmt.Errorf("decoding block %s: %w", block.hash, err)
+	}
+	return msgBlock, nil, nil
+}
@@ -0,0 +1,148 @@
+package netsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// writeBlkFile writes the blocks as a node does, each after the network magic
+// and its size, followed by tail, and obfuscates the file with key if set.
+func writeBlkFile(t *testing.T, path string, net wire.BitcoinNet, blocks []*wire.MsgBlock, tail []byte, key []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, block := range blocks {
+		var record [blkRecordHeaderSize]byte
+		binary.LittleEndian.PutUint32(record[:4], uint32(net))
+		binary.LittleEndian.PutUint32(record[4:], uint32(block.SerializeSize()))
+		buf.Write(record[:])
+		if err := block.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.Write(tail)
+	data := buf.Bytes()
+	for i := range data {
+		if len(key) > 0 {
+			data[i] ^= key[i%len(key)]
+		}
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportBlkFiles(t *testing.T) {
+	params := chaincfg.RegressionNetParams
+	genesis := params.GenesisBlock
+	common := buildBranch(t, genesis, 1, 3, 'c', params.PowLimitBits, false)
+	main := buildBranch(t, common[2], 4, 3, 'a', params.PowLimitBits, true)
+	// a stale block the node downloaded after the main chain one
+	stale := buildBranch(t, common[2], 4, 1, 'b', params.PowLimitBits, false)
+
+	// the children come before their parents, a block is written twice, the
+	// first file is padded with zeros and the last block of the second one
+	// is cut short
+	dir := t.TempDir()
+	writeBlkFile(t, filepath.Join(dir, "blk00000.dat"), params.Net,
+		[]*wire.MsgBlock{genesis, common[0], common[2], common[1], main[0]}, make([]byte, 1000), nil)
+	var truncated bytes.Buffer
+	if err := main[2].Serialize(&truncated); err != nil {
+		t.Fatal(err)
+	}
+	var record [blkRecordHeaderSize]byte
+	binary.LittleEndian.PutUint32(record[:4], uint32(params.Net))
+	binary.LittleEndian.PutUint32(record[4:], uint32(truncated.Len()))
+	writeBlkFile(t, filepath.Join(dir, "blk00001.dat"), params.Net,
+		[]*wire.MsgBlock{stale[0], main[2], main[1], main[0]}, append(record[:], truncated.Bytes()[:100]...), nil)
+
+	s := newTestSyncManager(t)
+	if err := s.ImportBlkFiles(context.Background(), dir); err != nil {
+		t.Fatal(err)
+	}
+	assertTip(t, s, main[2], 6)
+	expected := newTestSyncManager(t)
+	putBlocks(t, expected, common)
+	putBlocks(t, expected, main)
+	assertSameIndexes(t, s, expected, append(common, main...), stale)
+
+	// importing again finds every block indexed
+	if err := s.ImportBlkFiles(context.Background(), dir); err != nil {
+		t.Fatal(err)
+	}
+	assertTip(t, s, main[2], 6)
+}
+
+func TestImportBlkFilesObfuscated(t *testing.T) {
+	params := chaincfg.RegressionNetParams
+	blocks := buildBranch(t, params.GenesisBlock, 1, 3, 'c', params.PowLimitBits, false)
+	key := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "xor.dat"), key, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeBlkFile(t, filepath.Join(dir, "blk00000.dat"), params.Net, append([]*wire.MsgBlock{params.GenesisBlock}, blocks...), nil, key)
+
+	s := newTestSyncManager(t)
+	if err := s.ImportBlkFiles(context.Background(), dir); err != nil {
+		t.Fatal(err)
+	}
+	assertTip(t, s, blocks[2], 3)
+}
+
+func TestImportBlkFilesOtherNetwork(t *testing.T) {
+	params := chaincfg.RegressionNetParams
+	blocks := buildBranch(t, params.GenesisBlock, 1, 2, 'c', params.PowLimitBits, false)
+	dir := t.TempDir()
+	writeBlkFile(t, filepath.Join(dir, "blk00000.dat"), chaincfg.MainNetParams.Net, blocks, nil, nil)
+
+	s := newTestSyncManager(t)
+	err := s.ImportBlkFiles(context.Background(), dir)
+	if err == nil || !strings.Contains(err.Error(), "network magic") {
+		t.Fatalf("expected a network magic error, got %v", err)
+	}
+	assertTip(t, s, params.GenesisBlock, 0)
+}
+
+func TestDecodeAuxPowBlock(t *testing.T) {
+	header := wire.NewBlockHeader(0x620104, &chainhash.Hash{7}, &chainhash.Hash{8}, 0x1e0fffff, 9)
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), []byte{4}, nil))
+	tx.AddTxOut(wire.NewTxOut(10, []byte{0x51}))
+	var data bytes.Buffer
+	_ = header.Serialize(&data)
+	if err := testAuxPow().Serialize(&data); err != nil {
+		t.Fatal(err)
+	}
+	_ = wire.WriteVarInt(&data, 0, 1)
+	_ = tx.Serialize(&data)
+
+	block, auxPow, err := decodeAuxPowBlock(data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.BlockHash() != header.BlockHash() || len(block.Transactions) != 1 || block.Transactions[0].TxHash() != tx.TxHash() {
+		t.Fatalf("unexpected block %#v", block)
+	}
+	if auxPow == nil || auxPow.ChainIndex != 2 {
+		t.Fatalf("unexpected AuxPoW %#v", auxPow)
+	}
+
+	// a plain block has no AuxPoW
+	header.Version = 0x620004
+	data.Reset()
+	_ = header.Serialize(&data)
+	_ = wire.WriteVarInt(&data, 0, 1)
+	_ = tx.Serialize(&data)
+	if _, auxPow, err := decodeAuxPowBlock(data.Bytes()); err != nil || auxPow != nil {
+		t.Fatalf("expected a block without AuxPoW, got %v, %v", auxPow, err)
+	}
+}
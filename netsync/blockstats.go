@@ -0,0 +1,142 @@
+package netsync
+
+import (
+	"sort"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/utils"
+)
+
+// feeRatePercentiles are the weight percentiles reported in
+// BlockStats.FeeRatePercentiles, the same ones bitcoind reports.
+var feeRatePercentiles = [5]float64{0.10, 0.25, 0.50, 0.75, 0.90}
+
+type weightedFeeRate struct {
+	feeRate int64
+	weight  int
+}
+
+// computeBlockStats calculates the statistics of block. prevouts holds the
+// outputs spent by the block, keyed by outpoint; transactions with missing
+// prevouts are left out of the fee statistics.
+func computeBlockStats(block *wire.MsgBlock, height uint64, prevouts map[wire.OutPoint]*model.Vout, chainParams *chaincfg.Params) *model.BlockStats {
+	stats := &model.BlockStats{
+		Height:    height,
+		BlockHash: block.BlockHash().String(),
+		Time:      block.Header.Timestamp,
+		Txs:       len(block.Transactions),
+		Subsidy:   blockchain.CalcBlockSubsidy(int32(height), chainParams),
+	}
+
+	feeRates := make([]weightedFeeRate, 0, len(block.Transactions))
+	feeWeight := 0
+	for _, tx := range block.Transactions {
+		size := tx.SerializeSize()
+		weight := size + (blockchain.WitnessScaleFactor-1)*tx.SerializeSizeStripped()
+		stats.TotalSize += size
+		stats.TotalWeight += weight
+		stats.Outs += len(tx.TxOut)
+
+		totalOut := int64(0)
+		for _, txOut := range tx.TxOut {
+			totalOut += txOut.Value
+		}
+		stats.TotalOut += totalOut
+
+		if utils.IsCoinbase(tx) {
+			continue
+		}
+		stats.Ins += len(tx.TxIn)
+		if tx.HasWitness() {
+			stats.SegwitTxs++
+		}
+
+		totalIn := int64(0)
+		resolved := true
+		spendsTaproot := false
+		for _, txIn := range tx.TxIn {
+			prevout, ok := prevouts[txIn.PreviousOutPoint]
+			if !ok || prevout == nil {
+				resolved = false
+				continue
+			}
+			totalIn += prevout.Value
+			if prevout.Type == txscript.WitnessV1TaprootTy.String() {
+				spendsTaproot = true
+			}
+		}
+		if spendsTaproot {
+			stats.TaprootTxs++
+		}
+		if !resolved {
+			stats.UnresolvedTxs++
+			continue
+		}
+
+		fee := totalIn - totalOut
+		stats.TotalFee += fee
+		feeWeight += weight
+		feeRates = append(feeRates, weightedFeeRate{
+			feeRate: fee * blockchain.WitnessScaleFactor / int64(weight),
+			weight:  weight,
+		})
+	}
+
+	if stats.Txs > 1 {
+		stats.SegwitShare = float64(stats.SegwitTxs) / float64(stats.Txs-1)
+		stats.TaprootShare = float64(stats.TaprootTxs) / float64(stats.Txs-1)
+	}
+	if len(feeRates) == 0 {
+		return stats
+	}
+
+	stats.AvgFee = stats.TotalFee / int64(len(feeRates))
+	stats.AvgFeeRate = stats.TotalFee * blockchain.WitnessScaleFactor / int64(feeWeight)
+
+	sort.Slice(feeRates, func(i, j int) bool {
+		return feeRates[i].feeRate < feeRates[j].feeRate
+	})
+	stats.MinFeeRate = feeRates[0].feeRate
+	stats.MaxFeeRate = feeRates[len(feeRates)-1].feeRate
+
+	// percentiles are weighted by transaction weight like in bitcoind
+	next := 0
+	cumulative := 0
+	for _, rate := range feeRates {
+		cumulative += rate.weight
+		for next < len(feeRatePercentiles) && float64(cumulative) >= float64(feeWeight)*feeRatePercentiles[next] {
+			stats.FeeRatePercentiles[next] = rate.feeRate
+			next++
+		}
+	}
+	for ; next < len(feeRatePercentiles); next++ {
+		stats.FeeRatePercentiles[next] = stats.MaxFeeRate
+	}
+	stats.MedianFeeRate = stats.FeeRatePercentiles[2]
+	return stats
+}
+
+// resolvePrevouts looks up the outputs spent by a block, keyed by outpoint.
+func (s *SyncManager) resolvePrevouts(hashes []string, indices []uint32) (map[wire.OutPoint]*model.Vout, error) {
+	vouts, err := s.store.GetPrevouts(hashes, indices)
+	if err != nil {
+		return nil, err
+	}
+	prevouts := make(map[wire.OutPoint]*model.Vout, len(vouts))
+	for i, vout := range vouts {
+		if vout == nil {
+			continue
+		}
+		hash, err := chainhash.NewHashFromStr(hashes[i])
+		if err != nil {
+			return nil, err
+		}
+		prevouts[*wire.NewOutPoint(hash, indices[i])] = vout
+	}
+	return prevouts, nil
+}
@@ -0,0 +1,176 @@
+package netsync
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/model"
+)
+
+// The sizes below are counted by hand: a transaction with one input and one
+// output is 4 (version) + 1 (input count) + 36 (outpoint) + 1 + len(script)
+// (signature script) + 4 (sequence) + 1 (output count) + 8 (value) + 1 +
+// len(script) (script) + 4 (lock time) bytes, and each extra output adds 10
+// bytes for a one byte script.
+
+// statsCoinbase is 65 bytes with its 4 byte signature script, 260 weight.
+func statsCoinbase(value int64) *wire.MsgTx {
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), []byte{1, 2, 3, 4}, nil))
+	tx.AddTxOut(wire.NewTxOut(value, []byte{txscript.OP_TRUE}))
+	return tx
+}
+
+var (
+	legacyPrevout = wire.OutPoint{Hash: chainhash.Hash{1}, Index: 0}
+	segwitPrevout = wire.OutPoint{Hash: chainhash.Hash{2}, Index: 1}
+)
+
+// legacyTx spends 100000 to 60000 and 30000: 71 bytes, 284 weight, a fee of
+// 10000 and a fee rate of 10000 / 71 = 140 sat/vB.
+func legacyTx() *wire.MsgTx {
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(wire.NewTxIn(&legacyPrevout, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(60000, []byte{txscript.OP_TRUE}))
+	tx.AddTxOut(wire.NewTxOut(30000, []byte{txscript.OP_TRUE}))
+	return tx
+}
+
+// segwitTx spends a taproot output of 50000 to 45000: 61 bytes stripped, 66
+// with the marker, the flag and a witness of one byte, so 66 + 3 * 61 = 249
+// weight, a fee of 5000 and a fee rate of 5000 * 4 / 249 = 80 sat/vB.
+func segwitTx() *wire.MsgTx {
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(wire.NewTxIn(&segwitPrevout, nil, wire.TxWitness{{1}}))
+	tx.AddTxOut(wire.NewTxOut(45000, []byte{txscript.OP_TRUE}))
+	return tx
+}
+
+func TestComputeBlockStats(t *testing.T) {
+	prevouts := map[wire.OutPoint]*model.Vout{
+		legacyPrevout: {Value: 100000, Type: txscript.PubKeyHashTy.String()},
+		segwitPrevout: {Value: 50000, Type: txscript.WitnessV1TaprootTy.String()},
+	}
+	tests := []struct {
+		name     string
+		height   uint64
+		txs      []*wire.MsgTx
+		prevouts map[wire.OutPoint]*model.Vout
+		expected model.BlockStats
+	}{
+		{
+			name:   "coinbase only",
+			height: 1,
+			txs:    []*wire.MsgTx{statsCoinbase(5000000000)},
+			expected: model.BlockStats{
+				Txs:         1,
+				Outs:        1,
+				TotalOut:    5000000000,
+				TotalSize:   65,
+				TotalWeight: 260,
+				Subsidy:     5000000000,
+			},
+		},
+		{
+			// the subsidy of regtest halves every 150 blocks
+			name:   "coinbase only after a halving",
+			height: 150,
+			txs:    []*wire.MsgTx{statsCoinbase(2500000000)},
+			expected: model.BlockStats{
+				Txs:         1,
+				Outs:        1,
+				TotalOut:    2500000000,
+				TotalSize:   65,
+				TotalWeight: 260,
+				Subsidy:     2500000000,
+			},
+		},
+		{
+			name:     "single fee paying transaction",
+			height:   1,
+			txs:      []*wire.MsgTx{statsCoinbase(5000010000), legacyTx()},
+			prevouts: prevouts,
+			expected: model.BlockStats{
+				Txs:                2,
+				Ins:                1,
+				Outs:               3,
+				TotalOut:           5000010000 + 90000,
+				TotalSize:          65 + 71,
+				TotalWeight:        260 + 284,
+				TotalFee:           10000,
+				AvgFee:             10000,
+				AvgFeeRate:         140,
+				MinFeeRate:         140,
+				MaxFeeRate:         140,
+				MedianFeeRate:      140,
+				FeeRatePercentiles: [5]int64{140, 140, 140, 140, 140},
+				Subsidy:            5000000000,
+			},
+		},
+		{
+			// the segwit transaction is 249 of the 533 weight paying fees,
+			// so it holds the 10th and 25th percentiles but not the median
+			name:     "segwit and taproot",
+			height:   1,
+			txs:      []*wire.MsgTx{statsCoinbase(5000015000), legacyTx(), segwitTx()},
+			prevouts: prevouts,
+			expected: model.BlockStats{
+				Txs:                3,
+				Ins:                2,
+				Outs:               4,
+				TotalOut:           5000015000 + 90000 + 45000,
+				TotalSize:          65 + 71 + 66,
+				TotalWeight:        260 + 284 + 249,
+				TotalFee:           15000,
+				AvgFee:             7500,
+				AvgFeeRate:         15000 * 4 / 533,
+				MinFeeRate:         80,
+				MaxFeeRate:         140,
+				MedianFeeRate:      140,
+				FeeRatePercentiles: [5]int64{80, 80, 140, 140, 140},
+				SegwitTxs:          1,
+				SegwitShare:        0.5,
+				TaprootTxs:         1,
+				TaprootShare:       0.5,
+				Subsidy:            5000000000,
+			},
+		},
+		{
+			name:   "unresolved prevouts",
+			height: 1,
+			txs:    []*wire.MsgTx{statsCoinbase(5000010000), legacyTx()},
+			expected: model.BlockStats{
+				Txs:           2,
+				Ins:           1,
+				Outs:          3,
+				TotalOut:      5000010000 + 90000,
+				TotalSize:     65 + 71,
+				TotalWeight:   260 + 284,
+				UnresolvedTxs: 1,
+				Subsidy:       5000000000,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			block := wire.NewMsgBlock(&chaincfg.RegressionNetParams.GenesisBlock.Header)
+			for _, tx := range test.txs {
+				if err := block.AddTransaction(tx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected := test.expected
+			expected.Height = test.height
+			expected.BlockHash = block.BlockHash().String()
+			expected.Time = block.Header.Timestamp
+
+			stats := computeBlockStats(block, test.height, test.prevouts, &chaincfg.RegressionNetParams)
+			if *stats != expected {
+				t.Fatalf("expected stats\n%+v\ngot\n%+v", expected, *stats)
+			}
+		})
+	}
+}
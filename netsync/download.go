@@ -0,0 +1,257 @@
+package netsync
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// blocksPerRequest is the number of blocks asked for in one getdata
+	blocksPerRequest = 16
+	// downloadWindow bounds how far past the next block to connect blocks
+	// are requested, and so the blocks buffered out of order
+	downloadWindow     = 1024
+	maxRequestsPerPeer = 4
+	// a peer missing blocks of a request for blockRequestTimeout is
+	// considered stalled and the request given to another peer
+	blockRequestTimeout = 30 * time.Second
+)
+
+// downloadPeer is the part of a peer the block download uses.
+type downloadPeer interface {
+	Addr() string
+	Connected() bool
+	LastBlock() int32
+	QueueMessage(msg wire.Message, doneChan chan<- struct{})
+}
+
+// blockDownload fetches the blocks of a validated header chain in parallel
+// from several peers, and connects them strictly in chain order as they
+// arrive.
+type blockDownload struct {
+	hashes      []chainhash.Hash
+	index       map[chainhash.Hash]int
+	startHeight uint64
+	connect     func(p downloadPeer, block *wire.MsgBlock) error
+	timeout     time.Duration
+
+	mu       sync.Mutex
+	received map[int]receivedBlock
+	// next is the index of the next block to connect
+	next     int
+	requests []*blockRequest
+	done     []bool
+	err      error
+	progress chan struct{}
+}
+
+type receivedBlock struct {
+	peer  downloadPeer
+	block *wire.MsgBlock
+}
+
+type blockRequest struct {
+	peer downloadPeer
+	at   time.Time
+}
+
+// newBlockDownload prepares the download of the blocks with the given hashes,
+// the first of which is at startHeight. connect is called with each block and
+// the peer it came from.
+func newBlockDownload(hashes []chainhash.Hash, startHeight uint64, connect func(p downloadPeer, block *wire.MsgBlock) error) *blockDownload {
+	index := make(map[chainhash.Hash]int, len(hashes))
+	for i, hash := range hashes {
+		index[hash] = i
+	}
+	chunks := (len(hashes) + blocksPerRequest - 1) / blocksPerRequest
+	return &blockDownload{
+		hashes:      hashes,
+		index:       index,
+		startHeight: startHeight,
+		connect:     connect,
+		timeout:     blockRequestTimeout,
+		received:    make(map[int]receivedBlock),
+		requests:    make([]*blockRequest, chunks),
+		done:        make([]bool, chunks),
+		progress:    make(chan struct{}, 1),
+	}
+}
+
+// run requests the blocks from the peers until all of them are connected,
+// connecting one fails or ctx is cancelled. Peers missing blocks past the
+// timeout are passed to stalled and their requests given to other peers.
+func (d *blockDownload) run(ctx context.Context, peers func() []downloadPeer, stalled func(p downloadPeer)) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		d.mu.Lock()
+		if d.err != nil {
+			err := d.err
+			d.mu.Unlock()
+			return err
+		}
+		if d.next == len(d.hashes) {
+			d.mu.Unlock()
+			return nil
+		}
+		stalledPeers := d.schedule(peers(), time.Now())
+		d.mu.Unlock()
+
+		for _, p := range stalledPeers {
+			stalled(p)
+		}
+		select {
+		case <-d.progress:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// schedule hands the chunks of the window that are not in flight to the
+// least loaded peers, and returns the peers whose requests timed out. It is
+// called with mu held.
+func (d *blockDownload) schedule(peers []downloadPeer, now time.Time) []downloadPeer {
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Addr() < peers[j].Addr() })
+	load := make(map[string]int, len(peers))
+	stalled := make([]downloadPeer, 0)
+	isStalled := make(map[string]bool)
+
+	first := d.next / blocksPerRequest
+	last := (d.next + downloadWindow - 1) / blocksPerRequest
+	if last >= len(d.requests) {
+		last = len(d.requests) - 1
+	}
+	pending := make([]int, 0)
+	for c := first; c <= last; c++ {
+		if d.done[c] {
+			continue
+		}
+		if len(d.missing(c)) == 0 {
+			d.done[c] = true
+			d.requests[c] = nil
+			continue
+		}
+		if req := d.requests[c]; req != nil {
+			switch {
+			case !req.peer.Connected():
+				d.requests[c] = nil
+			case now.Sub(req.at) >= d.timeout:
+				d.requests[c] = nil
+				if !isStalled[req.peer.Addr()] {
+					isStalled[req.peer.Addr()] = true
+					stalled = append(stalled, req.peer)
+				}
+			default:
+				load[req.peer.Addr()]++
+				continue
+			}
+		}
+		pending = append(pending, c)
+	}
+
+	for _, c := range pending {
+		// the peer must have the last block of the chunk
+		end := (c+1)*blocksPerRequest - 1
+		if end >= len(d.hashes) {
+			end = len(d.hashes) - 1
+		}
+		height := d.startHeight + uint64(end)
+
+		var best downloadPeer
+		for _, p := range peers {
+			if isStalled[p.Addr()] || !p.Connected() || uint64(p.LastBlock()) < height {
+				continue
+			}
+			if load[p.Addr()] >= maxRequestsPerPeer {
+				continue
+			}
+			if best == nil || load[p.Addr()] < load[best.Addr()] {
+				best = p
+			}
+		}
+		if best == nil {
+			break
+		}
+
+		getData := wire.NewMsgGetData()
+		for _, i := range d.missing(c) {
+			getData.AddInvVect(wire.NewInvVect(wire.InvTypeBlock, &d.hashes[i]))
+		}
+		best.QueueMessage(getData, nil)
+		d.requests[c] = &blockRequest{peer: best, at: now}
+		load[best.Addr()]++
+	}
+	return stalled
+}
+
+// missing returns the indexes of the blocks of the chunk neither received
+// nor connected. It is called with mu held.
+func (d *blockDownload) missing(chunk int) []int {
+	start := chunk * blocksPerRequest
+	end := start + blocksPerRequest
+	if end > len(d.hashes) {
+		end = len(d.hashes)
+	}
+	missing := make([]int, 0)
+	for i := start; i < end; i++ {
+		if i < d.next {
+			continue
+		}
+		if _, ok := d.received[i]; !ok {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// deliver buffers a block of the download and connects the blocks that are
+// next in order. It returns false for blocks that are not part of the
+// download. It must only be called from one goroutine so blocks are
+// connected in order.
+func (d *blockDownload) deliver(p downloadPeer, block *wire.MsgBlock) bool {
+	i, ok := d.index[block.BlockHash()]
+	if !ok {
+		return false
+	}
+	d.mu.Lock()
+	if i >= d.next {
+		d.received[i] = receivedBlock{peer: p, block: block}
+	}
+	d.mu.Unlock()
+
+	for {
+		d.mu.Lock()
+		next, ok := d.received[d.next]
+		if !ok || d.err != nil {
+			d.mu.Unlock()
+			break
+		}
+		d.mu.Unlock()
+
+		// the block stays buffered while it is connected, so it is not
+		// requested again
+		err := d.connect(next.peer, next.block)
+
+		d.mu.Lock()
+		delete(d.received, d.next)
+		if err != nil {
+			d.err = err
+		} else {
+			d.next++
+		}
+		d.mu.Unlock()
+	}
+
+	select {
+	case d.progress <- struct{}{}:
+	default:
+	}
+	return true
+}
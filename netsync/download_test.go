@@ -0,0 +1,224 @@
+package netsync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// testChain is a chain of empty blocks.
+type testChain struct {
+	hashes []chainhash.Hash
+	blocks map[chainhash.Hash]*wire.MsgBlock
+	height map[chainhash.Hash]int
+}
+
+func newTestChain(n int) *testChain {
+	c := &testChain{
+		blocks: make(map[chainhash.Hash]*wire.MsgBlock, n),
+		height: make(map[chainhash.Hash]int, n),
+	}
+	prev := chainhash.Hash{}
+	for i := 0; i < n; i++ {
+		block := wire.NewMsgBlock(wire.NewBlockHeader(1, &prev, &chainhash.Hash{}, 0x207fffff, uint32(i)))
+		hash := block.BlockHash()
+		c.hashes = append(c.hashes, hash)
+		c.blocks[hash] = block
+		c.height[hash] = i
+		prev = hash
+	}
+	return c
+}
+
+// simPeer serves the blocks of a testChain after a round trip latency,
+// sending them one after the other.
+type simPeer struct {
+	addr      string
+	chain     *testChain
+	latency   time.Duration
+	perBlock  time.Duration
+	stalling  bool
+	connected int32
+	blocks    chan<- *wire.MsgBlock
+	invs      chan []*wire.InvVect
+	sendMu    sync.Mutex
+}
+
+func newSimPeer(addr string, chain *testChain, latency, perBlock time.Duration, blocks chan<- *wire.MsgBlock) *simPeer {
+	return &simPeer{
+		addr:      addr,
+		chain:     chain,
+		latency:   latency,
+		perBlock:  perBlock,
+		connected: 1,
+		blocks:    blocks,
+		invs:      make(chan []*wire.InvVect, 1),
+	}
+}
+
+func (p *simPeer) Addr() string     { return p.addr }
+func (p *simPeer) Connected() bool  { return atomic.LoadInt32(&p.connected) == 1 }
+func (p *simPeer) LastBlock() int32 { return int32(len(p.chain.hashes) - 1) }
+
+func (p *simPeer) QueueMessage(msg wire.Message, doneChan chan<- struct{}) {
+	switch msg := msg.(type) {
+	case *wire.MsgGetData:
+		if p.stalling {
+			return
+		}
+		go func() {
+			time.Sleep(p.latency)
+			p.sendMu.Lock()
+			defer p.sendMu.Unlock()
+			for _, inv := range msg.InvList {
+				time.Sleep(p.perBlock)
+				p.blocks <- p.chain.blocks[inv.Hash]
+			}
+		}()
+	case *wire.MsgGetBlocks:
+		go func() {
+			time.Sleep(p.latency)
+			start := 0
+			if len(msg.BlockLocatorHashes) > 0 {
+				start = p.chain.height[*msg.BlockLocatorHashes[0]] + 1
+			}
+			invs := make([]*wire.InvVect, 0, wire.MaxBlocksPerMsg)
+			for i := start; i < len(p.chain.hashes) && len(invs) < wire.MaxBlocksPerMsg; i++ {
+				invs = append(invs, wire.NewInvVect(wire.InvTypeBlock, &p.chain.hashes[i]))
+			}
+			p.invs <- invs
+		}()
+	}
+}
+
+func TestBlockDownloadConnectsInOrder(t *testing.T) {
+	chain := newTestChain(200)
+	blocks := make(chan *wire.MsgBlock, 64)
+	peers := []downloadPeer{
+		newSimPeer("a", chain, time.Millisecond, 0, blocks),
+		newSimPeer("b", chain, 2*time.Millisecond, 0, blocks),
+		newSimPeer("c", chain, 3*time.Millisecond, 0, blocks),
+	}
+	stalling := newSimPeer("d", chain, 0, 0, blocks)
+	stalling.stalling = true
+	peers = append(peers, stalling)
+
+	connected := 0
+	download := newBlockDownload(chain.hashes, 0, func(p downloadPeer, block *wire.MsgBlock) error {
+		if block.BlockHash() != chain.hashes[connected] {
+			return fmt.Errorf("block %d connected out of order", chain.height[block.BlockHash()])
+		}
+		connected++
+		return nil
+	})
+	download.timeout = 50 * time.Millisecond
+	go func() {
+		for block := range blocks {
+			download.deliver(nil, block)
+		}
+	}()
+
+	stalled := make([]string, 0)
+	err := download.run(context.Background(), func() []downloadPeer {
+		return append([]downloadPeer{}, peers...)
+	}, func(p downloadPeer) {
+		stalled = append(stalled, p.Addr())
+		atomic.StoreInt32(&p.(*simPeer).connected, 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connected != len(chain.hashes) {
+		t.Fatalf("connected %d of %d blocks", connected, len(chain.hashes))
+	}
+	if len(stalled) != 1 || stalled[0] != "d" {
+		t.Fatalf("unexpected stalled peers %v", stalled)
+	}
+}
+
+const (
+	benchBlocks   = 2000
+	benchPeers    = 4
+	benchLatency  = 10 * time.Millisecond
+	benchPerBlock = 200 * time.Microsecond
+)
+
+// BenchmarkSyncGetBlocks measures the previous sync loop: getblocks to one
+// peer, getdata for the announced batch, then waiting for the whole batch
+// before asking for the next one.
+func BenchmarkSyncGetBlocks(b *testing.B) {
+	chain := newTestChain(benchBlocks)
+	for n := 0; n < b.N; n++ {
+		blocks := make(chan *wire.MsgBlock, wire.MaxBlocksPerMsg)
+		p := newSimPeer("a", chain, benchLatency, benchPerBlock, blocks)
+		height := 0
+		for height < benchBlocks {
+			getBlocks := wire.NewMsgGetBlocks(&chainhash.Hash{})
+			if height > 0 {
+				getBlocks.AddBlockLocatorHash(&chain.hashes[height-1])
+			}
+			p.QueueMessage(getBlocks, nil)
+			invs := <-p.invs
+			getData := wire.NewMsgGetData()
+			for _, inv := range invs {
+				getData.AddInvVect(inv)
+			}
+			p.QueueMessage(getData, nil)
+			for range invs {
+				<-blocks
+				height++
+			}
+		}
+	}
+}
+
+// BenchmarkSyncHeadersFirst measures the headers first sync: a getheaders
+// round trip per 2000 blocks, then their download in parallel from all the
+// peers.
+func BenchmarkSyncHeadersFirst(b *testing.B) {
+	chain := newTestChain(benchBlocks)
+	for n := 0; n < b.N; n++ {
+		blocks := make(chan *wire.MsgBlock, downloadWindow)
+		peers := make([]downloadPeer, benchPeers)
+		for i := range peers {
+			peers[i] = newSimPeer(fmt.Sprint(i), chain, benchLatency, benchPerBlock, blocks)
+		}
+		for start := 0; start < benchBlocks; start += wire.MaxBlockHeadersPerMsg {
+			end := start + wire.MaxBlockHeadersPerMsg
+			if end > benchBlocks {
+				end = benchBlocks
+			}
+			// the getheaders round trip
+			time.Sleep(2 * benchLatency)
+
+			download := newBlockDownload(chain.hashes[start:end], uint64(start), func(p downloadPeer, block *wire.MsgBlock) error {
+				return nil
+			})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for {
+					select {
+					case block := <-blocks:
+						download.deliver(nil, block)
+					case <-done:
+						return
+					}
+				}
+			}()
+			err := download.run(context.Background(), func() []downloadPeer {
+				return append([]downloadPeer{}, peers...)
+			}, func(p downloadPeer) {})
+			done <- struct{}{}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
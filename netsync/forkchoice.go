@@ -0,0 +1,403 @@
+package netsync
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/utils"
+	"go.uber.org/zap"
+)
+
+// chainFork is a branch of side chain blocks forking off the main chain.
+type chainFork struct {
+	// ancestor is the last main chain block shared with the fork
+	ancestor *model.Block
+	// blocks are the side chain blocks from the child of ancestor up to the
+	// tip of the fork
+	blocks []*model.Block
+}
+
+// findFork walks back from a side chain block to the main chain. It returns
+// false if the branch does not connect to the main chain.
+func (s *SyncManager) findFork(tip *model.Block) (*chainFork, bool, error) {
+	blocks := []*model.Block{tip}
+	for {
+		prev := blocks[len(blocks)-1].PreviousBlock
+		ancestor, exists, err := s.store.GetBlock(prev)
+		if err != nil {
+			return nil, false, err
+		}
+		if exists {
+			for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+				blocks[i], blocks[j] = blocks[j], blocks[i]
+			}
+			return &chainFork{ancestor: ancestor, blocks: blocks}, true, nil
+		}
+		block, exists, err := s.store.GetOrphanBlock(prev)
+		if err != nil {
+			return nil, false, err
+		}
+		if !exists {
+			return nil, false, nil
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+// chainWork returns the work done to mine the blocks.
+func chainWork(blocks []*model.Block) *big.Int {
+	work := new(big.Int)
+	for _, block := range blocks {
+		work.Add(work, blockchain.CalcWork(block.Bits))
+	}
+	return work
+}
+
+// reorganize makes the side chain ending at tip the main chain if it has more
+// work than the main chain above their common ancestor. The reorganization is
+// recorded before the main chain is touched, then applied by applyReorg. On
+// equal work the main chain, seen first, is kept.
+func (s *SyncManager) reorganize(tip *model.Block) error {
+	fork, connected, err := s.findFork(tip)
+	if err != nil || !connected {
+		return err
+	}
+	mainBlocks, err := s.store.GetBlocksRange(fork.ancestor.Height+1, s.latestHeight, false)
+	if err != nil {
+		return err
+	}
+	if uint64(len(mainBlocks)) != s.latestHeight-fork.ancestor.Height {
+		return fmt.Errorf("main chain is missing blocks above %d", fork.ancestor.Height)
+	}
+	if chainWork(fork.blocks).Cmp(chainWork(mainBlocks)) <= 0 {
+		return nil
+	}
+
+	// everything is loaded before the main chain is touched, so a pruned or
+	// incomplete block aborts the reorg without leaving it half done
+	loaded := make(map[string][]*model.Transaction, len(mainBlocks)+len(fork.blocks))
+	progress := &model.ReorgProgress{
+		Ancestor:       fork.ancestor.Hash,
+		AncestorHeight: fork.ancestor.Height,
+		Disconnect:     make([]string, len(mainBlocks)),
+		Connect:        make([]string, len(fork.blocks)),
+	}
+	for i, block := range mainBlocks {
+		if loaded[block.Hash], err = s.blockTxs(block, false); err != nil {
+			return err
+		}
+		// the outputs the block spends are put back in the UTXO set once it
+		// is disconnected, so they must be known
+		if _, _, _, err := s.blockOutputs(block, loaded[block.Hash]); err != nil {
+			return err
+		}
+		progress.Disconnect[i] = block.Hash
+	}
+	for i, block := range fork.blocks {
+		if loaded[block.Hash], err = s.blockTxs(block, true); err != nil {
+			return err
+		}
+		progress.Connect[i] = block.Hash
+	}
+
+	s.logger.Warn("reorganizing the chain",
+		zap.String("ancestor", fork.ancestor.Hash),
+		zap.Uint64("ancestorHeight", fork.ancestor.Height),
+		zap.Int("disconnected", len(mainBlocks)),
+		zap.Int("connected", len(fork.blocks)),
+		zap.String("tip", tip.Hash))
+
+	if err := s.store.PutReorgProgress(progress); err != nil {
+		return err
+	}
+	return s.applyReorg(progress, loaded)
+}
+
+// resumeReorg finishes the reorganization a crash interrupted, if any.
+func (s *SyncManager) resumeReorg() error {
+	s.blockMu.Lock()
+	defer s.blockMu.Unlock()
+
+	progress, exists, err := s.store.GetReorgProgress()
+	if err != nil || !exists {
+		return err
+	}
+	s.logger.Warn("resuming an interrupted reorganization",
+		zap.String("ancestor", progress.Ancestor),
+		zap.Uint64("ancestorHeight", progress.AncestorHeight),
+		zap.Int("disconnected", len(progress.Disconnect)),
+		zap.Int("connected", len(progress.Connect)))
+	return s.applyReorg(progress, nil)
+}
+
+// applyReorg disconnects the main chain blocks of a reorganization from the
+// tip down, connects the side chain blocks in order, then puts the
+// transactions of the disconnected blocks back in the mempool. A block is
+// only moved to the other chain once it is indexed there and indexing it
+// again is harmless, so an interrupted reorganization is finished by applying
+// it again. loaded holds the transactions of the blocks read beforehand, the
+// others are read from the store.
+func (s *SyncManager) applyReorg(progress *model.ReorgProgress, loaded map[string][]*model.Transaction) error {
+	for i := len(progress.Disconnect) - 1; i >= 0; i-- {
+		block, onMainChain, err := s.store.GetBlock(progress.Disconnect[i])
+		if err != nil {
+			return err
+		}
+		if !onMainChain {
+			continue
+		}
+		txs, err := s.reorgTxs(block, loaded)
+		if err != nil {
+			return err
+		}
+		if err := s.disconnectBlock(block, txs); err != nil {
+			return fmt.Errorf("disconnecting block %s: %w", block.Hash, err)
+		}
+	}
+
+	for _, hash := range progress.Connect {
+		block, onMainChain, err := s.store.GetBlock(hash)
+		if err != nil {
+			return err
+		}
+		if !onMainChain {
+			var exists bool
+			block, exists, err = s.store.GetOrphanBlock(hash)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("side chain block %s is missing", hash)
+			}
+			txs, err := s.reorgTxs(block, loaded)
+			if err != nil {
+				return err
+			}
+			wireBlock, err := toWireBlock(block, txs)
+			if err != nil {
+				return err
+			}
+			block.IsOrphan = false
+			if err := s.connectBlock(wireBlock, block); err != nil {
+				return fmt.Errorf("connecting block %s: %w", block.Hash, err)
+			}
+		}
+		if err := s.store.RemoveOrphanBlock(block); err != nil {
+			return err
+		}
+	}
+
+	// the tip is set again in case the crash came between moving a block and
+	// recording the new tip
+	height := progress.AncestorHeight + uint64(len(progress.Connect))
+	if err := s.store.SetLatestBlockHeight(height); err != nil {
+		return err
+	}
+	s.latestHeight = height
+
+	if err := s.readdTxs(progress.Disconnect, loaded); err != nil {
+		return err
+	}
+	return s.store.RemoveReorgProgress()
+}
+
+// reorgTxs returns the transactions of a block of a reorganization.
+func (s *SyncManager) reorgTxs(block *model.Block, loaded map[string][]*model.Transaction) ([]*model.Transaction, error) {
+	if txs, ok := loaded[block.Hash]; ok {
+		return txs, nil
+	}
+	return s.blockTxs(block, block.IsOrphan)
+}
+
+// readdTxs puts the transactions of the disconnected blocks but their
+// coinbases back in the mempool, in chain order. The mempool drops the ones
+// the new main chain confirmed or conflicts with.
+func (s *SyncManager) readdTxs(disconnected []string, loaded map[string][]*model.Transaction) error {
+	wireTxs := make([]*wire.MsgTx, 0)
+	for _, hash := range disconnected {
+		block, exists, err := s.store.GetOrphanBlock(hash)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("disconnected block %s is missing", hash)
+		}
+		txs, err := s.reorgTxs(block, loaded)
+		if err != nil {
+			return err
+		}
+		for _, tx := range txs[1:] {
+			wireTx, err := tx.ToWireTx()
+			if err != nil {
+				return err
+			}
+			wireTxs = append(wireTxs, wireTx)
+		}
+	}
+	return s.mempool.ReaddTxs(wireTxs)
+}
+
+// blockTxs returns all the transactions of a stored block, in block order.
+func (s *SyncManager) blockTxs(block *model.Block, isOrphan bool) ([]*model.Transaction, error) {
+	txs, err := s.store.GetBlockTxs(block.Hash, isOrphan)
+	if err != nil {
+		return nil, fmt.Errorf("block %s: %w", block.Hash, err)
+	}
+	if len(txs) != len(block.Txs) {
+		return nil, fmt.Errorf("block %s: %d of %d transactions are missing", block.Hash, len(block.Txs)-len(txs), len(block.Txs))
+	}
+	return txs, nil
+}
+
+// disconnectBlock reverts connectBlock for the tip of the main chain, which
+// is moved to the side chain blocks.
+func (s *SyncManager) disconnectBlock(block *model.Block, txs []*model.Transaction) error {
+	created, spentVins, spent, err := s.blockOutputs(block, txs)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.RemoveBlockUTXOs(created); err != nil {
+		return err
+	}
+	if err := s.store.UnspendUTXOs(spent, spentVins); err != nil {
+		return err
+	}
+	if err := s.store.RemoveOpReturns(utils.OpReturns(created, block.Hash, block.Height)); err != nil {
+		return err
+	}
+	if err := s.wallets.DisconnectTxs(txs); err != nil {
+		return err
+	}
+	if err := s.swaps.DisconnectTxs(txs); err != nil {
+		return err
+	}
+	// the block is kept as an orphan before it leaves the main chain, so a
+	// crash in between does not lose it
+	block.IsOrphan = true
+	if err := s.store.PutOrphanBlock(block); err != nil {
+		return err
+	}
+	// drops the block from the main chain with its transaction locations
+	if err := s.store.RemoveBlock(block.Hash); err != nil {
+		return err
+	}
+	if err := s.store.RemoveBlockUndo(block.Hash); err != nil {
+		return err
+	}
+
+	height := block.Height - 1
+	if err := s.store.SetLatestBlockHeight(height); err != nil {
+		return err
+	}
+	s.latestHeight = height
+	s.logger.Info("block disconnected", zap.Uint64("height", block.Height), zap.String("hash", block.Hash))
+	return nil
+}
+
+// blockOutputs returns the outputs created by a main chain block, and the
+// outputs it spends from earlier blocks along with their spending inputs.
+func (s *SyncManager) blockOutputs(block *model.Block, txs []*model.Transaction) ([]model.Vout, []model.Vin, []model.Vout, error) {
+	created := make([]model.Vout, 0)
+	spenders := make([]model.Vin, 0)
+	for _, tx := range txs {
+		for _, vout := range tx.Vouts {
+			vout.Height = block.Height
+			created = append(created, vout)
+		}
+		for _, vin := range tx.Vins {
+			// skips the coinbase input
+			if vin.PreviousTxId == "" {
+				continue
+			}
+			spenders = append(spenders, vin)
+		}
+	}
+
+	// the outputs created and spent in the block are gone with it
+	createdInBlock := make(map[string]bool, len(txs))
+	for _, tx := range txs {
+		createdInBlock[tx.Hash] = true
+	}
+	spentVins := make([]model.Vin, 0, len(spenders))
+	for _, vin := range spenders {
+		if !createdInBlock[vin.PreviousTxId] {
+			spentVins = append(spentVins, vin)
+		}
+	}
+	spent, err := s.spentOutputs(block.Hash, spentVins)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("block %s: %w", block.Hash, err)
+	}
+	return created, spentVins, spent, nil
+}
+
+// spentOutputs returns the outputs spent by vins in the block, with the
+// height of their main chain block. They are taken from the undo data of the
+// block, or looked up in the transactions that created them for the blocks
+// connected without it.
+func (s *SyncManager) spentOutputs(blockHash string, vins []model.Vin) ([]model.Vout, error) {
+	undo, _, err := s.store.GetBlockUndo(blockHash)
+	if err != nil {
+		return nil, err
+	}
+	recorded := make(map[wire.OutPoint]*model.Vout, len(undo))
+	for _, vout := range undo {
+		txHash, err := chainhash.NewHashFromStr(vout.TxId)
+		if err != nil {
+			return nil, err
+		}
+		recorded[*wire.NewOutPoint(txHash, vout.Index)] = vout
+	}
+
+	outpoints := make([]wire.OutPoint, len(vins))
+	hashes := make([]string, 0)
+	indices := make([]uint32, 0)
+	for i, vin := range vins {
+		txHash, err := chainhash.NewHashFromStr(vin.PreviousTxId)
+		if err != nil {
+			return nil, err
+		}
+		outpoints[i] = *wire.NewOutPoint(txHash, vin.PreviousIndex)
+		if _, ok := recorded[outpoints[i]]; !ok {
+			hashes = append(hashes, vin.PreviousTxId)
+			indices = append(indices, vin.PreviousIndex)
+		}
+	}
+	prevouts, err := s.resolveStoredPrevouts(hashes, indices)
+	if err != nil {
+		return nil, err
+	}
+
+	heights := make(map[string]uint64)
+	spent := make([]model.Vout, len(vins))
+	for i, vin := range vins {
+		if vout, ok := recorded[outpoints[i]]; ok {
+			spent[i] = *vout
+			continue
+		}
+		height, ok := heights[vin.PreviousTxId]
+		if !ok {
+			location, exists, err := s.store.GetTxLocation(vin.PreviousTxId)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				return nil, fmt.Errorf("spent transaction %s is not in the main chain", vin.PreviousTxId)
+			}
+			height = location.Height
+			heights[vin.PreviousTxId] = height
+		}
+		prevout, ok := prevouts[outpoints[i]]
+		if !ok {
+			return nil, fmt.Errorf("spent output %s:%d not found", vin.PreviousTxId, vin.PreviousIndex)
+		}
+		spent[i] = *prevout
+		spent[i].Height = height
+	}
+	return spent, nil
+}
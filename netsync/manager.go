@@ -2,113 +2,295 @@ package netsync
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 	"os"
+	"sync"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 
+	"github.com/catalogfi/indexer/consensus"
+	"github.com/catalogfi/indexer/fees"
 	"github.com/catalogfi/indexer/mempool"
 	"github.com/catalogfi/indexer/model"
 	"github.com/catalogfi/indexer/store"
 	"github.com/catalogfi/indexer/utils"
+	"github.com/catalogfi/indexer/swap"
+	"github.com/catalogfi/indexer/wallet"
 	"go.uber.org/zap"
 )
 
+const (
+	// a peer not answering a getheaders for headersTimeout is considered
+	// stalled
+	headersTimeout        = time.Minute
+	stallPenalty          = 20
+	invalidHeadersPenalty = BanThreshold / 2
+	// peerWaitInterval is how long the sync waits for a healthy peer before
+	// looking again
+	peerWaitInterval = 5 * time.Second
+	// catchUpInterval is how often the sync checks the peers for blocks it
+	// missed
+	catchUpInterval = time.Minute
+)
+
+var (
+	errSyncStalled    = errors.New("stalled header download")
+	errInvalidHeaders = errors.New("headers do not connect")
+	errShuttingDown   = errors.New("sync manager is shutting down")
+	errUnknownParent  = errors.New("parent block is unknown")
+)
+
 type SyncManager struct {
-	peer         *Peer //TODO: will we have multiple peers in future?
+	// peers are the peers of the P2P source, nil with another source
+	peers        *PeerManager
+	source       BlockSource
 	mempool      *mempool.Mempool
+	feeEstimator *fees.Estimator
+	wallets      *wallet.Manager
+	swaps        *swap.Watcher
 	store        *store.Storage
 	chainParams  *chaincfg.Params
+	rules        consensus.Rules
+	validator    *consensus.Validator
+	verifyAuxPow bool
 	latestHeight uint64
 	isSynced     bool
 	isMempoolSynced bool
+	// pruneDepth is the number of blocks whose transactions are kept, zero
+	// disables pruning
+	pruneDepth   uint64
 	logger       *zap.Logger
+
+	// headers receives the headers messages of the peers
+	headers chan PeerMsg
+	// fetch asks for the missing blocks to be fetched from the peers
+	fetch chan struct{}
+	// download is the block download in progress, if any
+	downloadMu sync.Mutex
+	download   *blockDownload
+
+	// blockMu is held while a block is connected
+	blockMu    sync.Mutex
+	reindexMu  sync.Mutex
+	reindexing bool
+
+	// shutdown is closed once Sync is cancelled, wg tracks the background
+	// work it waits for
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+
+	// statusMu guards the sync status, which the rpc server reads
+	statusMu sync.Mutex
+	// headersHeight is the height of the last validated header
+	headersHeight uint64
+	rate          syncRate
 }
 
 type SyncConfig struct {
-	PeerAddr    string
+	// PeerAddrs are the static peers, DNSSeeds enables discovering more from
+	// the DNS seeds of the chain
+	PeerAddrs   []string
+	DNSSeeds    bool
+	MaxPeers    int
 	ChainParams *chaincfg.Params
-	Store       *store.Storage
-	Logger      *zap.Logger
+	// Rules are the proof of work rules of the chain, without them the
+	// header difficulty is not checked
+	Rules  consensus.Rules
+	Store  *store.Storage
+	Logger *zap.Logger
+	// PruneDepth enables pruning the transactions of the blocks more than
+	// PruneDepth blocks deep, it must be at least MinPruneDepth
+	PruneDepth uint64
+	// VerifyAuxPow enables checking that the merged mining proofs of merged
+	// mined chains commit to their headers, without it only the work of their
+	// parent headers is checked
+	VerifyAuxPow bool
+	// Source is where the blocks are fetched from, the peers when nil
+	Source BlockSource
 }
 
 func NewSyncManager(config SyncConfig) (*SyncManager, error) {
 
+	if config.PruneDepth != 0 && config.PruneDepth < MinPruneDepth {
+		return nil, fmt.Errorf("prune depth must be at least %d blocks", MinPruneDepth)
+	}
+
 	logger := config.Logger.Named("syncManager")
-	peer, err := NewPeer(config.PeerAddr, config.ChainParams, logger)
+	var peers *PeerManager
+	if config.Source == nil {
+		var err error
+		peers, err = NewPeerManager(PeerManagerConfig{
+			ChainParams: config.ChainParams,
+			Rules:       config.Rules,
+			StaticAddrs: config.PeerAddrs,
+			DNSSeeds:    config.DNSSeeds,
+			MaxPeers:    config.MaxPeers,
+			Logger:      logger,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	latestHeight, _, err := config.Store.GetLatestBlockHeight()
 	if err != nil {
 		return nil, err
 	}
 
-	latestHeight, _, err := config.Store.GetLatestBlockHeight()
+	feeEstimator := fees.NewEstimator(config.ChainParams)
+	feeEstimator.ProcessBlock(latestHeight, nil)
+
+	wallets, err := wallet.NewManager(config.Store, config.ChainParams)
 	if err != nil {
 		return nil, err
 	}
 
-	return &SyncManager{
-		peer:         peer,
+	swaps := swap.NewWatcher(config.Store)
+
+	if config.Rules == nil {
+		logger.Warn("no proof of work rules for the chain, header difficulty is not checked", zap.String("chain", config.ChainParams.Name))
+	}
+
+	s := &SyncManager{
+		peers:        peers,
+		source:       config.Source,
 		chainParams:  config.ChainParams,
+		rules:        config.Rules,
+		validator:    consensus.NewValidator(config.ChainParams, config.Rules, blockChain{config.Store}),
 		logger:       logger,
 		store:        config.Store,
 		latestHeight: latestHeight,
-		mempool:      mempool.New(config.Store),
-	}, nil
+		mempool:      mempool.New(config.Store).SetFeeEstimator(feeEstimator).SetWalletManager(wallets).SetSwapWatcher(swaps),
+		feeEstimator: feeEstimator,
+		wallets:      wallets,
+		swaps:        swaps,
+		pruneDepth:   config.PruneDepth,
+		verifyAuxPow: config.VerifyAuxPow,
+		headers:      make(chan PeerMsg, 1),
+		fetch:        make(chan struct{}, 1),
+		shutdown:     make(chan struct{}),
+	}
+	if s.source == nil {
+		s.source = &peerSource{s: s}
+	}
+	return s, nil
+}
+
+// FeeEstimator returns the estimator fed with the mempool transactions and
+// blocks seen by the sync manager.
+func (s *SyncManager) FeeEstimator() *fees.Estimator {
+	return s.feeEstimator
+}
+
+// Wallets returns the watch-only wallets maintained by the sync manager.
+func (s *SyncManager) Wallets() *wallet.Manager {
+	return s.wallets
 }
 
-func (s *SyncManager) Sync() error {
+// Sync indexes the blocks of the source, and the transactions the peers send,
+// until ctx is cancelled. It then waits for the source, the block being
+// connected and the background work to stop, so the store is left at the last
+// connected block, where the next Sync resumes.
+func (s *SyncManager) Sync(ctx context.Context) error {
 	if err := s.checkForGensisBlock(); err != nil {
 		return err
 	}
+	if err := s.resumeReorg(); err != nil {
+		return err
+	}
+	if s.pruneDepth > 0 {
+		s.goBackground(func() { s.runPruner(ctx) })
+	}
 
-	for {
-		ctx, cancel := context.WithCancel(context.Background())
-
-		closed := s.peer.OnMsg(ctx, func(msg interface{}) error {
-			if s.isSynced && !s.isMempoolSynced {
-				go func() {
-					s.logger.Info("syncing all mempool transactions...")
-					err := s.mempool.SyncMempool(os.Getenv("RPC_URL"), os.Getenv("RPC_USER"), os.Getenv("RPC_PASS"))
-					if err != nil {
-						s.logger.Error("mempool sync error", zap.Error(err))
-						s.isMempoolSynced = false
-					}
-				}()
-				s.isMempoolSynced = true
-			}
-			switch m := msg.(type) {
-			case *wire.MsgBlock:
-				block := m
-				if err := s.putBlock(block); err != nil {
-					s.logger.Error("sync: ", zap.String("hash", block.BlockHash().String()), zap.Error(err))
-					return err
-				}
-				return nil
-			case *wire.MsgTx:
-				tx := m
-				s.logger.Info("received tx", zap.String("txid", tx.TxHash().String()))
-				if err := s.putMempoolTx(tx); err != nil {
-					s.logger.Error("sync: ", zap.String("txid", tx.TxHash().String()), zap.Error(err))
-					return err
-				}
-			}
-			return nil
-		})
+	err := s.source.Run(ctx, s)
+	s.stop()
+	return err
+}
+
+// stop waits for the background work.
+func (s *SyncManager) stop() {
+	s.logger.Info("shutting down")
+	s.reindexMu.Lock()
+	close(s.shutdown)
+	s.reindexMu.Unlock()
+	s.wg.Wait()
+	s.logger.Info("shut down", zap.Uint64("height", s.latestHeight))
+}
 
-		go s.fetchBlocks()
-		s.peer.WaitForDisconnect()
-		cancel()
+// goBackground runs fn in a goroutine Sync waits for before returning.
+func (s *SyncManager) goBackground(fn func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fn()
+	}()
+}
 
-		<-closed
-		s.logger.Warn("peer got disconnected... reconnecting")
-		reconnectedPeer, err := s.peer.Reconnect()
-		if err != nil {
-			s.logger.Error("error reconnecting peer", zap.Error(err))
-			panic(err)
+// sleep waits for d, returning false if ctx is cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (s *SyncManager) handleMsg(ctx context.Context, msg PeerMsg) {
+	if s.startMempoolSync() {
+		s.goBackground(func() {
+			s.logger.Info("syncing all mempool transactions...")
+			err := s.mempool.SyncMempool(ctx, os.Getenv("RPC_URL"), os.Getenv("RPC_USER"), os.Getenv("RPC_PASS"))
+			if err != nil {
+				s.logger.Error("mempool sync error", zap.Error(err))
+				s.statusMu.Lock()
+				s.isMempoolSynced = false
+				s.statusMu.Unlock()
+			}
+		})
+	}
+	switch m := msg.Msg.(type) {
+	case *wire.MsgBlock:
+		block := m
+		if download := s.getDownload(); download != nil && download.deliver(msg.Peer, block) {
+			return
+		}
+		err := s.processBlock(msg.Peer, block)
+		if errors.Is(err, errUnknownParent) {
+			// we fell behind the peer
+			s.logger.Info("block with an unknown parent, fetching the missing blocks", zap.String("hash", block.BlockHash().String()))
+			s.requestFetch()
+		} else if err != nil {
+			s.logger.Error("sync: ", zap.String("hash", block.BlockHash().String()), zap.String("peer", msg.Peer.Addr()), zap.Error(err))
+		}
+	case *wire.MsgHeaders:
+		select {
+		case s.headers <- msg:
+		default:
+			// headers announcing new blocks rather than answering a fetch
+			s.requestFetch()
+		}
+	case *wire.MsgTx:
+		tx := m
+		s.logger.Info("received tx", zap.String("txid", tx.TxHash().String()))
+		if err := s.putMempoolTx(tx); err != nil {
+			s.logger.Error("sync: ", zap.String("txid", tx.TxHash().String()), zap.Error(err))
 		}
-		s.peer = reconnectedPeer
+	}
+}
+
+// requestFetch has the missing blocks fetched from the peers, unless a fetch
+// is already pending.
+func (s *SyncManager) requestFetch() {
+	select {
+	case s.fetch <- struct{}{}:
+	default:
 	}
 }
 
@@ -122,7 +304,7 @@ func (s *SyncManager) putMempoolTx(tx *wire.MsgTx) error {
     // If the latest block height is not available or if the latest block height
     // is different from the last block height reported by the peer,
     // then return without processing the mempool transaction
-    if latest != 0 && latest != uint64(s.peer.LastBlock()) {
+    if latest != 0 && latest != s.source.BestHeight() {
         // We don't process mempool txs until the blockchain is completely synced
         return nil
     }
@@ -130,122 +312,254 @@ func (s *SyncManager) putMempoolTx(tx *wire.MsgTx) error {
     return s.mempool.ProcessTx(tx)
 }
 
-func (s *SyncManager) fetchBlocks() {
-	for {
-		// Check if the peer is connected
-		if !s.peer.Connected() {
-			s.logger.Info("peer disconnected")
-			break
-		}
-
+// fetchBlocks syncs headers first until we reach the best height announced
+// by the peers: it fetches the next headers from one peer, checks that they
+// connect, then downloads their blocks in parallel from all the healthy peers
+// and connects them in order. Peers that stall or send headers that do not
+// connect are penalised and another one is used, the ones sending headers
+// breaking the consensus rules are banned.
+func (s *SyncManager) fetchBlocks(ctx context.Context) {
+	for ctx.Err() == nil {
 		// Get the latest block height from the store
 		latestBlockHeight, _, err := s.store.GetLatestBlockHeight()
 		if err != nil {
 			s.logger.Error("error getting latest block height", zap.Error(err))
+			sleep(ctx, time.Second)
 			continue
 		}
 
-		peerLastBlock := s.peer.LastBlock()
-		s.logger.Info("latest block height", zap.Uint64("latestBlockHeight", latestBlockHeight), zap.Int32("peerLastBlock", peerLastBlock))
+		bestHeight := s.peers.BestHeight()
+		s.logger.Info("latest block height", zap.Uint64("latestBlockHeight", latestBlockHeight), zap.Int32("bestPeerHeight", bestHeight))
 
-		// Check if the peer's last block is valid
-		if peerLastBlock == 0 {
-			s.logger.Warn("peer's last block is 0, waiting for peer to synchronize")
+		// Check if the peers' last block is valid
+		if bestHeight == 0 {
+			s.logger.Warn("peers' last block is 0, waiting for peers to synchronize")
+			if !sleep(ctx, peerWaitInterval) {
+				return
+			}
 			continue
 		}
 
 		// Check if the blockchain is already synced
-		if latestBlockHeight == uint64(peerLastBlock) && latestBlockHeight != 0 {
+		if latestBlockHeight >= uint64(bestHeight) && latestBlockHeight != 0 {
 			s.logger.Info("blockchain synced ✅")
-			s.setSyncedStatus(true)
+			s.SetSynced(true)
 			return
 		}
 
+		syncPeer := s.peers.NextPeer(int32(latestBlockHeight) + 1)
+		if syncPeer == nil {
+			s.logger.Warn("no healthy peer to fetch blocks from")
+			if !sleep(ctx, peerWaitInterval) {
+				return
+			}
+			continue
+		}
+		s.SetSynced(false)
+
 		// Get block locator
 		locator, err := s.getBlockLocator(latestBlockHeight)
 		if err != nil {
 			s.logger.Error("error getting block locator", zap.Error(err))
+			sleep(ctx, time.Second)
 			continue
 		}
 
-		// Push getblocks message to peer
-		if err := s.peer.PushGetBlocksMsg(locator, &chainhash.Hash{}); err != nil {
-			s.logger.Error("error pushing getblocks message", zap.Error(err))
+		headers, startHeight, err := s.fetchHeaders(ctx, syncPeer, locator)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.logger.Warn("error fetching headers", zap.String("peer", syncPeer.Addr()), zap.Error(err))
+			penalty := uint32(stallPenalty)
+			if errors.Is(err, consensus.ErrInvalidHeader) {
+				penalty = BanThreshold
+			} else if errors.Is(err, errInvalidHeaders) {
+				penalty = invalidHeadersPenalty
+			}
+			s.peers.Misbehaving(syncPeer, penalty, err.Error())
+			syncPeer.Disconnect()
 			continue
 		}
-
-		// Wait for blocks to be processed
-		if s.waitForBlocksToBeProcessed(locator) {
-			s.logger.Info("blocks processed")
-		} else {
+		if len(headers) == 0 {
+			// the peer has nothing past our chain
 			s.logger.Info("blockchain synced ✅")
-			s.setSyncedStatus(true)
+			s.SetSynced(true)
 			return
 		}
+
+		if err := s.downloadBlocks(ctx, headers, startHeight); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.logger.Error("error downloading blocks", zap.Error(err))
+			sleep(ctx, time.Second)
+			continue
+		}
+		s.logger.Info("blocks processed", zap.Uint64("from", startHeight), zap.Int("count", len(headers)))
 	}
 }
 
-// setSyncedStatus sets the synced status for both the SyncManager and its peer
-func (s *SyncManager) setSyncedStatus(status bool) {
-	s.isSynced = status
-	if s.peer != nil {
-		s.peer.isSynced = status
+// fetchHeaders requests the headers following the locator from p. It returns
+// the ones we do not have yet, checked to connect to a stored block and to
+// follow the consensus rules, along with the height of the first one.
+func (s *SyncManager) fetchHeaders(ctx context.Context, p *Peer, locator []*chainhash.Hash) ([]*wire.BlockHeader, uint64, error) {
+	// drops a stale answer
+	select {
+	case <-s.headers:
+	default:
+	}
+	getHeaders := wire.NewMsgGetHeaders()
+	for _, hash := range locator {
+		if err := getHeaders.AddBlockLocatorHash(hash); err != nil {
+			return nil, 0, err
+		}
+	}
+	p.QueueMessage(getHeaders, nil)
+
+	timeout := time.After(headersTimeout)
+	var headers []*wire.BlockHeader
+	for headers == nil {
+		select {
+		case msg := <-s.headers:
+			if msg.Peer == p {
+				headers = msg.Msg.(*wire.MsgHeaders).Headers
+				if headers == nil {
+					headers = []*wire.BlockHeader{}
+				}
+			}
+		case <-timeout:
+			return nil, 0, errSyncStalled
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+
+	for _, header := range headers {
+		auxPow := p.AuxPow(header.BlockHash())
+		if err := s.validator.CheckAuxPow(header, auxPow, s.verifyAuxPow); err != nil {
+			return nil, 0, fmt.Errorf("header %s: %w", header.BlockHash(), err)
+		}
+	}
+
+	// the locator is sparse, so the peer may start below our tip
+	for len(headers) > 0 {
+		exists, err := s.store.BlockExists(headers[0].BlockHash().String())
+		if err != nil {
+			return nil, 0, err
+		}
+		if !exists {
+			break
+		}
+		headers = headers[1:]
+	}
+	if len(headers) == 0 {
+		return headers, 0, nil
+	}
+
+	parent, exists, err := s.store.GetBlock(headers[0].PrevBlock.String())
+	if err != nil {
+		return nil, 0, err
+	}
+	if !exists {
+		return nil, 0, errInvalidHeaders
 	}
+	if err := s.validator.CheckHeaders(parent, headers); err != nil {
+		return nil, 0, err
+	}
+	s.setHeadersHeight(parent.Height + uint64(len(headers)))
+	return headers, parent.Height + 1, nil
 }
 
+// downloadBlocks fetches the blocks of the headers from the healthy peers and
+// connects them in order.
+func (s *SyncManager) downloadBlocks(ctx context.Context, headers []*wire.BlockHeader, startHeight uint64) error {
+	hashes := make([]chainhash.Hash, len(headers))
+	for i, header := range headers {
+		hashes[i] = header.BlockHash()
+	}
+	download := newBlockDownload(hashes, startHeight, func(p downloadPeer, block *wire.MsgBlock) error {
+		return s.processBlock(p.(*Peer), block)
+	})
+	s.setDownload(download)
+	defer s.setDownload(nil)
+
+	return download.run(ctx, func() []downloadPeer {
+		healthy := s.peers.HealthyPeers()
+		peers := make([]downloadPeer, len(healthy))
+		for i, p := range healthy {
+			peers[i] = p
+		}
+		return peers
+	}, func(p downloadPeer) {
+		s.peers.Misbehaving(p.(*Peer), stallPenalty, "stalled block download")
+	})
+}
 
-// while syncing, we need to make sure all requested blocks ..
-// are processed first and then only we request for more blocks
-// everytime we request, 500 new blocks are received
-// so we wait for 500 blocks to be processed.
-// if the blockchain is completely synced,
-// then peers send the mined block(we don't request for it, it's just sent to us)
-// In that case, below function will wait for next 501 blocks to be processed
-// and then callee function should handle the case where the blockchain is completely synced
-func (s *SyncManager) waitForBlocksToBeProcessed(locator []*chainhash.Hash) bool {
-    // Set a default limit
-    limit := 501
-    
-    // Calculate the difference between the last block and the latest block height
-    diff := int(s.peer.LastBlock() - int32(s.latestHeight))
-    
-    // Check if the latest block height is non-zero and the difference is zero,
-    // which means all blocks have been processed
-    if s.latestHeight != 0 && diff == 0 {
-        return false
-    }
-    
-    // Adjust limit if the difference is within a reasonable range
-    if diff > 0 && diff < 500 {
-        limit = diff
-    }
-    
-    // If the locator is empty, set limit to 500
-    if len(locator) == 0 {
-        limit = 500
-    }
-    
-    // Iterate up to the limit
-    for i := 0; i < limit; i++ {
-        // Recalculate the difference inside the loop to reflect any changes
-        diff = int(s.peer.LastBlock() - int32(s.latestHeight))
-		
-        // Check if the latest block height is non-zero and the difference is zero,
-        // which means all blocks have been processed
-        if s.latestHeight != 0 && diff == 0 {
-            <-s.peer.blockProcessed
-			return false
-        }
-		
-		// Wait for a block to be processed
-		<-s.peer.blockProcessed
-        
-    }
-    
-    // All blocks up to the limit have been processed
-    return true
+func (s *SyncManager) getDownload() *blockDownload {
+	s.downloadMu.Lock()
+	defer s.downloadMu.Unlock()
+	return s.download
+}
+
+func (s *SyncManager) setDownload(download *blockDownload) {
+	s.downloadMu.Lock()
+	defer s.downloadMu.Unlock()
+	s.download = download
 }
 
+// processBlock puts a block received from p, with its AuxPoW if it was
+// merged mined, banning p if the block breaks the consensus rules.
+func (s *SyncManager) processBlock(p *Peer, block *wire.MsgBlock) error {
+	err := s.PutBlock(block, p.AuxPow(block.BlockHash()))
+	if errors.Is(err, consensus.ErrInvalidHeader) {
+		s.peers.Misbehaving(p, BanThreshold, err.Error())
+	}
+	return err
+}
+
+// PutBlock checks the AuxPoW of a merged mined block and puts the block: it
+// extends the main chain, or is kept on a side chain which replaces the main
+// chain once it has more work.
+func (s *SyncManager) PutBlock(block *wire.MsgBlock, auxPow *consensus.AuxPow) error {
+	if err := s.validator.CheckAuxPow(&block.Header, auxPow, s.verifyAuxPow); err != nil {
+		return err
+	}
+	return s.putBlock(block, auxPow)
+}
+
+// blockChain looks blocks up in the main chain, then among the orphans, so
+// the blocks of forks are validated against their own ancestors.
+type blockChain struct {
+	*store.Storage
+}
+
+func (c blockChain) GetBlock(hash string) (*model.Block, bool, error) {
+	block, exists, err := c.Storage.GetBlock(hash)
+	if err != nil || exists {
+		return block, exists, err
+	}
+	return c.Storage.GetOrphanBlock(hash)
+}
+
+// SetSynced sets the synced status of the SyncManager
+func (s *SyncManager) SetSynced(status bool) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	s.isSynced = status
+}
+
+// startMempoolSync tells whether the mempool has to be synced, which is once
+// the blocks are, and marks it as synced.
+func (s *SyncManager) startMempoolSync() bool {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	if !s.isSynced || s.isMempoolSynced {
+		return false
+	}
+	s.isMempoolSynced = true
+	return true
+}
 
 func (s *SyncManager) getBlockLocator(latestBlockHeight uint64) ([]*chainhash.Hash, error) {
 
@@ -280,11 +594,11 @@ func (s *SyncManager) checkForGensisBlock() error {
 	return nil
 }
 
-func (s *SyncManager) putBlock(block *wire.MsgBlock) error {
+func (s *SyncManager) putBlock(block *wire.MsgBlock, auxPow *consensus.AuxPow) error {
+	s.blockMu.Lock()
+	defer s.blockMu.Unlock()
 
-	height := uint64(0)
 	// we check if w already have the block
-
 	exists, err := s.store.BlockExists(block.BlockHash().String())
 	if err != nil {
 		return err
@@ -303,63 +617,54 @@ func (s *SyncManager) putBlock(block *wire.MsgBlock) error {
 		return nil
 	}
 
-	previousBlock, exists, err := s.store.GetBlock(block.Header.PrevBlock.String())
+	previousBlock, onMainChain, err := s.store.GetBlock(block.Header.PrevBlock.String())
 	if err != nil {
 		return err
 	}
-
-	if !exists {
-		orphanBlock, exists, err := s.store.GetOrphanBlock(block.Header.PrevBlock.String())
+	if !onMainChain {
+		var exists bool
+		previousBlock, exists, err = s.store.GetOrphanBlock(block.Header.PrevBlock.String())
 		if err != nil {
 			return err
 		}
-		if exists {
-			if s.latestHeight <= orphanBlock.Height+1 {
-				// the block we got might not be orphan anymore
-				// reorganize the blocks
-				fmt.Println(s.latestHeight , orphanBlock.Height)
-				for s.latestHeight <= orphanBlock.Height {
-					// get the previous block of the orphan block
-					previousBlock, exists, err := s.store.GetBlock(orphanBlock.PreviousBlock)
-					if err != nil {
-						return err
-					}
-					if !exists {
-						// we don't have the previous block in the main chain or orphan chain
-						// do not process the block
-						return nil
-					}
-					orphanBlock = previousBlock
-				}
-				err := s.reorganizeBlocks(orphanBlock)
-				if err != nil {
-					return err
-				}
-				//proceed with the current block
-			} else {
-				// we don't have the previous block in the main chain or orphan chain
-				// do not process the block
-				return s.putOrphanBlock(block, orphanBlock.Height+1)
-			}
-		} else {
+		if !exists {
 			// we don't have the previous block in the main chain or orphan chain
-			// do not process the block
-			return nil
+			// do not process the block, its ancestors have to be fetched first
+			return errUnknownParent
 		}
 	}
+	if err := s.validator.CheckBlock(previousBlock, block); err != nil {
+		return err
+	}
 
-	if s.latestHeight >= previousBlock.Height+1 {
-		return s.putOrphanBlock(block, previousBlock.Height+1)
+	newBlock, err := newBlockModel(block, previousBlock.Height+1, auxPow)
+	if err != nil {
+		return err
+	}
+	if onMainChain && previousBlock.Height == s.latestHeight {
+		return s.connectBlock(block, newBlock)
 	}
 
-	height = previousBlock.Height + 1
-	// s.logger.Info("processing block", zap.Uint64("height", height), zap.String("hash", block.BlockHash().String()))
+	// the block is on a side chain, which becomes the main chain once it has
+	// more work than the main chain
+	newBlock.IsOrphan = true
+	if err := s.putOrphanBlock(block, newBlock); err != nil {
+		return err
+	}
+	return s.reorganize(newBlock)
+}
 
+// newBlockModel returns the stored form of a block at height.
+func newBlockModel(block *wire.MsgBlock, height uint64, auxPow *consensus.AuxPow) (*model.Block, error) {
+	encodedAuxPow, err := encodeAuxPow(auxPow)
+	if err != nil {
+		return nil, err
+	}
 	txHashes := make([]string, len(block.Transactions))
 	for i, tx := range block.Transactions {
 		txHashes[i] = tx.TxHash().String()
 	}
-	newBlock := model.Block{
+	return &model.Block{
 		Hash:   block.Header.BlockHash().String(),
 		Height: height,
 
@@ -371,9 +676,18 @@ func (s *SyncManager) putBlock(block *wire.MsgBlock) error {
 		Bits:          block.Header.Bits,
 		MerkleRoot:    block.Header.MerkleRoot.String(),
 		Txs:           txHashes,
-	}
-	if err := s.store.PutBlock(&newBlock); err != nil {
-		s.logger.Error("error putting block with hash", zap.Error(err))
+		AuxPow:        encodedAuxPow,
+	}, nil
+}
+
+// connectBlock indexes block, extending the main chain, as newBlock.
+func (s *SyncManager) connectBlock(block *wire.MsgBlock, newBlock *model.Block) error {
+	height := newBlock.Height
+	txHashes := newBlock.Txs
+	// s.logger.Info("processing block", zap.Uint64("height", height), zap.String("hash", block.BlockHash().String()))
+
+	if err := s.store.PutTxLocations(newBlock.Hash, height, txHashes); err != nil {
+		s.logger.Error("error putting tx locations", zap.Error(err))
 		return err
 	}
 
@@ -381,6 +695,9 @@ func (s *SyncManager) putBlock(block *wire.MsgBlock) error {
 	if err != nil {
 		return err
 	}
+	for i := range vouts {
+		vouts[i].Height = height
+	}
 
 	err = s.store.PutUTXOs(vouts)
 	if err != nil {
@@ -388,6 +705,11 @@ func (s *SyncManager) putBlock(block *wire.MsgBlock) error {
 		return err
 	}
 
+	if err := s.store.PutOpReturns(utils.OpReturns(vouts, newBlock.Hash, height)); err != nil {
+		s.logger.Error("error putting op_returns", zap.Error(err))
+		return err
+	}
+
 	timeNow := time.Now()
 	s.logger.Info("putting raw txs")
 	err = s.store.PutTxs(transactions)
@@ -397,6 +719,15 @@ func (s *SyncManager) putBlock(block *wire.MsgBlock) error {
 	}
 	s.logger.Info("putting raw txs done", zap.Duration("time", time.Since(timeNow)))
 
+	if err := s.wallets.ConnectTxs(transactions, height, newBlock.Hash); err != nil {
+		s.logger.Error("error updating wallets", zap.Error(err))
+		return err
+	}
+	if err := s.swaps.ConnectTxs(transactions, height, newBlock.Hash); err != nil {
+		s.logger.Error("error indexing swaps", zap.Error(err))
+		return err
+	}
+
 	timeNow = time.Now()
 	hashes := make([]string, 0)
 	indices := make([]uint32, 0)
@@ -409,43 +740,67 @@ func (s *SyncManager) putBlock(block *wire.MsgBlock) error {
 		indices = append(indices, in.PreviousOutPoint.Index)
 	}
 	s.logger.Info("removing utxos step 2", zap.Int("len hashes", len(hashes)),zap.Int("len indices", len(indices)),zap.Int("len vins",len(vins)))
+
+	// prevouts have to be resolved before they are removed from the utxo set
+	prevouts, err := s.resolvePrevouts(hashes, indices)
+	if err != nil {
+		s.logger.Error("error resolving prevouts", zap.Error(err))
+		return err
+	}
+	if err := s.store.PutBlockStats(computeBlockStats(block, height, prevouts, s.chainParams)); err != nil {
+		s.logger.Error("error putting block stats", zap.Error(err))
+		return err
+	}
+	// the spent outputs are kept to disconnect the block, as the
+	// transactions creating them may be pruned by then
+	spent := make([]*model.Vout, 0, len(prevouts))
+	for _, prevout := range prevouts {
+		spent = append(spent, prevout)
+	}
+	if err := s.store.PutBlockUndo(newBlock.Hash, spent); err != nil {
+		s.logger.Error("error putting block undo data", zap.Error(err))
+		return err
+	}
+
 	//Ignores the coinbase transaction
 	if len(vins) > 0 {
-    err = s.store.RemoveUTXOs(hashes, indices, vins[1:])
+    replaced, err := s.store.RemoveUTXOs(hashes, indices, vins[1:])
 	  if err != nil {
 		  s.logger.Error("error removing utxos", zap.Error(err))
 		  return err
 	  }
+	  // the mempool transactions spending the same outputs as the block are
+	  // dropped
+	  if err := s.mempool.RemoveTxs(replaced); err != nil {
+		  return err
+	  }
   }
 	s.logger.Info("removing utxos done", zap.Duration("time", time.Since(timeNow)))
 
+	// the block is only stored once it is indexed, so a block interrupted by
+	// a crash is indexed again on restart instead of being skipped as known
+	if err := s.store.PutBlock(newBlock); err != nil {
+		s.logger.Error("error putting block with hash", zap.Error(err))
+		return err
+	}
 	if err := s.store.SetLatestBlockHeight(height); err != nil {
 		return err
 	}
+	s.feeEstimator.ProcessBlock(height, txHashes)
 	s.logger.Info("successfully block indexed", zap.Uint64("height", height))
 	s.latestHeight = height
-	s.peer.UpdateLastBlockHeight(int32(height))
+	s.recordHeight(height)
+	// only the peers of the P2P source announce our height
+	if s.peers != nil {
+		s.peers.UpdateLastBlockHeight(int32(height))
+	}
 	return nil
 }
 
-func (s *SyncManager) putOrphanBlock(block *wire.MsgBlock, height uint64) error {
-	txHashes := make([]string, len(block.Transactions))
-	for i, tx := range block.Transactions {
-		txHashes[i] = tx.TxHash().String()
-	}
-	orphanBlock := model.Block{
-		Hash:          block.Header.BlockHash().String(),
-		Height:        height,
-		IsOrphan:      true,
-		PreviousBlock: block.Header.PrevBlock.String(),
-		Version:       block.Header.Version,
-		Nonce:         block.Header.Nonce,
-		Timestamp:     block.Header.Timestamp,
-		Bits:          block.Header.Bits,
-		MerkleRoot:    block.Header.MerkleRoot.String(),
-		Txs:           txHashes,
-	}
-	if err := s.store.PutOrphanBlock(&orphanBlock); err != nil {
+// putOrphanBlock stores a side chain block and its transactions, without
+// indexing them.
+func (s *SyncManager) putOrphanBlock(block *wire.MsgBlock, orphanBlock *model.Block) error {
+	if err := s.store.PutOrphanBlock(orphanBlock); err != nil {
 		return err
 	}
 
@@ -460,95 +815,6 @@ func (s *SyncManager) putOrphanBlock(block *wire.MsgBlock, height uint64) error
 	return nil
 }
 
-// goal is to travel back to common ancestor of orphan chain and the main chain
-// and then reorganize the blocks such that the orphan chain becomes the main chain
-// and the main chain becomes the orphan chain (from the common ancestor)
-func (s *SyncManager) reorganizeBlocks(orphanBlock *model.Block) error {
-	// get the common ancestor of the orphan chain and the main chain
-	commonAncestor, exists, err := s.store.GetBlockByHeight(orphanBlock.Height)
-	if err != nil {
-		return err
-	}
-	if !exists {
-		return fmt.Errorf("common ancestor block not found")
-	}
-
-	// get all blocks from the main chain from the common ancestor
-	mainChainBlocks, err := s.store.GetBlocksRange(commonAncestor.Height+1, s.latestHeight, false)
-	if err != nil {
-		return err
-	}
-
-	// get all blocks from the orphan chain from the orphan block
-	orphanChainBlocks, err := s.store.GetBlocksRange(orphanBlock.Height+1, s.latestHeight, true)
-	if err != nil {
-		return err
-	}
-
-	// remove all blocks from the main chain from the common ancestor
-	// and put them in the orphan chain
-	for _, block := range mainChainBlocks {
-		if err := s.orphanBlock(block); err != nil {
-			return err
-		}
-	}
-
-	// remove all blocks from the orphan chain from the orphan block
-	// and put them in the main chain
-	for _, block := range orphanChainBlocks {
-		if err := s.unorphanBlock(block); err != nil {
-			return err
-		}
-	}
-	s.latestHeight = orphanBlock.Height
-	s.peer.UpdateLastBlockHeight(int32(orphanBlock.Height))
-
-	return nil
-
-}
-
-func (s *SyncManager) unorphanBlock(block *model.Block) error {
-	block.IsOrphan = false
-	txs, err := s.store.GetBlockTxs(block.Hash, true)
-	if err != nil {
-		return err
-	}
-	vouts := make([]model.Vout, 0)
-	for _, tx := range txs {
-		for _, vout := range tx.Vouts {
-			vouts = append(vouts, vout)
-		}
-	}
-	if err := s.store.PutUTXOs(vouts); err != nil {
-		return err
-	}
-	return s.store.PutBlock(block)
-}
-
-func (s *SyncManager) orphanBlock(block *model.Block) error {
-	block.IsOrphan = true
-	txs, err := s.store.GetBlockTxs(block.Hash, false)
-	if err != nil {
-		return err
-	}
-	hashes := make([]string, 0)
-	indices := make([]uint32, 0)
-	vins := make([]model.Vin, 0)
-	for _, tx := range txs {
-		vins = append(vins, tx.Vins...)
-		for _, vin := range tx.Vouts {
-			hashes = append(hashes, vin.TxId)
-			indices = append(indices, vin.Index)
-		}
-	}
-
-	if err := s.store.RemoveUTXOs(hashes, indices, vins); err != nil {
-		return err
-	}
-
-	return s.store.PutOrphanBlock(block)
-}
-
 func (s *SyncManager) putGensisBlock(block *wire.MsgBlock) error {
 	genesisBlock := btcutil.NewBlock(s.chainParams.GenesisBlock)
 	genesisBlock.SetHeight(0)
@@ -568,6 +834,9 @@ func (s *SyncManager) putGensisBlock(block *wire.MsgBlock) error {
 	if err := s.store.PutBlock(genBlock); err != nil {
 		return err
 	}
+	if err := s.store.PutTxLocations(genBlock.Hash, 0, genBlock.Txs); err != nil {
+		return err
+	}
 
 	tx := &model.Transaction{
 		Hash: "0000000000000000000000000000000000000000000000000000000000000000",
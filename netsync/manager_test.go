@@ -0,0 +1,76 @@
+package netsync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+func TestSyncStopsOnCancel(t *testing.T) {
+	s := newTestSyncManager(t)
+	s.peers.dial = func(addr string, listeners PeerListeners) (*Peer, error) {
+		return nil, errors.New("no network in tests")
+	}
+	blocks := buildBranch(t, chaincfg.RegressionNetParams.GenesisBlock, 1, 3, 'c', chaincfg.RegressionNetParams.PowLimitBits, false)
+	putBlocks(t, s, blocks)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Sync(ctx)
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync did not return after the cancellation")
+	}
+
+	if _, err := s.Reindex([]string{IndexUTXOs}); err != errShuttingDown {
+		t.Fatalf("expected errShuttingDown, got %v", err)
+	}
+	// a new sync manager resumes from the last connected block
+	restarted, err := NewSyncManager(SyncConfig{
+		PeerAddrs:   []string{"127.0.0.1:18444"},
+		ChainParams: &chaincfg.RegressionNetParams,
+		Rules:       regtestRules,
+		Store:       s.store,
+		Logger:      s.logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted.latestHeight != 3 {
+		t.Fatalf("expected to resume at 3, got %d", restarted.latestHeight)
+	}
+}
+
+func TestBlockWithUnknownParentFetches(t *testing.T) {
+	s := newTestSyncManager(t)
+	blocks := buildBranch(t, chaincfg.RegressionNetParams.GenesisBlock, 1, 2, 'c', chaincfg.RegressionNetParams.PowLimitBits, false)
+
+	if err := s.putBlock(blocks[1], nil); err != errUnknownParent {
+		t.Fatalf("expected errUnknownParent, got %v", err)
+	}
+	// a peer announcing a block we can not connect yet triggers a fetch
+	s.handleMsg(context.Background(), PeerMsg{Peer: unconnectedPeer(t, "127.0.0.1:18444"), Msg: blocks[1]})
+	select {
+	case <-s.fetch:
+	default:
+		t.Fatal("no fetch requested for a block with an unknown parent")
+	}
+
+	s.handleMsg(context.Background(), PeerMsg{Peer: unconnectedPeer(t, "127.0.0.1:18444"), Msg: blocks[0]})
+	select {
+	case <-s.fetch:
+		t.Fatal("fetch requested for a block extending the chain")
+	default:
+	}
+	assertTip(t, s, blocks[0], 1)
+}
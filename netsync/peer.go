@@ -1,30 +1,48 @@
 package netsync
 
 import (
-	"context"
 	"fmt"
 	"net"
 	"time"
 
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/peer"
 	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/consensus"
 	"go.uber.org/zap"
 )
 
+const dialTimeout = 10 * time.Second
+
+// PeerListeners are the callbacks through which a peer hands what it
+// receives to its manager.
+type PeerListeners struct {
+	// OnInv returns the announced inventory to request from the peer
+	OnInv  func(p *Peer, invs []*wire.InvVect) []*wire.InvVect
+	OnAddr func(p *Peer, addrs []*wire.NetAddress)
+	// OnVerAck is called once the version handshake with the peer is done
+	OnVerAck func(p *Peer)
+	// OnMsg is called with the blocks, transactions and headers sent by the
+	// peer
+	OnMsg func(p *Peer, msg interface{})
+}
+
 type Peer struct {
 	*peer.Peer
 	chainParams *chaincfg.Params
-	// this chan is used to signal that a block has been processed
-	blockProcessed chan struct{}
-	msg            chan interface{}
-	logger         *zap.Logger
-	isSynced		bool
+	logger      *zap.Logger
+	// auxPows decodes the messages of merged mined chains
+	auxPows *auxPowConn
 }
 
-func NewPeer(url string, chainParams *chaincfg.Params, logger *zap.Logger) (*Peer, error) {
-	done := make(chan struct{})
-	peerMsg := make(chan interface{})
+// NewPeer connects to the peer at addr. The AuxPoWs of the headers and blocks
+// it sends are kept when rules are the rules of a merged mined chain.
+func NewPeer(addr string, chainParams *chaincfg.Params, rules consensus.Rules, listeners PeerListeners, logger *zap.Logger) (*Peer, error) {
+	np := &Peer{
+		chainParams: chainParams,
+		logger:      logger,
+	}
 	peerCfg := &peer.Config{
 		UserAgentName:    "peer",
 		UserAgentVersion: "1.0.0",
@@ -33,8 +51,15 @@ func NewPeer(url string, chainParams *chaincfg.Params, logger *zap.Logger) (*Pee
 		TrickleInterval:  time.Second * 10,
 		Listeners: peer.MessageListeners{
 			OnInv: func(p *peer.Peer, msg *wire.MsgInv) {
+				invs := msg.InvList
+				if listeners.OnInv != nil {
+					invs = listeners.OnInv(np, invs)
+				}
+				if len(invs) == 0 {
+					return
+				}
 				sendMsg := wire.NewMsgGetData()
-				for _, inv := range msg.InvList {
+				for _, inv := range invs {
 					if inv.Type == wire.InvTypeTx {
 						logger.Info("received tx inv", zap.String("hash", inv.Hash.String()))
 					} else if inv.Type == wire.InvTypeBlock {
@@ -44,66 +69,53 @@ func NewPeer(url string, chainParams *chaincfg.Params, logger *zap.Logger) (*Pee
 				}
 				p.QueueMessage(sendMsg, nil)
 			},
+			OnVerAck: func(p *peer.Peer, msg *wire.MsgVerAck) {
+				if listeners.OnVerAck != nil {
+					listeners.OnVerAck(np)
+				}
+			},
+			OnAddr: func(p *peer.Peer, msg *wire.MsgAddr) {
+				if listeners.OnAddr != nil {
+					listeners.OnAddr(np, msg.AddrList)
+				}
+			},
 			OnBlock: func(p *peer.Peer, msg *wire.MsgBlock, buf []byte) {
-				peerMsg <- msg
+				listeners.OnMsg(np, msg)
 			},
 			OnTx: func(p *peer.Peer, tx *wire.MsgTx) {
-				peerMsg <- tx
+				listeners.OnMsg(np, tx)
+			},
+			OnHeaders: func(p *peer.Peer, msg *wire.MsgHeaders) {
+				listeners.OnMsg(np, msg)
 			},
 		},
 		AllowSelfConns: true,
 	}
-	p, err := peer.NewOutboundPeer(peerCfg, url)
+	p, err := peer.NewOutboundPeer(peerCfg, addr)
 	if err != nil {
 		return nil, fmt.Errorf("syncManager: %v", err)
 	}
+	np.Peer = p
 
-	conn, err := net.Dial("tcp", p.Addr())
+	conn, err := net.DialTimeout("tcp", p.Addr(), dialTimeout)
 	if err != nil {
 		return nil, fmt.Errorf("syncManager: %v", err)
 	}
 
-	p.AssociateConnection(conn)
-	return &Peer{
-		Peer:           p,
-		blockProcessed: done,
-		msg:            peerMsg,
-		chainParams:    chainParams,
-		logger:         logger,
-		isSynced:	false,
-	}, nil
-}
-
-func (p *Peer) OnMsg(ctx context.Context, handler func(msg interface{}) error) chan struct{} {
-	closed := make(chan struct{})
-	go func() {
-		defer func() {
-			closed <- struct{}{}
-		}()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case msg, ok := <-p.msg:
-				if !ok {
-					return
-				}
-				if _, ok := msg.(*wire.MsgBlock); ok && !p.isSynced {
-					p.blockProcessed <- struct{}{}
-				}
-				err := handler(msg)
-				if err != nil {
-					p.logger.Error("error handling block. Exiting", zap.Error(err))
-					return
-				}
-			}
-		}
+	if _, ok := rules.(consensus.MergedMiningRules); ok {
+		np.auxPows = newAuxPowConn(conn)
+		conn = np.auxPows
+	}
 
-	}()
-	return closed
+	p.AssociateConnection(conn)
+	return np, nil
 }
 
-func (p *Peer) Reconnect() (*Peer, error) {
-	p.Disconnect()
-	return NewPeer(p.Addr(), p.chainParams, p.logger)
+// AuxPow returns the AuxPoW received with the merged mined header or block
+// with the given hash, once.
+func (p *Peer) AuxPow(hash chainhash.Hash) *consensus.AuxPow {
+	if p.auxPows == nil {
+		return nil
+	}
+	return p.auxPows.take(hash)
 }
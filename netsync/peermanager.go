@@ -0,0 +1,474 @@
+package netsync
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/consensus"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultMaxPeers    = 8
+	DefaultBanDuration = 24 * time.Hour
+	// BanThreshold is the ban score at which a peer is disconnected and
+	// banned. Peers are only used for syncing below half of it.
+	BanThreshold = 100
+
+	connectInterval = 10 * time.Second
+	// a failed address is not dialled again before retryInterval
+	retryInterval = time.Minute
+	// an inventory requested from a peer is not requested from another one
+	// before inventoryTimeout, unless the peer disconnects
+	inventoryTimeout = time.Minute
+	maxRequested     = 50000
+	maxKnownAddrs    = 1000
+)
+
+var ErrNoPeerSources = errors.New("no static peers and no dns seeds to discover peers from")
+
+type PeerManagerConfig struct {
+	ChainParams *chaincfg.Params
+	// Rules are the proof of work rules of the chain, the blocks of merged
+	// mined chains come with their AuxPoW
+	Rules consensus.Rules
+	// StaticAddrs are host:port addresses dialled before the discovered ones
+	StaticAddrs []string
+	// DNSSeeds enables discovering peers from the DNS seeds of the chain
+	DNSSeeds bool
+	// MaxPeers is the number of outbound connections to keep, DefaultMaxPeers
+	// if zero
+	MaxPeers int
+	// BanDuration is how long a misbehaving peer is banned for,
+	// DefaultBanDuration if zero
+	BanDuration time.Duration
+	Logger      *zap.Logger
+}
+
+// PeerManager keeps outbound connections to the static peers and the ones
+// discovered from the DNS seeds and the addr messages, replacing peers that
+// disconnect. Misbehaving peers are scored and banned once they reach the
+// BanThreshold.
+type PeerManager struct {
+	chainParams *chaincfg.Params
+	staticAddrs []string
+	dnsSeeds    bool
+	maxPeers    int
+	banDuration time.Duration
+	logger      *zap.Logger
+
+	msgs     chan PeerMsg
+	newPeers chan struct{}
+	wake     chan struct{}
+	quit     chan struct{}
+	stopOnce sync.Once
+
+	// dial and lookupHost are replaced in tests
+	dial       func(addr string, listeners PeerListeners) (*Peer, error)
+	lookupHost func(host string) ([]string, error)
+
+	mu        sync.Mutex
+	peers     map[string]*Peer
+	known     map[string]bool
+	attempts  map[string]time.Time
+	scores    map[string]uint32
+	banned    map[string]time.Time
+	requested map[chainhash.Hash]inventoryRequest
+	next      int
+}
+
+// PeerMsg is a block, transaction or headers message received from a peer.
+type PeerMsg struct {
+	Peer *Peer
+	Msg  interface{}
+}
+
+type inventoryRequest struct {
+	addr string
+	at   time.Time
+}
+
+func NewPeerManager(config PeerManagerConfig) (*PeerManager, error) {
+	if len(config.StaticAddrs) == 0 && (!config.DNSSeeds || len(config.ChainParams.DNSSeeds) == 0) {
+		return nil, ErrNoPeerSources
+	}
+	maxPeers := config.MaxPeers
+	if maxPeers <= 0 {
+		maxPeers = DefaultMaxPeers
+	}
+	banDuration := config.BanDuration
+	if banDuration <= 0 {
+		banDuration = DefaultBanDuration
+	}
+	logger := config.Logger.Named("peerManager")
+	return &PeerManager{
+		chainParams: config.ChainParams,
+		staticAddrs: config.StaticAddrs,
+		dnsSeeds:    config.DNSSeeds,
+		maxPeers:    maxPeers,
+		banDuration: banDuration,
+		logger:      logger,
+		msgs:        make(chan PeerMsg),
+		newPeers:    make(chan struct{}, 1),
+		wake:        make(chan struct{}, 1),
+		quit:        make(chan struct{}),
+		dial: func(addr string, listeners PeerListeners) (*Peer, error) {
+			return NewPeer(addr, config.ChainParams, config.Rules, listeners, logger)
+		},
+		lookupHost: net.LookupHost,
+		peers:      make(map[string]*Peer),
+		known:      make(map[string]bool),
+		attempts:   make(map[string]time.Time),
+		scores:     make(map[string]uint32),
+		banned:     make(map[string]time.Time),
+		requested:  make(map[chainhash.Hash]inventoryRequest),
+	}, nil
+}
+
+// Msgs returns the channel of the messages received from all the peers.
+func (m *PeerManager) Msgs() <-chan PeerMsg {
+	return m.msgs
+}
+
+// NewPeers is signalled whenever a peer finishes its version handshake.
+func (m *PeerManager) NewPeers() <-chan struct{} {
+	return m.newPeers
+}
+
+// Start connects to the peers in the background and keeps replacing the ones
+// that disconnect until Stop is called.
+func (m *PeerManager) Start() {
+	go func() {
+		ticker := time.NewTicker(connectInterval)
+		defer ticker.Stop()
+		for {
+			m.connectPeers()
+			select {
+			case <-m.quit:
+				return
+			case <-ticker.C:
+			case <-m.wake:
+			}
+		}
+	}()
+}
+
+// Stop disconnects all the peers.
+func (m *PeerManager) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.quit)
+		for _, p := range m.Peers() {
+			p.Disconnect()
+		}
+	})
+}
+
+// Peers returns the connected peers.
+func (m *PeerManager) Peers() []*Peer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	peers := make([]*Peer, 0, len(m.peers))
+	for _, p := range m.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// NextPeer returns the next healthy peer, in turns, whose chain reaches
+// minHeight, or nil if there is none.
+func (m *PeerManager) NextPeer(minHeight int32) *Peer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	healthy := m.healthyPeers()
+	candidates := make([]*Peer, 0, len(healthy))
+	for _, p := range healthy {
+		if p.LastBlock() >= minHeight {
+			candidates = append(candidates, p)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	m.next++
+	return candidates[m.next%len(candidates)]
+}
+
+// HealthyPeers returns the connected peers done with the handshake and
+// below half the ban threshold.
+func (m *PeerManager) HealthyPeers() []*Peer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.healthyPeers()
+}
+
+// BestHeight returns the highest chain height announced by the healthy
+// peers.
+func (m *PeerManager) BestHeight() int32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	best := int32(0)
+	for _, p := range m.healthyPeers() {
+		if p.LastBlock() > best {
+			best = p.LastBlock()
+		}
+	}
+	return best
+}
+
+// UpdateLastBlockHeight raises the chain height known for every peer.
+func (m *PeerManager) UpdateLastBlockHeight(height int32) {
+	for _, p := range m.Peers() {
+		p.UpdateLastBlockHeight(height)
+	}
+}
+
+// Misbehaving adds score to the ban score of the peer. The peer is
+// disconnected and its address banned once the score reaches BanThreshold.
+func (m *PeerManager) Misbehaving(p *Peer, score uint32, reason string) {
+	m.mu.Lock()
+	addr := p.Addr()
+	m.scores[addr] += score
+	total := m.scores[addr]
+	ban := total >= BanThreshold
+	if ban {
+		m.banned[addr] = time.Now().Add(m.banDuration)
+		delete(m.scores, addr)
+	}
+	m.mu.Unlock()
+
+	m.logger.Warn("peer misbehaving", zap.String("addr", addr), zap.String("reason", reason), zap.Uint32("score", total))
+	if ban {
+		m.logger.Warn("banning peer", zap.String("addr", addr), zap.Duration("duration", m.banDuration))
+		p.Disconnect()
+	}
+}
+
+// IsBanned tells whether the address is currently banned.
+func (m *PeerManager) IsBanned(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.isBanned(addr, time.Now())
+}
+
+func (m *PeerManager) isBanned(addr string, now time.Time) bool {
+	until, ok := m.banned[addr]
+	if !ok {
+		return false
+	}
+	if now.After(until) {
+		delete(m.banned, addr)
+		return false
+	}
+	return true
+}
+
+// healthyPeers returns the connected peers done with the handshake and
+// below half the ban threshold, sorted by address so turns are stable.
+func (m *PeerManager) healthyPeers() []*Peer {
+	peers := make([]*Peer, 0, len(m.peers))
+	for addr, p := range m.peers {
+		if p.Connected() && p.VerAckReceived() && m.scores[addr] < BanThreshold/2 {
+			peers = append(peers, p)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Addr() < peers[j].Addr() })
+	return peers
+}
+
+// connectPeers dials candidates until MaxPeers peers are connected,
+// discovering new addresses from the DNS seeds when it runs out of them.
+func (m *PeerManager) connectPeers() {
+	candidates := m.candidates()
+	if len(candidates) == 0 && m.dnsSeeds {
+		m.discover()
+		candidates = m.candidates()
+	}
+	for _, addr := range candidates {
+		select {
+		case <-m.quit:
+			return
+		default:
+		}
+		m.mu.Lock()
+		full := len(m.peers) >= m.maxPeers
+		m.attempts[addr] = time.Now()
+		m.mu.Unlock()
+		if full {
+			return
+		}
+
+		p, err := m.dial(addr, m.listeners())
+		if err != nil {
+			m.logger.Debug("error connecting to peer", zap.String("addr", addr), zap.Error(err))
+			continue
+		}
+		m.addPeer(addr, p)
+	}
+}
+
+// candidates returns the addresses to dial, the static ones first.
+func (m *PeerManager) candidates() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	usable := func(addr string) bool {
+		if _, ok := m.peers[addr]; ok {
+			return false
+		}
+		if m.isBanned(addr, now) {
+			return false
+		}
+		attempt, ok := m.attempts[addr]
+		return !ok || now.Sub(attempt) >= retryInterval
+	}
+
+	candidates := make([]string, 0)
+	static := make(map[string]bool, len(m.staticAddrs))
+	for _, addr := range m.staticAddrs {
+		static[addr] = true
+		if usable(addr) {
+			candidates = append(candidates, addr)
+		}
+	}
+	for addr := range m.known {
+		if !static[addr] && usable(addr) {
+			candidates = append(candidates, addr)
+		}
+	}
+	return candidates
+}
+
+func (m *PeerManager) discover() {
+	for _, seed := range m.chainParams.DNSSeeds {
+		ips, err := m.lookupHost(seed.Host)
+		if err != nil {
+			m.logger.Debug("error looking up dns seed", zap.String("seed", seed.Host), zap.Error(err))
+			continue
+		}
+		m.mu.Lock()
+		for _, ip := range ips {
+			m.addKnown(net.JoinHostPort(ip, m.chainParams.DefaultPort))
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *PeerManager) addKnown(addr string) {
+	if len(m.known) < maxKnownAddrs {
+		m.known[addr] = true
+	}
+}
+
+func (m *PeerManager) addPeer(addr string, p *Peer) {
+	m.mu.Lock()
+	m.peers[addr] = p
+	m.mu.Unlock()
+	m.logger.Info("connected to peer", zap.String("addr", addr))
+
+	p.QueueMessage(wire.NewMsgGetAddr(), nil)
+	// the handshake runs in the background and may be done already
+	if p.VerAckReceived() {
+		m.signalNewPeer()
+	}
+
+	go func() {
+		p.WaitForDisconnect()
+		m.removePeer(addr, p)
+		m.logger.Warn("peer got disconnected", zap.String("addr", addr))
+		select {
+		case m.wake <- struct{}{}:
+		default:
+		}
+	}()
+}
+
+// signalNewPeer tells that a peer finished its handshake, so its best height is
+// known and blocks can be fetched from it.
+func (m *PeerManager) signalNewPeer() {
+	select {
+	case m.newPeers <- struct{}{}:
+	default:
+	}
+}
+
+// removePeer forgets the peer and the inventory still requested from it, so
+// another peer can serve it.
+func (m *PeerManager) removePeer(addr string, p *Peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.peers[addr] == p {
+		delete(m.peers, addr)
+	}
+	for hash, req := range m.requested {
+		if req.addr == addr {
+			delete(m.requested, hash)
+		}
+	}
+}
+
+func (m *PeerManager) listeners() PeerListeners {
+	return PeerListeners{
+		OnInv:    m.filterInv,
+		OnAddr:   m.onAddr,
+		OnVerAck: func(p *Peer) { m.signalNewPeer() },
+		OnMsg:    m.onMsg,
+	}
+}
+
+// filterInv returns the announced blocks and transactions not already
+// requested from another peer, and records them as requested from p.
+func (m *PeerManager) filterInv(p *Peer, invs []*wire.InvVect) []*wire.InvVect {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if len(m.requested) > maxRequested {
+		for hash, req := range m.requested {
+			if now.Sub(req.at) >= inventoryTimeout {
+				delete(m.requested, hash)
+			}
+		}
+	}
+	wanted := make([]*wire.InvVect, 0, len(invs))
+	for _, inv := range invs {
+		req, ok := m.requested[inv.Hash]
+		if ok && req.addr != p.Addr() && now.Sub(req.at) < inventoryTimeout {
+			continue
+		}
+		m.requested[inv.Hash] = inventoryRequest{addr: p.Addr(), at: now}
+		wanted = append(wanted, inv)
+	}
+	return wanted
+}
+
+func (m *PeerManager) onAddr(p *Peer, addrs []*wire.NetAddress) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, addr := range addrs {
+		m.addKnown(net.JoinHostPort(addr.IP.String(), strconv.Itoa(int(addr.Port))))
+	}
+}
+
+func (m *PeerManager) onMsg(p *Peer, msg interface{}) {
+	var hash chainhash.Hash
+	switch msg := msg.(type) {
+	case *wire.MsgBlock:
+		hash = msg.BlockHash()
+	case *wire.MsgTx:
+		hash = msg.TxHash()
+	}
+	m.mu.Lock()
+	delete(m.requested, hash)
+	m.mu.Unlock()
+
+	select {
+	case m.msgs <- PeerMsg{Peer: p, Msg: msg}:
+	case <-m.quit:
+	}
+}
@@ -0,0 +1,103 @@
+package netsync
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+	"go.uber.org/zap"
+)
+
+func newTestPeerManager(t *testing.T, config PeerManagerConfig) *PeerManager {
+	config.ChainParams = &chaincfg.MainNetParams
+	config.Logger = zap.NewNop()
+	m, err := NewPeerManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.lookupHost = func(host string) ([]string, error) {
+		return []string{"10.0.0.1", "10.0.0.2"}, nil
+	}
+	return m
+}
+
+// unconnectedPeer is enough for the bookkeeping, which only needs the address.
+func unconnectedPeer(t *testing.T, addr string) *Peer {
+	p, err := peer.NewOutboundPeer(&peer.Config{ChainParams: &chaincfg.MainNetParams}, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Peer{Peer: p}
+}
+
+func TestNewPeerManagerNeedsPeers(t *testing.T) {
+	_, err := NewPeerManager(PeerManagerConfig{ChainParams: &chaincfg.RegressionNetParams, DNSSeeds: true, Logger: zap.NewNop()})
+	if err != ErrNoPeerSources {
+		t.Fatalf("expected ErrNoPeerSources, got %v", err)
+	}
+}
+
+func TestPeerManagerCandidates(t *testing.T) {
+	m := newTestPeerManager(t, PeerManagerConfig{StaticAddrs: []string{"127.0.0.1:8333"}, DNSSeeds: true})
+	m.discover()
+	candidates := m.candidates()
+	if len(candidates) != 3 || candidates[0] != "127.0.0.1:8333" {
+		t.Fatalf("unexpected candidates %v", candidates)
+	}
+
+	m.Misbehaving(unconnectedPeer(t, "10.0.0.1:8333"), BanThreshold/2, "test")
+	if m.IsBanned("10.0.0.1:8333") {
+		t.Fatal("banned below the threshold")
+	}
+	m.Misbehaving(unconnectedPeer(t, "10.0.0.1:8333"), BanThreshold/2, "test")
+	if !m.IsBanned("10.0.0.1:8333") {
+		t.Fatal("not banned at the threshold")
+	}
+	for _, addr := range m.candidates() {
+		if addr == "10.0.0.1:8333" {
+			t.Fatal("banned address is a candidate")
+		}
+	}
+}
+
+func TestPeerManagerFilterInv(t *testing.T) {
+	m := newTestPeerManager(t, PeerManagerConfig{StaticAddrs: []string{"127.0.0.1:8333"}})
+	a := unconnectedPeer(t, "127.0.0.1:8333")
+	b := unconnectedPeer(t, "127.0.0.2:8333")
+	inv := []*wire.InvVect{wire.NewInvVect(wire.InvTypeBlock, &chainhash.Hash{1})}
+
+	if len(m.filterInv(a, inv)) != 1 {
+		t.Fatal("first announcement filtered")
+	}
+	if len(m.filterInv(b, inv)) != 0 {
+		t.Fatal("inventory requested from two peers")
+	}
+	// the inventory is requested again once the first peer is gone
+	m.removePeer(a.Addr(), a)
+	if len(m.filterInv(b, inv)) != 1 {
+		t.Fatal("inventory of a disconnected peer not requested again")
+	}
+}
+
+func TestPeerManagerSignalsNewPeersAfterHandshake(t *testing.T) {
+	m := newTestPeerManager(t, PeerManagerConfig{StaticAddrs: []string{"127.0.0.1:8333"}})
+	p := unconnectedPeer(t, "127.0.0.1:8333")
+	defer p.Disconnect()
+
+	// the best height of the peer is not known before the handshake
+	m.addPeer("127.0.0.1:8333", p)
+	select {
+	case <-m.NewPeers():
+		t.Fatal("new peer signalled before the handshake")
+	default:
+	}
+
+	m.listeners().OnVerAck(p)
+	select {
+	case <-m.NewPeers():
+	default:
+		t.Fatal("new peer not signalled after the handshake")
+	}
+}
@@ -0,0 +1,85 @@
+package netsync
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// MinPruneDepth keeps enough blocks to handle any realistic reorg, like
+	// bitcoind's minimum of 288 blocks.
+	MinPruneDepth = 288
+
+	pruneInterval = time.Minute
+)
+
+var errReindexing = errors.New("a reindex is running")
+
+// runPruner periodically prunes the blocks more than pruneDepth blocks below
+// the tip until ctx is cancelled.
+func (s *SyncManager) runPruner(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.prune(); err != nil {
+			s.logger.Error("error pruning blocks", zap.Error(err))
+		}
+	}
+}
+
+func (s *SyncManager) prune() error {
+	tip, _, err := s.store.GetLatestBlockHeight()
+	if err != nil {
+		return err
+	}
+	if tip <= s.pruneDepth {
+		return nil
+	}
+	target := tip - s.pruneDepth
+
+	// the genesis block is never pruned
+	start := uint64(1)
+	pruned, exists, err := s.store.GetPrunedHeight()
+	if err != nil {
+		return err
+	}
+	if exists {
+		start = pruned + 1
+	}
+	if start > target {
+		return nil
+	}
+
+	timeNow := time.Now()
+	for height := start; height <= target; height++ {
+		if err := s.pruneBlock(height); err != nil {
+			if err == errReindexing {
+				s.logger.Info("pruning held off by a reindex", zap.Uint64("height", height))
+				return nil
+			}
+			return err
+		}
+	}
+	s.logger.Info("pruned blocks", zap.Uint64("from", start), zap.Uint64("to", target), zap.Duration("time", time.Since(timeNow)))
+	return nil
+}
+
+// pruneBlock prunes the block at height unless a reindex is running, as the
+// reindex needs the transactions of the blocks it has yet to reach. Reindex
+// checks the pruned height under the same lock.
+func (s *SyncManager) pruneBlock(height uint64) error {
+	s.reindexMu.Lock()
+	defer s.reindexMu.Unlock()
+	if s.reindexing {
+		return errReindexing
+	}
+	return s.store.PruneBlock(height)
+}
@@ -0,0 +1,121 @@
+package netsync
+
+import (
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/store"
+)
+
+func TestPrune(t *testing.T) {
+	blocks := buildBranch(t, chaincfg.RegressionNetParams.GenesisBlock, 1, 5, 'c', chaincfg.RegressionNetParams.PowLimitBits, false)
+	s := newTestSyncManager(t)
+	s.pruneDepth = 2
+	putBlocks(t, s, blocks)
+
+	// a mempool transaction spends an output of a block to be pruned
+	unspent := blocks[1].Transactions[2].TxHash()
+	mempoolTx := wire.NewMsgTx(1)
+	mempoolTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&unspent, 0), nil, nil))
+	mempoolTx.AddTxOut(wire.NewTxOut(1000, payScript))
+	if err := s.mempool.ProcessTx(mempoolTx); err != nil {
+		t.Fatal(err)
+	}
+
+	type indexes struct {
+		info    model.UTXOSetInfo
+		utxos   int
+		history string
+	}
+	snapshot := func() indexes {
+		t.Helper()
+		info, err := s.store.GetUTXOSetInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshot := indexes{info: *info}
+		for _, script := range [][]byte{minerScript, payScript} {
+			utxos, err := s.store.GetUTXOs(hex.EncodeToString(script))
+			if err != nil {
+				t.Fatal(err)
+			}
+			history, err := s.store.GetTxHashesOfPubScript(hex.EncodeToString(script))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(history)
+			snapshot.utxos += len(utxos)
+			snapshot.history += strings.Join(history, ",") + ";"
+		}
+		return snapshot
+	}
+	before := snapshot()
+
+	// the tip is at 5, so the blocks up to 3 are pruned
+	if err := s.prune(); err != nil {
+		t.Fatal(err)
+	}
+	if height, exists, err := s.store.GetPrunedHeight(); err != nil || !exists || height != 3 {
+		t.Fatalf("expected the blocks to be pruned up to 3, got %d", height)
+	}
+	for height, block := range append([]*wire.MsgBlock{chaincfg.RegressionNetParams.GenesisBlock}, blocks...) {
+		stored, exists, err := s.store.GetBlockByHeight(uint64(height))
+		if err != nil || !exists {
+			t.Fatalf("expected the header of block %d to be kept", height)
+		}
+		header, err := stored.Header()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.BlockHash() != block.BlockHash() {
+			t.Fatalf("expected the header of %s at %d, got %s", block.BlockHash(), height, header.BlockHash())
+		}
+		// the genesis block is never pruned
+		pruned := height >= 1 && height <= 3
+		if stored.Pruned != pruned || pruned && len(stored.Txs) != 0 {
+			t.Fatalf("expected block %d pruned %v, got pruned %v with %d transactions", height, pruned, stored.Pruned, len(stored.Txs))
+		}
+		if height == 0 {
+			continue
+		}
+		for _, tx := range block.Transactions {
+			_, exists, err := s.store.GetTx(tx.TxHash().String())
+			if pruned && !errors.Is(err, store.ErrTxPruned) {
+				t.Fatalf("expected the transaction %s of block %d to be pruned, got %v", tx.TxHash(), height, err)
+			}
+			if !pruned && (err != nil || !exists) {
+				t.Fatalf("expected the transaction %s of block %d to be kept, got %v", tx.TxHash(), height, err)
+			}
+		}
+	}
+
+	after := snapshot()
+	if after.info.TxOuts != before.info.TxOuts || after.info.TotalAmount != before.info.TotalAmount || after.utxos != before.utxos {
+		t.Fatalf("expected the utxo set to be kept, got %+v instead of %+v", after, before)
+	}
+	if after.history != before.history {
+		t.Fatalf("expected the address history to be kept, got %s instead of %s", after.history, before.history)
+	}
+	// the outspend of the mempool transaction is kept
+	conflicting := &model.Transaction{
+		Hash: strings.Repeat("ff", 32),
+		Vins: []model.Vin{{PreviousTxId: unspent.String(), PreviousIndex: 0}},
+	}
+	if spender, conflict, err := s.store.GetTxConflict(conflicting); err != nil || !conflict || spender != mempoolTx.TxHash().String() {
+		t.Fatalf("expected a conflict with %s, got %v %q %v", mempoolTx.TxHash(), conflict, spender, err)
+	}
+
+	// nothing is left to prune until the tip moves
+	if err := s.prune(); err != nil {
+		t.Fatal(err)
+	}
+	if height, _, err := s.store.GetPrunedHeight(); err != nil || height != 3 {
+		t.Fatalf("expected the pruned height to stay at 3, got %d", height)
+	}
+}
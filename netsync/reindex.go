@@ -0,0 +1,391 @@
+package netsync
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/store"
+	"github.com/catalogfi/indexer/utils"
+	"go.uber.org/zap"
+)
+
+// Indexes that can be rebuilt from the stored blocks. Balances are served
+// from the UTXO set and rebuilt with it, along with the UTXO set statistics.
+const (
+	IndexUTXOs      = "utxos"
+	IndexHistory    = "history"
+	IndexOutspends  = "outspends"
+	IndexOpReturns  = "op_returns"
+	IndexBlockStats = "block_stats"
+	IndexSwaps      = "swaps"
+	IndexLocations  = "tx_locations"
+)
+
+var (
+	ErrReindexRunning  = errors.New("a reindex is already running")
+	ErrNothingToResume = errors.New("no unfinished reindex to resume")
+)
+
+var reindexableIndexes = map[string]bool{
+	IndexUTXOs:      true,
+	IndexHistory:    true,
+	IndexOutspends:  true,
+	IndexOpReturns:  true,
+	IndexBlockStats: true,
+	IndexSwaps:      true,
+	IndexLocations:  true,
+}
+
+// Reindex starts rebuilding the given indexes from the stored blocks in the
+// background, while the old data keeps being served. Without indexes the
+// last unfinished reindex is resumed from where it stopped.
+func (s *SyncManager) Reindex(indexes []string) (*model.ReindexProgress, error) {
+	s.reindexMu.Lock()
+	defer s.reindexMu.Unlock()
+
+	if s.reindexing {
+		return nil, ErrReindexRunning
+	}
+	select {
+	case <-s.shutdown:
+		return nil, errShuttingDown
+	default:
+	}
+	progress, exists, err := s.store.GetReindexProgress()
+	if err != nil {
+		return nil, err
+	}
+	if len(indexes) == 0 {
+		if !exists || progress.Done {
+			return nil, ErrNothingToResume
+		}
+	} else {
+		for _, index := range indexes {
+			if !reindexableIndexes[index] {
+				return nil, fmt.Errorf("unknown index %q", index)
+			}
+		}
+		// the staging area of an abandoned reindex is discarded
+		if err := s.store.ClearStagedUTXOs(); err != nil {
+			return nil, err
+		}
+		progress = &model.ReindexProgress{
+			Indexes:   indexes,
+			StartedAt: time.Now().UTC(),
+		}
+	}
+
+	// the indexes are rebuilt from the transactions of every block, which
+	// the pruned ones do not have anymore
+	pruned, prunedExists, err := s.store.GetPrunedHeight()
+	if err != nil {
+		return nil, err
+	}
+	if prunedExists && progress.NextHeight <= pruned {
+		return nil, fmt.Errorf("%w: can not reindex from height %d, the blocks are pruned up to height %d", store.ErrBlockPruned, progress.NextHeight, pruned)
+	}
+
+	progress.Running = true
+	progress.Error = ""
+	progress.UpdatedAt = time.Now().UTC()
+	if err := s.store.PutReindexProgress(progress); err != nil {
+		return nil, err
+	}
+	s.reindexing = true
+	started := *progress
+	s.goBackground(func() { s.runReindex(progress) })
+	return &started, nil
+}
+
+// ReindexProgress returns the progress of the last reindex.
+func (s *SyncManager) ReindexProgress() (*model.ReindexProgress, bool, error) {
+	progress, exists, err := s.store.GetReindexProgress()
+	if err != nil || !exists {
+		return nil, exists, err
+	}
+	s.reindexMu.Lock()
+	// a reindex interrupted by a restart is not running anymore
+	progress.Running = s.reindexing
+	s.reindexMu.Unlock()
+	return progress, true, nil
+}
+
+func (s *SyncManager) runReindex(progress *model.ReindexProgress) {
+	err := s.reindex(progress)
+
+	s.reindexMu.Lock()
+	s.reindexing = false
+	s.reindexMu.Unlock()
+
+	progress.Running = false
+	progress.UpdatedAt = time.Now().UTC()
+	if errors.Is(err, errShuttingDown) {
+		// the reindex is resumed from NextHeight after a restart
+		s.logger.Info("reindex interrupted", zap.Uint64("height", progress.NextHeight))
+	} else if err != nil {
+		s.logger.Error("reindex failed", zap.Uint64("height", progress.NextHeight), zap.Error(err))
+		progress.Error = err.Error()
+	} else {
+		s.logger.Info("reindex done", zap.Strings("indexes", progress.Indexes))
+	}
+	if err := s.store.PutReindexProgress(progress); err != nil {
+		s.logger.Error("error saving reindex progress", zap.Error(err))
+	}
+}
+
+func (s *SyncManager) reindex(progress *model.ReindexProgress) error {
+	indexes := make(map[string]bool, len(progress.Indexes))
+	for _, index := range progress.Indexes {
+		indexes[index] = true
+	}
+
+	for {
+		select {
+		case <-s.shutdown:
+			return errShuttingDown
+		default:
+		}
+		// no block may be connected or disconnected while a block is rebuilt,
+		// nor while the rebuilt indexes replace the live ones
+		s.blockMu.Lock()
+		done, err := s.reindexStep(progress, indexes)
+		s.blockMu.Unlock()
+		if err != nil || done {
+			return err
+		}
+
+		progress.UpdatedAt = time.Now().UTC()
+		if err := s.store.PutReindexProgress(progress); err != nil {
+			return err
+		}
+		if progress.NextHeight%1000 == 0 {
+			s.logger.Info("reindexing", zap.Uint64("height", progress.NextHeight), zap.Uint64("target", progress.TargetHeight))
+		}
+	}
+}
+
+// reindexStep rebuilds the next block, or replaces the live indexes once the
+// tip is reached, and tells whether the reindex is done. Callers must hold
+// blockMu.
+func (s *SyncManager) reindexStep(progress *model.ReindexProgress, indexes map[string]bool) (bool, error) {
+	// a reorg of the rebuilt blocks disconnects the last one too, so checking
+	// its hash is enough to tell whether the staged UTXO set was built from
+	// blocks which are not on the main chain anymore. It can not be rolled
+	// back, so the reindex starts over.
+	if progress.NextHeight > 0 {
+		hash, exists, err := s.BlockHashAt(progress.NextHeight - 1)
+		if err != nil {
+			return false, err
+		}
+		if !exists || hash != progress.LastHash {
+			s.logger.Warn("rebuilt blocks were reorganized, restarting the reindex", zap.Uint64("height", progress.NextHeight-1), zap.String("hash", progress.LastHash))
+			if err := s.store.ClearStagedUTXOs(); err != nil {
+				return false, err
+			}
+			progress.NextHeight = 0
+			progress.LastHash = ""
+			return false, nil
+		}
+	}
+
+	tip, _, err := s.store.GetLatestBlockHeight()
+	if err != nil {
+		return false, err
+	}
+	progress.TargetHeight = tip
+	if progress.NextHeight > tip {
+		return true, s.finishReindex(progress, indexes)
+	}
+
+	hash, err := s.reindexBlock(progress.NextHeight, indexes)
+	if err != nil {
+		return false, err
+	}
+	progress.NextHeight++
+	progress.LastHash = hash
+	return false, nil
+}
+
+// reindexBlock rebuilds the indexes of the main chain block at height and
+// returns its hash.
+func (s *SyncManager) reindexBlock(height uint64, indexes map[string]bool) (string, error) {
+	block, exists, err := s.store.GetBlockByHeight(height)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("block %d: %w", height, store.ErrGetBlockNotFound)
+	}
+	if block.Pruned {
+		return "", fmt.Errorf("block %d: %w", height, store.ErrBlockPruned)
+	}
+	txs, err := s.store.GetTxs(block.Txs)
+	if err != nil {
+		return "", err
+	}
+	if len(txs) != len(block.Txs) {
+		return "", fmt.Errorf("block %d: %d of %d transactions are missing", height, len(block.Txs)-len(txs), len(block.Txs))
+	}
+
+	vouts := make([]model.Vout, 0)
+	hashes := make([]string, 0)
+	indices := make([]uint32, 0)
+	for i, tx := range txs {
+		for _, vout := range tx.Vouts {
+			vout.Height = height
+			vout.Coinbase = i == 0
+			vouts = append(vouts, vout)
+		}
+		if i == 0 {
+			continue
+		}
+		for _, vin := range tx.Vins {
+			hashes = append(hashes, vin.PreviousTxId)
+			indices = append(indices, vin.PreviousIndex)
+		}
+	}
+
+	if indexes[IndexUTXOs] {
+		if err := s.store.PutStagedUTXOs(vouts); err != nil {
+			return "", err
+		}
+		if err := s.store.RemoveStagedUTXOs(hashes, indices); err != nil {
+			return "", err
+		}
+	}
+	if indexes[IndexHistory] {
+		if err := s.store.PutTxHistory(txs); err != nil {
+			return "", err
+		}
+	}
+	if indexes[IndexOpReturns] {
+		if err := s.store.PutOpReturns(utils.OpReturns(vouts, block.Hash, height)); err != nil {
+			return "", err
+		}
+	}
+	if indexes[IndexLocations] {
+		if err := s.store.PutTxLocations(block.Hash, height, block.Txs); err != nil {
+			return "", err
+		}
+	}
+	if indexes[IndexSwaps] {
+		if err := s.swaps.ConnectTxs(txs, height, block.Hash); err != nil {
+			return "", err
+		}
+	}
+	// the genesis block has no stats
+	if indexes[IndexBlockStats] && height > 0 {
+		wireBlock, err := toWireBlock(block, txs)
+		if err != nil {
+			return "", err
+		}
+		prevouts, err := s.resolveStoredPrevouts(hashes, indices)
+		if err != nil {
+			return "", err
+		}
+		if err := s.store.PutBlockStats(computeBlockStats(wireBlock, height, prevouts, s.chainParams)); err != nil {
+			return "", err
+		}
+	}
+	return block.Hash, nil
+}
+
+// finishReindex replaces the live UTXO set with the rebuilt one. The other
+// indexes are rebuilt in place, so the entries of transactions which left the
+// main chain are deleted, the locations first as the others are checked
+// against them.
+func (s *SyncManager) finishReindex(progress *model.ReindexProgress, indexes map[string]bool) error {
+	if indexes[IndexUTXOs] {
+		if err := s.store.CommitStagedUTXOs(); err != nil {
+			return err
+		}
+	}
+	if indexes[IndexLocations] {
+		cleaned, err := s.store.CleanTxLocations()
+		if err != nil {
+			return err
+		}
+		s.logger.Info("removed stale transaction locations", zap.Int("count", cleaned))
+	}
+	if indexes[IndexHistory] {
+		cleaned, err := s.store.CleanTxHistory()
+		if err != nil {
+			return err
+		}
+		s.logger.Info("removed stale history", zap.Int("count", cleaned))
+	}
+	if indexes[IndexOpReturns] {
+		cleaned, err := s.store.CleanOpReturns()
+		if err != nil {
+			return err
+		}
+		s.logger.Info("removed stale op_returns", zap.Int("count", cleaned))
+	}
+	if indexes[IndexOutspends] {
+		cleaned, err := s.store.CleanOutspends()
+		if err != nil {
+			return err
+		}
+		s.logger.Info("removed stale outspends", zap.Int("count", cleaned))
+	}
+	progress.Done = true
+	return nil
+}
+
+// resolveStoredPrevouts looks up already spent outputs in the bodies of the
+// transactions that created them, keyed by outpoint. Pruned ones are left out.
+func (s *SyncManager) resolveStoredPrevouts(hashes []string, indices []uint32) (map[wire.OutPoint]*model.Vout, error) {
+	unique := make([]string, 0, len(hashes))
+	seen := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		if !seen[hash] {
+			seen[hash] = true
+			unique = append(unique, hash)
+		}
+	}
+	txs, err := s.store.GetTxs(unique)
+	if err != nil {
+		return nil, err
+	}
+	byHash := make(map[string]*model.Transaction, len(txs))
+	for _, tx := range txs {
+		byHash[tx.Hash] = tx
+	}
+
+	prevouts := make(map[wire.OutPoint]*model.Vout, len(hashes))
+	for i, hash := range hashes {
+		tx, ok := byHash[hash]
+		if !ok || int(indices[i]) >= len(tx.Vouts) {
+			continue
+		}
+		txHash, err := chainhash.NewHashFromStr(hash)
+		if err != nil {
+			return nil, err
+		}
+		vout := tx.Vouts[indices[i]]
+		prevouts[*wire.NewOutPoint(txHash, indices[i])] = &vout
+	}
+	return prevouts, nil
+}
+
+func toWireBlock(block *model.Block, txs []*model.Transaction) (*wire.MsgBlock, error) {
+	header, err := block.Header()
+	if err != nil {
+		return nil, err
+	}
+	wireBlock := wire.NewMsgBlock(header)
+	for _, tx := range txs {
+		wireTx, err := tx.ToWireTx()
+		if err != nil {
+			return nil, err
+		}
+		if err := wireBlock.AddTransaction(wireTx); err != nil {
+			return nil, err
+		}
+	}
+	return wireBlock, nil
+}
@@ -0,0 +1,212 @@
+package netsync
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/database"
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/store"
+	"github.com/catalogfi/indexer/utils"
+)
+
+var allIndexes = []string{IndexUTXOs, IndexHistory, IndexOutspends, IndexOpReturns, IndexBlockStats, IndexSwaps, IndexLocations}
+
+// wipeIndexes deletes the UTXO set and the address history of the test
+// scripts, as a corrupted database would have lost them.
+func wipeIndexes(t *testing.T, db database.Db) {
+	keys := []string{"utxoSetInfo"}
+	for _, script := range [][]byte{minerScript, payScript} {
+		for _, prefix := range []string{"", "tx"} {
+			err := db.IterateWithPrefix(prefix+hex.EncodeToString(script), func(key, value []byte) bool {
+				keys = append(keys, string(key))
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.DeleteMulti(keys); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func reindexSteps(t *testing.T, s *SyncManager, progress *model.ReindexProgress, n int) {
+	indexes := make(map[string]bool, len(progress.Indexes))
+	for _, index := range progress.Indexes {
+		indexes[index] = true
+	}
+	for i := 0; i < n; i++ {
+		if done, err := s.reindexStep(progress, indexes); err != nil || done {
+			t.Fatalf("reindex step %d: done %v, error %v", i, done, err)
+		}
+	}
+}
+
+func TestReindex(t *testing.T) {
+	bits := chaincfg.RegressionNetParams.PowLimitBits
+	blocks := buildBranch(t, chaincfg.RegressionNetParams.GenesisBlock, 1, 5, 'c', bits, true)
+	s, db := newTestSyncManagerWithDB(t)
+	putBlocks(t, s, blocks)
+	expected := newTestSyncManager(t)
+	putBlocks(t, expected, blocks)
+
+	wipeIndexes(t, db)
+	if utxos, err := s.store.GetUTXOs(hex.EncodeToString(payScript)); err != nil || len(utxos) != 0 {
+		t.Fatalf("expected the utxos to be wiped, got %d", len(utxos))
+	}
+	progress := &model.ReindexProgress{Indexes: allIndexes}
+	if err := s.reindex(progress); err != nil {
+		t.Fatal(err)
+	}
+	if !progress.Done || progress.NextHeight != 6 || progress.LastHash != blocks[4].BlockHash().String() {
+		t.Fatalf("unexpected progress %+v", progress)
+	}
+	assertSameIndexes(t, s, expected, blocks, nil)
+}
+
+func TestReindexResume(t *testing.T) {
+	bits := chaincfg.RegressionNetParams.PowLimitBits
+	blocks := buildBranch(t, chaincfg.RegressionNetParams.GenesisBlock, 1, 5, 'c', bits, true)
+	s, db := newTestSyncManagerWithDB(t)
+	putBlocks(t, s, blocks)
+	expected := newTestSyncManager(t)
+	putBlocks(t, expected, blocks)
+	wipeIndexes(t, db)
+
+	// the reindex is interrupted after 3 blocks
+	progress := &model.ReindexProgress{Indexes: allIndexes}
+	reindexSteps(t, s, progress, 3)
+	if err := s.store.PutReindexProgress(progress); err != nil {
+		t.Fatal(err)
+	}
+
+	started, err := s.Reindex(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started.NextHeight != 3 {
+		t.Fatalf("expected the reindex to resume at 3, got %d", started.NextHeight)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		progress, _, err := s.ReindexProgress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if progress.Done && !progress.Running {
+			break
+		}
+		if progress.Error != "" || time.Now().After(deadline) {
+			t.Fatalf("the reindex did not finish: %+v", progress)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertSameIndexes(t, s, expected, blocks, nil)
+
+	if _, err := s.Reindex(nil); err != ErrNothingToResume {
+		t.Fatalf("expected nothing to resume, got %v", err)
+	}
+}
+
+func TestReindexReorganized(t *testing.T) {
+	bits := chaincfg.RegressionNetParams.PowLimitBits
+	common := buildBranch(t, chaincfg.RegressionNetParams.GenesisBlock, 1, 3, 'c', bits, false)
+	main := buildBranch(t, common[2], 4, 2, 'a', bits, true)
+	fork := buildBranch(t, common[2], 4, 3, 'b', bits, false)
+	s := newTestSyncManager(t)
+	putBlocks(t, s, common)
+	putBlocks(t, s, main)
+
+	// the blocks of main are rebuilt before the reorg disconnects them
+	progress := &model.ReindexProgress{Indexes: allIndexes}
+	reindexSteps(t, s, progress, 6)
+	putBlocks(t, s, fork)
+	assertTip(t, s, fork[2], 6)
+
+	if err := s.reindex(progress); err != nil {
+		t.Fatal(err)
+	}
+	if !progress.Done || progress.LastHash != fork[2].BlockHash().String() {
+		t.Fatalf("unexpected progress %+v", progress)
+	}
+	expected := newTestSyncManager(t)
+	putBlocks(t, expected, common)
+	putBlocks(t, expected, fork)
+	putMempoolTxs(t, expected, main[0].Transactions[1:])
+	assertSameIndexes(t, s, expected, append(append([]*wire.MsgBlock{}, common...), fork...), main)
+}
+
+// TestReindexStaleEntries checks that the reindex deletes the entries left by
+// the transactions of orphaned blocks, as it rebuilds over the live indexes.
+func TestReindexStaleEntries(t *testing.T) {
+	bits := chaincfg.RegressionNetParams.PowLimitBits
+	common := buildBranch(t, chaincfg.RegressionNetParams.GenesisBlock, 1, 3, 'c', bits, false)
+	main := buildBranch(t, common[2], 4, 2, 'a', bits, true)
+	fork := buildBranch(t, common[2], 4, 3, 'b', bits, false)
+	s := newTestSyncManager(t)
+	putBlocks(t, s, common)
+	putBlocks(t, s, main)
+	putBlocks(t, s, fork)
+
+	// the orphaned transactions of main[1] are still indexed, as a database
+	// corrupted by a crash would have them
+	staleHash := main[1].BlockHash().String()
+	_, _, _, stale, err := utils.SplitTxs(main[1].Transactions, staleHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txHashes := make([]string, len(stale))
+	for i, tx := range stale {
+		txHashes[i] = tx.Hash
+	}
+	if err := s.store.PutTxLocations(staleHash, 5, txHashes); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.PutTxHistory(stale); err != nil {
+		t.Fatal(err)
+	}
+	opReturn := model.OpReturn{TxId: txHashes[1], Payload: "aabb", Height: 5, BlockHash: staleHash}
+	if err := s.store.PutOpReturns([]model.OpReturn{opReturn}); err != nil {
+		t.Fatal(err)
+	}
+
+	progress := &model.ReindexProgress{Indexes: allIndexes}
+	if err := s.reindex(progress); err != nil {
+		t.Fatal(err)
+	}
+	expected := newTestSyncManager(t)
+	putBlocks(t, expected, common)
+	putBlocks(t, expected, fork)
+	putMempoolTxs(t, expected, main[0].Transactions[1:])
+	assertSameIndexes(t, s, expected, append(append([]*wire.MsgBlock{}, common...), fork...), main)
+	opReturns, _, err := s.store.SearchOpReturns("aabb", false, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opReturns) != 0 {
+		t.Fatalf("expected the stale op_return to be deleted, got %d", len(opReturns))
+	}
+}
+
+func TestReindexPruned(t *testing.T) {
+	s := newTestSyncManager(t)
+	blocks := buildBranch(t, chaincfg.RegressionNetParams.GenesisBlock, 1, 3, 'c', chaincfg.RegressionNetParams.PowLimitBits, false)
+	putBlocks(t, s, blocks)
+	if err := s.store.PruneBlock(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reindex([]string{IndexUTXOs}); !errors.Is(err, store.ErrBlockPruned) {
+		t.Fatalf("expected a pruned error, got %v", err)
+	}
+
+	// no block is pruned while a reindex runs
+	s.reindexing = true
+	if err := s.pruneBlock(2); err != errReindexing {
+		t.Fatalf("expected pruning to be held off, got %v", err)
+	}
+}
@@ -0,0 +1,809 @@
+package netsync
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/command"
+	"github.com/catalogfi/indexer/consensus"
+	"github.com/catalogfi/indexer/database"
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/muhash"
+	"github.com/catalogfi/indexer/store"
+	"go.uber.org/zap"
+)
+
+var (
+	minerScript = testScript(1)
+	payScript   = testScript(2)
+	// regtestRules are the rules the tests sync regtest with
+	regtestRules = consensus.NewBitcoinRules(&chaincfg.RegressionNetParams, consensus.DoubleSHA256)
+)
+
+func testScript(tag byte) []byte {
+	script, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_DUP).AddOp(txscript.OP_HASH160).
+		AddData(bytes.Repeat([]byte{tag}, 20)).
+		AddOp(txscript.OP_EQUALVERIFY).AddOp(txscript.OP_CHECKSIG).
+		Script()
+	if err != nil {
+		panic(err)
+	}
+	return script
+}
+
+func newTestSyncManager(t *testing.T) *SyncManager {
+	s, _ := newTestSyncManagerWithDB(t)
+	return s
+}
+
+// newTestSyncManagerWithDB also returns the database of the sync manager, for
+// the tests tampering with the keys the store does not expose.
+func newTestSyncManagerWithDB(t *testing.T) (*SyncManager, database.Db) {
+	db, err := database.NewRocksDB(t.TempDir(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSyncManager(SyncConfig{
+		PeerAddrs:   []string{"127.0.0.1:18444"},
+		ChainParams: &chaincfg.RegressionNetParams,
+		Rules:       regtestRules,
+		Store:       store.NewStorage(db),
+		Logger:      zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkForGensisBlock(); err != nil {
+		t.Fatal(err)
+	}
+	return s, db
+}
+
+// buildBranch mines n blocks on prev, the first at height. The coinbase of
+// each block is tagged with branch, and every block but the first, unless
+// spendFirst is set, spends the coinbase of its parent with a chain of two
+// transactions.
+func buildBranch(t *testing.T, prev *wire.MsgBlock, height uint64, n int, branch byte, bits uint32, spendFirst bool) []*wire.MsgBlock {
+	blocks := make([]*wire.MsgBlock, 0, n)
+	for i := 0; i < n; i++ {
+		coinbase := wire.NewMsgTx(1)
+		coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), []byte{branch, byte(height), byte(height >> 8)}, nil))
+		coinbase.AddTxOut(wire.NewTxOut(50*btcutil.SatoshiPerBitcoin, minerScript))
+		txs := []*wire.MsgTx{coinbase}
+
+		if i > 0 || spendFirst {
+			parentCoinbase := prev.Transactions[0].TxHash()
+			spend := wire.NewMsgTx(1)
+			spend.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&parentCoinbase, 0), nil, nil))
+			spend.AddTxOut(wire.NewTxOut(prev.Transactions[0].TxOut[0].Value-1000, payScript))
+			spendHash := spend.TxHash()
+			// spent in the block that created it
+			respend := wire.NewMsgTx(1)
+			respend.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&spendHash, 0), nil, nil))
+			respend.AddTxOut(wire.NewTxOut(spend.TxOut[0].Value-1000, payScript))
+			txs = append(txs, spend, respend)
+		}
+
+		utilTxs := make([]*btcutil.Tx, len(txs))
+		for j, tx := range txs {
+			utilTxs[j] = btcutil.NewTx(tx)
+		}
+		prevHash := prev.BlockHash()
+		merkleRoot := blockchain.CalcMerkleRoot(utilTxs, false)
+		header := wire.NewBlockHeader(1, &prevHash, &merkleRoot, bits, 0)
+		header.Timestamp = prev.Header.Timestamp.Add(time.Minute)
+		solveHeader(header)
+
+		block := wire.NewMsgBlock(header)
+		for _, tx := range txs {
+			if err := block.AddTransaction(tx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		blocks = append(blocks, block)
+		prev = block
+		height++
+	}
+	return blocks
+}
+
+// solveHeader increments the nonce of header until its hash meets its bits.
+func solveHeader(header *wire.BlockHeader) {
+	target := blockchain.CompactToBig(header.Bits)
+	for {
+		hash := header.BlockHash()
+		if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+			return
+		}
+		header.Nonce++
+	}
+}
+
+// addTxs appends txs to block and solves its header again.
+func addTxs(t *testing.T, block *wire.MsgBlock, txs ...*wire.MsgTx) {
+	for _, tx := range txs {
+		if err := block.AddTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	utilTxs := make([]*btcutil.Tx, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		utilTxs[i] = btcutil.NewTx(tx)
+	}
+	block.Header.MerkleRoot = blockchain.CalcMerkleRoot(utilTxs, false)
+	solveHeader(&block.Header)
+}
+
+func putBlocks(t *testing.T, s *SyncManager, blocks []*wire.MsgBlock) {
+	for _, block := range blocks {
+		if err := s.putBlock(block, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// putMempoolTxs puts txs in the mempool of s, as a reorg does with the
+// transactions of the blocks it disconnects.
+func putMempoolTxs(t *testing.T, s *SyncManager, txs []*wire.MsgTx) {
+	t.Helper()
+	for _, tx := range txs {
+		if err := s.mempool.ProcessTx(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func assertTip(t *testing.T, s *SyncManager, tip *wire.MsgBlock, height uint64) {
+	t.Helper()
+	hash, _, err := s.store.GetLatestTipHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.latestHeight != height || hash != tip.BlockHash().String() {
+		t.Fatalf("expected tip %s at %d, got %s at %d", tip.BlockHash(), height, hash, s.latestHeight)
+	}
+}
+
+// assertSameIndexes checks that the indexes of s match the ones of expected,
+// which only ever saw the chain s reorganized to.
+func assertSameIndexes(t *testing.T, s, expected *SyncManager, connected, disconnected []*wire.MsgBlock) {
+	t.Helper()
+	info, err := s.store.GetUTXOSetInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedInfo, err := expected.store.GetUTXOSetInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.TxOuts != expectedInfo.TxOuts || info.TotalAmount != expectedInfo.TotalAmount || muHash(t, info.MuHash) != muHash(t, expectedInfo.MuHash) {
+		t.Fatalf("expected utxo set %d outputs of %d, got %d outputs of %d", expectedInfo.TxOuts, expectedInfo.TotalAmount, info.TxOuts, info.TotalAmount)
+	}
+
+	for _, script := range [][]byte{minerScript, payScript} {
+		scriptHex := hex.EncodeToString(script)
+		utxos, err := s.store.GetUTXOs(scriptHex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedUTXOs, err := expected.store.GetUTXOs(scriptHex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(utxos) != len(expectedUTXOs) {
+			t.Fatalf("expected %d utxos of %s, got %d", len(expectedUTXOs), scriptHex, len(utxos))
+		}
+		for i := range utxos {
+			if *utxos[i] != *expectedUTXOs[i] {
+				t.Fatalf("expected utxo %+v, got %+v", expectedUTXOs[i], utxos[i])
+			}
+		}
+
+		history, err := s.store.GetTxHashesOfPubScript(scriptHex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedHistory, err := expected.store.GetTxHashesOfPubScript(scriptHex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(history)
+		sort.Strings(expectedHistory)
+		if len(history) != len(expectedHistory) {
+			t.Fatalf("expected %d history entries of %s, got %d", len(expectedHistory), scriptHex, len(history))
+		}
+		for i := range history {
+			if history[i] != expectedHistory[i] {
+				t.Fatalf("expected history %v, got %v", expectedHistory, history)
+			}
+		}
+	}
+
+	for _, block := range connected {
+		for i, tx := range block.Transactions {
+			location, exists, err := s.store.GetTxLocation(tx.TxHash().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !exists || location.BlockHash != block.BlockHash().String() || location.Index != uint32(i) {
+				t.Fatalf("transaction %s not located in block %s", tx.TxHash(), block.BlockHash())
+			}
+		}
+	}
+	for _, block := range disconnected {
+		if _, exists, err := s.store.GetBlock(block.BlockHash().String()); err != nil || exists {
+			t.Fatalf("disconnected block %s is still in the main chain", block.BlockHash())
+		}
+		if _, exists, err := s.store.GetOrphanBlock(block.BlockHash().String()); err != nil || !exists {
+			t.Fatalf("disconnected block %s is not kept as an orphan", block.BlockHash())
+		}
+		for _, tx := range block.Transactions {
+			if _, exists, err := s.store.GetTxLocation(tx.TxHash().String()); err != nil || exists {
+				t.Fatalf("transaction %s of a disconnected block is still located", tx.TxHash())
+			}
+		}
+	}
+}
+
+// muHash returns the digest of a serialized MuHash, whose serialization
+// depends on the order of the updates.
+func muHash(t *testing.T, data []byte) [32]byte {
+	t.Helper()
+	hash, err := muhash.Deserialize(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash.Finalize()
+}
+
+func TestReorganize(t *testing.T) {
+	for _, depth := range []int{1, 6, 100} {
+		t.Run(fmt.Sprintf("%d blocks", depth), func(t *testing.T) {
+			testReorganize(t, depth)
+		})
+	}
+}
+
+func testReorganize(t *testing.T, depth int) {
+	bits := chaincfg.RegressionNetParams.PowLimitBits
+	s := newTestSyncManager(t)
+	genesis := chaincfg.RegressionNetParams.GenesisBlock
+	common := buildBranch(t, genesis, 1, 3, 'c', bits, false)
+	ancestor := common[len(common)-1]
+	main := buildBranch(t, ancestor, 4, depth, 'a', bits, true)
+	// the fork does not spend the coinbase of the ancestor, which has
+	// to be back in the utxo set after the reorg
+	fork := buildBranch(t, ancestor, 4, depth+1, 'b', bits, false)
+
+	putBlocks(t, s, common)
+	putBlocks(t, s, main)
+	// a fork with as much work as the main chain does not replace it
+	putBlocks(t, s, fork[:depth])
+	assertTip(t, s, main[depth-1], uint64(3+depth))
+
+	putBlocks(t, s, fork[depth:])
+	assertTip(t, s, fork[depth], uint64(4+depth))
+
+	// the spends of the ancestor's coinbase are back in the mempool, the
+	// other transactions of main spend outputs gone with it
+	expected := newTestSyncManager(t)
+	putBlocks(t, expected, common)
+	putBlocks(t, expected, fork)
+	putMempoolTxs(t, expected, main[0].Transactions[1:])
+	assertSameIndexes(t, s, expected, fork, main)
+
+	// the old main chain takes over again once it has more work
+	extension := buildBranch(t, main[depth-1], uint64(4+depth), 2, 'a', bits, true)
+	putBlocks(t, s, extension)
+	assertTip(t, s, extension[1], uint64(5+depth))
+	expected = newTestSyncManager(t)
+	putBlocks(t, expected, common)
+	putBlocks(t, expected, main)
+	putBlocks(t, expected, extension)
+	assertSameIndexes(t, s, expected, append(main, extension...), fork)
+}
+
+func TestReorganizeByWork(t *testing.T) {
+	s := newTestSyncManager(t)
+	// the rules of regtest never change the difficulty
+	s.validator = consensus.NewValidator(s.chainParams, nil, blockChain{s.store})
+	bits := chaincfg.RegressionNetParams.PowLimitBits
+	genesis := chaincfg.RegressionNetParams.GenesisBlock
+	common := buildBranch(t, genesis, 1, 3, 'c', bits, false)
+	ancestor := common[len(common)-1]
+	main := buildBranch(t, ancestor, 4, 3, 'a', bits, true)
+	// two blocks with a 256 times smaller target outweigh the main chain
+	fork := buildBranch(t, ancestor, 4, 2, 'b', 0x1f7fffff, false)
+
+	putBlocks(t, s, common)
+	putBlocks(t, s, main)
+	putBlocks(t, s, fork)
+	assertTip(t, s, fork[1], 5)
+	if _, exists, err := s.store.GetBlockByHeight(6); err != nil || exists {
+		t.Fatal("a disconnected block is still at height 6")
+	}
+
+	expected := newTestSyncManager(t)
+	expected.validator = consensus.NewValidator(expected.chainParams, nil, blockChain{expected.store})
+	putBlocks(t, expected, common)
+	putBlocks(t, expected, fork)
+	putMempoolTxs(t, expected, main[0].Transactions[1:])
+	assertSameIndexes(t, s, expected, fork, main)
+}
+
+// TestReorgAcrossPrunedHeight checks that the blocks spending outputs of
+// pruned blocks are disconnected from their undo data, and that a reorg
+// is refused before it starts if the spent outputs are not known.
+func TestReorgAcrossPrunedHeight(t *testing.T) {
+	bits := chaincfg.RegressionNetParams.PowLimitBits
+	common := buildBranch(t, chaincfg.RegressionNetParams.GenesisBlock, 1, 3, 'c', bits, false)
+	main := buildBranch(t, common[2], 4, 2, 'a', bits, true)
+	fork := buildBranch(t, common[2], 4, 3, 'b', bits, false)
+	prune := func(t *testing.T, s *SyncManager) {
+		for height := uint64(1); height <= 3; height++ {
+			if err := s.store.PruneBlock(height); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	s := newTestSyncManager(t)
+	putBlocks(t, s, common)
+	putBlocks(t, s, main)
+	prune(t, s)
+	putBlocks(t, s, fork)
+	assertTip(t, s, fork[2], 6)
+
+	expected := newTestSyncManager(t)
+	putBlocks(t, expected, common)
+	putBlocks(t, expected, fork)
+	putMempoolTxs(t, expected, main[0].Transactions[1:])
+	assertSameIndexes(t, s, expected, fork, main)
+
+	// main[0] spends the coinbase of a pruned block without recording it
+	s = newTestSyncManager(t)
+	putBlocks(t, s, common)
+	putBlocks(t, s, main)
+	prune(t, s)
+	if err := s.store.RemoveBlockUndo(main[0].BlockHash().String()); err != nil {
+		t.Fatal(err)
+	}
+	putBlocks(t, s, fork[:2])
+	if err := s.putBlock(fork[2], nil); err == nil {
+		t.Fatal("expected the reorg to be refused")
+	}
+	assertTip(t, s, main[1], 5)
+	if _, exists, err := s.store.GetReorgProgress(); err != nil || exists {
+		t.Fatalf("expected no reorg progress, got %v, %v", exists, err)
+	}
+}
+
+// TestTxStatusAcrossReorg checks the locations and the statuses get_tx reports
+// for the transactions of the blocks connected and disconnected by a reorg,
+// and of the mempool.
+func TestTxStatusAcrossReorg(t *testing.T) {
+	bits := chaincfg.RegressionNetParams.PowLimitBits
+	common := buildBranch(t, chaincfg.RegressionNetParams.GenesisBlock, 1, 3, 'c', bits, false)
+	main := buildBranch(t, common[2], 4, 2, 'a', bits, true)
+	fork := buildBranch(t, common[2], 4, 3, 'b', bits, false)
+	s := newTestSyncManager(t)
+	putBlocks(t, s, common)
+	putBlocks(t, s, main)
+
+	getTx := command.GetTx(s.store)
+	assertStatus := func(tx *wire.MsgTx, status string, height, confirmations uint64, replacedBy string) command.TxWithStatus {
+		t.Helper()
+		result, err := getTx.Execute(json.RawMessage(`"` + tx.TxHash().String() + `"`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		txStatus := result.(command.TxWithStatus)
+		if txStatus.Status != status || txStatus.Height != height || txStatus.Confirmations != confirmations || txStatus.ReplacedBy != replacedBy {
+			t.Fatalf("expected %s %s at %d with %d confirmations, replaced by %q, got %s at %d with %d confirmations, replaced by %q",
+				tx.TxHash(), status, height, confirmations, replacedBy, txStatus.Status, txStatus.Height, txStatus.Confirmations, txStatus.ReplacedBy)
+		}
+		return txStatus
+	}
+
+	confirmed := assertStatus(main[1].Transactions[2], command.TxConfirmed, 5, 1, "")
+	if confirmed.Position == nil || *confirmed.Position != 2 || confirmed.BlockHash != main[1].BlockHash().String() {
+		t.Fatalf("expected the transaction at position 2 of %s, got %+v", main[1].BlockHash(), confirmed)
+	}
+
+	putBlocks(t, s, fork)
+	assertTip(t, s, fork[2], 6)
+	// the transactions of the disconnected blocks lose their location, the
+	// ones still valid on the new main chain are back in the mempool
+	assertStatus(main[0].Transactions[1], command.TxMempool, 0, 0, "")
+	assertStatus(main[0].Transactions[2], command.TxMempool, 0, 0, "")
+	assertStatus(main[1].Transactions[0], command.TxOrphaned, 5, 0, "")
+	assertStatus(main[1].Transactions[1], command.TxOrphaned, 5, 0, "")
+	assertStatus(common[1].Transactions[1], command.TxConfirmed, 2, 5, "")
+	moved := assertStatus(fork[1].Transactions[1], command.TxConfirmed, 5, 2, "")
+	if moved.BlockHash != fork[1].BlockHash().String() {
+		t.Fatalf("expected the transaction in %s, got %s", fork[1].BlockHash(), moved.BlockHash)
+	}
+
+	// two mempool transactions spend the coinbase of the tip
+	coinbase := fork[2].Transactions[0].TxHash()
+	spend := func(value int64) *wire.MsgTx {
+		tx := wire.NewMsgTx(1)
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&coinbase, 0), nil, nil))
+		tx.AddTxOut(wire.NewTxOut(value, payScript))
+		return tx
+	}
+	original, replacement := spend(1000), spend(2000)
+	if err := s.mempool.ProcessTx(original); err != nil {
+		t.Fatal(err)
+	}
+	assertStatus(original, command.TxMempool, 0, 0, "")
+	if err := s.mempool.ProcessTx(replacement); err != nil {
+		t.Fatal(err)
+	}
+	assertStatus(original, command.TxReplaced, 0, 0, replacement.TxHash().String())
+	assertStatus(replacement, command.TxMempool, 0, 0, "")
+}
+
+// TestWalletTxsAcrossReorg checks that the wallet transactions which can not
+// go back to the mempool are dropped when their block is disconnected, along
+// with the replaced ones.
+func TestWalletTxsAcrossReorg(t *testing.T) {
+	bits := chaincfg.RegressionNetParams.PowLimitBits
+	common := buildBranch(t, chaincfg.RegressionNetParams.GenesisBlock, 1, 3, 'c', bits, false)
+	main := buildBranch(t, common[2], 4, 2, 'a', bits, true)
+	fork := buildBranch(t, common[2], 4, 3, 'b', bits, false)
+	s := newTestSyncManager(t)
+	if _, err := s.wallets.CreateWallet("w"); err != nil {
+		t.Fatal(err)
+	}
+	for _, script := range [][]byte{minerScript, payScript} {
+		addr, err := btcutil.NewAddressPubKeyHash(script[3:23], s.chainParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.wallets.ImportAddress("w", addr.EncodeAddress(), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putBlocks(t, s, common)
+	putBlocks(t, s, main)
+
+	assertWalletTx := func(tx *wire.MsgTx, exists bool, height uint64) {
+		t.Helper()
+		walletTx, found, err := s.store.GetWalletTx("w", tx.TxHash().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != exists {
+			t.Fatalf("expected %s in the wallet to be %v, got %v", tx.TxHash(), exists, found)
+		}
+		if exists && walletTx.Height != height {
+			t.Fatalf("expected %s at %d, got %d", tx.TxHash(), height, walletTx.Height)
+		}
+	}
+	assertWalletTx(main[1].Transactions[0], true, 5)
+	assertWalletTx(main[1].Transactions[1], true, 5)
+
+	putBlocks(t, s, fork)
+	assertTip(t, s, fork[2], 6)
+	// back in the mempool
+	assertWalletTx(main[0].Transactions[1], true, 0)
+	assertWalletTx(main[0].Transactions[2], true, 0)
+	// the coinbases and the transactions spending them are gone
+	assertWalletTx(main[0].Transactions[0], false, 0)
+	assertWalletTx(main[1].Transactions[0], false, 0)
+	assertWalletTx(main[1].Transactions[1], false, 0)
+	assertWalletTx(main[1].Transactions[2], false, 0)
+	assertWalletTx(fork[1].Transactions[1], true, 5)
+
+	// a mempool transaction replaced by another one spending the same output
+	coinbase := fork[2].Transactions[0].TxHash()
+	spend := func(value int64) *wire.MsgTx {
+		tx := wire.NewMsgTx(1)
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&coinbase, 0), nil, nil))
+		tx.AddTxOut(wire.NewTxOut(value, payScript))
+		return tx
+	}
+	original, replacement := spend(1000), spend(2000)
+	if err := s.mempool.ProcessTx(original); err != nil {
+		t.Fatal(err)
+	}
+	assertWalletTx(original, true, 0)
+	if err := s.mempool.ProcessTx(replacement); err != nil {
+		t.Fatal(err)
+	}
+	assertWalletTx(original, false, 0)
+	assertWalletTx(replacement, true, 0)
+
+	// a block confirming a transaction conflicting with the replacement
+	conflict := spend(3000)
+	next := buildBranch(t, fork[2], 7, 1, 'b', bits, false)[0]
+	addTxs(t, next, conflict)
+	putBlocks(t, s, []*wire.MsgBlock{next})
+	assertWalletTx(replacement, false, 0)
+	assertWalletTx(conflict, true, 7)
+}
+
+// TestFeesOfReplacedTxs checks that the fee estimator stops tracking the
+// mempool transactions replaced in the mempool or by a block.
+func TestFeesOfReplacedTxs(t *testing.T) {
+	bits := chaincfg.RegressionNetParams.PowLimitBits
+	blocks := buildBranch(t, chaincfg.RegressionNetParams.GenesisBlock, 1, 2, 'c', bits, false)
+	s := newTestSyncManager(t)
+	putBlocks(t, s, blocks)
+
+	coinbase := blocks[1].Transactions[0]
+	coinbaseHash := coinbase.TxHash()
+	spend := func(fee int64) *wire.MsgTx {
+		tx := wire.NewMsgTx(1)
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&coinbaseHash, 0), nil, nil))
+		tx.AddTxOut(wire.NewTxOut(coinbase.TxOut[0].Value-fee, payScript))
+		return tx
+	}
+	assertTracked := func(txs ...*wire.MsgTx) {
+		t.Helper()
+		expected := 0.0
+		for _, tx := range txs {
+			expected += float64(tx.SerializeSize())
+		}
+		tracked := 0.0
+		for _, bin := range s.feeEstimator.FeeHistogram() {
+			tracked += bin[1]
+		}
+		if tracked != expected {
+			t.Fatalf("expected %v vbytes of tracked transactions, got %v", expected, tracked)
+		}
+	}
+
+	original, replacement := spend(1000), spend(2000)
+	if err := s.mempool.ProcessTx(original); err != nil {
+		t.Fatal(err)
+	}
+	assertTracked(original)
+	if err := s.mempool.ProcessTx(replacement); err != nil {
+		t.Fatal(err)
+	}
+	assertTracked(replacement)
+
+	next := buildBranch(t, blocks[1], 3, 1, 'c', bits, false)[0]
+	addTxs(t, next, spend(3000))
+	putBlocks(t, s, []*wire.MsgBlock{next})
+	assertTracked()
+}
+
+// TestResumeReorg checks that a reorg interrupted by a crash at any point is
+// finished on restart.
+func TestResumeReorg(t *testing.T) {
+	bits := chaincfg.RegressionNetParams.PowLimitBits
+	common := buildBranch(t, chaincfg.RegressionNetParams.GenesisBlock, 1, 3, 'c', bits, false)
+	main := buildBranch(t, common[2], 4, 3, 'a', bits, true)
+	fork := buildBranch(t, common[2], 4, 4, 'b', bits, false)
+
+	disconnect := func(t *testing.T, s *SyncManager, block *wire.MsgBlock) *model.Block {
+		stored, _, err := s.store.GetBlock(block.BlockHash().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs, err := s.blockTxs(stored, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.disconnectBlock(stored, txs); err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+	connect := func(t *testing.T, s *SyncManager, block *wire.MsgBlock) *model.Block {
+		stored, _, err := s.store.GetOrphanBlock(block.BlockHash().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored.IsOrphan = false
+		if err := s.connectBlock(block, stored); err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+
+	tests := []struct {
+		name string
+		// crash moves some blocks of the reorg, as it would have been applied
+		// until the crash
+		crash func(t *testing.T, s *SyncManager)
+	}{
+		{"recorded", func(t *testing.T, s *SyncManager) {}},
+		{"disconnected", func(t *testing.T, s *SyncManager) {
+			disconnect(t, s, main[2])
+			disconnect(t, s, main[1])
+		}},
+		{"before leaving the main chain", func(t *testing.T, s *SyncManager) {
+			disconnect(t, s, main[2])
+			block := disconnect(t, s, main[1])
+			block.IsOrphan = false
+			if err := s.store.PutBlock(block); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.store.PutTxLocations(block.Hash, block.Height, block.Txs); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"connected", func(t *testing.T, s *SyncManager) {
+			for i := 2; i >= 0; i-- {
+				disconnect(t, s, main[i])
+			}
+			for _, block := range fork[:2] {
+				if err := s.store.RemoveOrphanBlock(connect(t, s, block)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}},
+		{"before leaving the orphans", func(t *testing.T, s *SyncManager) {
+			for i := 2; i >= 0; i-- {
+				disconnect(t, s, main[i])
+			}
+			connect(t, s, fork[0])
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestSyncManager(t)
+			putBlocks(t, s, common)
+			putBlocks(t, s, main)
+			putBlocks(t, s, fork[:3])
+			tip, err := newBlockModel(fork[3], 7, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tip.IsOrphan = true
+			if err := s.putOrphanBlock(fork[3], tip); err != nil {
+				t.Fatal(err)
+			}
+
+			progress := &model.ReorgProgress{
+				Ancestor:       common[2].BlockHash().String(),
+				AncestorHeight: 3,
+			}
+			for _, block := range main {
+				progress.Disconnect = append(progress.Disconnect, block.BlockHash().String())
+			}
+			for _, block := range fork {
+				progress.Connect = append(progress.Connect, block.BlockHash().String())
+			}
+			if err := s.store.PutReorgProgress(progress); err != nil {
+				t.Fatal(err)
+			}
+			test.crash(t, s)
+
+			if err := s.resumeReorg(); err != nil {
+				t.Fatal(err)
+			}
+			assertTip(t, s, fork[3], 7)
+			if _, exists, err := s.store.GetReorgProgress(); err != nil || exists {
+				t.Fatal("the reorg is still recorded")
+			}
+			for _, block := range fork {
+				if _, exists, err := s.store.GetOrphanBlock(block.BlockHash().String()); err != nil || exists {
+					t.Fatalf("connected block %s is still an orphan", block.BlockHash())
+				}
+			}
+			expected := newTestSyncManager(t)
+			putBlocks(t, expected, common)
+			putBlocks(t, expected, fork)
+			putMempoolTxs(t, expected, main[0].Transactions[1:])
+			assertSameIndexes(t, s, expected, fork, main)
+		})
+	}
+}
+
+// withStaleCopy syncs a main chain of two blocks, then a side chain block
+// including the same transactions as the first, which keeps their bodies
+// pointing at the side chain block.
+func withStaleCopy(t *testing.T) (*SyncManager, []*wire.MsgBlock) {
+	bits := chaincfg.RegressionNetParams.PowLimitBits
+	common := buildBranch(t, chaincfg.RegressionNetParams.GenesisBlock, 1, 3, 'c', bits, false)
+	main := buildBranch(t, common[2], 4, 2, 'a', bits, true)
+	stale := buildBranch(t, common[2], 4, 1, 'b', bits, true)
+	s := newTestSyncManager(t)
+	putBlocks(t, s, common)
+	putBlocks(t, s, main)
+	putBlocks(t, s, stale)
+	assertTip(t, s, main[1], 5)
+
+	tx, _, err := s.store.GetTx(main[0].Transactions[1].TxHash().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.BlockHash != stale[0].BlockHash().String() {
+		t.Fatalf("expected the transaction body to point at the side chain block")
+	}
+	return s, main
+}
+
+func TestProofsOfStaleCopies(t *testing.T) {
+	s, main := withStaleCopy(t)
+	txId := main[0].Transactions[1].TxHash().String()
+
+	result, err := command.GetTxMerkleProof(s.store).Execute(json.RawMessage(`{"txid":"` + txId + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof := result.(command.TxMerkleProof)
+	if proof.BlockHash != main[0].BlockHash().String() || proof.BlockHeight != 4 || proof.Pos != 1 {
+		t.Fatalf("expected a proof in %s at 4, got %+v", main[0].BlockHash(), proof)
+	}
+
+	result, err = command.GetTxOutProof(s.store).Execute(json.RawMessage(`{"txids":["` + txId + `"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outProof := result.(command.TxOutProof)
+	result, err = command.VerifyTxOutProof(s.store).Execute(json.RawMessage(`{"proof":"` + outProof.Proof + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txIds := result.([]string); len(txIds) != 1 || txIds[0] != txId {
+		t.Fatalf("expected the proof to commit to %s, got %v", txId, txIds)
+	}
+}
+
+func TestSwapFundingsOfStaleCopies(t *testing.T) {
+	s, main := withStaleCopy(t)
+	result, err := command.GetSwapStatus(s.store, s.chainParams).Execute(json.RawMessage(`"` + hex.EncodeToString(payScript) + `"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := result.(command.SwapStatus)
+	txId := main[0].Transactions[1].TxHash().String()
+	for _, funding := range status.Fundings {
+		if funding.TxId == txId {
+			if funding.Height != 4 {
+				t.Fatalf("expected the funding confirmed at 4, got %d", funding.Height)
+			}
+			return
+		}
+	}
+	t.Fatalf("funding %s not found in %+v", txId, status.Fundings)
+}
+
+func TestRescanOfStaleCopies(t *testing.T) {
+	s, main := withStaleCopy(t)
+	if _, err := s.wallets.CreateWallet("stale"); err != nil {
+		t.Fatal(err)
+	}
+	addr, err := btcutil.NewAddressPubKeyHash(payScript[3:23], s.chainParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.wallets.ImportAddress("stale", addr.EncodeAddress(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.wallets.Rescan("stale", 0); err != nil {
+		t.Fatal(err)
+	}
+	txs, err := s.wallets.ListTransactions("stale", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txId := main[0].Transactions[1].TxHash().String()
+	for _, tx := range txs {
+		if tx.TxId == txId {
+			if tx.Height != 4 || tx.BlockHash != main[0].BlockHash().String() {
+				t.Fatalf("expected the transaction in %s at 4, got %+v", main[0].BlockHash(), tx)
+			}
+			return
+		}
+	}
+	t.Fatalf("transaction %s not rescanned", txId)
+}
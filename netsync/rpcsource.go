@@ -0,0 +1,225 @@
+package netsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/consensus"
+	"go.uber.org/zap"
+)
+
+// DefaultPollInterval is how often the node is asked for new blocks by
+// default.
+const DefaultPollInterval = 5 * time.Second
+
+type RPCSourceConfig struct {
+	// URL, User and Pass locate the RPC of the node, the URL being the host
+	// and port
+	URL         string
+	User        string
+	Pass        string
+	ChainParams *chaincfg.Params
+	// Rules are the proof of work rules of the chain, which tell whether its
+	// blocks are merged mined
+	Rules consensus.Rules
+	// PollInterval is the time between two polls, DefaultPollInterval if
+	// zero
+	PollInterval time.Duration
+	Logger       *zap.Logger
+}
+
+// RPCSource polls the block count of a bitcoind or dogecoind over RPC and
+// puts the blocks we are missing. The blocks are put from the last one the
+// node and the main chain share, found comparing their hashes, so the blocks
+// of a reorg of the node make a side chain which the fork choice switches to.
+// The node does not relay transactions over RPC, so the mempool is not
+// followed.
+type RPCSource struct {
+	client       *rpcclient.Client
+	mergedMining bool
+	pollInterval time.Duration
+	logger       *zap.Logger
+
+	mu         sync.Mutex
+	bestHeight uint64
+	connected  bool
+}
+
+func NewRPCSource(config RPCSourceConfig) (*RPCSource, error) {
+	client, err := rpcclient.New(&rpcclient.ConnConfig{
+		Host:         config.URL,
+		User:         config.User,
+		Pass:         config.Pass,
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	pollInterval := config.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = DefaultPollInterval
+	}
+	_, mergedMining := config.Rules.(consensus.MergedMiningRules)
+	return &RPCSource{
+		client:       client,
+		mergedMining: mergedMining,
+		pollInterval: pollInterval,
+		logger:       config.Logger.Named("rpcSource"),
+	}, nil
+}
+
+func (r *RPCSource) Run(ctx context.Context, sink BlockSink) error {
+	defer r.client.Shutdown()
+	for {
+		if err := r.poll(ctx, sink); err != nil && ctx.Err() == nil {
+			r.logger.Warn("error polling the node", zap.Error(err))
+		}
+		if !sleep(ctx, r.pollInterval) {
+			return nil
+		}
+	}
+}
+
+func (r *RPCSource) BestHeight() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.bestHeight
+}
+
+func (r *RPCSource) Connections() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.connected {
+		return 1
+	}
+	return 0
+}
+
+func (r *RPCSource) setConnected(connected bool, bestHeight uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connected = connected
+	if connected {
+		r.bestHeight = bestHeight
+	}
+}
+
+// poll puts the blocks of the node past the last block it shares with the
+// main chain.
+func (r *RPCSource) poll(ctx context.Context, sink BlockSink) error {
+	count, err := r.client.GetBlockCount()
+	if err != nil {
+		r.setConnected(false, 0)
+		return err
+	}
+	r.setConnected(true, uint64(count))
+	bestHeight := uint64(count)
+
+	tip, err := sink.TipHeight()
+	if err != nil {
+		return err
+	}
+	height := tip
+	if bestHeight < height {
+		height = bestHeight
+	}
+	for ; height > 0; height-- {
+		nodeHash, err := r.client.GetBlockHash(int64(height))
+		if err != nil {
+			return err
+		}
+		hash, exists, err := sink.BlockHashAt(height)
+		if err != nil {
+			return err
+		}
+		if exists && hash == nodeHash.String() {
+			break
+		}
+	}
+	if height < tip {
+		r.logger.Info("node is on another branch", zap.Uint64("forkHeight", height), zap.Uint64("tip", tip))
+	}
+	if height >= bestHeight {
+		sink.SetSynced(true)
+		return nil
+	}
+
+	sink.SetSynced(false)
+	for height++; height <= bestHeight; height++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hash, err := r.client.GetBlockHash(int64(height))
+		if err != nil {
+			return err
+		}
+		block, auxPow, err := r.getBlock(hash)
+		if err != nil {
+			return err
+		}
+		if err := sink.PutBlock(block, auxPow); err != nil {
+			return fmt.Errorf("block %s: %w", hash, err)
+		}
+	}
+	sink.SetSynced(true)
+	return nil
+}
+
+// getBlock fetches a serialized block, which is decoded here since btcd does
+// not decode the blocks of merged mined chains.
+func (r *RPCSource) getBlock(hash *chainhash.Hash) (*wire.MsgBlock, *consensus.AuxPow, error) {
+	params, err := marshalParams(hash.String(), false)
+	if err != nil {
+		return nil, nil, err
+	}
+	result, err := r.client.RawRequest("getblock", params)
+	if err != nil {
+		return nil, nil, err
+	}
+	var blockHex string
+	if err := json.Unmarshal(result, &blockHex); err != nil {
+		return nil, nil, err
+	}
+	data, err := hex.DecodeString(blockHex)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var block *wire.MsgBlock
+	var auxPow *consensus.AuxPow
+	if r.mergedMining {
+		block, auxPow, err = decodeAuxPowBlock(data)
+	} else {
+		block = &wire.MsgBlock{}
+		err = block.Deserialize(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding block %s: %w", hash, err)
+	}
+	if block.BlockHash() != *hash {
+		return nil, nil, fmt.Errorf("node sent block %s for %s", block.BlockHash(), hash)
+	}
+	return block, auxPow, nil
+}
+
+func marshalParams(params ...interface{}) ([]json.RawMessage, error) {
+	raw := make([]json.RawMessage, len(params))
+	for i, param := range params {
+		data, err := json.Marshal(param)
+		if err != nil {
+			return nil, err
+		}
+		raw[i] = data
+	}
+	return raw, nil
+}
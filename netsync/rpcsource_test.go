@@ -0,0 +1,207 @@
+package netsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/database"
+	"github.com/catalogfi/indexer/store"
+	"go.uber.org/zap"
+)
+
+// fakeNode answers getblockcount, getblockhash and getblock over JSON-RPC
+// with the blocks of its chain, which starts at the genesis block.
+type fakeNode struct {
+	mu    sync.Mutex
+	chain []*wire.MsgBlock
+	calls map[string]int
+}
+
+func newFakeNode(t *testing.T, chain []*wire.MsgBlock) (*fakeNode, string) {
+	node := &fakeNode{chain: chain, calls: make(map[string]int)}
+	server := httptest.NewServer(http.HandlerFunc(node.serveHTTP))
+	t.Cleanup(server.Close)
+	return node, strings.TrimPrefix(server.URL, "http://")
+}
+
+func (n *fakeNode) setChain(chain []*wire.MsgBlock) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.chain = chain
+}
+
+func (n *fakeNode) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	var request struct {
+		ID     json.RawMessage   `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.calls[request.Method]++
+	var result interface{}
+	var rpcErr interface{}
+	switch request.Method {
+	case "getblockcount":
+		result = len(n.chain) - 1
+	case "getblockhash":
+		var height int
+		_ = json.Unmarshal(request.Params[0], &height)
+		if height < 0 || height >= len(n.chain) {
+			rpcErr = map[string]interface{}{"code": -8, "message": "Block height out of range"}
+			break
+		}
+		result = n.chain[height].BlockHash().String()
+	case "getblock":
+		var hash string
+		_ = json.Unmarshal(request.Params[0], &hash)
+		rpcErr = map[string]interface{}{"code": -5, "message": "Block not found"}
+		for _, block := range n.chain {
+			if block.BlockHash().String() == hash {
+				var buf bytes.Buffer
+				_ = block.Serialize(&buf)
+				result, rpcErr = hex.EncodeToString(buf.Bytes()), nil
+			}
+		}
+	default:
+		rpcErr = map[string]interface{}{"code": -32601, "message": "Method not found"}
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"result": result, "error": rpcErr, "id": request.ID})
+}
+
+func newTestRPCSyncManager(t *testing.T, url string) (*SyncManager, *RPCSource) {
+	source, err := NewRPCSource(RPCSourceConfig{
+		URL:          url,
+		User:         "user",
+		Pass:         "pass",
+		ChainParams:  &chaincfg.RegressionNetParams,
+		Rules:        regtestRules,
+		PollInterval: 10 * time.Millisecond,
+		Logger:       zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := database.NewRocksDB(t.TempDir(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSyncManager(SyncConfig{
+		ChainParams: &chaincfg.RegressionNetParams,
+		Rules:       regtestRules,
+		Store:       store.NewStorage(db),
+		Logger:      zap.NewNop(),
+		Source:      source,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkForGensisBlock(); err != nil {
+		t.Fatal(err)
+	}
+	return s, source
+}
+
+func TestRPCSourceReorganizes(t *testing.T) {
+	bits := chaincfg.RegressionNetParams.PowLimitBits
+	genesis := chaincfg.RegressionNetParams.GenesisBlock
+	common := buildBranch(t, genesis, 1, 3, 'c', bits, false)
+	main := buildBranch(t, common[2], 4, 2, 'a', bits, true)
+	fork := buildBranch(t, common[2], 4, 3, 'b', bits, false)
+
+	chain := append([]*wire.MsgBlock{genesis}, common...)
+	node, url := newFakeNode(t, append(chain, main...))
+	s, source := newTestRPCSyncManager(t, url)
+	if err := source.poll(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+	assertTip(t, s, main[1], 5)
+	if source.BestHeight() != 5 || source.Connections() != 1 || !s.Ready() {
+		t.Fatalf("expected a ready indexer at the height of the node")
+	}
+
+	// nothing is fetched once synced
+	gets := node.calls["getblock"]
+	if err := source.poll(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+	if node.calls["getblock"] != gets {
+		t.Fatalf("fetched %d blocks already indexed", node.calls["getblock"]-gets)
+	}
+
+	// the node reorganizes to the longer fork
+	node.setChain(append(chain, fork...))
+	if err := source.poll(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+	assertTip(t, s, fork[2], 6)
+	expected := newTestSyncManager(t)
+	putBlocks(t, expected, common)
+	putBlocks(t, expected, fork)
+	putMempoolTxs(t, expected, main[0].Transactions[1:])
+	assertSameIndexes(t, s, expected, fork, main)
+}
+
+func TestRPCSourceRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	s, source := newTestRPCSyncManager(t, strings.TrimPrefix(server.URL, "http://"))
+	if err := source.poll(context.Background(), s); err == nil {
+		t.Fatal("expected an error polling a node rejecting the credentials")
+	}
+	if source.Connections() != 0 || s.Ready() {
+		t.Fatal("a node rejecting the credentials is not connected")
+	}
+}
+
+func TestSyncFromRPCSource(t *testing.T) {
+	genesis := chaincfg.RegressionNetParams.GenesisBlock
+	blocks := buildBranch(t, genesis, 1, 3, 'c', chaincfg.RegressionNetParams.PowLimitBits, false)
+	node, url := newFakeNode(t, []*wire.MsgBlock{genesis})
+	s, _ := newTestRPCSyncManager(t, url)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Sync(ctx)
+	}()
+	// the blocks mined after the sync started are polled
+	node.setChain(append([]*wire.MsgBlock{genesis}, blocks...))
+	tip := blocks[2].BlockHash().String()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if hash, exists, err := s.BlockHashAt(3); err == nil && exists && hash == tip {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the blocks of the node were not indexed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync did not return after the cancellation")
+	}
+}
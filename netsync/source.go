@@ -0,0 +1,96 @@
+package netsync
+
+import (
+	"context"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/consensus"
+)
+
+// BlockSource is where the sync manager gets the blocks of the best chain
+// from: its peers by default, or a node over RPC.
+type BlockSource interface {
+	// Run feeds the blocks to sink until ctx is cancelled.
+	Run(ctx context.Context, sink BlockSink) error
+	// BestHeight returns the height of the best chain the source knows of.
+	BestHeight() uint64
+	// Connections returns the number of peers or nodes the source is
+	// connected to.
+	Connections() int
+}
+
+// BlockSink is the side of the sync manager the block sources feed.
+type BlockSink interface {
+	// TipHeight returns the height of the main chain.
+	TipHeight() (uint64, error)
+	// BlockHashAt returns the hash of the main chain block at height.
+	BlockHashAt(height uint64) (string, bool, error)
+	PutBlock(block *wire.MsgBlock, auxPow *consensus.AuxPow) error
+	// SetSynced tells whether the main chain is the best chain of the source.
+	SetSynced(synced bool)
+}
+
+func (s *SyncManager) TipHeight() (uint64, error) {
+	height, _, err := s.store.GetLatestBlockHeight()
+	return height, err
+}
+
+func (s *SyncManager) BlockHashAt(height uint64) (string, bool, error) {
+	block, exists, err := s.store.GetBlockByHeight(height)
+	if err != nil || !exists {
+		return "", false, err
+	}
+	return block.Hash, true, nil
+}
+
+// peerSource syncs headers first from the peers of the sync manager. It feeds
+// the sync manager directly rather than through the sink, as the peers sending
+// blocks breaking the consensus rules are banned.
+type peerSource struct {
+	s *SyncManager
+}
+
+func (p *peerSource) Run(ctx context.Context, sink BlockSink) error {
+	s := p.s
+	s.peers.Start()
+	// every new peer may know blocks we are missing, as may the peers sending
+	// blocks we can not connect, and the sync catches up periodically in case
+	// it fell behind without noticing
+	s.goBackground(func() {
+		ticker := time.NewTicker(catchUpInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.peers.NewPeers():
+			case <-s.fetch:
+			case <-ticker.C:
+			}
+			s.fetchBlocks(ctx)
+		}
+	})
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.peers.Stop()
+			return nil
+		case msg := <-s.peers.Msgs():
+			s.handleMsg(ctx, msg)
+		}
+	}
+}
+
+func (p *peerSource) BestHeight() uint64 {
+	height := p.s.peers.BestHeight()
+	if height < 0 {
+		return 0
+	}
+	return uint64(height)
+}
+
+func (p *peerSource) Connections() int {
+	return len(p.s.peers.Peers())
+}
@@ -0,0 +1,140 @@
+package netsync
+
+import (
+	"time"
+
+	"github.com/catalogfi/indexer/model"
+)
+
+// syncRateWindows are the windows the indexing rate is reported over.
+var syncRateWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"10m", 10 * time.Minute},
+}
+
+type heightSample struct {
+	at     time.Time
+	height uint64
+}
+
+// syncRate keeps the heights indexed over the longest rate window, at most one
+// sample a second.
+type syncRate struct {
+	samples []heightSample
+}
+
+func (r *syncRate) add(now time.Time, height uint64) {
+	if n := len(r.samples); n > 0 && now.Sub(r.samples[n-1].at) < time.Second {
+		r.samples[n-1].height = height
+	} else {
+		r.samples = append(r.samples, heightSample{at: now, height: height})
+	}
+	// keeps the last sample before the longest window, the height the window
+	// is counted from
+	oldest := now.Add(-syncRateWindows[len(syncRateWindows)-1].duration)
+	drop := 0
+	for drop < len(r.samples)-1 && !r.samples[drop+1].at.After(oldest) {
+		drop++
+	}
+	r.samples = r.samples[drop:]
+}
+
+// perSecond returns the blocks indexed a second over the window ending at
+// now. Blocks disconnected by reorgs are not counted.
+func (r *syncRate) perSecond(now time.Time, window time.Duration) float64 {
+	if len(r.samples) == 0 {
+		return 0
+	}
+	// the blocks are counted from the height at the start of the window, or
+	// from the first sample if it is younger
+	start := now.Add(-window)
+	base := r.samples[0]
+	for _, sample := range r.samples[1:] {
+		if sample.at.After(start) {
+			break
+		}
+		base = sample
+	}
+	if base.at.Before(start) {
+		base.at = start
+	}
+	last := r.samples[len(r.samples)-1]
+	elapsed := now.Sub(base.at)
+	if elapsed <= 0 || last.height <= base.height {
+		return 0
+	}
+	return float64(last.height-base.height) / elapsed.Seconds()
+}
+
+// recordHeight adds a connected block to the indexing rate.
+func (s *SyncManager) recordHeight(height uint64) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	s.rate.add(time.Now(), height)
+}
+
+func (s *SyncManager) setHeadersHeight(height uint64) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	if height > s.headersHeight {
+		s.headersHeight = height
+	}
+}
+
+// SyncStatus reports the indexed height against the best height of the
+// source, and the indexing rate.
+func (s *SyncManager) SyncStatus() (*model.SyncStatus, error) {
+	indexed, _, err := s.store.GetLatestBlockHeight()
+	if err != nil {
+		return nil, err
+	}
+	best := s.source.BestHeight()
+
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	status := &model.SyncStatus{
+		IndexedHeight:   indexed,
+		BestPeerHeight:  best,
+		HeadersHeight:   s.headersHeight,
+		Progress:        100,
+		BlocksPerSecond: make(map[string]float64, len(syncRateWindows)),
+		Synced:          s.isSynced,
+		MempoolSynced:   s.isMempoolSynced,
+		Peers:           s.source.Connections(),
+	}
+	if status.HeadersHeight < indexed {
+		status.HeadersHeight = indexed
+	}
+	if indexed < best {
+		status.Progress = 100 * float64(indexed) / float64(best)
+	}
+
+	now := time.Now()
+	// the longest window with blocks gives the steadiest estimate
+	rate := 0.0
+	for _, window := range syncRateWindows {
+		status.BlocksPerSecond[window.name] = s.rate.perSecond(now, window.duration)
+		if status.BlocksPerSecond[window.name] > 0 {
+			rate = status.BlocksPerSecond[window.name]
+		}
+	}
+	if indexed < best && rate > 0 {
+		eta := float64(best-indexed) / rate
+		status.ETASeconds = &eta
+	}
+	return status, nil
+}
+
+// Ready tells whether the indexer is caught up with its source and connected
+// to at least one of its peers or nodes, so it can serve up to date data.
+func (s *SyncManager) Ready() bool {
+	if s.source.Connections() == 0 {
+		return false
+	}
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	return s.isSynced
+}
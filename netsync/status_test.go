@@ -0,0 +1,70 @@
+package netsync
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+func TestSyncRate(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	var rate syncRate
+	// 10 blocks a second for 2 minutes, then 1 block a second for a minute
+	height := uint64(0)
+	for i := 0; i < 120; i++ {
+		height += 10
+		rate.add(start.Add(time.Duration(i)*time.Second), height)
+	}
+	for i := 120; i < 180; i++ {
+		height++
+		rate.add(start.Add(time.Duration(i)*time.Second), height)
+	}
+	now := start.Add(179 * time.Second)
+
+	if perSecond := rate.perSecond(now, time.Minute); math.Abs(perSecond-1) > 0.01 {
+		t.Fatalf("expected 1 block a second over a minute, got %f", perSecond)
+	}
+	// the samples only span 3 minutes of the 10 minute window
+	if perSecond := rate.perSecond(now, 10*time.Minute); math.Abs(perSecond-float64(height-10)/179) > 0.01 {
+		t.Fatalf("expected %f blocks a second over 10 minutes, got %f", float64(height-10)/179, perSecond)
+	}
+	if perSecond := rate.perSecond(now.Add(time.Hour), time.Minute); perSecond != 0 {
+		t.Fatalf("expected no blocks in the last minute, got %f", perSecond)
+	}
+
+	// only the last sample before the longest window is kept
+	rate.add(now.Add(time.Hour), height+1)
+	if len(rate.samples) != 2 {
+		t.Fatalf("expected 2 samples, got %d", len(rate.samples))
+	}
+}
+
+func TestSyncStatus(t *testing.T) {
+	s := newTestSyncManager(t)
+	blocks := buildBranch(t, chaincfg.RegressionNetParams.GenesisBlock, 1, 3, 'c', chaincfg.RegressionNetParams.PowLimitBits, false)
+	// the indexing started 30 seconds ago
+	s.rate.add(time.Now().Add(-30*time.Second), 0)
+	putBlocks(t, s, blocks)
+
+	status, err := s.SyncStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.IndexedHeight != 3 || status.HeadersHeight != 3 || status.Peers != 0 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if math.Abs(status.BlocksPerSecond["1m"]-0.1) > 0.01 || math.Abs(status.BlocksPerSecond["10m"]-0.1) > 0.01 {
+		t.Fatalf("expected an indexing rate, got %v", status.BlocksPerSecond)
+	}
+	// without peers there is nothing left to index
+	if status.Progress != 100 || status.ETASeconds != nil || status.Synced {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	s.SetSynced(true)
+	if s.Ready() {
+		t.Fatal("an indexer without peers is not ready")
+	}
+}
@@ -0,0 +1,182 @@
+package netsync
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/catalogfi/indexer/database"
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/store"
+)
+
+// verifyIssues runs VerifyChain over the whole chain and returns the kinds of
+// the issues found, and whether they were all repaired.
+func verifyIssues(t *testing.T, s *SyncManager, repair bool) (map[string]bool, bool) {
+	t.Helper()
+	report, err := s.store.VerifyChain(store.VerifyOptions{EndHeight: 100, Repair: repair})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]bool, len(report.Issues))
+	repaired := true
+	for _, issue := range report.Issues {
+		kinds[issue.Kind] = true
+		repaired = repaired && issue.Repaired
+	}
+	return kinds, repaired
+}
+
+// TestVerifyChain corrupts the store indexed by a sync manager and checks that
+// VerifyChain reports the corruption and repairs what the stored data allows.
+func TestVerifyChain(t *testing.T) {
+	blocks := buildBranch(t, chaincfg.RegressionNetParams.GenesisBlock, 1, 3, 'c', chaincfg.RegressionNetParams.PowLimitBits, false)
+	// the second block spends the coinbase of the first one
+	spent := blocks[0].Transactions[0].TxHash().String()
+	coinbase := blocks[1].Transactions[0].TxHash().String()
+	minerScriptHex := hex.EncodeToString(minerScript)
+
+	updateBlock := func(t *testing.T, s *SyncManager, update func(block *model.Block)) {
+		block, _, err := s.store.GetBlockByHeight(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		update(block)
+		if err := s.store.PutBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name       string
+		corrupt    func(t *testing.T, s *SyncManager, db database.Db)
+		kind       string
+		repairable bool
+	}{
+		{
+			name: "hash index",
+			corrupt: func(t *testing.T, s *SyncManager, db database.Db) {
+				if err := db.Delete(blocks[1].BlockHash().String()); err != nil {
+					t.Fatal(err)
+				}
+			},
+			kind:       store.IssueHashIndex,
+			repairable: true,
+		},
+		{
+			name: "latest block height past the stored blocks",
+			corrupt: func(t *testing.T, s *SyncManager, db database.Db) {
+				if err := s.store.SetLatestBlockHeight(5); err != nil {
+					t.Fatal(err)
+				}
+			},
+			kind:       store.IssueTipMismatch,
+			repairable: true,
+		},
+		{
+			name: "merkle root",
+			corrupt: func(t *testing.T, s *SyncManager, db database.Db) {
+				updateBlock(t, s, func(block *model.Block) {
+					block.MerkleRoot = spent
+				})
+			},
+			kind: store.IssueMerkleRoot,
+		},
+		{
+			name: "transaction missing from the block",
+			corrupt: func(t *testing.T, s *SyncManager, db database.Db) {
+				updateBlock(t, s, func(block *model.Block) {
+					block.Txs = block.Txs[:len(block.Txs)-1]
+				})
+			},
+			kind: store.IssueMerkleRoot,
+		},
+		{
+			name: "transaction body missing",
+			corrupt: func(t *testing.T, s *SyncManager, db database.Db) {
+				if err := db.Delete(coinbase); err != nil {
+					t.Fatal(err)
+				}
+			},
+			kind: store.IssueMissingTx,
+		},
+		{
+			name: "spent output in the utxo set",
+			corrupt: func(t *testing.T, s *SyncManager, db database.Db) {
+				tx, _, err := s.store.GetTx(spent)
+				if err != nil {
+					t.Fatal(err)
+				}
+				vout := tx.Vouts[0]
+				vout.Height = 1
+				vout.Coinbase = true
+				if err := db.Put(minerScriptHex+spent+string(rune(0)), model.MarshalVout(vout)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			kind:       store.IssueSpentUTXO,
+			repairable: true,
+		},
+		{
+			name: "outpoint script",
+			corrupt: func(t *testing.T, s *SyncManager, db database.Db) {
+				if err := db.Put("pk"+coinbase+string(rune(0)), []byte(hex.EncodeToString(payScript))); err != nil {
+					t.Fatal(err)
+				}
+			},
+			kind:       store.IssuePkScript,
+			repairable: true,
+		},
+		{
+			name: "address history",
+			corrupt: func(t *testing.T, s *SyncManager, db database.Db) {
+				if err := db.Delete("tx" + minerScriptHex + coinbase); err != nil {
+					t.Fatal(err)
+				}
+			},
+			kind:       store.IssueHistory,
+			repairable: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, db := newTestSyncManagerWithDB(t)
+			putBlocks(t, s, blocks)
+			if kinds, _ := verifyIssues(t, s, false); len(kinds) != 0 {
+				t.Fatalf("expected no issues before the corruption, got %v", kinds)
+			}
+			test.corrupt(t, s, db)
+
+			kinds, _ := verifyIssues(t, s, false)
+			if !kinds[test.kind] {
+				t.Fatalf("expected a %s issue, got %v", test.kind, kinds)
+			}
+			// without repair nothing changed
+			if kinds, _ = verifyIssues(t, s, false); !kinds[test.kind] {
+				t.Fatalf("expected the %s issue to remain, got %v", test.kind, kinds)
+			}
+
+			kinds, repaired := verifyIssues(t, s, true)
+			if !kinds[test.kind] || repaired != test.repairable {
+				t.Fatalf("expected a %s issue repaired %v, got %v repaired %v", test.kind, test.repairable, kinds, repaired)
+			}
+			kinds, _ = verifyIssues(t, s, false)
+			if test.repairable && len(kinds) != 0 {
+				t.Fatalf("expected no issues after the repair, got %v", kinds)
+			}
+			if !test.repairable && !kinds[test.kind] {
+				t.Fatalf("expected the %s issue to remain, got %v", test.kind, kinds)
+			}
+		})
+	}
+
+	// the blocks of a tip mismatch are not lost by the repair
+	s := newTestSyncManager(t)
+	putBlocks(t, s, blocks)
+	if err := s.store.SetLatestBlockHeight(5); err != nil {
+		t.Fatal(err)
+	}
+	verifyIssues(t, s, true)
+	if height, _, err := s.store.GetLatestBlockHeight(); err != nil || height != 3 {
+		t.Fatalf("expected the latest block height to be lowered to 3, got %d", height)
+	}
+}
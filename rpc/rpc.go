@@ -1,10 +1,12 @@
 package rpc
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/catalogfi/indexer/command"
@@ -17,13 +19,21 @@ type RPC interface {
 	RegisterCommand(cmd command.Command)
 	HandleJSONRPC(ctx *gin.Context)
 	SetLogger(logger *zap.Logger) RPC
-	Run(port string) error
+	// SetReadiness sets the check behind GET /ready, which load balancers
+	// use to route requests to indexers that are caught up
+	SetReadiness(ready func() bool) RPC
+	Run(ctx context.Context, port string) error
 }
 
+// shutdownTimeout bounds how long the requests in flight are waited for on
+// shutdown.
+const shutdownTimeout = 10 * time.Second
+
 type rpc struct {
 	store    *store.Storage
 	commands map[string]command.Command
 	logger   *zap.Logger
+	ready    func() bool
 }
 
 type Request struct {
@@ -46,6 +56,7 @@ func New(store *store.Storage) RPC {
 		store:    store,
 		commands: make(map[string]command.Command),
 		logger:   logger,
+		ready:    func() bool { return true },
 	}
 }
 
@@ -74,8 +85,13 @@ func (r *rpc) HandleJSONRPC(ctx *gin.Context) {
 
 	resp, err := r.commands[req.Method].Execute(params)
 	if err != nil {
-		if errors.As(err, &RpcError{}) {
-			ctx.JSON(http.StatusBadRequest, Response{Result: nil, Error: err.(*RpcError), ID: req.ID, Version: req.Version})
+		var rpcErr *RpcError
+		if errors.As(err, &rpcErr) {
+			ctx.JSON(http.StatusBadRequest, Response{Result: nil, Error: rpcErr, ID: req.ID, Version: req.Version})
+			return
+		}
+		if errors.Is(err, store.ErrTxPruned) || errors.Is(err, store.ErrBlockPruned) {
+			ctx.JSON(http.StatusBadRequest, Response{Result: nil, Error: NewPrunedError(err.Error()), ID: req.ID, Version: req.Version})
 			return
 		}
 		ctx.JSON(http.StatusBadRequest, Response{Result: nil, Error: NewInternalError(err.Error()), ID: req.ID, Version: req.Version})
@@ -93,6 +109,20 @@ func Default(store *store.Storage, chainParams *chaincfg.Params) RPC {
 	rpc.RegisterCommand(command.LatestTipHash(store))
 	rpc.RegisterCommand(command.NewBroadcastCommand(os.Getenv("RPC_URL"), os.Getenv("RPC_USER"), os.Getenv("RPC_PASS")))
 	rpc.RegisterCommand(command.GetBlockByHeight(store))
+	rpc.RegisterCommand(command.SearchOpReturn(store))
+	rpc.RegisterCommand(command.GetTxOutSetInfo(store))
+	rpc.RegisterCommand(command.GetBlockStats(store))
+	rpc.RegisterCommand(command.GetBlockStatsRange(store))
+	rpc.RegisterCommand(command.GetBlockByTime(store))
+	rpc.RegisterCommand(command.GetXpubBalance(store, chainParams))
+	rpc.RegisterCommand(command.GetXpubUTXOs(store, chainParams))
+	rpc.RegisterCommand(command.GetXpubTxs(store, chainParams))
+	rpc.RegisterCommand(command.VerifyChain(store))
+	rpc.RegisterCommand(command.GetTxMerkleProof(store))
+	rpc.RegisterCommand(command.GetTxOutProof(store))
+	rpc.RegisterCommand(command.VerifyTxOutProof(store))
+	rpc.RegisterCommand(command.GetSwapStatus(store, chainParams))
+	rpc.RegisterCommand(command.GetSecretByHash(store))
 	return rpc
 }
 
@@ -101,8 +131,51 @@ func (r *rpc) SetLogger(logger *zap.Logger) RPC {
 	return r
 }
 
-func (r *rpc) Run(port string) error {
+func (r *rpc) SetReadiness(ready func() bool) RPC {
+	r.ready = ready
+	return r
+}
+
+// HandleReady answers 200 when the indexer is ready to serve and 503
+// otherwise.
+func (r *rpc) HandleReady(ctx *gin.Context) {
+	ready := r.ready()
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	ctx.JSON(status, gin.H{"ready": ready})
+}
+
+// Run serves the commands on port until ctx is cancelled, then waits for the
+// requests in flight.
+func (r *rpc) Run(ctx context.Context, port string) error {
 	s := gin.Default()
 	s.POST("/", r.HandleJSONRPC)
-	return s.Run(port)
+	s.GET("/ready", r.HandleReady)
+	server := &http.Server{
+		Addr:    port,
+		Handler: s,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	r.logger.Info("shutting down the rpc server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errs; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
@@ -34,6 +34,11 @@ func NewInternalError(message string) *RpcError {
 	return NewRpcError(-32603, message, nil)
 }
 
+// NewPrunedError is returned for data removed by pruning.
+func NewPrunedError(message string) *RpcError {
+	return NewRpcError(-32001, message, "pruned")
+}
+
 func (e *RpcError) Error() string {
 	return e.Message
 }
@@ -0,0 +1,63 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/catalogfi/indexer/command"
+	"github.com/catalogfi/indexer/database"
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/store"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestGetPrunedTx(t *testing.T) {
+	db, err := database.NewRocksDB(t.TempDir(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewStorage(db)
+	pruned := strings.Repeat("01", 32)
+	if err := s.PutBlock(&model.Block{Hash: "block", Height: 1, Txs: []string{pruned}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutTx(&model.Transaction{Hash: pruned}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PruneBlock(1); err != nil {
+		t.Fatal(err)
+	}
+
+	r := New(s)
+	r.RegisterCommand(command.GetTx(s))
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.POST("/", r.HandleJSONRPC)
+	getTx := func(hash string) *RpcError {
+		t.Helper()
+		body, err := json.Marshal(Request{Version: "2.0", ID: "1", Method: "get_tx", Params: hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		var response Response
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Error
+	}
+
+	if rpcErr := getTx(pruned); rpcErr == nil || rpcErr.Code != -32001 || rpcErr.Data != "pruned" {
+		t.Fatalf("expected a pruned error, got %+v", rpcErr)
+	}
+	// a transaction never indexed is not found
+	if rpcErr := getTx(strings.Repeat("02", 32)); rpcErr == nil || rpcErr.Message != store.ErrGetTxNotFound.Error() {
+		t.Fatalf("expected a not found error, got %+v", rpcErr)
+	}
+}
@@ -175,6 +175,9 @@ func (s *Storage) GetBlockTxs(blockHash string, isOrphan bool) ([]*model.Transac
 	if err != nil {
 		return nil, err
 	}
+	if block.Pruned {
+		return nil, ErrBlockPruned
+	}
 	return s.GetTxs(block.Txs)
 
 }
@@ -192,6 +195,22 @@ func (s *Storage) PutOrphanBlock(block *model.Block) error {
 	return s.db.Put(key, blockInBytes)
 }
 
+// RemoveOrphanBlock drops a side chain block joining the main chain from the
+// orphans. The orphan at its height is only dropped if it is that block.
+func (s *Storage) RemoveOrphanBlock(block *model.Block) error {
+	if err := s.db.Delete(fmt.Sprintf("%s_%s", orphanKey, block.Hash)); err != nil {
+		return err
+	}
+	atHeight, exists, err := s.GetOrphanBlockByHeight(block.Height)
+	if err != nil {
+		return err
+	}
+	if !exists || atHeight.Hash != block.Hash {
+		return nil
+	}
+	return s.db.Delete(fmt.Sprintf("%s_%d", orphanKey, block.Height))
+}
+
 func (s *Storage) PutBlock(block *model.Block) error {
 	blockInBytes, err := block.Marshal()
 	if err != nil {
@@ -212,6 +231,9 @@ func (s *Storage) RemoveBlock(hash string) error {
 	if !exists {
 		return nil
 	}
+	if err := s.RemoveTxLocations(hash, block.Txs); err != nil {
+		return err
+	}
 	err = s.db.Delete(hash)
 	if err != nil {
 		return err
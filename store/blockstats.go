@@ -0,0 +1,44 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/catalogfi/indexer/model"
+)
+
+var (
+	blockStatsKey = "bst"
+)
+
+// block stats are keyed by block hash so a reorg never serves the stats of
+// a stale block for a height.
+func (s *Storage) PutBlockStats(stats *model.BlockStats) error {
+	data, err := stats.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.db.Put(blockStatsKey+stats.BlockHash, data)
+}
+
+func (s *Storage) GetBlockStats(hash string) (*model.BlockStats, bool, error) {
+	data, err := s.db.Get(blockStatsKey + hash)
+	if err != nil {
+		if err.Error() == ErrKeyNotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	stats, err := model.UnmarshalBlockStats(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("GetBlockStats: error unmarshalling block stats: %w", err)
+	}
+	return stats, true, nil
+}
+
+func (s *Storage) GetBlockStatsByHeight(height uint64) (*model.BlockStats, bool, error) {
+	block, exists, err := s.GetBlockByHeight(height)
+	if err != nil || !exists {
+		return nil, exists, err
+	}
+	return s.GetBlockStats(block.Hash)
+}
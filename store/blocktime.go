@@ -0,0 +1,100 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/catalogfi/indexer/model"
+)
+
+// medianTimeBlocks is the number of blocks used to compute the median time
+// past, the same as in bitcoind.
+const medianTimeBlocks = 11
+
+// GetMedianTimePast returns the median timestamp of the block at height and
+// the ten blocks before it. Unlike header timestamps it never decreases with
+// height.
+func (s *Storage) GetMedianTimePast(height uint64) (time.Time, error) {
+	start := uint64(0)
+	if height >= medianTimeBlocks {
+		start = height - medianTimeBlocks + 1
+	}
+	timestamps := make([]time.Time, 0, medianTimeBlocks)
+	for h := start; h <= height; h++ {
+		block, exists, err := s.GetBlockByHeight(h)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !exists {
+			return time.Time{}, fmt.Errorf("GetMedianTimePast: %w at height %d", ErrGetBlockNotFound, h)
+		}
+		timestamps = append(timestamps, block.Timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i].Before(timestamps[j])
+	})
+	return timestamps[len(timestamps)/2], nil
+}
+
+// GetBlockByTime returns the last block at or before t, i.e. the chain tip at
+// time t, or the block right after it when after is set. Blocks are compared
+// by median time past unless useHeaderTime is set.
+func (s *Storage) GetBlockByTime(t time.Time, after bool, useHeaderTime bool) (*model.Block, bool, error) {
+	tip, exists, err := s.GetLatestBlockHeight()
+	if err != nil || !exists {
+		return nil, false, err
+	}
+
+	// the first height whose median time past is after t
+	var searchErr error
+	firstAfter := sort.Search(int(tip)+1, func(i int) bool {
+		if searchErr != nil {
+			return true
+		}
+		mtp, err := s.GetMedianTimePast(uint64(i))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return mtp.After(t)
+	})
+	if searchErr != nil {
+		return nil, false, searchErr
+	}
+	// a block is the tip at t if it has no successor at or before t
+	lastBefore := firstAfter - 1
+
+	if useHeaderTime {
+		// header timestamps are only bound by the median time past of the
+		// previous block, so every block above lastBefore+1 is after t and
+		// the highest block at or before t is found scanning down from there
+		height := firstAfter
+		if height > int(tip) {
+			height = int(tip)
+		}
+		lastBefore = -1
+		for ; height >= 0; height-- {
+			block, exists, err := s.GetBlockByHeight(uint64(height))
+			if err != nil {
+				return nil, false, err
+			}
+			if !exists {
+				return nil, false, fmt.Errorf("GetBlockByTime: %w at height %d", ErrGetBlockNotFound, height)
+			}
+			if !block.Timestamp.After(t) {
+				lastBefore = height
+				break
+			}
+		}
+	}
+
+	height := lastBefore
+	if after {
+		height++
+	}
+	if height < 0 || height > int(tip) {
+		return nil, false, nil
+	}
+	return s.GetBlockByHeight(uint64(height))
+}
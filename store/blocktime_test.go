@@ -0,0 +1,82 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/catalogfi/indexer/model"
+)
+
+func TestGetBlockByTime(t *testing.T) {
+	s := newTestStorage(t)
+	base := time.Unix(1700000000, 0).UTC()
+	at := func(minutes int) time.Time {
+		return base.Add(time.Duration(minutes) * time.Minute)
+	}
+	// header timestamps going back at heights 4, 7 and 11, whose median
+	// times past are 0 10 10 20 20 25 25 30 30 40 40 45 50 60 70
+	timestamps := []int{0, 10, 20, 30, 25, 40, 50, 45, 60, 70, 80, 75, 90, 100, 110}
+	for height, minutes := range timestamps {
+		block := &model.Block{
+			Hash:      fmt.Sprintf("block%d", height),
+			Height:    uint64(height),
+			Timestamp: at(minutes),
+		}
+		if err := s.PutBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetLatestBlockHeight(uint64(len(timestamps) - 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	mtp, err := s.GetMedianTimePast(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mtp.Equal(at(45)) {
+		t.Fatalf("expected a median time past of %s at 11, got %s", at(45), mtp)
+	}
+
+	tests := []struct {
+		name          string
+		minutes       int
+		after         bool
+		useHeaderTime bool
+		// -1 when no block is expected
+		expected int
+	}{
+		{"median time past", 27, false, false, 6},
+		{"median time past, after", 27, true, false, 7},
+		{"equal median time past", 10, false, false, 2},
+		{"header time before earlier timestamps", 27, false, true, 4},
+		{"header time before earlier timestamps, after", 27, true, true, 5},
+		{"header time", 47, false, true, 7},
+		{"before genesis", -5, false, false, -1},
+		{"before genesis, after", -5, true, false, 0},
+		{"before genesis, header time", -5, false, true, -1},
+		{"before genesis, header time, after", -5, true, true, 0},
+		{"after the tip", 200, false, false, 14},
+		{"after the tip, after", 200, true, false, -1},
+		{"after the tip, header time", 200, false, true, 14},
+		{"after the tip, header time, after", 200, true, true, -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			block, exists, err := s.GetBlockByTime(at(test.minutes), test.after, test.useHeaderTime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.expected < 0 {
+				if exists {
+					t.Fatalf("expected no block, got %d", block.Height)
+				}
+				return
+			}
+			if !exists || block.Height != uint64(test.expected) {
+				t.Fatalf("expected block %d, got %+v", test.expected, block)
+			}
+		})
+	}
+}
@@ -12,4 +12,7 @@ var (
 	ErrGetLatestTipHash         = errors.New("latest tip hash not found")
 	ErrGetTxNotFound            = errors.New("transaction not found")
 	ErrGetBlockNotFound         = errors.New("block not found")
+	ErrGetBlockStatsNotFound    = errors.New("block stats not found")
+	ErrTxPruned                 = errors.New("transaction data has been pruned")
+	ErrBlockPruned              = errors.New("block data has been pruned")
 )
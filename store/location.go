@@ -0,0 +1,148 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/catalogfi/indexer/model"
+)
+
+// Transactions of main chain blocks are located by their hash:
+//
+//	txl<txid>  height and position of the transaction in its block
+var txLocationKey = "txl"
+
+// PutTxLocations indexes the transactions of a main chain block, in block
+// order.
+func (s *Storage) PutTxLocations(blockHash string, height uint64, txHashes []string) error {
+	if len(txHashes) == 0 {
+		return nil
+	}
+	keys := make([]string, len(txHashes))
+	values := make([][]byte, len(txHashes))
+	for i, hash := range txHashes {
+		location := model.TxLocation{
+			BlockHash: blockHash,
+			Height:    height,
+			Index:     uint32(i),
+		}
+		data, err := location.Marshal()
+		if err != nil {
+			return err
+		}
+		keys[i] = txLocationKey + hash
+		values[i] = data
+	}
+	return s.db.PutMulti(keys, values)
+}
+
+// RemoveTxLocations drops the locations of the transactions of a block
+// leaving the main chain. Locations in other blocks are kept.
+func (s *Storage) RemoveTxLocations(blockHash string, txHashes []string) error {
+	if len(txHashes) == 0 {
+		return nil
+	}
+	keys := make([]string, len(txHashes))
+	for i, hash := range txHashes {
+		keys[i] = txLocationKey + hash
+	}
+	data, err := s.db.GetMulti(keys)
+	if err != nil {
+		return err
+	}
+	stale := make([]string, 0, len(keys))
+	for i, val := range data {
+		if len(val) == 0 {
+			continue
+		}
+		location, err := model.UnmarshalTxLocation(val)
+		if err != nil {
+			return err
+		}
+		if location.BlockHash == blockHash {
+			stale = append(stale, keys[i])
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	return s.db.DeleteMulti(stale)
+}
+
+// GetTxLocation returns the main chain location of the transaction.
+func (s *Storage) GetTxLocation(hash string) (*model.TxLocation, bool, error) {
+	data, err := s.db.Get(txLocationKey + hash)
+	if err != nil {
+		if err.Error() == ErrKeyNotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	location, err := model.UnmarshalTxLocation(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("GetTxLocation: error unmarshalling location: %w", err)
+	}
+	return location, true, nil
+}
+
+// GetTxConflict reports whether an input of the unconfirmed transaction is
+// spent by another transaction, in the mempool or in a block. The spender is
+// only known for mempool conflicts.
+func (s *Storage) GetTxConflict(tx *model.Transaction) (string, bool, error) {
+	hashes := make([]string, 0, len(tx.Vins))
+	indices := make([]uint32, 0, len(tx.Vins))
+	outspendKeys := make([]string, 0, len(tx.Vins))
+	for _, vin := range tx.Vins {
+		if vin.PreviousTxId == "" {
+			continue
+		}
+		hashes = append(hashes, vin.PreviousTxId)
+		indices = append(indices, vin.PreviousIndex)
+		outspendKeys = append(outspendKeys, getOutspendKey(vin.PreviousTxId, vin.PreviousIndex))
+	}
+	if len(hashes) == 0 {
+		return "", false, nil
+	}
+
+	outspends, err := s.db.GetMulti(outspendKeys)
+	if err != nil {
+		return "", false, err
+	}
+	for _, data := range outspends {
+		if len(data) == 0 {
+			continue
+		}
+		outspend, err := model.UnmarshalOutspend(data)
+		if err != nil {
+			return "", false, err
+		}
+		if outspend.TxId != tx.Hash {
+			return outspend.TxId, true, nil
+		}
+	}
+
+	// an output spent in a block is no longer in the utxo set
+	scriptPubKeys, err := s.GetPkScripts(hashes, indices)
+	if err != nil {
+		return "", false, err
+	}
+	utxoKeys := make([]string, 0, len(scriptPubKeys))
+	for i, pk := range scriptPubKeys {
+		if pk == "" {
+			continue
+		}
+		utxoKeys = append(utxoKeys, getUTXOKey(pk, hashes[i], indices[i]))
+	}
+	if len(utxoKeys) == 0 {
+		return "", false, nil
+	}
+	utxos, err := s.db.GetMulti(utxoKeys)
+	if err != nil {
+		return "", false, err
+	}
+	for _, data := range utxos {
+		if len(data) == 0 {
+			return "", true, nil
+		}
+	}
+	return "", false, nil
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/catalogfi/indexer/model"
+)
+
+func TestTxLocations(t *testing.T) {
+	s := newTestStorage(t)
+	txs := []string{testTxId(1), testTxId(2), testTxId(3)}
+	if err := s.PutTxLocations("a", 5, txs); err != nil {
+		t.Fatal(err)
+	}
+	for i, hash := range txs {
+		location, exists, err := s.GetTxLocation(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists || location.BlockHash != "a" || location.Height != 5 || location.Index != uint32(i) {
+			t.Fatalf("expected %s at %d in block a, got %+v", hash, i, location)
+		}
+	}
+
+	// the second transaction is mined again by block b on another branch
+	if err := s.PutTxLocations("b", 5, []string{testTxId(4), testTxId(2)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveTxLocations("a", txs); err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{testTxId(1), testTxId(3)} {
+		if _, exists, err := s.GetTxLocation(hash); err != nil || exists {
+			t.Fatalf("expected %s to be unlocated", hash)
+		}
+	}
+	location, exists, err := s.GetTxLocation(testTxId(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || location.BlockHash != "b" || location.Index != 1 {
+		t.Fatalf("expected the location in block b to be kept, got %+v", location)
+	}
+}
+
+func TestGetTxConflict(t *testing.T) {
+	s := newTestStorage(t)
+	funding := []model.Vout{
+		{TxId: testTxId(1), Index: 0, Value: 1000, ScriptPubKey: "51", Height: 1},
+		{TxId: testTxId(1), Index: 1, Value: 1000, ScriptPubKey: "51", Height: 1},
+	}
+	if err := s.PutUTXOs(funding); err != nil {
+		t.Fatal(err)
+	}
+	spend := func(hash string, index uint32) *model.Transaction {
+		return &model.Transaction{
+			Hash: hash,
+			Vins: []model.Vin{{TxId: hash, PreviousTxId: testTxId(1), PreviousIndex: index}},
+		}
+	}
+	markSpent := func(tx *model.Transaction) {
+		t.Helper()
+		vin := tx.Vins[0]
+		if _, err := s.MarkUTXOsSpent([]string{vin.PreviousTxId}, []uint32{vin.PreviousIndex}, tx.Vins); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertConflict := func(tx *model.Transaction, expectedSpender string, expected bool) {
+		t.Helper()
+		spender, conflict, err := s.GetTxConflict(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conflict != expected || spender != expectedSpender {
+			t.Fatalf("expected conflict %v with %q, got %v with %q", expected, expectedSpender, conflict, spender)
+		}
+	}
+
+	original := spend(testTxId(2), 0)
+	markSpent(original)
+	// a transaction does not conflict with itself
+	assertConflict(original, "", false)
+
+	replacement := spend(testTxId(3), 0)
+	markSpent(replacement)
+	assertConflict(original, testTxId(3), true)
+	assertConflict(replacement, "", false)
+
+	// the spender of an output spent in a block is not known
+	mined := spend(testTxId(4), 1)
+	if _, err := s.RemoveUTXOs([]string{testTxId(1)}, []uint32{1}, mined.Vins); err != nil {
+		t.Fatal(err)
+	}
+	assertConflict(spend(testTxId(5), 1), "", true)
+
+	// coinbase transactions never conflict
+	assertConflict(&model.Transaction{Hash: testTxId(6), Vins: []model.Vin{{TxId: testTxId(6)}}}, "", false)
+}
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/utils"
+)
+
+var (
+	opReturnKey = "opr"
+)
+
+// PutOpReturns indexes nulldata outputs by their payload. Mempool outputs are
+// stored with a zero height and get overwritten once they are mined.
+func (s *Storage) PutOpReturns(opReturns []model.OpReturn) error {
+	if len(opReturns) == 0 {
+		return nil
+	}
+	keys := make([]string, len(opReturns))
+	values := make([][]byte, len(opReturns))
+	for i, opReturn := range opReturns {
+		data, err := opReturn.Marshal()
+		if err != nil {
+			return err
+		}
+		keys[i] = getOpReturnKey(opReturn.Payload, opReturn.TxId, opReturn.Index)
+		values[i] = data
+	}
+	return s.db.PutMulti(keys, values)
+}
+
+func (s *Storage) RemoveOpReturns(opReturns []model.OpReturn) error {
+	if len(opReturns) == 0 {
+		return nil
+	}
+	keys := make([]string, len(opReturns))
+	for i, opReturn := range opReturns {
+		keys[i] = getOpReturnKey(opReturn.Payload, opReturn.TxId, opReturn.Index)
+	}
+	return s.db.DeleteMulti(keys)
+}
+
+// removeReplacedOpReturns drops the nulldata outputs of the mempool
+// transactions losing their inputs to other spenders, and returns their
+// hashes. previous holds the outspend markers of the inputs before they were
+// spent by spenders, aligned with them. The outputs of the descendants of a
+// replaced transaction are left until the descendants are replaced
+// themselves.
+func (s *Storage) removeReplacedOpReturns(previous [][]byte, spenders []string) ([]string, error) {
+	replaced := make(map[string]bool)
+	for i, data := range previous {
+		if len(data) == 0 {
+			continue
+		}
+		outspend, err := model.UnmarshalOutspend(data)
+		if err != nil {
+			return nil, err
+		}
+		if outspend.TxId != spenders[i] {
+			replaced[outspend.TxId] = true
+		}
+	}
+	hashes := make([]string, 0, len(replaced))
+	for hash := range replaced {
+		tx, exists, err := s.GetTx(hash)
+		if err != nil && err != ErrTxPruned {
+			return nil, err
+		}
+		// a mined output is indexed under the same key as when it was in the
+		// mempool, and stays
+		if !exists || tx.BlockHash != "" {
+			continue
+		}
+		if err := s.RemoveOpReturns(utils.OpReturns(tx.Vouts, "", 0)); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// SearchOpReturns returns the nulldata outputs whose payload equals the given
+// hex payload, or starts with it when isPrefix is set. It skips the first
+// offset matches and returns at most limit of them, along with whether more
+// matches are available.
+func (s *Storage) SearchOpReturns(payload string, isPrefix bool, offset, limit int) ([]*model.OpReturn, bool, error) {
+	prefix := opReturnKey + payload
+	if !isPrefix {
+		prefix += ":"
+	}
+
+	opReturns := make([]*model.OpReturn, 0)
+	hasMore := false
+	var decodeErr error
+	skipped := 0
+	err := s.db.IterateWithPrefix(prefix, func(key, value []byte) bool {
+		if skipped < offset {
+			skipped++
+			return true
+		}
+		if len(opReturns) == limit {
+			hasMore = true
+			return false
+		}
+		opReturn, err := model.UnmarshalOpReturn(value)
+		if err != nil {
+			decodeErr = fmt.Errorf("SearchOpReturns: error unmarshalling op_return: %w", err)
+			return false
+		}
+		opReturns = append(opReturns, opReturn)
+		return true
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if decodeErr != nil {
+		return nil, false, decodeErr
+	}
+	return opReturns, hasMore, nil
+}
+
+// payloads are hex encoded, so ":" can never appear inside one and marks
+// the end of an exact match.
+func getOpReturnKey(payload, txId string, index uint32) string {
+	return fmt.Sprintf("%s%s:%s:%d", opReturnKey, payload, txId, index)
+}
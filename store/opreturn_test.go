@@ -0,0 +1,149 @@
+package store
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/catalogfi/indexer/database"
+	"github.com/catalogfi/indexer/model"
+	"go.uber.org/zap"
+)
+
+func newTestStorage(t *testing.T) *Storage {
+	db, err := database.NewRocksDB(t.TempDir(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewStorage(db)
+}
+
+func testTxId(b byte) string {
+	return strings.Repeat(hex.EncodeToString([]byte{b}), 32)
+}
+
+func TestSearchOpReturns(t *testing.T) {
+	s := newTestStorage(t)
+	opReturns := []model.OpReturn{
+		{TxId: testTxId(1), Index: 0, Payload: "aabb", Height: 1, BlockHash: "b1"},
+		{TxId: testTxId(2), Index: 0, Payload: "aabb", Height: 2, BlockHash: "b2"},
+		{TxId: testTxId(2), Index: 1, Payload: "aabb", Height: 2, BlockHash: "b2"},
+		{TxId: testTxId(3), Index: 0, Payload: "aabbcc"},
+		{TxId: testTxId(4), Index: 0, Payload: "aa"},
+	}
+	if err := s.PutOpReturns(opReturns); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		payload  string
+		isPrefix bool
+		offset   int
+		limit    int
+		expected []model.OpReturn
+		hasMore  bool
+	}{
+		{"exact", "aabb", false, 0, 10, opReturns[:3], false},
+		{"prefix", "aabb", true, 0, 10, opReturns[:4], false},
+		{"limited", "aabb", true, 0, 2, opReturns[:2], true},
+		{"offset", "aabb", true, 2, 10, opReturns[2:4], false},
+		{"offset and limit", "aabb", true, 1, 2, opReturns[1:3], true},
+		{"last page", "aabb", false, 1, 2, opReturns[1:3], false},
+		{"offset past the matches", "aabb", false, 5, 2, nil, false},
+		{"no match", "bb", true, 0, 10, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			results, hasMore, err := s.SearchOpReturns(test.payload, test.isPrefix, test.offset, test.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hasMore != test.hasMore || len(results) != len(test.expected) {
+				t.Fatalf("expected %d results, more %v, got %d, more %v", len(test.expected), test.hasMore, len(results), hasMore)
+			}
+			for i := range results {
+				if *results[i] != test.expected[i] {
+					t.Fatalf("expected %+v, got %+v", test.expected[i], *results[i])
+				}
+			}
+		})
+	}
+}
+
+// TestReplacedOpReturns checks that the nulldata outputs of a mempool
+// transaction are dropped once another transaction spends its inputs, and
+// that the replaced transaction is reported.
+func TestReplacedOpReturns(t *testing.T) {
+	s := newTestStorage(t)
+	funding := model.Vout{TxId: testTxId(1), Index: 0, Value: 1000, ScriptPubKey: "51", Height: 1}
+	if err := s.PutUTXOs([]model.Vout{funding}); err != nil {
+		t.Fatal(err)
+	}
+	nullData := hex.EncodeToString([]byte{txscript.OP_RETURN, 0x02, 0xaa, 0xbb})
+	putMempoolTx := func(hash string) []string {
+		t.Helper()
+		vin := model.Vin{TxId: hash, PreviousTxId: funding.TxId, PreviousIndex: funding.Index}
+		tx := &model.Transaction{
+			Hash:  hash,
+			Vins:  []model.Vin{vin},
+			Vouts: []model.Vout{{TxId: hash, Index: 0, ScriptPubKey: nullData}},
+		}
+		if err := s.PutTx(tx); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutOpReturns([]model.OpReturn{{TxId: hash, Index: 0, Payload: "aabb"}}); err != nil {
+			t.Fatal(err)
+		}
+		replaced, err := s.MarkUTXOsSpent([]string{funding.TxId}, []uint32{funding.Index}, []model.Vin{vin})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return replaced
+	}
+	assertReplaced := func(replaced []string, hashes ...string) {
+		t.Helper()
+		if len(replaced) != len(hashes) {
+			t.Fatalf("expected %d replaced transactions, got %v", len(hashes), replaced)
+		}
+		for i := range replaced {
+			if replaced[i] != hashes[i] {
+				t.Fatalf("expected %s to be replaced, got %s", hashes[i], replaced[i])
+			}
+		}
+	}
+	assertOpReturns := func(hashes ...string) {
+		t.Helper()
+		results, _, err := s.SearchOpReturns("aabb", false, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(hashes) {
+			t.Fatalf("expected %d op_returns, got %d", len(hashes), len(results))
+		}
+		for i := range results {
+			if results[i].TxId != hashes[i] {
+				t.Fatalf("expected the op_return of %s, got %s", hashes[i], results[i].TxId)
+			}
+		}
+	}
+
+	assertReplaced(putMempoolTx(testTxId(2)))
+	// the same transaction seen again is not replaced
+	assertReplaced(putMempoolTx(testTxId(2)))
+	assertOpReturns(testTxId(2))
+
+	// a replacement in the mempool
+	assertReplaced(putMempoolTx(testTxId(3)), testTxId(2))
+	assertOpReturns(testTxId(3))
+
+	// a block spending the output with another transaction
+	spender := model.Vin{TxId: testTxId(4), PreviousTxId: funding.TxId, PreviousIndex: funding.Index}
+	replaced, err := s.RemoveUTXOs([]string{funding.TxId}, []uint32{funding.Index}, []model.Vin{spender})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertReplaced(replaced, testTxId(3))
+	assertOpReturns()
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+)
+
+var (
+	prunedHeightKey = "prunedHeight"
+	// prn<txid> marks the transactions whose bodies have been pruned, keeping
+	// the height of their block
+	prunedTxKey = "prn"
+)
+
+// GetPrunedHeight returns the height of the last pruned block.
+func (s *Storage) GetPrunedHeight() (uint64, bool, error) {
+	data, err := s.db.Get(prunedHeightKey)
+	if err != nil {
+		if err.Error() == ErrKeyNotFound {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	height, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("GetPrunedHeight: error converting height to int: %w", err)
+	}
+	return height, true, nil
+}
+
+// PruneBlock deletes the transaction bodies of the block at height and its
+// list of transactions. The block header, the UTXO set, the address history
+// and the outspends are kept.
+func (s *Storage) PruneBlock(height uint64) error {
+	block, exists, err := s.GetBlockByHeight(height)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrGetBlockNotFound
+	}
+	if !block.Pruned {
+		markerKeys := make([]string, len(block.Txs))
+		markerValues := make([][]byte, len(block.Txs))
+		for i, hash := range block.Txs {
+			markerKeys[i] = prunedTxKey + hash
+			markerValues[i] = []byte(strconv.FormatUint(height, 10))
+		}
+		// markers go first so a transaction is never missing without one
+		if err := s.db.PutMulti(markerKeys, markerValues); err != nil {
+			return err
+		}
+		if err := s.db.DeleteMulti(block.Txs); err != nil {
+			return err
+		}
+		block.Txs = nil
+		block.Pruned = true
+		if err := s.PutBlock(block); err != nil {
+			return err
+		}
+	}
+	return s.db.Put(prunedHeightKey, []byte(strconv.FormatUint(height, 10)))
+}
+
+// IsTxPruned tells whether the body of the transaction has been pruned.
+func (s *Storage) IsTxPruned(hash string) (bool, error) {
+	_, err := s.db.Get(prunedTxKey + hash)
+	if err != nil {
+		if err.Error() == ErrKeyNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,441 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/catalogfi/indexer/model"
+)
+
+// A reindex of the UTXO set is built in a staging area keyed by outpoint and
+// only replaces the live set once it reached the tip, so the old data keeps
+// being served meanwhile.
+var (
+	reindexProgressKey    = "reindexProgress"
+	stagedUTXOKey         = "rxu"
+	stagedUTXOSetInfoKey  = "rxs"
+	reindexCommitBatchLen = 1000
+)
+
+func (s *Storage) GetReindexProgress() (*model.ReindexProgress, bool, error) {
+	data, err := s.db.Get(reindexProgressKey)
+	if err != nil {
+		if err.Error() == ErrKeyNotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	progress, err := model.UnmarshalReindexProgress(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("GetReindexProgress: error unmarshalling progress: %w", err)
+	}
+	return progress, true, nil
+}
+
+func (s *Storage) PutReindexProgress(progress *model.ReindexProgress) error {
+	data, err := progress.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.db.Put(reindexProgressKey, data)
+}
+
+// PutStagedUTXOs adds confirmed outputs to the staged UTXO set. Their scripts
+// are indexed by outpoint right away as those never change.
+func (s *Storage) PutStagedUTXOs(utxos []model.Vout) error {
+	keys := make([]string, 0, 2*len(utxos))
+	values := make([][]byte, 0, 2*len(utxos))
+	added := make([]*model.Vout, len(utxos))
+	for i := range utxos {
+		keys = append(keys, getStagedUTXOKey(utxos[i].TxId, utxos[i].Index), getPkKey(utxos[i].TxId, utxos[i].Index))
+		values = append(values, model.MarshalVout(utxos[i]), []byte(utxos[i].ScriptPubKey))
+		added[i] = &utxos[i]
+	}
+	if err := s.db.PutMulti(keys, values); err != nil {
+		return err
+	}
+	return s.applyUTXOSetInfo(stagedUTXOSetInfoKey, added, nil)
+}
+
+// RemoveStagedUTXOs removes the spent outputs from the staged UTXO set.
+func (s *Storage) RemoveStagedUTXOs(hashes []string, indices []uint32) error {
+	if len(hashes) != len(indices) {
+		return fmt.Errorf("hashes and indices must have the same length")
+	}
+	keys := make([]string, len(hashes))
+	for i := range hashes {
+		keys[i] = getStagedUTXOKey(hashes[i], indices[i])
+	}
+	data, err := s.db.GetMulti(keys)
+	if err != nil {
+		return err
+	}
+	removed := make([]*model.Vout, 0, len(data))
+	for _, val := range data {
+		if len(val) == 0 {
+			continue
+		}
+		vout, err := model.UnmarshalVout(val)
+		if err != nil {
+			return err
+		}
+		removed = append(removed, vout)
+	}
+	if err := s.db.DeleteMulti(keys); err != nil {
+		return err
+	}
+	return s.applyUTXOSetInfo(stagedUTXOSetInfoKey, nil, removed)
+}
+
+// ClearStagedUTXOs discards the staged UTXO set of an abandoned reindex.
+func (s *Storage) ClearStagedUTXOs() error {
+	keys := make([]string, 0)
+	err := s.db.IterateWithPrefix(stagedUTXOKey, func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	keys = append(keys, stagedUTXOSetInfoKey)
+	return s.db.DeleteMulti(keys)
+}
+
+// CommitStagedUTXOs makes the staged UTXO set the live one. Every output ever
+// indexed is visited: confirmed outputs missing from the staged set are
+// deleted, staged ones are written and mempool outputs are left alone.
+// Callers must make sure no block is connected meanwhile.
+func (s *Storage) CommitStagedUTXOs() error {
+	s.utxoSetMu.Lock()
+	defer s.utxoSetMu.Unlock()
+
+	type outpoint struct {
+		hash         string
+		index        uint32
+		scriptPubKey string
+	}
+	batch := make([]outpoint, 0, reindexCommitBatchLen)
+	commit := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		liveKeys := make([]string, len(batch))
+		stagedKeys := make([]string, len(batch))
+		for i, op := range batch {
+			liveKeys[i] = getUTXOKey(op.scriptPubKey, op.hash, op.index)
+			stagedKeys[i] = getStagedUTXOKey(op.hash, op.index)
+		}
+		live, err := s.db.GetMulti(liveKeys)
+		if err != nil {
+			return err
+		}
+		staged, err := s.db.GetMulti(stagedKeys)
+		if err != nil {
+			return err
+		}
+
+		putKeys := make([]string, 0)
+		putValues := make([][]byte, 0)
+		deleteKeys := make([]string, 0)
+		for i := range batch {
+			var liveVout *model.Vout
+			if len(live[i]) > 0 {
+				if liveVout, err = model.UnmarshalVout(live[i]); err != nil {
+					return err
+				}
+			}
+			switch {
+			case len(staged[i]) > 0:
+				if liveVout == nil || liveVout.Height == 0 || string(live[i]) != string(staged[i]) {
+					putKeys = append(putKeys, liveKeys[i])
+					putValues = append(putValues, staged[i])
+				}
+				deleteKeys = append(deleteKeys, stagedKeys[i])
+			case liveVout != nil && liveVout.Height > 0:
+				deleteKeys = append(deleteKeys, liveKeys[i])
+			}
+		}
+		if err := s.db.PutMulti(putKeys, putValues); err != nil {
+			return err
+		}
+		if err := s.db.DeleteMulti(deleteKeys); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	var commitErr error
+	err := s.db.IterateWithPrefix("pk", func(key, value []byte) bool {
+		hash, index, ok := decodePkKey(string(key))
+		if !ok {
+			return true
+		}
+		batch = append(batch, outpoint{hash: hash, index: index, scriptPubKey: string(value)})
+		if len(batch) == reindexCommitBatchLen {
+			if commitErr = commit(); commitErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if commitErr != nil {
+		return commitErr
+	}
+	if err := commit(); err != nil {
+		return err
+	}
+
+	info, err := s.getUTXOSetInfo(stagedUTXOSetInfoKey)
+	if err != nil {
+		return err
+	}
+	data, err := info.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := s.db.Put(utxoSetInfoKey, data); err != nil {
+		return err
+	}
+	return s.db.Delete(stagedUTXOSetInfoKey)
+}
+
+// PutTxHistory indexes the transactions under the scripts they pay to and
+// spend from.
+func (s *Storage) PutTxHistory(txs []*model.Transaction) error {
+	keys := make([]string, 0)
+	values := make([][]byte, 0)
+	for _, tx := range txs {
+		for _, vout := range tx.Vouts {
+			keys = append(keys, "tx"+vout.ScriptPubKey+tx.Hash)
+			values = append(values, []byte(tx.Hash))
+		}
+		hashes := make([]string, 0, len(tx.Vins))
+		indices := make([]uint32, 0, len(tx.Vins))
+		for _, vin := range tx.Vins {
+			if vin.PreviousTxId == "" {
+				continue
+			}
+			hashes = append(hashes, vin.PreviousTxId)
+			indices = append(indices, vin.PreviousIndex)
+		}
+		scriptPubKeys, err := s.GetPkScripts(hashes, indices)
+		if err != nil {
+			return err
+		}
+		for _, pk := range scriptPubKeys {
+			if pk == "" {
+				continue
+			}
+			keys = append(keys, "tx"+pk+tx.Hash)
+			values = append(values, []byte(tx.Hash))
+		}
+	}
+	return s.db.PutMulti(keys, values)
+}
+
+// CleanOutspends deletes the outspend markers whose spending transaction is
+// gone or already confirmed, and returns how many were deleted.
+func (s *Storage) CleanOutspends() (int, error) {
+	keys := make([]string, 0)
+	spenders := make([]string, 0)
+	var unmarshalErr error
+	err := s.db.IterateWithPrefix("os", func(key, value []byte) bool {
+		outspend, err := model.UnmarshalOutspend(value)
+		if err != nil {
+			unmarshalErr = err
+			return false
+		}
+		keys = append(keys, string(key))
+		spenders = append(spenders, outspend.TxId)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if unmarshalErr != nil {
+		return 0, unmarshalErr
+	}
+
+	stale := make([]string, 0)
+	for i, hash := range spenders {
+		tx, exists, err := s.GetTx(hash)
+		if err != nil && err != ErrTxPruned {
+			return 0, err
+		}
+		if err == ErrTxPruned || !exists || tx.BlockHash != "" {
+			stale = append(stale, keys[i])
+		}
+	}
+	return len(stale), s.db.DeleteMulti(stale)
+}
+
+// CleanTxLocations deletes the transaction locations pointing to blocks which
+// are not on the main chain anymore, and returns how many were deleted.
+func (s *Storage) CleanTxLocations() (int, error) {
+	keys := make([]string, 0)
+	locations := make([]*model.TxLocation, 0)
+	var unmarshalErr error
+	err := s.db.IterateWithPrefix(txLocationKey, func(key, value []byte) bool {
+		location, err := model.UnmarshalTxLocation(value)
+		if err != nil {
+			unmarshalErr = err
+			return false
+		}
+		keys = append(keys, string(key))
+		locations = append(locations, location)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if unmarshalErr != nil {
+		return 0, unmarshalErr
+	}
+
+	mainChain := make(map[uint64]string)
+	stale := make([]string, 0)
+	for i, location := range locations {
+		hash, ok := mainChain[location.Height]
+		if !ok {
+			block, exists, err := s.GetBlockByHeight(location.Height)
+			if err != nil {
+				return 0, err
+			}
+			if exists {
+				hash = block.Hash
+			}
+			mainChain[location.Height] = hash
+		}
+		if hash != location.BlockHash {
+			stale = append(stale, keys[i])
+		}
+	}
+	return len(stale), s.db.DeleteMulti(stale)
+}
+
+// CleanTxHistory deletes the script history entries of the transactions
+// neither on the main chain nor in the mempool, and returns how many were
+// deleted.
+func (s *Storage) CleanTxHistory() (int, error) {
+	keys := make([]string, 0)
+	hashes := make([]string, 0)
+	err := s.db.IterateWithPrefix("tx", func(key, value []byte) bool {
+		// the transaction locations share the prefix
+		if strings.HasPrefix(string(key), txLocationKey) {
+			return true
+		}
+		keys = append(keys, string(key))
+		hashes = append(hashes, string(value))
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return s.deleteStale(keys, hashes)
+}
+
+// CleanOpReturns deletes the nulldata outputs of the transactions neither on
+// the main chain nor in the mempool, and returns how many were deleted.
+func (s *Storage) CleanOpReturns() (int, error) {
+	keys := make([]string, 0)
+	hashes := make([]string, 0)
+	var unmarshalErr error
+	err := s.db.IterateWithPrefix(opReturnKey, func(key, value []byte) bool {
+		opReturn, err := model.UnmarshalOpReturn(value)
+		if err != nil {
+			unmarshalErr = err
+			return false
+		}
+		keys = append(keys, string(key))
+		hashes = append(hashes, opReturn.TxId)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if unmarshalErr != nil {
+		return 0, unmarshalErr
+	}
+	return s.deleteStale(keys, hashes)
+}
+
+// deleteStale deletes the keys indexing transactions, aligned with hashes,
+// which are neither on the main chain nor in the mempool.
+func (s *Storage) deleteStale(keys, hashes []string) (int, error) {
+	live := make(map[string]bool)
+	mainChain := make(map[string]bool)
+	stale := make([]string, 0)
+	for i, hash := range hashes {
+		isLive, ok := live[hash]
+		if !ok {
+			var err error
+			if isLive, err = s.isLiveTx(hash, mainChain); err != nil {
+				return 0, err
+			}
+			live[hash] = isLive
+		}
+		if !isLive {
+			stale = append(stale, keys[i])
+		}
+	}
+	return len(stale), s.db.DeleteMulti(stale)
+}
+
+// isLiveTx tells whether the transaction is in the mempool or on the main
+// chain. The block hash of a stored transaction is the last block including
+// it, so a transaction of an orphaned block is looked up by location too.
+// mainChain caches whether block hashes are on the main chain.
+func (s *Storage) isLiveTx(hash string, mainChain map[string]bool) (bool, error) {
+	_, located, err := s.GetTxLocation(hash)
+	if err != nil || located {
+		return located, err
+	}
+	tx, exists, err := s.GetTx(hash)
+	if err == ErrTxPruned {
+		// pruned transactions are only kept for the main chain
+		return true, nil
+	}
+	if err != nil || !exists {
+		return false, err
+	}
+	if tx.BlockHash == "" {
+		return true, nil
+	}
+	onMainChain, ok := mainChain[tx.BlockHash]
+	if !ok {
+		block, exists, err := s.GetBlock(tx.BlockHash)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			atHeight, exists, err := s.GetBlockByHeight(block.Height)
+			if err != nil {
+				return false, err
+			}
+			onMainChain = exists && atHeight.Hash == block.Hash
+		}
+		mainChain[tx.BlockHash] = onMainChain
+	}
+	return onMainChain, nil
+}
+
+func getStagedUTXOKey(hash string, i uint32) string {
+	return stagedUTXOKey + hash + string(rune(i))
+}
+
+// decodePkKey splits a key built by getPkKey into its outpoint.
+func decodePkKey(key string) (string, uint32, bool) {
+	if len(key) <= 2+64 {
+		return "", 0, false
+	}
+	index, size := utf8.DecodeRuneInString(key[2+64:])
+	if size == 0 || 2+64+size != len(key) {
+		return "", 0, false
+	}
+	return key[2 : 2+64], uint32(index), true
+}
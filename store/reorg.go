@@ -0,0 +1,39 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/catalogfi/indexer/model"
+)
+
+// A reorganization is recorded under reorgProgressKey until all its blocks
+// are moved, so the indexes are never left between two chains.
+var reorgProgressKey = "reorgProgress"
+
+func (s *Storage) GetReorgProgress() (*model.ReorgProgress, bool, error) {
+	data, err := s.db.Get(reorgProgressKey)
+	if err != nil {
+		if err.Error() == ErrKeyNotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	progress, err := model.UnmarshalReorgProgress(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("GetReorgProgress: error unmarshalling progress: %w", err)
+	}
+	return progress, true, nil
+}
+
+func (s *Storage) PutReorgProgress(progress *model.ReorgProgress) error {
+	data, err := progress.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.db.Put(reorgProgressKey, data)
+}
+
+// RemoveReorgProgress drops the record of a finished reorganization.
+func (s *Storage) RemoveReorgProgress() error {
+	return s.db.Delete(reorgProgressKey)
+}
@@ -1,16 +1,20 @@
 package store
 
 import (
+	"sync"
+
 	"github.com/catalogfi/indexer/database"
 	"go.uber.org/zap"
 )
 
-// TODO: test reorgs
 // TODO: test pending transactions
 
 type Storage struct {
 	db     database.Db
 	logger *zap.Logger
+
+	// guards the read-modify-write of the UTXO set statistics
+	utxoSetMu sync.Mutex
 }
 
 func NewStorage(db database.Db) *Storage {
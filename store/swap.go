@@ -0,0 +1,106 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/catalogfi/indexer/model"
+)
+
+// HTLC spends are indexed by the script of the spent output, and the secrets
+// revealed by redeems by their hash:
+//
+//	swp<scriptPubKey>:<txid>:<vin>  spend of the output
+//	secret_<hash>                   redeem revealing the secret
+var (
+	swapSpendKey = "swp"
+	secretKey    = "secret_"
+)
+
+// PutSwapSpends stores the spends and indexes the secrets of the redeems. A
+// secret revealed by a confirmed transaction is only replaced by the same
+// transaction, so it survives other spends in the mempool.
+func (s *Storage) PutSwapSpends(spends []*model.SwapSpend) error {
+	if len(spends) == 0 {
+		return nil
+	}
+	secretKeys := make([]string, 0)
+	redeems := make([]*model.SwapSpend, 0)
+	for _, spend := range spends {
+		if spend.Secret != "" {
+			secretKeys = append(secretKeys, secretKey+spend.SecretHash)
+			redeems = append(redeems, spend)
+		}
+	}
+	existing, err := s.db.GetMulti(secretKeys)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(spends)+len(redeems))
+	values := make([][]byte, 0, len(spends)+len(redeems))
+	for _, spend := range spends {
+		data, err := spend.Marshal()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, getSwapSpendKey(spend.ScriptPubKey, spend.TxId, spend.Vin))
+		values = append(values, data)
+	}
+	for i, redeem := range redeems {
+		if len(existing[i]) > 0 {
+			current, err := model.UnmarshalSwapSpend(existing[i])
+			if err != nil {
+				return err
+			}
+			if current.Height > 0 && current.TxId != redeem.TxId {
+				continue
+			}
+		}
+		data, err := redeem.Marshal()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, secretKeys[i])
+		values = append(values, data)
+	}
+	return s.db.PutMulti(keys, values)
+}
+
+// GetSwapSpends returns the spends of the HTLC outputs paying to
+// scriptPubKey.
+func (s *Storage) GetSwapSpends(scriptPubKey string) ([]*model.SwapSpend, error) {
+	data, err := s.db.GetWithPrefix(swapSpendKey + scriptPubKey + ":")
+	if err != nil {
+		return nil, err
+	}
+	spends := make([]*model.SwapSpend, len(data))
+	for i, val := range data {
+		spend, err := model.UnmarshalSwapSpend(val)
+		if err != nil {
+			return nil, err
+		}
+		spends[i] = spend
+	}
+	return spends, nil
+}
+
+// GetSecret returns the redeem which revealed the preimage of the hex encoded
+// hash.
+func (s *Storage) GetSecret(hash string) (*model.SwapSpend, bool, error) {
+	data, err := s.db.Get(secretKey + hash)
+	if err != nil {
+		if err.Error() == ErrKeyNotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	spend, err := model.UnmarshalSwapSpend(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("GetSecret: error unmarshalling spend: %w", err)
+	}
+	return spend, true, nil
+}
+
+func getSwapSpendKey(scriptPubKey, txId string, vin uint32) string {
+	return fmt.Sprintf("%s%s:%s:%d", swapSpendKey, scriptPubKey, txId, vin)
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/catalogfi/indexer/model"
 	"go.uber.org/zap"
@@ -33,10 +34,54 @@ func (s *Storage) GetPkScripts(hashes []string, indices []uint32) ([]string, err
 	return scriptPubKeys, nil
 }
 
+// GetPrevouts returns the unspent outputs at the given outpoints. The result
+// is aligned with hashes and holds nil for outpoints not in the UTXO set.
+func (s *Storage) GetPrevouts(hashes []string, indices []uint32) ([]*model.Vout, error) {
+	if len(hashes) != len(indices) {
+		return nil, fmt.Errorf("hashes and indices must have the same length")
+	}
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	scriptPubKeys, err := s.GetPkScripts(hashes, indices)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(scriptPubKeys))
+	for i, pk := range scriptPubKeys {
+		keys[i] = getUTXOKey(pk, hashes[i], indices[i])
+	}
+	data, err := s.db.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	prevouts := make([]*model.Vout, len(data))
+	for i, val := range data {
+		if len(val) == 0 || scriptPubKeys[i] == "" {
+			continue
+		}
+		vout, err := model.UnmarshalVout(val)
+		if err != nil {
+			return nil, err
+		}
+		prevouts[i] = vout
+	}
+	return prevouts, nil
+}
+
+// GetTx returns the transaction with the given hash, or ErrTxPruned if its
+// body has been pruned.
 func (s *Storage) GetTx(hash string) (*model.Transaction, bool, error) {
 	data, err := s.db.Get(hash)
 	if err != nil {
 		if err.Error() == ErrKeyNotFound {
+			pruned, err := s.IsTxPruned(hash)
+			if err != nil {
+				return nil, false, err
+			}
+			if pruned {
+				return nil, false, ErrTxPruned
+			}
 			return nil, false, nil
 		}
 		return nil, false, err
@@ -48,17 +93,26 @@ func (s *Storage) GetTx(hash string) (*model.Transaction, bool, error) {
 	return tx, true, nil
 }
 
-func (s *Storage) RemoveUTXOs(hashes []string, indices []uint32, vins []model.Vin) error {
+// RemoveUTXOs removes the outputs spent by a block from the UTXO set. It
+// returns the hashes of the mempool transactions replaced by the block, as
+// they spent the same outputs.
+func (s *Storage) RemoveUTXOs(hashes []string, indices []uint32, vins []model.Vin) ([]string, error) {
 
 	if len(hashes) != len(indices) {
-		return fmt.Errorf("hashes and indices must have the same length")
+		return nil, fmt.Errorf("hashes and indices must have the same length")
 	}
 	if len(hashes) == 0 {
-		return nil
+		return nil, nil
 	}
 
+	s.utxoSetMu.Lock()
+	defer s.utxoSetMu.Unlock()
+
 	batchSize := 100
 	eg := new(errgroup.Group)
+	removedMu := new(sync.Mutex)
+	removed := make([]*model.Vout, 0)
+	replaced := make([]string, 0)
 	for i := 0; i < len(hashes); i += batchSize {
 		i := i
 		eg.Go(func() error {
@@ -71,14 +125,52 @@ func (s *Storage) RemoveUTXOs(hashes []string, indices []uint32, vins []model.Vi
 				s.logger.Error("error getting txs to remove utxos from db", zap.Error(err))
 				return err
 			}
-			keys := make([]string, len(scriptPubKeys))
+			keys := make([]string, 0, 2*len(scriptPubKeys))
+			utxoKeys := make([]string, len(scriptPubKeys))
+			outspendKeys := make([]string, len(scriptPubKeys))
+			spenders := make([]string, len(scriptPubKeys))
 			txKeys := make([]string, len(scriptPubKeys))
 			txVals := make([][]byte, len(scriptPubKeys))
 			for j, pk := range scriptPubKeys {
-				keys[j] = pk + hashes[i+j] + string(indices[i+j])
+				utxoKeys[j] = getUTXOKey(pk, hashes[i+j], indices[i+j])
+				outspendKeys[j] = getOutspendKey(hashes[i+j], indices[i+j])
+				spenders[j] = vins[i+j].TxId
 				txKeys[j] = "tx" + pk + vins[i+j].TxId
 				txVals[j] = []byte(vins[i+j].TxId)
+				keys = append(keys, utxoKeys[j], outspendKeys[j])
 			}
+
+			// the mempool transactions spending the same outputs as the block
+			// are dropped
+			previous, err := s.db.GetMulti(outspendKeys)
+			if err != nil {
+				return err
+			}
+			batchReplaced, err := s.removeReplacedOpReturns(previous, spenders)
+			if err != nil {
+				return err
+			}
+
+			// the spent outputs are needed to keep the utxo set statistics in sync
+			spent, err := s.db.GetMulti(utxoKeys)
+			if err != nil {
+				s.logger.Error("error getting utxos to remove from db", zap.Error(err))
+				return err
+			}
+			confirmed := make([]*model.Vout, 0, len(spent))
+			for _, data := range spent {
+				if len(data) == 0 {
+					continue
+				}
+				vout, err := model.UnmarshalVout(data)
+				if err != nil {
+					return err
+				}
+				if vout.Height > 0 {
+					confirmed = append(confirmed, vout)
+				}
+			}
+
 			err = s.db.DeleteMulti(keys)
 			if err != nil {
 				s.logger.Error("error deleting utxos from db", zap.Error(err))
@@ -90,21 +182,162 @@ func (s *Storage) RemoveUTXOs(hashes []string, indices []uint32, vins []model.Vi
 				return err
 			}
 
+			removedMu.Lock()
+			removed = append(removed, confirmed...)
+			replaced = append(replaced, batchReplaced...)
+			removedMu.Unlock()
 			return nil
 		})
 	}
 	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	if err := s.updateUTXOSetInfo(nil, removed); err != nil {
+		return nil, err
+	}
+	return replaced, nil
+}
+
+// UnspendUTXOs reverts RemoveUTXOs for the outputs spent by a block leaving
+// the main chain: they are put back in the UTXO set and the spending
+// transactions, aligned with vins, dropped from the history of their scripts.
+func (s *Storage) UnspendUTXOs(spent []model.Vout, vins []model.Vin) error {
+	if len(spent) != len(vins) {
+		return fmt.Errorf("spent and vins must have the same length")
+	}
+	if len(spent) == 0 {
+		return nil
+	}
+	keys := make([]string, len(spent))
+	for i, vout := range spent {
+		keys[i] = "tx" + vout.ScriptPubKey + vins[i].TxId
+	}
+	if err := s.db.DeleteMulti(keys); err != nil {
+		return err
+	}
+	return s.PutUTXOs(spent)
+}
+
+// RemoveBlockUTXOs drops the outputs created by a block leaving the main
+// chain from the UTXO set, along with their transactions from the history of
+// their scripts. Outputs already spent are only dropped from the history.
+func (s *Storage) RemoveBlockUTXOs(utxos []model.Vout) error {
+	if len(utxos) == 0 {
+		return nil
+	}
+
+	s.utxoSetMu.Lock()
+	defer s.utxoSetMu.Unlock()
+
+	utxoKeys := make([]string, len(utxos))
+	keys := make([]string, 0, 3*len(utxos))
+	for i, utxo := range utxos {
+		utxoKeys[i] = getUTXOKey(utxo.ScriptPubKey, utxo.TxId, utxo.Index)
+		keys = append(keys, utxoKeys[i], getPkKey(utxo.TxId, utxo.Index), "tx"+utxo.ScriptPubKey+utxo.TxId)
+	}
+	existing, err := s.db.GetMulti(utxoKeys)
+	if err != nil {
 		return err
 	}
-	return nil
+	removed := make([]*model.Vout, 0, len(existing))
+	for _, data := range existing {
+		if len(data) == 0 {
+			continue
+		}
+		vout, err := model.UnmarshalVout(data)
+		if err != nil {
+			return err
+		}
+		if vout.Height > 0 {
+			removed = append(removed, vout)
+		}
+	}
+	if err := s.db.DeleteMulti(keys); err != nil {
+		return err
+	}
+	return s.updateUTXOSetInfo(nil, removed)
+}
+
+// MarkUTXOsSpent records the outputs spent by mempool transactions without
+// removing them, so the confirmed UTXO set only changes once the spending
+// transaction is mined. It returns the hashes of the mempool transactions
+// replaced, as they spent the same outputs.
+func (s *Storage) MarkUTXOsSpent(hashes []string, indices []uint32, vins []model.Vin) ([]string, error) {
+	if len(hashes) != len(indices) || len(hashes) != len(vins) {
+		return nil, fmt.Errorf("hashes, indices and vins must have the same length")
+	}
+	outpointHashes := make([]string, 0, len(hashes))
+	outpointIndices := make([]uint32, 0, len(indices))
+	spenders := make([]model.Vin, 0, len(vins))
+	for i, hash := range hashes {
+		// skips the coinbase inputs
+		if hash == "" {
+			continue
+		}
+		outpointHashes = append(outpointHashes, hash)
+		outpointIndices = append(outpointIndices, indices[i])
+		spenders = append(spenders, vins[i])
+	}
+	if len(outpointHashes) == 0 {
+		return nil, nil
+	}
+
+	scriptPubKeys, err := s.GetPkScripts(outpointHashes, outpointIndices)
+	if err != nil {
+		return nil, err
+	}
+	// a mempool transaction spending the same outputs is replaced
+	outspendKeys := make([]string, len(outpointHashes))
+	spenderHashes := make([]string, len(spenders))
+	for i := range outpointHashes {
+		outspendKeys[i] = getOutspendKey(outpointHashes[i], outpointIndices[i])
+		spenderHashes[i] = spenders[i].TxId
+	}
+	previous, err := s.db.GetMulti(outspendKeys)
+	if err != nil {
+		return nil, err
+	}
+	replaced, err := s.removeReplacedOpReturns(previous, spenderHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, 2*len(scriptPubKeys))
+	values := make([][]byte, 0, 2*len(scriptPubKeys))
+	for i, pk := range scriptPubKeys {
+		outspend := model.Outspend{
+			TxId:  spenders[i].TxId,
+			Index: spenders[i].Index,
+		}
+		data, err := outspend.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, outspendKeys[i], "tx"+pk+spenders[i].TxId)
+		values = append(values, data, []byte(spenders[i].TxId))
+	}
+	if err := s.db.PutMulti(keys, values); err != nil {
+		return nil, err
+	}
+	return replaced, nil
 }
 
+// PutUTXOs adds the outputs to the UTXO set. Outputs with a height are
+// confirmed and counted in the UTXO set statistics.
 func (s *Storage) PutUTXOs(utxos []model.Vout) error {
-	size := len(utxos) * 2
-	keys := make([]string, size)
-	values := make([][]byte, size)
+	s.utxoSetMu.Lock()
+	defer s.utxoSetMu.Unlock()
+
+	added, err := s.newConfirmedUTXOs(utxos)
+	if err != nil {
+		return err
+	}
+
+	size := len(utxos) * 3
+	keys := make([]string, 0, size)
+	values := make([][]byte, 0, size)
 	for _, utxo := range utxos {
-		key1 := utxo.ScriptPubKey + utxo.TxId + string(utxo.Index)
+		key1 := getUTXOKey(utxo.ScriptPubKey, utxo.TxId, utxo.Index)
 		key2 := getPkKey(utxo.TxId, utxo.Index)
 		key3 := "tx" + utxo.ScriptPubKey + utxo.TxId
 		value1 := model.MarshalVout(utxo)
@@ -113,37 +346,139 @@ func (s *Storage) PutUTXOs(utxos []model.Vout) error {
 		keys = append(keys, key1, key2, key3)
 		values = append(values, value1, value2, value3)
 	}
-	return s.db.PutMulti(keys, values)
+	if err := s.db.PutMulti(keys, values); err != nil {
+		return err
+	}
+	return s.updateUTXOSetInfo(added, nil)
 }
 
+// newConfirmedUTXOs returns the confirmed outputs which are not yet counted in
+// the UTXO set, either because they are new or were only seen in the mempool.
+func (s *Storage) newConfirmedUTXOs(utxos []model.Vout) ([]*model.Vout, error) {
+	confirmed := make([]*model.Vout, 0, len(utxos))
+	keys := make([]string, 0, len(utxos))
+	for i := range utxos {
+		if utxos[i].Height == 0 {
+			continue
+		}
+		confirmed = append(confirmed, &utxos[i])
+		keys = append(keys, getUTXOKey(utxos[i].ScriptPubKey, utxos[i].TxId, utxos[i].Index))
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	existing, err := s.db.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	added := make([]*model.Vout, 0, len(confirmed))
+	for i, data := range existing {
+		if len(data) > 0 {
+			vout, err := model.UnmarshalVout(data)
+			if err != nil {
+				return nil, err
+			}
+			if vout.Height > 0 {
+				continue
+			}
+		}
+		added = append(added, confirmed[i])
+	}
+	return added, nil
+}
+
+// GetUTXOs returns the unspent outputs of scriptPubKey, leaving out the ones
+// already spent by a mempool transaction.
 func (s *Storage) GetUTXOs(scriptPubKey string) ([]*model.Vout, error) {
-	data, err := s.db.GetWithPrefix(scriptPubKey)
+	utxos, pendingSpends, err := s.GetUTXOsWithPendingSpends(scriptPubKey)
 	if err != nil {
 		return nil, err
 	}
-	utxos := make([]*model.Vout, len(data))
-	for i, val := range data {
+	unspent := make([]*model.Vout, 0, len(utxos))
+	for i, utxo := range utxos {
+		if !pendingSpends[i] {
+			unspent = append(unspent, utxo)
+		}
+	}
+	return unspent, nil
+}
+
+// GetUTXOsWithPendingSpends returns the unspent outputs of scriptPubKey, and
+// for each whether it is already spent by a mempool transaction.
+func (s *Storage) GetUTXOsWithPendingSpends(scriptPubKey string) ([]*model.Vout, []bool, error) {
+	data, err := s.db.GetWithPrefix(scriptPubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	utxos := make([]*model.Vout, 0, len(data))
+	outspendKeys := make([]string, 0, len(data))
+	for _, val := range data {
 		utxo, err := model.UnmarshalVout(val)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		utxos[i] = utxo
+		utxos = append(utxos, utxo)
+		outspendKeys = append(outspendKeys, getOutspendKey(utxo.TxId, utxo.Index))
+	}
+	pendingSpends := make([]bool, len(utxos))
+	if len(outspendKeys) == 0 {
+		return utxos, pendingSpends, nil
 	}
-	return utxos, nil
+
+	outspends, err := s.db.GetMulti(outspendKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range utxos {
+		pendingSpends[i] = len(outspends[i]) > 0
+	}
+	return utxos, pendingSpends, nil
 }
 
+// IterateUTXOs walks the unspent outputs of scriptPubKey in key order and
+// calls fn with each of them and whether it is already spent by a mempool
+// transaction. Iteration stops as soon as fn returns false.
+func (s *Storage) IterateUTXOs(scriptPubKey string, fn func(utxo *model.Vout, pendingSpend bool) bool) error {
+	var iterErr error
+	err := s.db.IterateWithPrefix(scriptPubKey, func(key, value []byte) bool {
+		utxo, err := model.UnmarshalVout(value)
+		if err != nil {
+			iterErr = fmt.Errorf("IterateUTXOs: error unmarshalling utxo: %w", err)
+			return false
+		}
+		pendingSpend := true
+		if _, err := s.db.Get(getOutspendKey(utxo.TxId, utxo.Index)); err != nil {
+			if err.Error() != ErrKeyNotFound {
+				iterErr = err
+				return false
+			}
+			pendingSpend = false
+		}
+		return fn(utxo, pendingSpend)
+	})
+	if err != nil {
+		return err
+	}
+	return iterErr
+}
+
+// GetTxs returns the transactions with the given hashes. Pruned transactions
+// are left out.
 func (s *Storage) GetTxs(hashes []string) ([]*model.Transaction, error) {
 	data, err := s.db.GetMulti(hashes)
 	if err != nil {
 		return nil, err
 	}
-	txs := make([]*model.Transaction, len(data))
-	for i, val := range data {
+	txs := make([]*model.Transaction, 0, len(data))
+	for _, val := range data {
+		if len(val) == 0 {
+			continue
+		}
 		tx, err := model.UnmarshalTransaction(val)
 		if err != nil {
 			return nil, err
 		}
-		txs[i] = tx
+		txs = append(txs, tx)
 	}
 	return txs, nil
 }
@@ -163,6 +498,16 @@ func (s *Storage) PutTxs(txs []*model.Transaction) error {
 }
 
 func (s *Storage) GetTxsOfPubScript(scriptPubKey string) ([]*model.Transaction, error) {
+	txHashes, err := s.GetTxHashesOfPubScript(scriptPubKey)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetTxs(txHashes)
+}
+
+// GetTxHashesOfPubScript returns the hashes of the transactions paying to or
+// spending from scriptPubKey.
+func (s *Storage) GetTxHashesOfPubScript(scriptPubKey string) ([]string, error) {
 	data, err := s.db.GetWithPrefix("tx" + scriptPubKey)
 	if err != nil {
 		return nil, err
@@ -171,10 +516,17 @@ func (s *Storage) GetTxsOfPubScript(scriptPubKey string) ([]*model.Transaction,
 	for i, val := range data {
 		txHashes[i] = string(val)
 	}
-
-	return s.GetTxs(txHashes)
+	return txHashes, nil
 }
 
 func getPkKey(hash string, i uint32) string {
-	return "pk" + hash + string(i)
+	return "pk" + hash + string(rune(i))
+}
+
+func getUTXOKey(scriptPubKey, hash string, i uint32) string {
+	return scriptPubKey + hash + string(rune(i))
+}
+
+func getOutspendKey(hash string, i uint32) string {
+	return fmt.Sprintf("os%s:%d", hash, i)
 }
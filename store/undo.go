@@ -0,0 +1,46 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/catalogfi/indexer/model"
+)
+
+// The outputs spent by a main chain block are kept as it is connected, so
+// it can be disconnected once the transactions creating them are pruned:
+//
+//	und<blockhash>  outputs spent by the block, with their height
+var undoKey = "und"
+
+// PutBlockUndo records the outputs spent by the block.
+func (s *Storage) PutBlockUndo(hash string, spent []*model.Vout) error {
+	data, err := json.Marshal(spent)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(undoKey+hash, data)
+}
+
+// GetBlockUndo returns the outputs spent by the block, if they were recorded
+// when it was connected.
+func (s *Storage) GetBlockUndo(hash string) ([]*model.Vout, bool, error) {
+	data, err := s.db.Get(undoKey + hash)
+	if err != nil {
+		if err.Error() == ErrKeyNotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	spent, err := model.UnmarshalVouts(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("GetBlockUndo: error unmarshalling outputs: %w", err)
+	}
+	return spent, true, nil
+}
+
+// RemoveBlockUndo drops the outputs spent by a block which left the main
+// chain.
+func (s *Storage) RemoveBlockUndo(hash string) error {
+	return s.db.Delete(undoKey + hash)
+}
@@ -0,0 +1,142 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/muhash"
+)
+
+var (
+	utxoSetInfoKey = "utxoSetInfo"
+)
+
+// GetUTXOSetInfo returns the statistics of the confirmed UTXO set. Outputs of
+// mempool transactions are not part of the set.
+func (s *Storage) GetUTXOSetInfo() (*model.UTXOSetInfo, error) {
+	return s.getUTXOSetInfo(utxoSetInfoKey)
+}
+
+func (s *Storage) getUTXOSetInfo(key string) (*model.UTXOSetInfo, error) {
+	data, err := s.db.Get(key)
+	if err != nil {
+		if err.Error() == ErrKeyNotFound {
+			return &model.UTXOSetInfo{
+				ScriptTypes: map[string]uint64{},
+				MuHash:      muhash.New().Serialize(),
+			}, nil
+		}
+		return nil, err
+	}
+	info, err := model.UnmarshalUTXOSetInfo(data)
+	if err != nil {
+		return nil, fmt.Errorf("getUTXOSetInfo: error unmarshalling utxo set info: %w", err)
+	}
+	if info.ScriptTypes == nil {
+		info.ScriptTypes = map[string]uint64{}
+	}
+	return info, nil
+}
+
+// updateUTXOSetInfo applies the added and removed confirmed outputs to the
+// stored statistics. Callers must hold utxoSetMu.
+func (s *Storage) updateUTXOSetInfo(added, removed []*model.Vout) error {
+	return s.applyUTXOSetInfo(utxoSetInfoKey, added, removed)
+}
+
+func (s *Storage) applyUTXOSetInfo(key string, added, removed []*model.Vout) error {
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	info, err := s.getUTXOSetInfo(key)
+	if err != nil {
+		return err
+	}
+	hash, err := muhash.Deserialize(info.MuHash)
+	if err != nil {
+		return err
+	}
+
+	for _, vout := range added {
+		if isUnspendable(vout) {
+			continue
+		}
+		data, err := serializeUTXO(vout)
+		if err != nil {
+			return err
+		}
+		hash.Insert(data)
+		info.TxOuts++
+		info.TotalAmount += vout.Value
+		info.ScriptTypes[vout.Type]++
+	}
+	for _, vout := range removed {
+		if isUnspendable(vout) {
+			continue
+		}
+		data, err := serializeUTXO(vout)
+		if err != nil {
+			return err
+		}
+		hash.Remove(data)
+		info.TxOuts--
+		info.TotalAmount -= vout.Value
+		if info.ScriptTypes[vout.Type] <= 1 {
+			delete(info.ScriptTypes, vout.Type)
+		} else {
+			info.ScriptTypes[vout.Type]--
+		}
+	}
+
+	info.MuHash = hash.Serialize()
+	data, err := info.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.db.Put(key, data)
+}
+
+// isUnspendable mirrors bitcoind, which never adds provably unspendable
+// outputs to its UTXO set.
+func isUnspendable(vout *model.Vout) bool {
+	return vout.Type == txscript.NullDataTy.String() ||
+		len(vout.ScriptPubKey) > 2*txscript.MaxScriptSize ||
+		len(vout.ScriptPubKey) >= 2 && vout.ScriptPubKey[:2] == "6a"
+}
+
+// serializeUTXO encodes an output the way bitcoind feeds coins to MuHash:
+// outpoint, height*2+coinbase and the serialized txout.
+func serializeUTXO(vout *model.Vout) ([]byte, error) {
+	txHash, err := chainhash.NewHashFromStr(vout.TxId)
+	if err != nil {
+		return nil, err
+	}
+	pkScript, err := hex.DecodeString(vout.ScriptPubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(txHash[:])
+	var scratch [8]byte
+	binary.LittleEndian.PutUint32(scratch[:4], vout.Index)
+	buf.Write(scratch[:4])
+	code := uint32(vout.Height) << 1
+	if vout.Coinbase {
+		code |= 1
+	}
+	binary.LittleEndian.PutUint32(scratch[:4], code)
+	buf.Write(scratch[:4])
+	binary.LittleEndian.PutUint64(scratch[:], uint64(vout.Value))
+	buf.Write(scratch[:])
+	if err := wire.WriteVarBytes(&buf, 0, pkScript); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,445 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/catalogfi/indexer/merkle"
+	"github.com/catalogfi/indexer/model"
+)
+
+// Kinds of inconsistencies reported by VerifyChain.
+const (
+	IssueTipMismatch  = "tip_mismatch"
+	IssueMissingBlock = "missing_block"
+	IssueHashIndex    = "hash_index"
+	IssueBrokenLink   = "broken_link"
+	IssueMissingTx    = "missing_tx"
+	IssueMerkleRoot   = "merkle_root"
+	IssuePkScript     = "pk_script"
+	IssueHistory      = "history"
+	IssueUTXOMismatch = "utxo_mismatch"
+	IssueSpentUTXO    = "spent_utxo"
+)
+
+// VerifyOptions selects the blocks to verify. An EndHeight above the tip is
+// lowered to the tip.
+type VerifyOptions struct {
+	StartHeight uint64
+	EndHeight   uint64
+	// Repair fixes the issues which can be fixed from the stored data. It must
+	// not be used while blocks are being indexed.
+	Repair bool
+}
+
+// VerifyChain checks the blocks in the given range: the height to hash to
+// previous block linkage, the merkle roots of the stored transactions, and
+// the consistency of the UTXO, outpoint script and address history keys of
+// their outputs and inputs. Missing blocks and transactions can only be
+// fetched again from a peer, so they are reported but never repaired.
+func (s *Storage) VerifyChain(opts VerifyOptions) (*model.VerifyReport, error) {
+	tip, exists, err := s.GetLatestBlockHeight()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrGetLatestBlockHeightNone
+	}
+	report := &model.VerifyReport{
+		StartHeight: opts.StartHeight,
+		Repair:      opts.Repair,
+		Issues:      []model.VerifyIssue{},
+		StartedAt:   time.Now().UTC(),
+	}
+	if tip, err = s.verifyTip(report, tip, opts.Repair); err != nil {
+		return nil, err
+	}
+	report.TipHeight = tip
+	report.EndHeight = opts.EndHeight
+	if report.EndHeight > tip {
+		report.EndHeight = tip
+	}
+	if report.StartHeight > report.EndHeight {
+		return nil, fmt.Errorf("start height %d is above end height %d", report.StartHeight, report.EndHeight)
+	}
+
+	var prev *model.Block
+	if report.StartHeight > 0 {
+		if prev, _, err = s.GetBlockByHeight(report.StartHeight - 1); err != nil {
+			return nil, err
+		}
+	}
+	for height := report.StartHeight; height <= report.EndHeight; height++ {
+		block, exists, err := s.GetBlockByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			report.Issues = append(report.Issues, model.VerifyIssue{
+				Kind:   IssueMissingBlock,
+				Height: height,
+				Detail: "no block stored at this height",
+			})
+			prev = nil
+			continue
+		}
+		if err := s.verifyBlock(report, block, prev, opts.Repair); err != nil {
+			return nil, fmt.Errorf("VerifyChain: block %d: %w", height, err)
+		}
+		report.BlocksChecked++
+		prev = block
+	}
+
+	for _, issue := range report.Issues {
+		if issue.Repaired {
+			report.Repaired++
+		}
+	}
+	report.EndedAt = time.Now().UTC()
+	return report, nil
+}
+
+// verifyTip checks that a block is stored at the latest block height and
+// none above it, and returns the tip to verify up to. A tip without a block
+// is lowered to the highest stored block in repair mode. Blocks above the tip
+// are left alone as syncing replaces them.
+func (s *Storage) verifyTip(report *model.VerifyReport, tip uint64, repair bool) (uint64, error) {
+	_, exists, err := s.GetBlockByHeight(tip)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		stored := tip
+		for stored > 0 && !exists {
+			stored--
+			if _, exists, err = s.GetBlockByHeight(stored); err != nil {
+				return 0, err
+			}
+		}
+		issue := model.VerifyIssue{
+			Kind:   IssueTipMismatch,
+			Height: tip,
+			Detail: fmt.Sprintf("latest block height is %d but the highest block stored below it is at %d", tip, stored),
+		}
+		if repair && exists {
+			if err := s.SetLatestBlockHeight(stored); err != nil {
+				return 0, err
+			}
+			issue.Repaired = true
+			tip = stored
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	above := tip
+	for {
+		_, exists, err := s.GetBlockByHeight(above + 1)
+		if err != nil {
+			return 0, err
+		}
+		if !exists {
+			break
+		}
+		above++
+	}
+	if above > tip {
+		report.Issues = append(report.Issues, model.VerifyIssue{
+			Kind:   IssueTipMismatch,
+			Height: tip,
+			Detail: fmt.Sprintf("blocks are stored above the latest block height %d up to %d", tip, above),
+		})
+	}
+	return tip, nil
+}
+
+func (s *Storage) verifyBlock(report *model.VerifyReport, block *model.Block, prev *model.Block, repair bool) error {
+	byHash, exists, err := s.GetBlock(block.Hash)
+	if err != nil {
+		return err
+	}
+	if !exists || byHash.Height != block.Height {
+		issue := model.VerifyIssue{
+			Kind:   IssueHashIndex,
+			Height: block.Height,
+			Hash:   block.Hash,
+			Detail: "block hash does not resolve to the block at this height",
+		}
+		if repair {
+			data, err := block.Marshal()
+			if err != nil {
+				return err
+			}
+			if err := s.db.Put(block.Hash, data); err != nil {
+				return err
+			}
+			issue.Repaired = true
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+	if prev != nil && block.PreviousBlock != prev.Hash {
+		report.Issues = append(report.Issues, model.VerifyIssue{
+			Kind:   IssueBrokenLink,
+			Height: block.Height,
+			Hash:   block.Hash,
+			Detail: fmt.Sprintf("previous block is %s but the block stored at height %d is %s", block.PreviousBlock, prev.Height, prev.Hash),
+		})
+	}
+
+	if block.Pruned {
+		report.PrunedBlocks++
+		return nil
+	}
+	data, err := s.db.GetMulti(block.Txs)
+	if err != nil {
+		return err
+	}
+	txs := make([]*model.Transaction, 0, len(data))
+	for i, val := range data {
+		if len(val) == 0 {
+			report.Issues = append(report.Issues, model.VerifyIssue{
+				Kind:   IssueMissingTx,
+				Height: block.Height,
+				Hash:   block.Txs[i],
+				Detail: "transaction of block " + block.Hash + " is not stored",
+			})
+			continue
+		}
+		tx, err := model.UnmarshalTransaction(val)
+		if err != nil {
+			return err
+		}
+		txs = append(txs, tx)
+	}
+	report.TxsChecked += uint64(len(txs))
+
+	// the merkle root only covers complete blocks, and the genesis block is
+	// stored with a placeholder for its unspendable coinbase
+	if len(txs) == len(block.Txs) && block.Height > 0 {
+		// the hashes of the stored bodies, not the stored hash fields
+		hashes := make([]chainhash.Hash, len(txs))
+		for i, tx := range txs {
+			wireTx, err := tx.ToWireTx()
+			if err != nil {
+				return err
+			}
+			hashes[i] = wireTx.TxHash()
+		}
+		merkleRoot, err := merkle.Root(hashes)
+		if err != nil {
+			return err
+		}
+		if merkleRoot.String() != block.MerkleRoot {
+			report.Issues = append(report.Issues, model.VerifyIssue{
+				Kind:   IssueMerkleRoot,
+				Height: block.Height,
+				Hash:   block.Hash,
+				Detail: fmt.Sprintf("merkle root of the stored transactions is %s, the header commits to %s", merkleRoot, block.MerkleRoot),
+			})
+		}
+	}
+
+	for _, tx := range txs {
+		coinbase := tx.Hash == block.Txs[0]
+		if err := s.verifyOutputs(report, tx, block.Height, coinbase, repair); err != nil {
+			return err
+		}
+		if coinbase {
+			continue
+		}
+		if err := s.verifyInputs(report, tx, block.Height, repair); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyOutputs checks the outpoint script and address history keys of the
+// outputs of a confirmed transaction, and that the ones still in the UTXO set
+// match the transaction.
+func (s *Storage) verifyOutputs(report *model.VerifyReport, tx *model.Transaction, height uint64, coinbase bool, repair bool) error {
+	if len(tx.Vouts) == 0 {
+		return nil
+	}
+	pkKeys := make([]string, len(tx.Vouts))
+	historyKeys := make([]string, len(tx.Vouts))
+	utxoKeys := make([]string, len(tx.Vouts))
+	for i, vout := range tx.Vouts {
+		pkKeys[i] = getPkKey(tx.Hash, vout.Index)
+		historyKeys[i] = "tx" + vout.ScriptPubKey + tx.Hash
+		utxoKeys[i] = getUTXOKey(vout.ScriptPubKey, tx.Hash, vout.Index)
+	}
+	pkScripts, err := s.db.GetMulti(pkKeys)
+	if err != nil {
+		return err
+	}
+	history, err := s.db.GetMulti(historyKeys)
+	if err != nil {
+		return err
+	}
+
+	s.utxoSetMu.Lock()
+	defer s.utxoSetMu.Unlock()
+	utxos, err := s.db.GetMulti(utxoKeys)
+	if err != nil {
+		return err
+	}
+
+	putKeys := make([]string, 0)
+	putValues := make([][]byte, 0)
+	added := make([]*model.Vout, 0)
+	removed := make([]*model.Vout, 0)
+	for i := range tx.Vouts {
+		vout := tx.Vouts[i]
+		index := vout.Index
+		if string(pkScripts[i]) != vout.ScriptPubKey {
+			report.Issues = append(report.Issues, model.VerifyIssue{
+				Kind:     IssuePkScript,
+				Height:   height,
+				Hash:     tx.Hash,
+				Index:    &index,
+				Detail:   fmt.Sprintf("outpoint script is %q, the output pays to %q", pkScripts[i], vout.ScriptPubKey),
+				Repaired: repair,
+			})
+			putKeys = append(putKeys, pkKeys[i])
+			putValues = append(putValues, []byte(vout.ScriptPubKey))
+		}
+		if len(history[i]) == 0 {
+			report.Issues = append(report.Issues, model.VerifyIssue{
+				Kind:     IssueHistory,
+				Height:   height,
+				Hash:     tx.Hash,
+				Index:    &index,
+				Detail:   "transaction is missing from the history of the script it pays to",
+				Repaired: repair,
+			})
+			putKeys = append(putKeys, historyKeys[i])
+			putValues = append(putValues, []byte(tx.Hash))
+		}
+
+		if len(utxos[i]) == 0 {
+			continue
+		}
+		utxo, err := model.UnmarshalVout(utxos[i])
+		if err != nil {
+			return err
+		}
+		if utxo.TxId == tx.Hash && utxo.Index == vout.Index && utxo.Value == vout.Value && utxo.Height == height {
+			continue
+		}
+		report.Issues = append(report.Issues, model.VerifyIssue{
+			Kind:     IssueUTXOMismatch,
+			Height:   height,
+			Hash:     tx.Hash,
+			Index:    &index,
+			Detail:   fmt.Sprintf("unspent output has value %d at height %d, the transaction has value %d at height %d", utxo.Value, utxo.Height, vout.Value, height),
+			Repaired: repair,
+		})
+		vout.Height = height
+		vout.Coinbase = coinbase
+		putKeys = append(putKeys, utxoKeys[i])
+		putValues = append(putValues, model.MarshalVout(vout))
+		if utxo.Height > 0 {
+			removed = append(removed, utxo)
+		}
+		added = append(added, &vout)
+	}
+	if !repair {
+		return nil
+	}
+	if err := s.db.PutMulti(putKeys, putValues); err != nil {
+		return err
+	}
+	return s.updateUTXOSetInfo(added, removed)
+}
+
+// verifyInputs checks that the outputs spent by a confirmed transaction are
+// gone from the UTXO set and that the transaction is in the history of the
+// scripts it spends from.
+func (s *Storage) verifyInputs(report *model.VerifyReport, tx *model.Transaction, height uint64, repair bool) error {
+	hashes := make([]string, 0, len(tx.Vins))
+	indices := make([]uint32, 0, len(tx.Vins))
+	for _, vin := range tx.Vins {
+		if vin.PreviousTxId == "" {
+			continue
+		}
+		hashes = append(hashes, vin.PreviousTxId)
+		indices = append(indices, vin.PreviousIndex)
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	// the outpoint scripts are verified along with the outputs creating them
+	scriptPubKeys, err := s.GetPkScripts(hashes, indices)
+	if err != nil {
+		return err
+	}
+	historyKeys := make([]string, len(hashes))
+	utxoKeys := make([]string, len(hashes))
+	for i, pk := range scriptPubKeys {
+		historyKeys[i] = "tx" + pk + tx.Hash
+		utxoKeys[i] = getUTXOKey(pk, hashes[i], indices[i])
+	}
+	history, err := s.db.GetMulti(historyKeys)
+	if err != nil {
+		return err
+	}
+
+	s.utxoSetMu.Lock()
+	defer s.utxoSetMu.Unlock()
+	utxos, err := s.db.GetMulti(utxoKeys)
+	if err != nil {
+		return err
+	}
+
+	putKeys := make([]string, 0)
+	putValues := make([][]byte, 0)
+	deleteKeys := make([]string, 0)
+	removed := make([]*model.Vout, 0)
+	for i, pk := range scriptPubKeys {
+		if pk == "" {
+			continue
+		}
+		index := indices[i]
+		if len(history[i]) == 0 {
+			report.Issues = append(report.Issues, model.VerifyIssue{
+				Kind:     IssueHistory,
+				Height:   height,
+				Hash:     tx.Hash,
+				Detail:   fmt.Sprintf("transaction is missing from the history of the script spent at %s:%d", hashes[i], index),
+				Repaired: repair,
+			})
+			putKeys = append(putKeys, historyKeys[i])
+			putValues = append(putValues, []byte(tx.Hash))
+		}
+		if len(utxos[i]) == 0 {
+			continue
+		}
+		utxo, err := model.UnmarshalVout(utxos[i])
+		if err != nil {
+			return err
+		}
+		report.Issues = append(report.Issues, model.VerifyIssue{
+			Kind:     IssueSpentUTXO,
+			Height:   height,
+			Hash:     hashes[i],
+			Index:    &index,
+			Detail:   "output spent by " + tx.Hash + " is still in the UTXO set",
+			Repaired: repair,
+		})
+		deleteKeys = append(deleteKeys, utxoKeys[i])
+		if utxo.Height > 0 {
+			removed = append(removed, utxo)
+		}
+	}
+	if !repair {
+		return nil
+	}
+	if err := s.db.PutMulti(putKeys, putValues); err != nil {
+		return err
+	}
+	if err := s.db.DeleteMulti(deleteKeys); err != nil {
+		return err
+	}
+	return s.updateUTXOSetInfo(nil, removed)
+}
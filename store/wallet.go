@@ -0,0 +1,241 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/catalogfi/indexer/model"
+)
+
+// wallets live in their own namespace:
+//
+//	wlt<name>                 wallet
+//	wad<name>:<scriptPubKey>  address watched by the wallet
+//	wsc<scriptPubKey>         names of the wallets watching the script
+//	wtx<name>:<txid>          transaction of the wallet
+var (
+	walletKey        = "wlt"
+	walletAddressKey = "wad"
+	walletScriptKey  = "wsc"
+	walletTxKey      = "wtx"
+)
+
+func (s *Storage) PutWallet(wallet *model.Wallet) error {
+	data, err := wallet.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.db.Put(walletKey+wallet.Name, data)
+}
+
+func (s *Storage) GetWallet(name string) (*model.Wallet, bool, error) {
+	data, err := s.db.Get(walletKey + name)
+	if err != nil {
+		if err.Error() == ErrKeyNotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	wallet, err := model.UnmarshalWallet(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("GetWallet: error unmarshalling wallet: %w", err)
+	}
+	return wallet, true, nil
+}
+
+func (s *Storage) ListWallets() ([]*model.Wallet, error) {
+	wallets := make([]*model.Wallet, 0)
+	var unmarshalErr error
+	err := s.db.IterateWithPrefix(walletKey, func(key, value []byte) bool {
+		wallet, err := model.UnmarshalWallet(value)
+		if err != nil {
+			unmarshalErr = err
+			return false
+		}
+		wallets = append(wallets, wallet)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return wallets, unmarshalErr
+}
+
+// PutWalletAddresses stores the addresses and indexes their scripts by the
+// wallets watching them. Callers must not update the same scripts
+// concurrently.
+func (s *Storage) PutWalletAddresses(addrs []*model.WalletAddress) error {
+	if len(addrs) == 0 {
+		return nil
+	}
+	scriptKeys := make([]string, 0, len(addrs))
+	watchers := make(map[string][]string)
+	for _, addr := range addrs {
+		key := walletScriptKey + addr.ScriptPubKey
+		if _, ok := watchers[key]; !ok {
+			scriptKeys = append(scriptKeys, key)
+			watchers[key] = nil
+		}
+	}
+	data, err := s.db.GetMulti(scriptKeys)
+	if err != nil {
+		return err
+	}
+	for i, val := range data {
+		if len(val) == 0 {
+			continue
+		}
+		var names []string
+		if err := json.Unmarshal(val, &names); err != nil {
+			return err
+		}
+		watchers[scriptKeys[i]] = names
+	}
+
+	keys := make([]string, 0, len(addrs)+len(scriptKeys))
+	values := make([][]byte, 0, len(addrs)+len(scriptKeys))
+	for _, addr := range addrs {
+		data, err := addr.Marshal()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, getWalletAddressKey(addr.Wallet, addr.ScriptPubKey))
+		values = append(values, data)
+
+		scriptKey := walletScriptKey + addr.ScriptPubKey
+		if !contains(watchers[scriptKey], addr.Wallet) {
+			watchers[scriptKey] = append(watchers[scriptKey], addr.Wallet)
+		}
+	}
+	for _, key := range scriptKeys {
+		data, err := json.Marshal(watchers[key])
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		values = append(values, data)
+	}
+	return s.db.PutMulti(keys, values)
+}
+
+func (s *Storage) GetWalletAddress(name, scriptPubKey string) (*model.WalletAddress, bool, error) {
+	data, err := s.db.Get(getWalletAddressKey(name, scriptPubKey))
+	if err != nil {
+		if err.Error() == ErrKeyNotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	addr, err := model.UnmarshalWalletAddress(data)
+	if err != nil {
+		return nil, false, err
+	}
+	return addr, true, nil
+}
+
+func (s *Storage) GetWalletAddresses(name string) ([]*model.WalletAddress, error) {
+	data, err := s.db.GetWithPrefix(walletAddressKey + name + ":")
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]*model.WalletAddress, len(data))
+	for i, val := range data {
+		addr, err := model.UnmarshalWalletAddress(val)
+		if err != nil {
+			return nil, err
+		}
+		addrs[i] = addr
+	}
+	return addrs, nil
+}
+
+// GetWatchingWallets returns the names of the wallets watching each of the
+// scripts, aligned with scriptPubKeys.
+func (s *Storage) GetWatchingWallets(scriptPubKeys []string) ([][]string, error) {
+	keys := make([]string, len(scriptPubKeys))
+	for i, pk := range scriptPubKeys {
+		keys[i] = walletScriptKey + pk
+	}
+	data, err := s.db.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	names := make([][]string, len(data))
+	for i, val := range data {
+		if len(val) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(val, &names[i]); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+func (s *Storage) PutWalletTx(tx *model.WalletTx) error {
+	data, err := tx.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.db.Put(getWalletTxKey(tx.Wallet, tx.TxId), data)
+}
+
+func (s *Storage) GetWalletTx(name, txId string) (*model.WalletTx, bool, error) {
+	data, err := s.db.Get(getWalletTxKey(name, txId))
+	if err != nil {
+		if err.Error() == ErrKeyNotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	tx, err := model.UnmarshalWalletTx(data)
+	if err != nil {
+		return nil, false, err
+	}
+	return tx, true, nil
+}
+
+func (s *Storage) GetWalletTxs(name string) ([]*model.WalletTx, error) {
+	data, err := s.db.GetWithPrefix(walletTxKey + name + ":")
+	if err != nil {
+		return nil, err
+	}
+	txs := make([]*model.WalletTx, len(data))
+	for i, val := range data {
+		tx, err := model.UnmarshalWalletTx(val)
+		if err != nil {
+			return nil, err
+		}
+		txs[i] = tx
+	}
+	return txs, nil
+}
+
+// RemoveWalletTxs drops the given transactions from the wallet.
+func (s *Storage) RemoveWalletTxs(name string, txIds []string) error {
+	if len(txIds) == 0 {
+		return nil
+	}
+	keys := make([]string, len(txIds))
+	for i, txId := range txIds {
+		keys[i] = getWalletTxKey(name, txId)
+	}
+	return s.db.DeleteMulti(keys)
+}
+
+func getWalletAddressKey(name, scriptPubKey string) string {
+	return walletAddressKey + name + ":" + scriptPubKey
+}
+
+func getWalletTxKey(name, txId string) string {
+	return walletTxKey + name + ":" + txId
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,376 @@
+// Package swap recognises the spends of hash time locked contracts used by
+// atomic swaps, and the secrets they reveal.
+package swap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/catalogfi/indexer/model"
+	"golang.org/x/crypto/ripemd160"
+)
+
+// Kinds of HTLC spends.
+const (
+	SpendRedeem = "redeem"
+	SpendRefund = "refund"
+)
+
+// HTLC is the hashlock and timelock of a contract. A two branch script holds
+// both, a tapscript leaf only one of them.
+type HTLC struct {
+	// HashType is the hash opcode of the hashlock: sha256, hash256, hash160
+	// or ripemd160
+	HashType   string
+	SecretHash []byte
+	// Timelock is the locktime of the refund, relative if checked with
+	// OP_CHECKSEQUENCEVERIFY and absolute with OP_CHECKLOCKTIMEVERIFY
+	Timelock int64
+	Relative bool
+
+	// HashlockFirst is set when the hashlock is in the OP_IF branch of a two
+	// branch script
+	HashlockFirst bool
+}
+
+func (h *HTLC) hasHashlock() bool {
+	return h.SecretHash != nil
+}
+
+// Spend is an input spending an HTLC. Secret is only set for redeems.
+type Spend struct {
+	Kind       string
+	HashType   string
+	SecretHash []byte
+	Secret     []byte
+}
+
+var hashTypes = map[byte]string{
+	txscript.OP_SHA256:    "sha256",
+	txscript.OP_HASH256:   "hash256",
+	txscript.OP_HASH160:   "hash160",
+	txscript.OP_RIPEMD160: "ripemd160",
+}
+
+var hashLens = map[byte]int{
+	txscript.OP_SHA256:    32,
+	txscript.OP_HASH256:   32,
+	txscript.OP_HASH160:   20,
+	txscript.OP_RIPEMD160: 20,
+}
+
+type token struct {
+	opcode byte
+	data   []byte
+}
+
+func tokenize(script []byte) ([]token, bool) {
+	tokens := make([]token, 0)
+	tokenizer := txscript.MakeScriptTokenizer(0, script)
+	for tokenizer.Next() {
+		tokens = append(tokens, token{opcode: tokenizer.Opcode(), data: tokenizer.Data()})
+	}
+	return tokens, tokenizer.Err() == nil
+}
+
+// ParseHTLC parses a two branch HTLC script, with a hashlock in one branch
+// and a timelock in the other:
+//
+//	OP_IF [OP_SIZE 32 OP_EQUALVERIFY] <hash op> <hash> OP_EQUALVERIFY <redeemer check>
+//	OP_ELSE <locktime> OP_CHECKSEQUENCEVERIFY|OP_CHECKLOCKTIMEVERIFY OP_DROP <refunder check>
+//	OP_ENDIF [<common check>]
+//
+// The branches may also come in the opposite order.
+func ParseHTLC(script []byte) (*HTLC, bool) {
+	tokens, ok := tokenize(script)
+	if !ok || len(tokens) == 0 || tokens[0].opcode != txscript.OP_IF || !hasSigCheck(tokens) {
+		return nil, false
+	}
+	elseAt, endAt := -1, -1
+	for i := 1; i < len(tokens); i++ {
+		switch tokens[i].opcode {
+		case txscript.OP_IF, txscript.OP_NOTIF:
+			return nil, false
+		case txscript.OP_ELSE:
+			if elseAt >= 0 {
+				return nil, false
+			}
+			elseAt = i
+		case txscript.OP_ENDIF:
+			endAt = i
+		}
+		if endAt >= 0 {
+			break
+		}
+	}
+	if elseAt < 0 || endAt < 0 {
+		return nil, false
+	}
+	first, second := tokens[1:elseAt], tokens[elseAt+1:endAt]
+
+	htlc := &HTLC{HashlockFirst: true}
+	hashlock, timelock := first, second
+	if _, _, _, ok := matchHashlock(first); !ok {
+		htlc.HashlockFirst = false
+		hashlock, timelock = second, first
+	}
+	hashOp, hash, _, ok := matchHashlock(hashlock)
+	if !ok {
+		return nil, false
+	}
+	locktime, relative, _, ok := matchTimelock(timelock)
+	if !ok {
+		return nil, false
+	}
+	htlc.HashType = hashTypes[hashOp]
+	htlc.SecretHash = hash
+	htlc.Timelock = locktime
+	htlc.Relative = relative
+	return htlc, true
+}
+
+// ParseLeaf parses a tapscript leaf holding either the hashlock or the
+// timelock of an HTLC, followed by a signature check.
+func ParseLeaf(script []byte) (*HTLC, bool) {
+	tokens, ok := tokenize(script)
+	if !ok || !hasSigCheck(tokens) {
+		return nil, false
+	}
+	if hashOp, hash, _, ok := matchHashlock(tokens); ok {
+		return &HTLC{HashType: hashTypes[hashOp], SecretHash: hash}, true
+	}
+	if locktime, relative, _, ok := matchTimelock(tokens); ok {
+		return &HTLC{Timelock: locktime, Relative: relative}, true
+	}
+	return nil, false
+}
+
+// matchHashlock matches [OP_SIZE <len> OP_EQUALVERIFY] <hash op> <hash>
+// OP_EQUALVERIFY at the start of tokens.
+func matchHashlock(tokens []token) (byte, []byte, []token, bool) {
+	if len(tokens) >= 3 && tokens[0].opcode == txscript.OP_SIZE && tokens[2].opcode == txscript.OP_EQUALVERIFY {
+		tokens = tokens[3:]
+	}
+	if len(tokens) < 3 {
+		return 0, nil, nil, false
+	}
+	hashOp := tokens[0].opcode
+	hashLen, ok := hashLens[hashOp]
+	if !ok || len(tokens[1].data) != hashLen || tokens[2].opcode != txscript.OP_EQUALVERIFY {
+		return 0, nil, nil, false
+	}
+	return hashOp, tokens[1].data, tokens[3:], true
+}
+
+// matchTimelock matches <locktime> OP_CHECKSEQUENCEVERIFY|
+// OP_CHECKLOCKTIMEVERIFY OP_DROP at the start of tokens.
+func matchTimelock(tokens []token) (int64, bool, []token, bool) {
+	if len(tokens) < 3 || tokens[2].opcode != txscript.OP_DROP {
+		return 0, false, nil, false
+	}
+	var relative bool
+	switch tokens[1].opcode {
+	case txscript.OP_CHECKSEQUENCEVERIFY:
+		relative = true
+	case txscript.OP_CHECKLOCKTIMEVERIFY:
+	default:
+		return 0, false, nil, false
+	}
+	locktime, ok := scriptNum(tokens[0])
+	if !ok || locktime <= 0 {
+		return 0, false, nil, false
+	}
+	return locktime, relative, tokens[3:], true
+}
+
+// scriptNum decodes a small integer opcode or a little endian sign and
+// magnitude push of up to 5 bytes, as accepted by the locktime opcodes.
+func scriptNum(t token) (int64, bool) {
+	if t.opcode >= txscript.OP_1 && t.opcode <= txscript.OP_16 {
+		return int64(t.opcode - txscript.OP_1 + 1), true
+	}
+	if len(t.data) == 0 || len(t.data) > 5 || t.opcode > txscript.OP_PUSHDATA4 {
+		return 0, false
+	}
+	var n int64
+	for i, b := range t.data {
+		n |= int64(b) << (8 * i)
+	}
+	if t.data[len(t.data)-1]&0x80 != 0 {
+		n &= ^(int64(0x80) << (8 * (len(t.data) - 1)))
+		n = -n
+	}
+	return n, true
+}
+
+// pushedStack returns the stack built by a push only script. Unlike
+// txscript.PushedData it keeps the small integers, which are commonly used as
+// branch selectors.
+func pushedStack(script []byte) ([][]byte, bool) {
+	tokens, ok := tokenize(script)
+	if !ok {
+		return nil, false
+	}
+	stack := make([][]byte, len(tokens))
+	for i, t := range tokens {
+		switch {
+		case t.opcode >= txscript.OP_1 && t.opcode <= txscript.OP_16:
+			stack[i] = []byte{t.opcode - txscript.OP_1 + 1}
+		case t.opcode == txscript.OP_1NEGATE:
+			stack[i] = []byte{0x81}
+		case t.opcode <= txscript.OP_PUSHDATA4:
+			stack[i] = t.data
+		default:
+			return nil, false
+		}
+	}
+	return stack, true
+}
+
+func hasSigCheck(tokens []token) bool {
+	for _, t := range tokens {
+		switch t.opcode {
+		case txscript.OP_CHECKSIG, txscript.OP_CHECKSIGVERIFY, txscript.OP_CHECKSIGADD,
+			txscript.OP_CHECKMULTISIG, txscript.OP_CHECKMULTISIGVERIFY:
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSpend recognises an input spending a P2SH, P2WSH or P2TR script path
+// HTLC output with the given script. The revealed script is checked against
+// the output so only genuine spends of the output are reported.
+func ParseSpend(vin *model.Vin, prevScriptPubKey []byte) (*Spend, bool) {
+	witness, err := vin.DecodeWitness()
+	if err != nil {
+		return nil, false
+	}
+	switch {
+	case txscript.IsPayToWitnessScriptHash(prevScriptPubKey):
+		return parseWitnessScriptSpend(witness, prevScriptPubKey)
+
+	case txscript.IsPayToScriptHash(prevScriptPubKey):
+		sigScript, err := hex.DecodeString(vin.SignatureScript)
+		if err != nil {
+			return nil, false
+		}
+		pushes, ok := pushedStack(sigScript)
+		if !ok || len(pushes) == 0 {
+			return nil, false
+		}
+		redeemScript := pushes[len(pushes)-1]
+		if !bytes.Equal(btcutil.Hash160(redeemScript), prevScriptPubKey[2:22]) {
+			return nil, false
+		}
+		// nested P2WSH keeps the contract in the witness
+		if txscript.IsPayToWitnessScriptHash(redeemScript) {
+			return parseWitnessScriptSpend(witness, redeemScript)
+		}
+		return parseScriptSpend(redeemScript, pushes[:len(pushes)-1])
+
+	case txscript.IsPayToTaproot(prevScriptPubKey):
+		return parseTapscriptSpend(witness, prevScriptPubKey[2:])
+	}
+	return nil, false
+}
+
+func parseWitnessScriptSpend(witness [][]byte, program []byte) (*Spend, bool) {
+	if len(witness) == 0 {
+		return nil, false
+	}
+	witnessScript := witness[len(witness)-1]
+	hash := sha256.Sum256(witnessScript)
+	if !bytes.Equal(hash[:], program[2:]) {
+		return nil, false
+	}
+	return parseScriptSpend(witnessScript, witness[:len(witness)-1])
+}
+
+// parseScriptSpend classifies the spend of a two branch HTLC by the branch
+// selector on top of the stack.
+func parseScriptSpend(script []byte, stack [][]byte) (*Spend, bool) {
+	htlc, ok := ParseHTLC(script)
+	if !ok || len(stack) == 0 {
+		return nil, false
+	}
+	selector := stack[len(stack)-1]
+	if isTrue(selector) != htlc.HashlockFirst {
+		return &Spend{Kind: SpendRefund, HashType: htlc.HashType, SecretHash: htlc.SecretHash}, true
+	}
+	return redeemSpend(htlc, stack[:len(stack)-1])
+}
+
+func parseTapscriptSpend(witness [][]byte, outputKey []byte) (*Spend, bool) {
+	if len(witness) >= 2 && len(witness[len(witness)-1]) > 0 && witness[len(witness)-1][0] == txscript.TaprootAnnexTag {
+		witness = witness[:len(witness)-1]
+	}
+	// a single element is a key path spend
+	if len(witness) < 2 {
+		return nil, false
+	}
+	leaf := witness[len(witness)-2]
+	controlBlock, err := txscript.ParseControlBlock(witness[len(witness)-1])
+	if err != nil {
+		return nil, false
+	}
+	if err := txscript.VerifyTaprootLeafCommitment(controlBlock, outputKey, leaf); err != nil {
+		return nil, false
+	}
+	htlc, ok := ParseLeaf(leaf)
+	if !ok {
+		return nil, false
+	}
+	if !htlc.hasHashlock() {
+		return &Spend{Kind: SpendRefund}, true
+	}
+	return redeemSpend(htlc, witness[:len(witness)-2])
+}
+
+// redeemSpend finds the secret among the stack elements, as the signatures
+// and keys around it vary between contracts.
+func redeemSpend(htlc *HTLC, stack [][]byte) (*Spend, bool) {
+	for _, item := range stack {
+		if bytes.Equal(hashSecret(htlc.HashType, item), htlc.SecretHash) {
+			return &Spend{
+				Kind:       SpendRedeem,
+				HashType:   htlc.HashType,
+				SecretHash: htlc.SecretHash,
+				Secret:     item,
+			}, true
+		}
+	}
+	return nil, false
+}
+
+func hashSecret(hashType string, secret []byte) []byte {
+	switch hashType {
+	case "sha256":
+		hash := sha256.Sum256(secret)
+		return hash[:]
+	case "hash256":
+		return chainhash.DoubleHashB(secret)
+	case "hash160":
+		return btcutil.Hash160(secret)
+	case "ripemd160":
+		hasher := ripemd160.New()
+		hasher.Write(secret)
+		return hasher.Sum(nil)
+	}
+	return nil
+}
+
+// isTrue mirrors the script interpreter: any non zero value other than
+// negative zero is true.
+func isTrue(value []byte) bool {
+	for i, b := range value {
+		if b != 0 {
+			return !(i == len(value)-1 && b == 0x80)
+		}
+	}
+	return false
+}
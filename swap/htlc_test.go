@@ -0,0 +1,149 @@
+package swap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/catalogfi/indexer/model"
+)
+
+var (
+	secret        = bytes.Repeat([]byte{0x42}, 32)
+	secretHash    = sha256.Sum256(secret)
+	redeemerKey   = bytes.Repeat([]byte{0x02}, 33)
+	refunderKey   = bytes.Repeat([]byte{0x03}, 33)
+	sig           = bytes.Repeat([]byte{0x30}, 71)
+	redeemerXOnly = bytes.Repeat([]byte{0x11}, 32)
+	refunderXOnly = bytes.Repeat([]byte{0x22}, 32)
+)
+
+// htlcScript is the two branch contract with a pubkey hash check after the
+// branches.
+func htlcScript(t *testing.T) []byte {
+	script, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_IF).
+		AddOp(txscript.OP_SHA256).AddData(secretHash[:]).AddOp(txscript.OP_EQUALVERIFY).
+		AddOp(txscript.OP_DUP).AddOp(txscript.OP_HASH160).AddData(btcutil.Hash160(redeemerKey)).
+		AddOp(txscript.OP_ELSE).
+		AddInt64(144).AddOp(txscript.OP_CHECKSEQUENCEVERIFY).AddOp(txscript.OP_DROP).
+		AddOp(txscript.OP_DUP).AddOp(txscript.OP_HASH160).AddData(btcutil.Hash160(refunderKey)).
+		AddOp(txscript.OP_ENDIF).
+		AddOp(txscript.OP_EQUALVERIFY).AddOp(txscript.OP_CHECKSIG).
+		Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+func witnessVin(witness ...[]byte) *model.Vin {
+	return &model.Vin{Witness: model.EncodeWitnesss(witness)}
+}
+
+func TestParseHTLC(t *testing.T) {
+	htlc, ok := ParseHTLC(htlcScript(t))
+	if !ok {
+		t.Fatal("expected an HTLC")
+	}
+	if htlc.HashType != "sha256" || !bytes.Equal(htlc.SecretHash, secretHash[:]) || htlc.Timelock != 144 || !htlc.Relative || !htlc.HashlockFirst {
+		t.Fatalf("unexpected HTLC %+v", htlc)
+	}
+
+	multisig, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_2).AddData(redeemerKey).AddData(refunderKey).AddOp(txscript.OP_2).AddOp(txscript.OP_CHECKMULTISIG).
+		Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ParseHTLC(multisig); ok {
+		t.Fatal("multisig parsed as an HTLC")
+	}
+}
+
+func TestParseWitnessScriptSpend(t *testing.T) {
+	script := htlcScript(t)
+	scriptHash := sha256.Sum256(script)
+	scriptPubKey := append([]byte{txscript.OP_0, txscript.OP_DATA_32}, scriptHash[:]...)
+
+	spend, ok := ParseSpend(witnessVin(sig, redeemerKey, secret, []byte{1}, script), scriptPubKey)
+	if !ok || spend.Kind != SpendRedeem || !bytes.Equal(spend.Secret, secret) {
+		t.Fatalf("expected a redeem, got %+v", spend)
+	}
+	spend, ok = ParseSpend(witnessVin(sig, refunderKey, []byte{}, script), scriptPubKey)
+	if !ok || spend.Kind != SpendRefund || spend.Secret != nil {
+		t.Fatalf("expected a refund, got %+v", spend)
+	}
+
+	// the revealed script must match the output
+	otherHash := sha256.Sum256(append(script, txscript.OP_NOP))
+	otherScriptPubKey := append([]byte{txscript.OP_0, txscript.OP_DATA_32}, otherHash[:]...)
+	if _, ok := ParseSpend(witnessVin(sig, redeemerKey, secret, []byte{1}, script), otherScriptPubKey); ok {
+		t.Fatal("spend of another output recognised")
+	}
+}
+
+func TestParseScriptHashSpend(t *testing.T) {
+	script := htlcScript(t)
+	scriptPubKey := append(append([]byte{txscript.OP_HASH160, txscript.OP_DATA_20}, btcutil.Hash160(script)...), txscript.OP_EQUAL)
+	sigScript, err := txscript.NewScriptBuilder().
+		AddData(sig).AddData(redeemerKey).AddData(secret).AddOp(txscript.OP_TRUE).AddData(script).
+		Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spend, ok := ParseSpend(&model.Vin{SignatureScript: hex.EncodeToString(sigScript)}, scriptPubKey)
+	if !ok || spend.Kind != SpendRedeem || !bytes.Equal(spend.Secret, secret) {
+		t.Fatalf("expected a redeem, got %+v", spend)
+	}
+}
+
+func TestParseTapscriptSpend(t *testing.T) {
+	redeemLeaf, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_SHA256).AddData(secretHash[:]).AddOp(txscript.OP_EQUALVERIFY).
+		AddData(redeemerXOnly).AddOp(txscript.OP_CHECKSIG).
+		Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refundLeaf, err := txscript.NewScriptBuilder().
+		AddInt64(144).AddOp(txscript.OP_CHECKSEQUENCEVERIFY).AddOp(txscript.OP_DROP).
+		AddData(refunderXOnly).AddOp(txscript.OP_CHECKSIG).
+		Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, internalKey := btcec.PrivKeyFromBytes(bytes.Repeat([]byte{0x01}, 32))
+	tree := txscript.AssembleTaprootScriptTree(txscript.NewBaseTapLeaf(redeemLeaf), txscript.NewBaseTapLeaf(refundLeaf))
+	rootHash := tree.RootNode.TapHash()
+	outputKey := txscript.ComputeTaprootOutputKey(internalKey, rootHash[:])
+	scriptPubKey, err := txscript.PayToTaprootScript(outputKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controlBlock := func(i int) []byte {
+		cb := tree.LeafMerkleProofs[i].ToControlBlock(internalKey)
+		data, err := cb.ToBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	spend, ok := ParseSpend(witnessVin(sig[:64], secret, redeemLeaf, controlBlock(0)), scriptPubKey)
+	if !ok || spend.Kind != SpendRedeem || !bytes.Equal(spend.Secret, secret) {
+		t.Fatalf("expected a redeem, got %+v", spend)
+	}
+	spend, ok = ParseSpend(witnessVin(sig[:64], refundLeaf, controlBlock(1)), scriptPubKey)
+	if !ok || spend.Kind != SpendRefund {
+		t.Fatalf("expected a refund, got %+v", spend)
+	}
+	// a key path spend reveals nothing
+	if _, ok := ParseSpend(witnessVin(sig[:64]), scriptPubKey); ok {
+		t.Fatal("key path spend recognised")
+	}
+}
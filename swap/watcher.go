@@ -0,0 +1,88 @@
+package swap
+
+import (
+	"encoding/hex"
+
+	"github.com/catalogfi/indexer/model"
+)
+
+type Storage interface {
+	GetPkScripts(hashes []string, indices []uint32) ([]string, error)
+	PutSwapSpends(spends []*model.SwapSpend) error
+}
+
+// Watcher indexes the HTLC spends of the transactions fed by the sync manager
+// and the mempool.
+type Watcher struct {
+	store Storage
+}
+
+func NewWatcher(store Storage) *Watcher {
+	return &Watcher{
+		store: store,
+	}
+}
+
+// ConnectTxs indexes the HTLC spends of the transactions, confirmed at the
+// given height or in the mempool if the height is zero.
+func (w *Watcher) ConnectTxs(txs []*model.Transaction, height uint64, blockHash string) error {
+	vins := make([]*model.Vin, 0)
+	hashes := make([]string, 0)
+	indices := make([]uint32, 0)
+	for _, tx := range txs {
+		for i := range tx.Vins {
+			if tx.Vins[i].PreviousTxId == "" {
+				continue
+			}
+			// only script spends can reveal a contract
+			if tx.Vins[i].Witness == "" && tx.Vins[i].SignatureScript == "" {
+				continue
+			}
+			vins = append(vins, &tx.Vins[i])
+			hashes = append(hashes, tx.Vins[i].PreviousTxId)
+			indices = append(indices, tx.Vins[i].PreviousIndex)
+		}
+	}
+	if len(vins) == 0 {
+		return nil
+	}
+	scriptPubKeys, err := w.store.GetPkScripts(hashes, indices)
+	if err != nil {
+		return err
+	}
+
+	spends := make([]*model.SwapSpend, 0)
+	for i, vin := range vins {
+		if scriptPubKeys[i] == "" {
+			continue
+		}
+		prevScript, err := hex.DecodeString(scriptPubKeys[i])
+		if err != nil {
+			return err
+		}
+		spend, ok := ParseSpend(vin, prevScript)
+		if !ok {
+			continue
+		}
+		spends = append(spends, &model.SwapSpend{
+			ScriptPubKey: scriptPubKeys[i],
+			TxId:         vin.TxId,
+			Vin:          vin.Index,
+			PrevTxId:     vin.PreviousTxId,
+			PrevIndex:    vin.PreviousIndex,
+			Kind:         spend.Kind,
+			HashType:     spend.HashType,
+			SecretHash:   hex.EncodeToString(spend.SecretHash),
+			Secret:       hex.EncodeToString(spend.Secret),
+			Height:       height,
+			BlockHash:    blockHash,
+		})
+	}
+	return w.store.PutSwapSpends(spends)
+}
+
+// DisconnectTxs moves the HTLC spends of the transactions of a disconnected
+// block back to the mempool.
+func (w *Watcher) DisconnectTxs(txs []*model.Transaction) error {
+	return w.ConnectTxs(txs, 0, "")
+}
@@ -2,8 +2,10 @@ package utils
 
 import (
 	"encoding/hex"
+	"math"
 	"strings"
 
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/catalogfi/indexer/model"
@@ -19,6 +21,7 @@ func SplitTxs(txs []*wire.MsgTx, blockHash string) ([]model.Vout, []model.Vin, [
 
 	for ti, tx := range txs {
 		transactionHash := tx.TxHash().String()
+		isCoinbase := IsCoinbase(tx)
 		txVins := make([]model.Vin, len(tx.TxIn))
 		txVouts := make([]model.Vout, len(tx.TxOut))
 		for i, txIn := range tx.TxIn {
@@ -35,6 +38,8 @@ func SplitTxs(txs []*wire.MsgTx, blockHash string) ([]model.Vout, []model.Vin, [
 				vin.Witness = witnessString
 				vin.TxId = transactionHash
 				vin.Index = inIndex
+				vin.PreviousTxId = txIn.PreviousOutPoint.Hash.String()
+				vin.PreviousIndex = txIn.PreviousOutPoint.Index
 				txVins[i] = *vin
 				txIns = append(txIns, txIn)
 				continue
@@ -62,7 +67,8 @@ func SplitTxs(txs []*wire.MsgTx, blockHash string) ([]model.Vout, []model.Vin, [
 				ScriptPubKey: hex.EncodeToString(txOut.PkScript),
 				Value:        txOut.Value,
 
-				Type: pkScript.Class().String(),
+				Type:     pkScript.Class().String(),
+				Coinbase: isCoinbase,
 			}
 			txVouts[i] = *vout
 		}
@@ -85,3 +91,54 @@ func SplitTxs(txs []*wire.MsgTx, blockHash string) ([]model.Vout, []model.Vin, [
 	return vouts, vins, txIns, transactions, nil
 
 }
+
+// NullDataPayload returns the data pushed by an OP_RETURN script. Scripts whose
+// pushes cannot be parsed fall back to the raw bytes following OP_RETURN.
+func NullDataPayload(pkScript []byte) ([]byte, bool) {
+	if len(pkScript) == 0 || pkScript[0] != txscript.OP_RETURN {
+		return nil, false
+	}
+	pushes, err := txscript.PushedData(pkScript[1:])
+	if err != nil {
+		return pkScript[1:], true
+	}
+	payload := make([]byte, 0, len(pkScript)-1)
+	for _, push := range pushes {
+		payload = append(payload, push...)
+	}
+	return payload, true
+}
+
+// OpReturns extracts the nulldata outputs from vouts so they can be indexed
+// by payload.
+func OpReturns(vouts []model.Vout, blockHash string, height uint64) []model.OpReturn {
+	opReturns := make([]model.OpReturn, 0)
+	for _, vout := range vouts {
+		pkScript, err := hex.DecodeString(vout.ScriptPubKey)
+		if err != nil {
+			continue
+		}
+		payload, ok := NullDataPayload(pkScript)
+		if !ok {
+			continue
+		}
+		opReturns = append(opReturns, model.OpReturn{
+			TxId:      vout.TxId,
+			Index:     vout.Index,
+			Payload:   hex.EncodeToString(payload),
+			Height:    height,
+			BlockHash: blockHash,
+		})
+	}
+	return opReturns
+}
+
+// IsCoinbase reports whether tx is a coinbase transaction, i.e. it has a
+// single input spending the null outpoint.
+func IsCoinbase(tx *wire.MsgTx) bool {
+	if len(tx.TxIn) != 1 {
+		return false
+	}
+	prevOut := tx.TxIn[0].PreviousOutPoint
+	return prevOut.Index == math.MaxUint32 && prevOut.Hash == (chainhash.Hash{})
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/catalogfi/indexer/model"
+)
+
+func TestNullDataPayload(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   []byte
+		expected []byte
+		ok       bool
+	}{
+		{"not nulldata", []byte{txscript.OP_TRUE}, nil, false},
+		{"empty script", nil, nil, false},
+		{"empty OP_RETURN", []byte{txscript.OP_RETURN}, []byte{}, true},
+		{"single push", []byte{txscript.OP_RETURN, 0x02, 0xaa, 0xbb}, []byte{0xaa, 0xbb}, true},
+		{"multiple pushes", []byte{txscript.OP_RETURN, 0x01, 0xaa, txscript.OP_PUSHDATA1, 0x02, 0xbb, 0xcc, 0x01, 0xdd}, []byte{0xaa, 0xbb, 0xcc, 0xdd}, true},
+		{"empty push", []byte{txscript.OP_RETURN, txscript.OP_0}, []byte{}, true},
+		// opcodes pushing no data are skipped, small integers included
+		{"non push opcodes", []byte{txscript.OP_RETURN, txscript.OP_DUP, 0x01, 0xaa, txscript.OP_1, txscript.OP_CHECKSIG}, []byte{0xaa}, true},
+		// a push running past the end of the script can not be parsed
+		{"truncated push", []byte{txscript.OP_RETURN, 0x05, 0xaa}, []byte{0x05, 0xaa}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload, ok := NullDataPayload(test.script)
+			if ok != test.ok || !bytes.Equal(payload, test.expected) {
+				t.Fatalf("expected %x %v, got %x %v", test.expected, test.ok, payload, ok)
+			}
+		})
+	}
+}
+
+func TestOpReturns(t *testing.T) {
+	vouts := []model.Vout{
+		{TxId: "a", Index: 0, ScriptPubKey: hex.EncodeToString([]byte{txscript.OP_TRUE})},
+		{TxId: "a", Index: 1, ScriptPubKey: hex.EncodeToString([]byte{txscript.OP_RETURN, 0x01, 0xaa, 0x01, 0xbb})},
+		{TxId: "b", Index: 0, ScriptPubKey: "not hex"},
+		{TxId: "b", Index: 2, ScriptPubKey: hex.EncodeToString([]byte{txscript.OP_RETURN})},
+	}
+	opReturns := OpReturns(vouts, "block", 7)
+	expected := []model.OpReturn{
+		{TxId: "a", Index: 1, Payload: "aabb", Height: 7, BlockHash: "block"},
+		{TxId: "b", Index: 2, Payload: "", Height: 7, BlockHash: "block"},
+	}
+	if len(opReturns) != len(expected) {
+		t.Fatalf("expected %d op_returns, got %+v", len(expected), opReturns)
+	}
+	for i := range expected {
+		if opReturns[i] != expected[i] {
+			t.Fatalf("expected %+v, got %+v", expected[i], opReturns[i])
+		}
+	}
+}
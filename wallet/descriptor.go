@@ -0,0 +1,300 @@
+// Package wallet derives the addresses of HD wallets from extended public keys
+// or output descriptors and queries their balance and history in the store.
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/catalogfi/indexer/dogecoin"
+)
+
+type ScriptType string
+
+const (
+	ScriptTypeP2PKH      ScriptType = "pkh"
+	ScriptTypeP2SHP2WPKH ScriptType = "sh(wpkh)"
+	ScriptTypeP2WPKH     ScriptType = "wpkh"
+	ScriptTypeP2TR       ScriptType = "tr"
+)
+
+var (
+	ErrInvalidDescriptor = errors.New("invalid descriptor")
+	ErrInvalidChecksum   = errors.New("invalid descriptor checksum")
+	ErrUnsupportedKey    = errors.New("unsupported extended key version")
+	ErrHardenedPath      = errors.New("hardened derivation is not possible from a public key")
+)
+
+// SLIP-0132 versions of extended public keys, which imply the script type
+// when a bare key is given instead of a descriptor.
+var keyVersions = map[[4]byte]struct {
+	scriptType ScriptType
+	testnet    bool
+}{
+	{0x04, 0x88, 0xb2, 0x1e}: {ScriptTypeP2PKH, false},      // xpub
+	{0x04, 0x9d, 0x7c, 0xb2}: {ScriptTypeP2SHP2WPKH, false}, // ypub
+	{0x04, 0xb2, 0x47, 0x46}: {ScriptTypeP2WPKH, false},     // zpub
+	{0x04, 0x35, 0x87, 0xcf}: {ScriptTypeP2PKH, true},       // tpub
+	{0x04, 0x4a, 0x52, 0x62}: {ScriptTypeP2SHP2WPKH, true},  // upub
+	{0x04, 0x5f, 0x1c, 0xf6}: {ScriptTypeP2WPKH, true},      // vpub
+}
+
+// Descriptor describes the addresses of an HD wallet. Every branch is the
+// path from Key to the parent of the addresses, the first branch holds the
+// receive addresses and the second, if any, the change addresses.
+type Descriptor struct {
+	Type     ScriptType
+	Key      *hdkeychain.ExtendedKey
+	Branches [][]uint32
+
+	chainParams *chaincfg.Params
+}
+
+// ParseDescriptor parses either a bare extended public key (xpub, ypub, zpub,
+// their testnet versions or the chain's own version such as Dogecoin's dgub)
+// or one of the descriptors pkh(KEY), wpkh(KEY), sh(wpkh(KEY)) and tr(KEY),
+// where KEY is an extended public key with an optional origin and derivation
+// path ending in /*, e.g. [d34db33f/84'/0'/0']xpub.../<0;1>/*.
+func ParseDescriptor(desc string, chainParams *chaincfg.Params) (*Descriptor, error) {
+	desc = strings.TrimSpace(desc)
+	if i := strings.LastIndex(desc, "#"); i >= 0 {
+		if DescriptorChecksum(desc[:i]) != desc[i+1:] {
+			return nil, ErrInvalidChecksum
+		}
+		desc = desc[:i]
+	}
+
+	if !strings.Contains(desc, "(") {
+		key, scriptType, err := parseExtendedKey(desc, chainParams)
+		if err != nil {
+			return nil, err
+		}
+		return newDescriptor(scriptType, key, [][]uint32{{0}, {1}}, chainParams)
+	}
+
+	var scriptType ScriptType
+	var inner string
+	switch {
+	case strings.HasPrefix(desc, "sh(wpkh(") && strings.HasSuffix(desc, "))"):
+		scriptType = ScriptTypeP2SHP2WPKH
+		inner = desc[len("sh(wpkh(") : len(desc)-2]
+	case strings.HasPrefix(desc, "pkh(") && strings.HasSuffix(desc, ")"):
+		scriptType = ScriptTypeP2PKH
+		inner = desc[len("pkh(") : len(desc)-1]
+	case strings.HasPrefix(desc, "wpkh(") && strings.HasSuffix(desc, ")"):
+		scriptType = ScriptTypeP2WPKH
+		inner = desc[len("wpkh(") : len(desc)-1]
+	case strings.HasPrefix(desc, "tr(") && strings.HasSuffix(desc, ")"):
+		scriptType = ScriptTypeP2TR
+		inner = desc[len("tr(") : len(desc)-1]
+	default:
+		return nil, fmt.Errorf("%w: expected pkh, wpkh, sh(wpkh) or tr", ErrInvalidDescriptor)
+	}
+
+	// the key origin only documents how the key was derived from the seed
+	if strings.HasPrefix(inner, "[") {
+		end := strings.Index(inner, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("%w: unterminated key origin", ErrInvalidDescriptor)
+		}
+		inner = inner[end+1:]
+	}
+
+	parts := strings.Split(inner, "/")
+	key, _, err := parseExtendedKey(parts[0], chainParams)
+	if err != nil {
+		return nil, err
+	}
+	branches, err := parseBranches(parts[1:])
+	if err != nil {
+		return nil, err
+	}
+	return newDescriptor(scriptType, key, branches, chainParams)
+}
+
+func newDescriptor(scriptType ScriptType, key *hdkeychain.ExtendedKey, branches [][]uint32, chainParams *chaincfg.Params) (*Descriptor, error) {
+	if scriptType != ScriptTypeP2PKH && !supportsSegwit(chainParams) {
+		return nil, fmt.Errorf("%w: %s addresses are not supported on %s", ErrInvalidDescriptor, scriptType, chainParams.Name)
+	}
+	return &Descriptor{
+		Type:        scriptType,
+		Key:         key,
+		Branches:    branches,
+		chainParams: chainParams,
+	}, nil
+}
+
+func supportsSegwit(chainParams *chaincfg.Params) bool {
+	return chainParams.Net != dogecoin.MainNet && chainParams.Net != dogecoin.TestNet3
+}
+
+func parseExtendedKey(str string, chainParams *chaincfg.Params) (*hdkeychain.ExtendedKey, ScriptType, error) {
+	key, err := hdkeychain.NewKeyFromString(str)
+	if err != nil {
+		return nil, "", err
+	}
+	if key.IsPrivate() {
+		return nil, "", fmt.Errorf("%w: expected a public key", ErrUnsupportedKey)
+	}
+
+	var version [4]byte
+	copy(version[:], key.Version())
+	if version == chainParams.HDPublicKeyID {
+		return key, ScriptTypeP2PKH, nil
+	}
+	known, ok := keyVersions[version]
+	if !ok {
+		return nil, "", ErrUnsupportedKey
+	}
+	isTestnet := chainParams.Net != chaincfg.MainNetParams.Net && chainParams.Net != dogecoin.MainNet
+	if known.testnet != isTestnet {
+		return nil, "", fmt.Errorf("%w: key is not for %s", ErrUnsupportedKey, chainParams.Name)
+	}
+	return key, known.scriptType, nil
+}
+
+// parseBranches parses a derivation path ending in /*, where at most one
+// element can be a <receive;change> pair.
+func parseBranches(path []string) ([][]uint32, error) {
+	if len(path) == 0 || path[len(path)-1] != "*" {
+		return nil, fmt.Errorf("%w: derivation path must end with /*", ErrInvalidDescriptor)
+	}
+	branches := [][]uint32{{}}
+	for _, elem := range path[:len(path)-1] {
+		if strings.HasSuffix(elem, "'") || strings.HasSuffix(elem, "h") {
+			return nil, ErrHardenedPath
+		}
+		if strings.HasPrefix(elem, "<") && strings.HasSuffix(elem, ">") {
+			if len(branches) > 1 {
+				return nil, fmt.Errorf("%w: only one multipath element is allowed", ErrInvalidDescriptor)
+			}
+			choices := strings.Split(elem[1:len(elem)-1], ";")
+			multi := make([][]uint32, len(choices))
+			for i, choice := range choices {
+				index, err := parseIndex(choice)
+				if err != nil {
+					return nil, err
+				}
+				multi[i] = append(append([]uint32{}, branches[0]...), index)
+			}
+			branches = multi
+			continue
+		}
+		index, err := parseIndex(elem)
+		if err != nil {
+			return nil, err
+		}
+		for i := range branches {
+			branches[i] = append(branches[i], index)
+		}
+	}
+	return branches, nil
+}
+
+func parseIndex(elem string) (uint32, error) {
+	index, err := strconv.ParseUint(elem, 10, 32)
+	if err != nil || index >= hdkeychain.HardenedKeyStart {
+		return 0, fmt.Errorf("%w: invalid path element %q", ErrInvalidDescriptor, elem)
+	}
+	return uint32(index), nil
+}
+
+// Address derives the address at index of the given branch.
+func (d *Descriptor) Address(branch int, index uint32) (btcutil.Address, error) {
+	if branch < 0 || branch >= len(d.Branches) {
+		return nil, fmt.Errorf("branch %d out of range", branch)
+	}
+	key := d.Key
+	var err error
+	for _, i := range append(append([]uint32{}, d.Branches[branch]...), index) {
+		key, err = key.Derive(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pubKey, err := key.ECPubKey()
+	if err != nil {
+		return nil, err
+	}
+
+	switch d.Type {
+	case ScriptTypeP2PKH:
+		return btcutil.NewAddressPubKeyHash(btcutil.Hash160(pubKey.SerializeCompressed()), d.chainParams)
+	case ScriptTypeP2WPKH:
+		return btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pubKey.SerializeCompressed()), d.chainParams)
+	case ScriptTypeP2SHP2WPKH:
+		witnessAddr, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pubKey.SerializeCompressed()), d.chainParams)
+		if err != nil {
+			return nil, err
+		}
+		redeemScript, err := txscript.PayToAddrScript(witnessAddr)
+		if err != nil {
+			return nil, err
+		}
+		return btcutil.NewAddressScriptHash(redeemScript, d.chainParams)
+	case ScriptTypeP2TR:
+		outputKey := txscript.ComputeTaprootKeyNoScript(pubKey)
+		return btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), d.chainParams)
+	default:
+		return nil, fmt.Errorf("unknown script type %s", d.Type)
+	}
+}
+
+const (
+	checksumInputCharset = "0123456789()[],'/*abcdefgh@:$%{}IJKLMNOPQRSTUVWXYZ&+-.;<=>?!^_|~ijklmnopqrstuvwxyzABCDEFGH`#\"\\ "
+	checksumCharset      = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+)
+
+// DescriptorChecksum returns the BIP-380 checksum of a descriptor, or an
+// empty string if it contains characters not allowed in descriptors.
+func DescriptorChecksum(desc string) string {
+	generator := [5]uint64{0xf5dee51989, 0xa9fdca3312, 0x1bab10e32d, 0x3706b1677a, 0x644d626ffd}
+	polymod := func(chk uint64, value uint64) uint64 {
+		top := chk >> 35
+		chk = (chk&0x7ffffffff)<<5 ^ value
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+		return chk
+	}
+
+	chk := uint64(1)
+	groups := make([]uint64, 0, 3)
+	for _, c := range desc {
+		pos := strings.IndexRune(checksumInputCharset, c)
+		if pos < 0 {
+			return ""
+		}
+		chk = polymod(chk, uint64(pos&31))
+		groups = append(groups, uint64(pos>>5))
+		if len(groups) == 3 {
+			chk = polymod(chk, groups[0]*9+groups[1]*3+groups[2])
+			groups = groups[:0]
+		}
+	}
+	switch len(groups) {
+	case 1:
+		chk = polymod(chk, groups[0])
+	case 2:
+		chk = polymod(chk, groups[0]*3+groups[1])
+	}
+	for i := 0; i < 8; i++ {
+		chk = polymod(chk, 0)
+	}
+	chk ^= 1
+
+	checksum := make([]byte, 8)
+	for i := range checksum {
+		checksum[i] = checksumCharset[(chk>>(5*(7-i)))&31]
+	}
+	return string(checksum)
+}
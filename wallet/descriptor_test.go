@@ -0,0 +1,66 @@
+package wallet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+const testXpub = "xpub6ERApfZwUNrhLCkDtcHTcxd75RbzS1ed54G1LkBUHQVHQKqhMkhgbmJbZRkrgZw4koxb5JaHWkY4ALHY2grBGRjaDMzQLcgJvLJuZZvRcEL"
+
+func TestDescriptorChecksum(t *testing.T) {
+	desc := "pkh([d34db33f/44'/0'/0']" + testXpub + "/1/*)"
+	if checksum := DescriptorChecksum(desc); checksum != "ml40v0wf" {
+		t.Fatalf("expected checksum ml40v0wf, got %s", checksum)
+	}
+	if _, err := ParseDescriptor(desc+"#ml40v0wf", &chaincfg.MainNetParams); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseDescriptor(desc+"#ml40v0wg", &chaincfg.MainNetParams); !errors.Is(err, ErrInvalidChecksum) {
+		t.Fatalf("expected ErrInvalidChecksum, got %v", err)
+	}
+}
+
+func TestParseDescriptor(t *testing.T) {
+	tests := []struct {
+		desc     string
+		branches int
+		err      error
+	}{
+		{testXpub, 2, nil},
+		{"wpkh(" + testXpub + "/<0;1>/*)", 2, nil},
+		{"sh(wpkh(" + testXpub + "/0/*))", 1, nil},
+		{"tr(" + testXpub + "/0/*)", 1, nil},
+		{"pkh(" + testXpub + "/0'/*)", 0, ErrHardenedPath},
+		{"pkh(" + testXpub + "/0)", 0, ErrInvalidDescriptor},
+		{"wsh(" + testXpub + "/0/*)", 0, ErrInvalidDescriptor},
+	}
+	for _, test := range tests {
+		desc, err := ParseDescriptor(test.desc, &chaincfg.MainNetParams)
+		if !errors.Is(err, test.err) {
+			t.Fatalf("%s: expected error %v, got %v", test.desc, test.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		if len(desc.Branches) != test.branches {
+			t.Fatalf("%s: expected %d branches, got %d", test.desc, test.branches, len(desc.Branches))
+		}
+	}
+
+	// the receive and change addresses of a bare xpub are m/0/* and m/1/*
+	desc, err := ParseDescriptor("pkh("+testXpub+"/1/*)", &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare, err := ParseDescriptor(testXpub, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := desc.Address(0, 3)
+	got, _ := bare.Address(1, 3)
+	if want.EncodeAddress() != got.EncodeAddress() {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
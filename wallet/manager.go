@@ -0,0 +1,644 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/store"
+)
+
+var (
+	ErrWalletExists      = errors.New("wallet already exists")
+	ErrWalletNotFound    = errors.New("wallet not found")
+	ErrInvalidWalletName = errors.New("wallet names can only contain letters, digits, '-' and '_'")
+	ErrAddressNotWatched = errors.New("address is not watched by the wallet")
+)
+
+var walletNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type ManagerStorage interface {
+	Storage
+	GetTx(hash string) (*model.Transaction, bool, error)
+	GetPkScripts(hashes []string, indices []uint32) ([]string, error)
+	GetPrevouts(hashes []string, indices []uint32) ([]*model.Vout, error)
+	GetTxLocation(hash string) (*model.TxLocation, bool, error)
+	GetLatestBlockHeight() (uint64, bool, error)
+
+	PutWallet(wallet *model.Wallet) error
+	GetWallet(name string) (*model.Wallet, bool, error)
+	ListWallets() ([]*model.Wallet, error)
+	PutWalletAddresses(addrs []*model.WalletAddress) error
+	GetWalletAddress(name, scriptPubKey string) (*model.WalletAddress, bool, error)
+	GetWalletAddresses(name string) ([]*model.WalletAddress, error)
+	GetWatchingWallets(scriptPubKeys []string) ([][]string, error)
+	PutWalletTx(tx *model.WalletTx) error
+	GetWalletTx(name, txId string) (*model.WalletTx, bool, error)
+	GetWalletTxs(name string) ([]*model.WalletTx, error)
+	RemoveWalletTxs(name string, txIds []string) error
+}
+
+// Balance of a wallet in satoshis. Unconfirmed only includes the outputs of
+// mempool transactions, outputs spent in the mempool are not counted.
+type Balance struct {
+	Confirmed   int64 `json:"confirmed"`
+	Unconfirmed int64 `json:"unconfirmed"`
+}
+
+// Manager maintains the persistent watch-only wallets. The sync manager and
+// the mempool feed it every transaction they index.
+type Manager struct {
+	mu          sync.Mutex
+	store       ManagerStorage
+	chainParams *chaincfg.Params
+
+	// hasWallets avoids looking up the scripts of every indexed transaction
+	// as long as no wallet exists
+	hasWallets bool
+}
+
+func NewManager(store ManagerStorage, chainParams *chaincfg.Params) (*Manager, error) {
+	wallets, err := store.ListWallets()
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{
+		store:       store,
+		chainParams: chainParams,
+		hasWallets:  len(wallets) > 0,
+	}, nil
+}
+
+func (m *Manager) CreateWallet(name string) (*model.Wallet, error) {
+	if !walletNameRegexp.MatchString(name) {
+		return nil, ErrInvalidWalletName
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, exists, err := m.store.GetWallet(name)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrWalletExists
+	}
+	wallet := &model.Wallet{
+		Name:        name,
+		Descriptors: []model.WalletDescriptor{},
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := m.store.PutWallet(wallet); err != nil {
+		return nil, err
+	}
+	m.hasWallets = true
+	return wallet, nil
+}
+
+func (m *Manager) ListWallets() ([]*model.Wallet, error) {
+	return m.store.ListWallets()
+}
+
+// ImportAddress starts watching address. Importing an address again only
+// updates its label.
+func (m *Manager) ImportAddress(name, address, label string) error {
+	scriptPubKey, err := m.addressScript(address)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.getWallet(name); err != nil {
+		return err
+	}
+	addr, exists, err := m.store.GetWalletAddress(name, scriptPubKey)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		addr = &model.WalletAddress{
+			Wallet:       name,
+			Address:      address,
+			ScriptPubKey: scriptPubKey,
+			Descriptor:   -1,
+		}
+	}
+	addr.Label = label
+	return m.store.PutWalletAddresses([]*model.WalletAddress{addr})
+}
+
+// ImportDescriptor starts watching the addresses of an output descriptor or
+// extended public key, gapLimit addresses past the last used one of every
+// branch.
+func (m *Manager) ImportDescriptor(name, descriptor string, gapLimit uint32, label string) error {
+	if gapLimit == 0 || gapLimit > MaxGapLimit {
+		return ErrInvalidGapLimit
+	}
+	desc, err := ParseDescriptor(descriptor, m.chainParams)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wallet, err := m.getWallet(name)
+	if err != nil {
+		return err
+	}
+	for _, d := range wallet.Descriptors {
+		if d.Descriptor == descriptor {
+			return nil
+		}
+	}
+	wallet.Descriptors = append(wallet.Descriptors, model.WalletDescriptor{
+		Descriptor: descriptor,
+		GapLimit:   gapLimit,
+		Label:      label,
+		NextIndex:  make([]uint32, len(desc.Branches)),
+		Derived:    make([]uint32, len(desc.Branches)),
+	})
+	if err := m.deriveAddresses(wallet, len(wallet.Descriptors)-1); err != nil {
+		return err
+	}
+	return m.store.PutWallet(wallet)
+}
+
+// SetLabel sets the label of an address watched by the wallet.
+func (m *Manager) SetLabel(name, address, label string) error {
+	scriptPubKey, err := m.addressScript(address)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.getWallet(name); err != nil {
+		return err
+	}
+	addr, exists, err := m.store.GetWalletAddress(name, scriptPubKey)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrAddressNotWatched
+	}
+	addr.Label = label
+	return m.store.PutWalletAddresses([]*model.WalletAddress{addr})
+}
+
+// rescanBatchLen is the number of transactions a rescan adds to the wallet
+// at a time. The manager is only locked for a batch, so the blocks connected
+// during a long rescan do not wait for all of it.
+const rescanBatchLen = 100
+
+// Rescan adds the transactions of the wallet's addresses confirmed from
+// startHeight on, and the unconfirmed ones, to the wallet. Addresses derived
+// while rescanning are scanned as well, pruned transactions are skipped. It
+// returns the number of transactions found.
+func (m *Manager) Rescan(name string, startHeight uint64) (int, error) {
+	if _, err := m.getWallet(name); err != nil {
+		return 0, err
+	}
+
+	scanned := make(map[string]bool)
+	processed := make(map[string]bool)
+	for {
+		addrs, err := m.store.GetWalletAddresses(name)
+		if err != nil {
+			return 0, err
+		}
+		pending := make([]*model.WalletAddress, 0)
+		for _, addr := range addrs {
+			if !scanned[addr.ScriptPubKey] {
+				pending = append(pending, addr)
+			}
+		}
+		if len(pending) == 0 {
+			return len(processed), nil
+		}
+
+		for _, addr := range pending {
+			scanned[addr.ScriptPubKey] = true
+			// the transactions indexed after the history is read are
+			// connected to the wallet as it watches the address already
+			txHashes, err := m.store.GetTxHashesOfPubScript(addr.ScriptPubKey)
+			if err != nil {
+				return 0, err
+			}
+			for start := 0; start < len(txHashes); start += rescanBatchLen {
+				end := start + rescanBatchLen
+				if end > len(txHashes) {
+					end = len(txHashes)
+				}
+				if err := m.rescanTxs(txHashes[start:end], startHeight, processed); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+}
+
+// rescanTxs adds the transactions confirmed from startHeight on, and the
+// unconfirmed ones, to the wallets watching them. The transactions and their
+// blocks are read under mu, so they can not be connected or disconnected
+// meanwhile.
+func (m *Manager) rescanTxs(hashes []string, startHeight uint64, processed map[string]bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, hash := range hashes {
+		if processed[hash] {
+			continue
+		}
+		tx, exists, err := m.store.GetTx(hash)
+		if errors.Is(err, store.ErrTxPruned) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+
+		// the block hash of the transaction may be the one of a side chain
+		// block including it too, its main chain block is located instead
+		height, blockHash := uint64(0), ""
+		if tx.BlockHash != "" {
+			location, exists, err := m.store.GetTxLocation(hash)
+			if err != nil {
+				return err
+			}
+			// transactions of orphaned blocks are left out
+			if !exists {
+				continue
+			}
+			if location.Height < startHeight {
+				continue
+			}
+			height, blockHash = location.Height, location.BlockHash
+		}
+		processed[hash] = true
+		if err := m.processTx(tx, height, blockHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConnectTxs records the transactions touching any wallet. Mempool
+// transactions are connected with a zero height and an empty block hash.
+func (m *Manager) ConnectTxs(txs []*model.Transaction, height uint64, blockHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.hasWallets {
+		return nil
+	}
+	for _, tx := range txs {
+		if err := m.processTx(tx, height, blockHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DisconnectTxs marks the wallet transactions of an orphaned block as
+// unconfirmed again. Its coinbase can not go back to the mempool and is
+// dropped.
+func (m *Manager) DisconnectTxs(txs []*model.Transaction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.hasWallets {
+		return nil
+	}
+	wallets, err := m.store.ListWallets()
+	if err != nil {
+		return err
+	}
+	for _, wallet := range wallets {
+		for _, tx := range txs {
+			walletTx, exists, err := m.store.GetWalletTx(wallet.Name, tx.Hash)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				continue
+			}
+			if len(tx.Vins) > 0 && tx.Vins[0].PreviousTxId == "" {
+				if err := m.store.RemoveWalletTxs(wallet.Name, []string{tx.Hash}); err != nil {
+					return err
+				}
+				continue
+			}
+			walletTx.Height = 0
+			walletTx.BlockHash = ""
+			if err := m.store.PutWalletTx(walletTx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RemoveTxs drops unconfirmed transactions from the wallets once they left
+// the mempool, replaced by other transactions spending the same outputs or
+// conflicting with the main chain.
+func (m *Manager) RemoveTxs(hashes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.hasWallets || len(hashes) == 0 {
+		return nil
+	}
+	wallets, err := m.store.ListWallets()
+	if err != nil {
+		return err
+	}
+	for _, wallet := range wallets {
+		if err := m.store.RemoveWalletTxs(wallet.Name, hashes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListTransactions returns up to count transactions of the wallet, skipping
+// the skip most recent ones. Transactions are ordered by height with the
+// unconfirmed ones last.
+func (m *Manager) ListTransactions(name string, count, skip int) ([]*model.WalletTx, error) {
+	if _, err := m.getWallet(name); err != nil {
+		return nil, err
+	}
+	txs, err := m.store.GetWalletTxs(name)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(txs, func(i, j int) bool {
+		if (txs[i].Height == 0) != (txs[j].Height == 0) {
+			return txs[j].Height == 0
+		}
+		return txs[i].Height < txs[j].Height
+	})
+
+	end := len(txs) - skip
+	if end <= 0 {
+		return []*model.WalletTx{}, nil
+	}
+	start := end - count
+	if start < 0 {
+		start = 0
+	}
+	return txs[start:end], nil
+}
+
+// ListUnspent returns the unspent outputs of the wallet with at least
+// minConf confirmations.
+func (m *Manager) ListUnspent(name string, minConf uint64) ([]UTXO, error) {
+	if _, err := m.getWallet(name); err != nil {
+		return nil, err
+	}
+	tip, _, err := m.store.GetLatestBlockHeight()
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := m.store.GetWalletAddresses(name)
+	if err != nil {
+		return nil, err
+	}
+	unspent := make([]UTXO, 0)
+	for _, addr := range addrs {
+		utxos, err := m.store.GetUTXOs(addr.ScriptPubKey)
+		if err != nil {
+			return nil, err
+		}
+		for _, utxo := range utxos {
+			confirmations := uint64(0)
+			if utxo.Height > 0 && tip >= utxo.Height {
+				confirmations = tip - utxo.Height + 1
+			}
+			if confirmations < minConf {
+				continue
+			}
+			unspent = append(unspent, UTXO{
+				Vout:         utxo,
+				Address:      addr.Address,
+				Label:        addr.Label,
+				Branch:       addr.Branch,
+				AddressIndex: addr.Index,
+			})
+		}
+	}
+	return unspent, nil
+}
+
+func (m *Manager) GetBalance(name string) (*Balance, error) {
+	utxos, err := m.ListUnspent(name, 0)
+	if err != nil {
+		return nil, err
+	}
+	balance := &Balance{}
+	for _, utxo := range utxos {
+		if utxo.Height > 0 {
+			balance.Confirmed += utxo.Value
+		} else {
+			balance.Unconfirmed += utxo.Value
+		}
+	}
+	return balance, nil
+}
+
+// processTx records tx in the wallets watching its outputs or prevouts and
+// extends the descriptors whose addresses it uses. Callers must hold mu.
+func (m *Manager) processTx(tx *model.Transaction, height uint64, blockHash string) error {
+	prevHashes := make([]string, 0, len(tx.Vins))
+	prevIndices := make([]uint32, 0, len(tx.Vins))
+	for _, vin := range tx.Vins {
+		// skips the coinbase inputs
+		if vin.PreviousTxId == "" {
+			continue
+		}
+		prevHashes = append(prevHashes, vin.PreviousTxId)
+		prevIndices = append(prevIndices, vin.PreviousIndex)
+	}
+	prevScripts, err := m.store.GetPkScripts(prevHashes, prevIndices)
+	if err != nil {
+		return err
+	}
+
+	scripts := make([]string, 0, len(tx.Vouts)+len(prevScripts))
+	for _, vout := range tx.Vouts {
+		scripts = append(scripts, vout.ScriptPubKey)
+	}
+	scripts = append(scripts, prevScripts...)
+	watchers, err := m.store.GetWatchingWallets(scripts)
+	if err != nil {
+		return err
+	}
+
+	walletTxs := make(map[string]*model.WalletTx)
+	touched := make(map[string]map[string]bool)
+	prevTxs := make(map[string]*model.Transaction)
+	var prevouts []*model.Vout
+	for i, names := range watchers {
+		for _, name := range names {
+			walletTx, ok := walletTxs[name]
+			if !ok {
+				walletTx = &model.WalletTx{
+					Wallet:    name,
+					TxId:      tx.Hash,
+					Height:    height,
+					BlockHash: blockHash,
+					Addresses: []string{},
+				}
+				walletTxs[name] = walletTx
+				touched[name] = make(map[string]bool)
+			}
+			touched[name][scripts[i]] = true
+
+			if i < len(tx.Vouts) {
+				walletTx.Received += tx.Vouts[i].Value
+				continue
+			}
+			j := i - len(tx.Vouts)
+			if prevouts == nil {
+				if prevouts, err = m.store.GetPrevouts(prevHashes, prevIndices); err != nil {
+					return err
+				}
+			}
+			if prevouts[j] != nil {
+				walletTx.Sent += prevouts[j].Value
+				continue
+			}
+			// the prevout is already spent when rescanning
+			prevTx, ok := prevTxs[prevHashes[j]]
+			if !ok {
+				var exists bool
+				prevTx, exists, err = m.store.GetTx(prevHashes[j])
+				if errors.Is(err, store.ErrTxPruned) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if !exists {
+					return fmt.Errorf("prevout %s:%d of %s not found", prevHashes[j], prevIndices[j], tx.Hash)
+				}
+				prevTxs[prevHashes[j]] = prevTx
+			}
+			if int(prevIndices[j]) < len(prevTx.Vouts) {
+				walletTx.Sent += prevTx.Vouts[prevIndices[j]].Value
+			}
+		}
+	}
+
+	for name, walletTx := range walletTxs {
+		var wallet *model.Wallet
+		for scriptPubKey := range touched[name] {
+			addr, exists, err := m.store.GetWalletAddress(name, scriptPubKey)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				continue
+			}
+			walletTx.Addresses = append(walletTx.Addresses, addr.Address)
+			if addr.Descriptor < 0 {
+				continue
+			}
+			if wallet == nil {
+				if wallet, err = m.getWallet(name); err != nil {
+					return err
+				}
+			}
+			desc := &wallet.Descriptors[addr.Descriptor]
+			if addr.Index >= desc.NextIndex[addr.Branch] {
+				desc.NextIndex[addr.Branch] = addr.Index + 1
+			}
+		}
+		sort.Strings(walletTx.Addresses)
+
+		if wallet != nil {
+			for i := range wallet.Descriptors {
+				if err := m.deriveAddresses(wallet, i); err != nil {
+					return err
+				}
+			}
+			if err := m.store.PutWallet(wallet); err != nil {
+				return err
+			}
+		}
+		if err := m.store.PutWalletTx(walletTx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deriveAddresses watches the addresses of a descriptor up to its gap limit
+// past the last used index of every branch. The caller stores the updated
+// wallet.
+func (m *Manager) deriveAddresses(wallet *model.Wallet, index int) error {
+	walletDesc := &wallet.Descriptors[index]
+	desc, err := ParseDescriptor(walletDesc.Descriptor, m.chainParams)
+	if err != nil {
+		return err
+	}
+	addrs := make([]*model.WalletAddress, 0)
+	for branch := range desc.Branches {
+		for i := walletDesc.Derived[branch]; i < walletDesc.NextIndex[branch]+walletDesc.GapLimit; i++ {
+			addr, err := desc.Address(branch, i)
+			if err != nil {
+				return err
+			}
+			script, err := txscript.PayToAddrScript(addr)
+			if err != nil {
+				return err
+			}
+			addrs = append(addrs, &model.WalletAddress{
+				Wallet:       wallet.Name,
+				Address:      addr.EncodeAddress(),
+				ScriptPubKey: hex.EncodeToString(script),
+				Label:        walletDesc.Label,
+				Descriptor:   index,
+				Branch:       branch,
+				Index:        i,
+			})
+			walletDesc.Derived[branch] = i + 1
+		}
+	}
+	return m.store.PutWalletAddresses(addrs)
+}
+
+func (m *Manager) getWallet(name string) (*model.Wallet, error) {
+	wallet, exists, err := m.store.GetWallet(name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrWalletNotFound
+	}
+	return wallet, nil
+}
+
+func (m *Manager) addressScript(address string) (string, error) {
+	addr, err := btcutil.DecodeAddress(address, m.chainParams)
+	if err != nil {
+		return "", err
+	}
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(script), nil
+}
@@ -0,0 +1,408 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/catalogfi/indexer/database"
+	"github.com/catalogfi/indexer/model"
+	"github.com/catalogfi/indexer/store"
+	"github.com/catalogfi/indexer/utils"
+	"go.uber.org/zap"
+)
+
+// otherScript is paid by the transactions no wallet watches
+var otherScript = []byte{txscript.OP_TRUE}
+
+// testChain indexes blocks in a real store the way the sync manager does,
+// and feeds them to the wallets.
+type testChain struct {
+	t      *testing.T
+	store  *store.Storage
+	m      *Manager
+	height uint64
+	// funded counts the transactions funded from nowhere, to keep them
+	// unique
+	funded uint32
+	// coinbaseScript is paid by the coinbases, otherScript if nil
+	coinbaseScript []byte
+	// coinbase is the coinbase of the last connected block
+	coinbase *wire.MsgTx
+}
+
+func newTestChain(t *testing.T) *testChain {
+	db, err := database.NewRocksDB(t.TempDir(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewStorage(db)
+	m, err := NewManager(s, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testChain{t: t, store: s, m: m}
+}
+
+// connect indexes a block of txs, after a coinbase paying no wallet, at the
+// next height and returns the block hash.
+func (c *testChain) connect(txs ...*wire.MsgTx) string {
+	c.t.Helper()
+	c.height++
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), []byte{byte(c.height), byte(c.height >> 8)}, nil))
+	coinbaseScript := c.coinbaseScript
+	if coinbaseScript == nil {
+		coinbaseScript = otherScript
+	}
+	coinbase.AddTxOut(wire.NewTxOut(50*btcutil.SatoshiPerBitcoin, coinbaseScript))
+	c.coinbase = coinbase
+	txs = append([]*wire.MsgTx{coinbase}, txs...)
+	blockHash := chainhash.DoubleHashH([]byte{byte(c.height), byte(c.height >> 8)}).String()
+
+	vouts, vins, txIns, transactions, err := utils.SplitTxs(txs, blockHash)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for i := range vouts {
+		vouts[i].Height = c.height
+	}
+	txHashes := make([]string, len(txs))
+	for i, tx := range txs {
+		txHashes[i] = tx.TxHash().String()
+	}
+	if err := c.store.PutTxLocations(blockHash, c.height, txHashes); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.store.PutUTXOs(vouts); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.store.PutTxs(transactions); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.m.ConnectTxs(transactions, c.height, blockHash); err != nil {
+		c.t.Fatal(err)
+	}
+	hashes := make([]string, 0)
+	indices := make([]uint32, 0)
+	for _, in := range txIns[1:] {
+		hashes = append(hashes, in.PreviousOutPoint.Hash.String())
+		indices = append(indices, in.PreviousOutPoint.Index)
+	}
+	if _, err := c.store.RemoveUTXOs(hashes, indices, vins[1:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.store.SetLatestBlockHeight(c.height); err != nil {
+		c.t.Fatal(err)
+	}
+	return blockHash
+}
+
+// disconnect drops the tip, a block of txs, from the main chain.
+func (c *testChain) disconnect(blockHash string, txs ...*wire.MsgTx) {
+	c.t.Helper()
+	_, _, _, transactions, err := utils.SplitTxs(txs, blockHash)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	txHashes := make([]string, len(txs))
+	for i, tx := range txs {
+		txHashes[i] = tx.TxHash().String()
+	}
+	if err := c.store.RemoveTxLocations(blockHash, txHashes); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.m.DisconnectTxs(transactions); err != nil {
+		c.t.Fatal(err)
+	}
+	c.height--
+	if err := c.store.SetLatestBlockHeight(c.height); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// fund returns a transaction paying value to script from an output no wallet
+// watches.
+func (c *testChain) fund(value int64, script []byte) *wire.MsgTx {
+	c.funded++
+	prev := chainhash.DoubleHashH([]byte{0xff, byte(c.funded), byte(c.funded >> 8)})
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prev, 0), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(value, script))
+	return tx
+}
+
+// spend returns a transaction spending the first output of prev to the
+// outputs.
+func spend(prev *wire.MsgTx, outs ...*wire.TxOut) *wire.MsgTx {
+	hash := prev.TxHash()
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&hash, 0), nil, nil))
+	for _, out := range outs {
+		tx.AddTxOut(out)
+	}
+	return tx
+}
+
+func testAddress(t *testing.T, tag byte) (string, []byte) {
+	addr, err := btcutil.NewAddressPubKeyHash(bytes.Repeat([]byte{tag}, 20), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr.EncodeAddress(), script
+}
+
+// walletTxs returns the transactions of the wallet by hash.
+func walletTxs(t *testing.T, m *Manager, name string) map[string]*model.WalletTx {
+	t.Helper()
+	txs, err := m.ListTransactions(name, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byHash := make(map[string]*model.WalletTx, len(txs))
+	for _, tx := range txs {
+		byHash[tx.TxId] = tx
+	}
+	return byHash
+}
+
+func assertWalletTx(t *testing.T, txs map[string]*model.WalletTx, tx *wire.MsgTx, height uint64, blockHash string, received, sent int64) {
+	t.Helper()
+	walletTx, ok := txs[tx.TxHash().String()]
+	if !ok {
+		t.Fatalf("transaction %s is not in the wallet", tx.TxHash())
+	}
+	if walletTx.Height != height || walletTx.BlockHash != blockHash || walletTx.Received != received || walletTx.Sent != sent {
+		t.Fatalf("expected %s at %d in %q receiving %d and sending %d, got %+v", tx.TxHash(), height, blockHash, received, sent, walletTx)
+	}
+}
+
+func TestRescan(t *testing.T) {
+	c := newTestChain(t)
+	address, script := testAddress(t, 1)
+	first := c.fund(1000, script)
+	firstBlock := c.connect(first)
+	second := c.fund(2000, script)
+	secondBlock := c.connect(second)
+	// sends 1000 back with 600 of change
+	sent := spend(first, wire.NewTxOut(300, otherScript), wire.NewTxOut(600, script))
+	sentBlock := c.connect(sent)
+	c.connect(c.fund(4000, otherScript))
+
+	// the wallet is created once the blocks are indexed
+	if _, err := c.m.CreateWallet("w"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.m.ImportAddress("w", address, "label"); err != nil {
+		t.Fatal(err)
+	}
+	if len(walletTxs(t, c.m, "w")) != 0 {
+		t.Fatal("expected no transaction before the rescan")
+	}
+
+	found, err := c.m.Rescan("w", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs := walletTxs(t, c.m, "w")
+	if found != 2 || len(txs) != 2 {
+		t.Fatalf("expected 2 transactions from height 2, got %d and %d listed", found, len(txs))
+	}
+	assertWalletTx(t, txs, second, 2, secondBlock, 2000, 0)
+	assertWalletTx(t, txs, sent, 3, sentBlock, 600, 1000)
+
+	found, err = c.m.Rescan("w", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs = walletTxs(t, c.m, "w")
+	if found != 3 || len(txs) != 3 {
+		t.Fatalf("expected 3 transactions, got %d and %d listed", found, len(txs))
+	}
+	assertWalletTx(t, txs, first, 1, firstBlock, 1000, 0)
+
+	balance, err := c.m.GetBalance("w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Confirmed != 2600 || balance.Unconfirmed != 0 {
+		t.Fatalf("expected a confirmed balance of 2600, got %+v", balance)
+	}
+}
+
+func TestConnectTxs(t *testing.T) {
+	c := newTestChain(t)
+	if _, err := c.m.CreateWallet("w"); err != nil {
+		t.Fatal(err)
+	}
+	address, script := testAddress(t, 1)
+	if err := c.m.ImportAddress("w", address, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, otherWalletScript := testAddress(t, 2)
+
+	funding := c.fund(5000, script)
+	fundingBlock := c.connect(funding)
+	// pays another wallet 3000 with 1500 of change
+	payment := spend(funding, wire.NewTxOut(3000, otherWalletScript), wire.NewTxOut(1500, script))
+	paymentBlock := c.connect(payment)
+	c.connect(c.fund(4000, otherScript))
+
+	txs := walletTxs(t, c.m, "w")
+	if len(txs) != 2 {
+		t.Fatalf("expected 2 transactions, got %d", len(txs))
+	}
+	assertWalletTx(t, txs, funding, 1, fundingBlock, 5000, 0)
+	assertWalletTx(t, txs, payment, 2, paymentBlock, 1500, 5000)
+}
+
+func TestGapLimitExtension(t *testing.T) {
+	c := newTestChain(t)
+	desc, err := ParseDescriptor("pkh("+testXpub+"/0/*)", &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addressScript := func(index uint32) []byte {
+		addr, err := desc.Address(0, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		script, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return script
+	}
+	assertDerived := func(n int) {
+		t.Helper()
+		addrs, err := c.store.GetWalletAddresses("w")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != n {
+			t.Fatalf("expected %d derived addresses, got %d", n, len(addrs))
+		}
+	}
+
+	// index 3 is only reachable once index 1 is found used
+	beforeImport := []*wire.MsgTx{c.fund(1000, addressScript(1)), c.fund(2000, addressScript(3))}
+	c.connect(beforeImport[0])
+	c.connect(beforeImport[1])
+
+	if _, err := c.m.CreateWallet("w"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.m.ImportDescriptor("w", "pkh("+testXpub+"/0/*)", 2, ""); err != nil {
+		t.Fatal(err)
+	}
+	assertDerived(2)
+	found, err := c.m.Rescan("w", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != 2 {
+		t.Fatalf("expected the rescan to find 2 transactions, got %d", found)
+	}
+	assertDerived(6)
+
+	// a new block using the last derived address extends the gap again
+	tx := c.fund(3000, addressScript(5))
+	blockHash := c.connect(tx)
+	assertDerived(8)
+	assertWalletTx(t, walletTxs(t, c.m, "w"), tx, 3, blockHash, 3000, 0)
+	addr, exists, err := c.store.GetWalletAddress("w", hex.EncodeToString(addressScript(7)))
+	if err != nil || !exists || addr.Index != 7 {
+		t.Fatalf("expected address 7 to be watched, got %+v", addr)
+	}
+}
+
+func TestDisconnectReconnect(t *testing.T) {
+	c := newTestChain(t)
+	if _, err := c.m.CreateWallet("w"); err != nil {
+		t.Fatal(err)
+	}
+	address, script := testAddress(t, 1)
+	if err := c.m.ImportAddress("w", address, ""); err != nil {
+		t.Fatal(err)
+	}
+	c.connect(c.fund(4000, otherScript))
+
+	tx := c.fund(1000, script)
+	blockHash := c.connect(tx)
+	assertWalletTx(t, walletTxs(t, c.m, "w"), tx, 2, blockHash, 1000, 0)
+
+	c.disconnect(blockHash, tx)
+	assertWalletTx(t, walletTxs(t, c.m, "w"), tx, 0, "", 1000, 0)
+
+	// the transaction is mined again by the new main chain, one block higher
+	c.connect(c.fund(5000, otherScript))
+	blockHash = c.connect(tx)
+	assertWalletTx(t, walletTxs(t, c.m, "w"), tx, 3, blockHash, 1000, 0)
+}
+
+func TestDisconnectCoinbase(t *testing.T) {
+	c := newTestChain(t)
+	if _, err := c.m.CreateWallet("w"); err != nil {
+		t.Fatal(err)
+	}
+	address, script := testAddress(t, 1)
+	if err := c.m.ImportAddress("w", address, ""); err != nil {
+		t.Fatal(err)
+	}
+	c.coinbaseScript = script
+	tx := c.fund(1000, script)
+	blockHash := c.connect(tx)
+	coinbase := c.coinbase
+	assertWalletTx(t, walletTxs(t, c.m, "w"), coinbase, 1, blockHash, 50*btcutil.SatoshiPerBitcoin, 0)
+
+	// the coinbase can not go back to the mempool
+	c.disconnect(blockHash, coinbase, tx)
+	txs := walletTxs(t, c.m, "w")
+	if _, ok := txs[coinbase.TxHash().String()]; ok || len(txs) != 1 {
+		t.Fatalf("expected the coinbase to be dropped, got %d transactions", len(txs))
+	}
+	assertWalletTx(t, txs, tx, 0, "", 1000, 0)
+}
+
+func TestRemoveTxs(t *testing.T) {
+	c := newTestChain(t)
+	address, script := testAddress(t, 1)
+	for _, name := range []string{"w1", "w2"} {
+		if _, err := c.m.CreateWallet(name); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.m.ImportAddress(name, address, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kept, replaced := c.fund(1000, script), c.fund(2000, script)
+	for _, tx := range []*wire.MsgTx{kept, replaced} {
+		_, _, _, transactions, err := utils.SplitTxs([]*wire.MsgTx{tx}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.m.ConnectTxs(transactions, 0, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.m.RemoveTxs([]string{replaced.TxHash().String()}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"w1", "w2"} {
+		txs := walletTxs(t, c.m, name)
+		if len(txs) != 1 {
+			t.Fatalf("expected 1 transaction in %s, got %d", name, len(txs))
+		}
+		assertWalletTx(t, txs, kept, 0, "", 1000, 0)
+	}
+}
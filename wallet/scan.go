@@ -0,0 +1,125 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"errors"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/catalogfi/indexer/model"
+)
+
+const (
+	DefaultGapLimit = 20
+	MaxGapLimit     = 1000
+)
+
+var ErrInvalidGapLimit = errors.New("invalid gap limit")
+
+type Storage interface {
+	GetUTXOs(scriptPubKey string) ([]*model.Vout, error)
+	GetTxHashesOfPubScript(scriptPubKey string) ([]string, error)
+}
+
+// Address is a derived address with history.
+type Address struct {
+	Address      string `json:"address"`
+	ScriptPubKey string `json:"script_pubkey"`
+	Branch       int    `json:"branch"`
+	AddressIndex uint32 `json:"address_index"`
+	TxCount      int    `json:"tx_count"`
+}
+
+// UTXO is an unspent output of a wallet address.
+type UTXO struct {
+	*model.Vout
+	Address      string `json:"address"`
+	Label        string `json:"label,omitempty"`
+	Branch       int    `json:"branch"`
+	AddressIndex uint32 `json:"address_index"`
+}
+
+// ScanResult aggregates the addresses of a descriptor. Balances are in
+// satoshis, unconfirmed ones only include the outputs of mempool transactions.
+type ScanResult struct {
+	Addresses          []Address `json:"addresses"`
+	UTXOs              []UTXO    `json:"utxos"`
+	TxHashes           []string  `json:"tx_hashes"`
+	ConfirmedBalance   int64     `json:"confirmed_balance"`
+	UnconfirmedBalance int64     `json:"unconfirmed_balance"`
+	// NextIndex is the first unused address index of every branch.
+	NextIndex []uint32 `json:"next_index"`
+}
+
+// Scan derives the addresses of every branch of desc until gapLimit
+// consecutive addresses have no history, and collects the history and
+// unspent outputs of the used ones.
+func Scan(store Storage, desc *Descriptor, gapLimit uint32) (*ScanResult, error) {
+	if gapLimit == 0 || gapLimit > MaxGapLimit {
+		return nil, ErrInvalidGapLimit
+	}
+
+	result := &ScanResult{
+		Addresses: make([]Address, 0),
+		UTXOs:     make([]UTXO, 0),
+		TxHashes:  make([]string, 0),
+		NextIndex: make([]uint32, len(desc.Branches)),
+	}
+	seen := make(map[string]bool)
+	for branch := range desc.Branches {
+		gap := uint32(0)
+		for index := uint32(0); gap < gapLimit; index++ {
+			addr, err := desc.Address(branch, index)
+			if err != nil {
+				return nil, err
+			}
+			script, err := txscript.PayToAddrScript(addr)
+			if err != nil {
+				return nil, err
+			}
+			scriptPubKey := hex.EncodeToString(script)
+
+			txHashes, err := store.GetTxHashesOfPubScript(scriptPubKey)
+			if err != nil {
+				return nil, err
+			}
+			if len(txHashes) == 0 {
+				gap++
+				continue
+			}
+			gap = 0
+			result.NextIndex[branch] = index + 1
+			result.Addresses = append(result.Addresses, Address{
+				Address:      addr.EncodeAddress(),
+				ScriptPubKey: scriptPubKey,
+				Branch:       branch,
+				AddressIndex: index,
+				TxCount:      len(txHashes),
+			})
+			for _, hash := range txHashes {
+				if !seen[hash] {
+					seen[hash] = true
+					result.TxHashes = append(result.TxHashes, hash)
+				}
+			}
+
+			utxos, err := store.GetUTXOs(scriptPubKey)
+			if err != nil {
+				return nil, err
+			}
+			for _, utxo := range utxos {
+				if utxo.Height > 0 {
+					result.ConfirmedBalance += utxo.Value
+				} else {
+					result.UnconfirmedBalance += utxo.Value
+				}
+				result.UTXOs = append(result.UTXOs, UTXO{
+					Vout:         utxo,
+					Address:      addr.EncodeAddress(),
+					Branch:       branch,
+					AddressIndex: index,
+				})
+			}
+		}
+	}
+	return result, nil
+}